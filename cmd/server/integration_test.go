@@ -0,0 +1,2114 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"pieces-os-go/internal/audit"
+	"pieces-os-go/internal/config"
+	"pieces-os-go/internal/fakeupstream"
+	"pieces-os-go/internal/keystore"
+	"pieces-os-go/internal/logging"
+	"pieces-os-go/internal/middleware"
+	"pieces-os-go/internal/model"
+	"pieces-os-go/internal/tracing"
+	"pieces-os-go/internal/usage"
+	"pieces-os-go/pkg/tokenizer"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var upstream *fakeupstream.Server
+
+func TestMain(m *testing.M) {
+	if err := model.InitModels(); err != nil {
+		log.Fatalf("Failed to initialize models: %v", err)
+	}
+	if err := tokenizer.InitTokenizers(); err != nil {
+		log.Fatalf("Failed to initialize tokenizers: %v", err)
+	}
+	if err := middleware.InitLogger(&config.Config{}); err != nil {
+		log.Fatalf("Failed to initialize logger: %v", err)
+	}
+
+	upstream = fakeupstream.New()
+	if _, err := upstream.Start(); err != nil {
+		log.Fatalf("Failed to start fake upstream: %v", err)
+	}
+
+	code := m.Run()
+	upstream.Stop()
+	os.Exit(code)
+}
+
+// newTestConfig 返回指向假上游的最小配置
+func newTestConfig(t *testing.T) *config.Config {
+	t.Helper()
+	return &config.Config{
+		APIPrefix:          "/v1",
+		VertexGRPCAddr:     upstream.Addr(),
+		GPTGRPCAddr:        upstream.Addr(),
+		GRPCPlaintext:      true,
+		MaxRetries:         1,
+		Timeout:            5,
+		RateLimits:         map[string]config.RateLimitRule{},
+		BlacklistMode:      "off",
+		BlacklistThreshold: 100,
+		BlacklistFile:      filepath.Join(t.TempDir(), "blacklist.txt"),
+		IPv4Mask:           config.DefaultIPv4Mask,
+		IPv6Mask:           config.DefaultIPv6Mask,
+	}
+}
+
+// newTestServer 使用真实路由启动 HTTP 服务
+func newTestServer(t *testing.T, cfg *config.Config) *httptest.Server {
+	t.Helper()
+	upstream.Reset()
+	keys, err := keystore.Open(cfg.KeysFile)
+	if err != nil {
+		t.Fatalf("open keys: %v", err)
+	}
+	var records *usage.Store
+	if cfg.UsageDB != "" {
+		if records, err = usage.Open(cfg.UsageDB); err != nil {
+			t.Fatalf("open usage db: %v", err)
+		}
+		t.Cleanup(func() { records.Close() })
+	}
+	srv := httptest.NewServer(newRouter(config.NewStore(cfg), keys, records, nil))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func postJSON(t *testing.T, url string, body string) *http.Response {
+	t.Helper()
+	resp, err := http.Post(url, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("POST %s: %v", url, err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+// readSSE 读取所有 data: 行的内容
+func readSSE(t *testing.T, r io.Reader) []string {
+	t.Helper()
+	var events []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if data, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+			events = append(events, data)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatalf("read SSE: %v", err)
+	}
+	return events
+}
+
+func decodeError(t *testing.T, r io.Reader) string {
+	t.Helper()
+	var body struct {
+		Error struct {
+			Code string `json:"code"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(r).Decode(&body); err != nil {
+		t.Fatalf("decode error body: %v", err)
+	}
+	return body.Error.Code
+}
+
+func TestChatCompletionGPT(t *testing.T) {
+	srv := newTestServer(t, newTestConfig(t))
+	upstream.Enqueue(fakeupstream.Script{Chunks: []string{"Hello", " world"}})
+
+	resp := postJSON(t, srv.URL+"/v1/chat/completions", `{
+		"model": "gpt-4o",
+		"messages": [{"role": "system", "content": "be brief"}, {"role": "user", "content": "hi"}]
+	}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+
+	var body model.ChatCompletionResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if got := body.Choices[0].Message.Content; got != "Hello world" {
+		t.Errorf("content = %q, want %q", got, "Hello world")
+	}
+	if body.Model != "gpt-4o" {
+		t.Errorf("model = %q, want gpt-4o", body.Model)
+	}
+	if body.Usage == nil || body.Usage.PromptTokens == 0 || body.Usage.CompletionTokens == 0 {
+		t.Errorf("usage not populated: %+v", body.Usage)
+	}
+
+	reqs := upstream.GPTRequests()
+	if len(reqs) != 1 {
+		t.Fatalf("upstream received %d GPT requests, want 1", len(reqs))
+	}
+	if reqs[0].Models != "gpt-4o" {
+		t.Errorf("upstream model = %q", reqs[0].Models)
+	}
+	if got := reqs[0].Messages[0].Message; got != "system:be brief;\r\n" {
+		t.Errorf("system message = %q", got)
+	}
+	if got := reqs[0].Messages[1].Message; got != "user:hi;\r\n" {
+		t.Errorf("dialog message = %q", got)
+	}
+}
+
+func TestChatCompletionVertexNormalizesClaudeModel(t *testing.T) {
+	srv := newTestServer(t, newTestConfig(t))
+	upstream.Enqueue(fakeupstream.Script{Chunks: []string{"Bonjour"}})
+
+	resp := postJSON(t, srv.URL+"/v1/chat/completions", `{
+		"model": "claude-3-5-sonnet-20240620",
+		"messages": [{"role": "user", "content": "hi"}]
+	}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+
+	var body model.ChatCompletionResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if got := body.Choices[0].Message.Content; got != "Bonjour" {
+		t.Errorf("content = %q", got)
+	}
+	if body.Model != "claude-3-5-sonnet-20240620" {
+		t.Errorf("model should echo the requested name, got %q", body.Model)
+	}
+
+	reqs := upstream.VertexRequests()
+	if len(reqs) != 1 {
+		t.Fatalf("upstream received %d Vertex requests, want 1", len(reqs))
+	}
+	if reqs[0].Models != "claude-3-5-sonnet@20240620" {
+		t.Errorf("upstream model = %q", reqs[0].Models)
+	}
+	if got := reqs[0].Args.Messages.Message; got != "user:hi;\r\n" {
+		t.Errorf("upstream message = %q", got)
+	}
+}
+
+func TestChatCompletionStreamWithTerminator(t *testing.T) {
+	srv := newTestServer(t, newTestConfig(t))
+	upstream.Enqueue(fakeupstream.Script{
+		Chunks:       []string{"Hel", "lo"},
+		Terminate:    true,
+		FinalContent: "!",
+	})
+
+	resp := postJSON(t, srv.URL+"/v1/chat/completions", `{
+		"model": "gpt-4o-mini",
+		"stream": true,
+		"messages": [{"role": "user", "content": "hi"}]
+	}`)
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("content type = %q", ct)
+	}
+
+	events := readSSE(t, resp.Body)
+	if len(events) != 5 || events[len(events)-1] != "[DONE]" {
+		t.Fatalf("unexpected events: %q", events)
+	}
+
+	var content strings.Builder
+	var chunks []model.ChatCompletionStreamResponse
+	for _, event := range events[:len(events)-1] {
+		var chunk model.ChatCompletionStreamResponse
+		if err := json.Unmarshal([]byte(event), &chunk); err != nil {
+			t.Fatalf("decode chunk %q: %v", event, err)
+		}
+		content.WriteString(chunk.Choices[0].Delta.Content)
+		chunks = append(chunks, chunk)
+	}
+
+	if got := content.String(); got != "Hello!" {
+		t.Errorf("content = %q, want Hello!", got)
+	}
+	if chunks[0].Choices[0].Delta.Role != model.RoleAssistant {
+		t.Errorf("first chunk should carry the assistant role")
+	}
+	final := chunks[len(chunks)-1]
+	if final.Choices[0].FinishReason != model.FinishReasonStop {
+		t.Errorf("finish reason = %q", final.Choices[0].FinishReason)
+	}
+	if final.Usage == nil || final.Usage.CompletionTokens == 0 {
+		t.Errorf("final chunk should carry usage: %+v", final.Usage)
+	}
+}
+
+func TestChatCompletionStopMaxTokensAndN(t *testing.T) {
+	srv := newTestServer(t, newTestConfig(t))
+
+	// 非流式：n 个选项各自调用一次上游，stop 截断内容
+	upstream.Enqueue(
+		fakeupstream.Script{Chunks: []string{"first answer END ignored"}},
+		fakeupstream.Script{Chunks: []string{"second answer"}},
+	)
+	resp := postJSON(t, srv.URL+"/v1/chat/completions", `{
+		"model": "gpt-4o-mini", "n": 2, "stop": "END",
+		"messages": [{"role": "user", "content": "hi"}]
+	}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	var body model.ChatCompletionResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if len(body.Choices) != 2 || len(upstream.GPTRequests()) != 2 {
+		t.Fatalf("choices = %d, upstream requests = %d, want 2 and 2", len(body.Choices), len(upstream.GPTRequests()))
+	}
+	var contents []string
+	for i, choice := range body.Choices {
+		if choice.Index != i || choice.FinishReason != model.FinishReasonStop {
+			t.Errorf("choice %d: index = %d, finish reason = %q", i, choice.Index, choice.FinishReason)
+		}
+		contents = append(contents, choice.Message.Content)
+	}
+	sort.Strings(contents)
+	if contents[0] != "first answer " || contents[1] != "second answer" {
+		t.Errorf("contents = %q", contents)
+	}
+
+	// 流式：停止序列跨越数据块时不输出其开头部分
+	upstream.Reset()
+	upstream.Enqueue(fakeupstream.Script{Chunks: []string{"Hello wor", "ld <st", "op> more"}, Terminate: true})
+	resp = postJSON(t, srv.URL+"/v1/chat/completions", `{
+		"model": "gpt-4o-mini", "stream": true, "stop": ["<stop>"],
+		"messages": [{"role": "user", "content": "hi"}]
+	}`)
+	content, finish := collectStream(t, resp.Body)
+	if content != "Hello world " || finish != model.FinishReasonStop {
+		t.Errorf("stop: content = %q, finish reason = %q", content, finish)
+	}
+
+	// 流式：按 max_tokens 截断，结束原因为 length
+	upstream.Reset()
+	upstream.Enqueue(fakeupstream.Script{Chunks: []string{"one two", " three four", " five six"}, Terminate: true})
+	resp = postJSON(t, srv.URL+"/v1/chat/completions", `{
+		"model": "gpt-4o-mini", "stream": true, "max_tokens": 3,
+		"messages": [{"role": "user", "content": "hi"}]
+	}`)
+	content, finish = collectStream(t, resp.Body)
+	if content != "one two three" || finish != model.FinishReasonLength {
+		t.Errorf("max_tokens: content = %q, finish reason = %q", content, finish)
+	}
+
+	// 流式 n=2：各选项带各自的序号，用量汇总在最后一个数据块中
+	upstream.Reset()
+	upstream.Enqueue(
+		fakeupstream.Script{Chunks: []string{"a"}, Terminate: true},
+		fakeupstream.Script{Chunks: []string{"b"}, Terminate: true},
+	)
+	resp = postJSON(t, srv.URL+"/v1/chat/completions", `{
+		"model": "gpt-4o-mini", "stream": true, "n": 2,
+		"messages": [{"role": "user", "content": "hi"}]
+	}`)
+	events := readSSE(t, resp.Body)
+	finished := map[int]bool{}
+	var last model.ChatCompletionStreamResponse
+	for _, event := range events[:len(events)-1] {
+		last = model.ChatCompletionStreamResponse{}
+		if err := json.Unmarshal([]byte(event), &last); err != nil {
+			t.Fatalf("decode chunk %q: %v", event, err)
+		}
+		for _, choice := range last.Choices {
+			if choice.FinishReason != "" {
+				finished[choice.Index] = true
+			}
+		}
+	}
+	if !finished[0] || !finished[1] {
+		t.Errorf("n=2: finished choices = %v", finished)
+	}
+	if len(last.Choices) != 0 || last.Usage == nil || last.Usage.CompletionTokens != 2 {
+		t.Errorf("n=2: last chunk should carry only the merged usage: %+v", last)
+	}
+
+	// 参数超出范围时返回 400
+	for _, params := range []string{`"n": 20`, `"temperature": 3`, `"stop": ["a", "b", "c", "d", "e"]`, `"max_tokens": -1`, `"max_completion_tokens": -1`} {
+		resp := postJSON(t, srv.URL+"/v1/chat/completions", `{"model": "gpt-4o-mini", `+params+`, "messages": [{"role": "user", "content": "hi"}]}`)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", params, resp.StatusCode)
+		}
+	}
+
+	// max_tokens 为 0 与未设置相同，不限制输出
+	upstream.Enqueue(fakeupstream.Script{Chunks: []string{"one two three"}})
+	resp = postJSON(t, srv.URL+"/v1/chat/completions", `{"model": "gpt-4o-mini", "max_tokens": 0, "messages": [{"role": "user", "content": "hi"}]}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("max_tokens 0: status = %d, want 200", resp.StatusCode)
+	}
+	resp.Body.Close()
+}
+
+// collectStream 拼接流式响应中第一个选项的内容，返回内容和结束原因
+func collectStream(t *testing.T, r io.Reader) (string, model.FinishReason) {
+	t.Helper()
+	var content strings.Builder
+	var finish model.FinishReason
+	for _, event := range readSSE(t, r) {
+		if event == "[DONE]" {
+			break
+		}
+		var chunk model.ChatCompletionStreamResponse
+		if err := json.Unmarshal([]byte(event), &chunk); err != nil {
+			t.Fatalf("decode chunk %q: %v", event, err)
+		}
+		for _, choice := range chunk.Choices {
+			content.WriteString(choice.Delta.Content)
+			if choice.FinishReason != "" {
+				finish = choice.FinishReason
+			}
+		}
+	}
+	return content.String(), finish
+}
+
+func TestChatCompletionToolCalls(t *testing.T) {
+	srv := newTestServer(t, newTestConfig(t))
+	tools := `"tools": [{"type": "function", "function": {"name": "get_weather", "description": "Get the weather", "parameters": {"type": "object", "properties": {"city": {"type": "string"}}}}}]`
+
+	// 非流式：历史中的调用和结果改写为文本，回复中的调用解析为 tool_calls
+	upstream.Enqueue(fakeupstream.Script{Chunks: []string{"Let me check.\n<tool_call>\n{\"name\": \"get_weather\", \"arguments\": {\"city\": \"Paris\"}}\n</tool_call>"}})
+	resp := postJSON(t, srv.URL+"/v1/chat/completions", `{
+		"model": "gpt-4o-mini", `+tools+`,
+		"messages": [
+			{"role": "user", "content": "weather in Oslo?"},
+			{"role": "assistant", "content": null, "tool_calls": [{"id": "call_1", "type": "function", "function": {"name": "get_weather", "arguments": "{\"city\":\"Oslo\"}"}}]},
+			{"role": "tool", "tool_call_id": "call_1", "content": "sunny"},
+			{"role": "user", "content": "and Paris?"}
+		]
+	}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	var body model.ChatCompletionResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	choice := body.Choices[0]
+	if choice.FinishReason != model.FinishReasonToolCalls || choice.Message.Content != "Let me check." {
+		t.Errorf("finish reason = %q, content = %q", choice.FinishReason, choice.Message.Content)
+	}
+	if calls := choice.Message.ToolCalls; len(calls) != 1 || calls[0].Function.Name != "get_weather" ||
+		calls[0].Function.Arguments != `{"city": "Paris"}` || !strings.HasPrefix(calls[0].ID, "call_") || calls[0].Index != nil {
+		t.Errorf("tool calls = %+v", calls)
+	}
+
+	reqs := upstream.GPTRequests()
+	if len(reqs) != 1 {
+		t.Fatalf("upstream received %d requests, want 1", len(reqs))
+	}
+	if system := reqs[0].Messages[0].Message; !strings.Contains(system, `"name": "get_weather"`) || !strings.Contains(system, "<tool_call>") {
+		t.Errorf("system prompt does not describe the tools: %q", system)
+	}
+	dialog := reqs[0].Messages[1].Message
+	for _, want := range []string{`assistant:<tool_call>` + "\n" + `{"name":"get_weather","arguments":{"city":"Oslo"}}`, `user:<tool_result id="call_1" name="get_weather">` + "\nsunny\n"} {
+		if !strings.Contains(dialog, want) {
+			t.Errorf("dialog %q should contain %q", dialog, want)
+		}
+	}
+
+	// 流式：调用标签跨越数据块时增量解析
+	upstream.Reset()
+	upstream.Enqueue(fakeupstream.Script{
+		Chunks:    []string{"Sure <tool", `_call>{"name": "get_weather", "argu`, `ments": {"city": "Oslo"}}</tool_call>`},
+		Terminate: true,
+	})
+	resp = postJSON(t, srv.URL+"/v1/chat/completions", `{
+		"model": "gpt-4o-mini", "stream": true, `+tools+`, "tool_choice": "required",
+		"messages": [{"role": "user", "content": "weather in Oslo?"}]
+	}`)
+	var content strings.Builder
+	var calls []model.ToolCall
+	var finish model.FinishReason
+	for _, event := range readSSE(t, resp.Body) {
+		if event == "[DONE]" {
+			break
+		}
+		var chunk model.ChatCompletionStreamResponse
+		if err := json.Unmarshal([]byte(event), &chunk); err != nil {
+			t.Fatalf("decode chunk %q: %v", event, err)
+		}
+		content.WriteString(chunk.Choices[0].Delta.Content)
+		calls = append(calls, chunk.Choices[0].Delta.ToolCalls...)
+		if chunk.Choices[0].FinishReason != "" {
+			finish = chunk.Choices[0].FinishReason
+		}
+	}
+	if content.String() != "Sure " || finish != model.FinishReasonToolCalls {
+		t.Errorf("stream: content = %q, finish reason = %q", content.String(), finish)
+	}
+	if len(calls) != 1 || calls[0].Index == nil || *calls[0].Index != 0 || calls[0].Function.Arguments != `{"city": "Oslo"}` {
+		t.Errorf("stream: tool calls = %+v", calls)
+	}
+
+	// tool_choice 指定的工具必须存在
+	resp = postJSON(t, srv.URL+"/v1/chat/completions", `{
+		"model": "gpt-4o-mini", `+tools+`, "tool_choice": {"type": "function", "function": {"name": "missing"}},
+		"messages": [{"role": "user", "content": "hi"}]
+	}`)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("unknown tool_choice: status = %d, want 400", resp.StatusCode)
+	}
+
+	// 没有 tools 时不允许指定 tool_choice
+	resp = postJSON(t, srv.URL+"/v1/chat/completions", `{
+		"model": "gpt-4o-mini", "tool_choice": "auto",
+		"messages": [{"role": "user", "content": "hi"}]
+	}`)
+	if code := decodeError(t, resp.Body); resp.StatusCode != http.StatusBadRequest || code != string(model.ErrInvalidRequest) {
+		t.Errorf("tool_choice without tools: status = %d, code = %s, want 400", resp.StatusCode, code)
+	}
+}
+
+func TestModelRouteKeepsToolChoice(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.EnableModelRoute = true
+	srv := newTestServer(t, cfg)
+	tools := `"tools": [{"type": "function", "function": {"name": "get_weather", "parameters": {"type": "object"}}}]`
+
+	// 模型路由只改写 model 字段，对象形式的 tool_choice 原样传给处理函数
+	upstream.Enqueue(fakeupstream.Script{Chunks: []string{`<tool_call>{"name": "get_weather", "arguments": {}}</tool_call>`}})
+	resp := postJSON(t, srv.URL+"/gpt-4o-mini/v1/chat/completions", `{
+		`+tools+`, "tool_choice": {"type": "function", "function": {"name": "get_weather"}},
+		"messages": [{"role": "user", "content": "weather?"}]
+	}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", resp.StatusCode, decodeError(t, resp.Body))
+	}
+	var body model.ChatCompletionResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if body.Model != "gpt-4o-mini" || body.Choices[0].FinishReason != model.FinishReasonToolCalls {
+		t.Errorf("model = %q, finish reason = %q", body.Model, body.Choices[0].FinishReason)
+	}
+
+	for choice, want := range map[model.ToolChoice]string{
+		{Mode: model.ToolChoiceRequired}:                          `"required"`,
+		{Mode: model.ToolChoiceFunction, Function: "get_weather"}: `{"type":"function","function":{"name":"get_weather"}}`,
+	} {
+		data, err := json.Marshal(choice)
+		if err != nil || string(data) != want {
+			t.Errorf("marshal %+v = %s, %v; want %s", choice, data, err, want)
+		}
+	}
+}
+
+func TestChatCompletionResponseFormat(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.FormatRetries = 1
+	srv := newTestServer(t, cfg)
+	schema := `"response_format": {"type": "json_schema", "json_schema": {"name": "weather", "schema": {
+		"type": "object",
+		"properties": {"city": {"type": "string"}, "temp": {"type": "number"}},
+		"required": ["city", "temp"],
+		"additionalProperties": false
+	}}}`
+
+	// 第一次输出不符合 schema，校验错误反馈给模型后重新生成，代码块标记被去掉
+	upstream.Enqueue(
+		fakeupstream.Script{Chunks: []string{`{"city": "Paris"}`}},
+		fakeupstream.Script{Chunks: []string{"```json\n{\"city\": \"Paris\", \"temp\": 21}\n```"}},
+	)
+	resp := postJSON(t, srv.URL+"/v1/chat/completions", `{
+		"model": "gpt-4o-mini", `+schema+`,
+		"messages": [{"role": "user", "content": "weather in Paris?"}]
+	}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	var body model.ChatCompletionResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if got := body.Choices[0].Message.Content; got != `{"city": "Paris", "temp": 21}` {
+		t.Errorf("content = %q", got)
+	}
+	reqs := upstream.GPTRequests()
+	if len(reqs) != 2 {
+		t.Fatalf("upstream received %d requests, want 2", len(reqs))
+	}
+	if system := reqs[0].Messages[0].Message; !strings.Contains(system, "JSON Schema (name: weather)") || !strings.Contains(system, `"required": ["city", "temp"]`) {
+		t.Errorf("system prompt does not describe the schema: %q", system)
+	}
+	retry := reqs[1].Messages[1].Message
+	if !strings.Contains(retry, `assistant:{"city": "Paris"}`) || !strings.Contains(retry, "missing required property 'temp'") {
+		t.Errorf("retry prompt should contain the rejected output and the validation error: %q", retry)
+	}
+
+	// 重试次数用完后返回 invalid_output
+	upstream.Reset()
+	upstream.Enqueue(
+		fakeupstream.Script{Chunks: []string{"Sure! Here it is."}},
+		fakeupstream.Script{Chunks: []string{`["not", "an", "object"]`}},
+	)
+	resp = postJSON(t, srv.URL+"/v1/chat/completions", `{
+		"model": "gpt-4o-mini", "response_format": {"type": "json_object"},
+		"messages": [{"role": "user", "content": "hi"}]
+	}`)
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("status = %d, want 502", resp.StatusCode)
+	}
+	if code := decodeError(t, resp.Body); code != string(model.ErrInvalidOutput) {
+		t.Errorf("error code = %q, want %q", code, model.ErrInvalidOutput)
+	}
+	if n := len(upstream.GPTRequests()); n != 2 {
+		t.Errorf("upstream received %d requests, want 2", n)
+	}
+
+	// 流式请求在校验通过后输出
+	upstream.Reset()
+	upstream.Enqueue(fakeupstream.Script{Chunks: []string{` {"ok": true} `}})
+	resp = postJSON(t, srv.URL+"/v1/chat/completions", `{
+		"model": "gpt-4o-mini", "stream": true, "response_format": {"type": "json_object"},
+		"messages": [{"role": "user", "content": "hi"}]
+	}`)
+	var content strings.Builder
+	var finish model.FinishReason
+	var usage *model.Usage
+	for _, event := range readSSE(t, resp.Body) {
+		if event == "[DONE]" {
+			break
+		}
+		var chunk model.ChatCompletionStreamResponse
+		if err := json.Unmarshal([]byte(event), &chunk); err != nil {
+			t.Fatalf("decode chunk %q: %v", event, err)
+		}
+		content.WriteString(chunk.Choices[0].Delta.Content)
+		if chunk.Choices[0].FinishReason != "" {
+			finish = chunk.Choices[0].FinishReason
+		}
+		if chunk.Usage != nil {
+			usage = chunk.Usage
+		}
+	}
+	if content.String() != `{"ok": true}` || finish != model.FinishReasonStop || usage == nil {
+		t.Errorf("stream: content = %q, finish reason = %q, usage = %+v", content.String(), finish, usage)
+	}
+
+	// schema 无法解析时返回 400
+	resp = postJSON(t, srv.URL+"/v1/chat/completions", `{
+		"model": "gpt-4o-mini", "response_format": {"type": "json_schema", "json_schema": {"name": "bad", "schema": {"type": "map"}}},
+		"messages": [{"role": "user", "content": "hi"}]
+	}`)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("invalid schema: status = %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestResponseFormatRetryAdmission(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.FormatRetries = 2
+	cfg.TokenLimits.PerIP = 500
+	srv := newTestServer(t, cfg)
+	rejected := strings.Repeat("nope ", 600)
+
+	// 追加反馈后的提示词需要重新预扣额度，额度不足时不再重试
+	upstream.Enqueue(fakeupstream.Script{Chunks: []string{rejected}})
+	resp := postJSON(t, srv.URL+"/v1/chat/completions", `{
+		"model": "gpt-4o-mini", "response_format": {"type": "json_object"},
+		"messages": [{"role": "user", "content": "hi"}]
+	}`)
+	if code := decodeError(t, resp.Body); resp.StatusCode != http.StatusTooManyRequests || code != string(model.ErrRateLimitExceeded) {
+		t.Errorf("tpm exceeded: status = %d, code = %q, want 429", resp.StatusCode, code)
+	}
+	if n := len(upstream.GPTRequests()); n != 1 {
+		t.Errorf("tpm exceeded: upstream received %d requests, want 1", n)
+	}
+
+	// 追加反馈后超出上下文窗口时停止重试，gpt-4 的输入上限为 4100 token
+	cfg = newTestConfig(t)
+	cfg.FormatRetries = 2
+	srv = newTestServer(t, cfg)
+	upstream.Reset()
+	upstream.Enqueue(fakeupstream.Script{Chunks: []string{rejected}})
+	resp = postJSON(t, srv.URL+"/v1/chat/completions", `{
+		"model": "gpt-4", "response_format": {"type": "json_object"},
+		"messages": [{"role": "user", "content": "`+strings.Repeat("word ", 3800)+`"}]
+	}`)
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("context exceeded: status = %d, want 502", resp.StatusCode)
+	}
+	var body struct {
+		Error struct {
+			Code    string `json:"code"`
+			Details struct {
+				Attempts       int `json:"attempts"`
+				PromptTokens   int `json:"prompt_tokens"`
+				MaxInputTokens int `json:"max_input_tokens"`
+			} `json:"details"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("decode error body: %v", err)
+	}
+	if body.Error.Code != string(model.ErrInvalidOutput) || body.Error.Details.Attempts != 1 ||
+		body.Error.Details.MaxInputTokens != 4100 || body.Error.Details.PromptTokens <= 4100 {
+		t.Errorf("context exceeded: error = %+v", body.Error)
+	}
+	if n := len(upstream.GPTRequests()); n != 1 {
+		t.Errorf("context exceeded: upstream received %d requests, want 1", n)
+	}
+}
+
+func TestChatCompletionContentParts(t *testing.T) {
+	srv := newTestServer(t, newTestConfig(t))
+	parts := `[
+		{"type": "text", "text": "Describe this"},
+		{"type": "image_url", "image_url": {"url": "data:image/png;base64,iVBORw0KGgo="}},
+		{"type": "text", "text": "briefly"}
+	]`
+
+	// 支持图片的模型丢弃图片片段，文本片段拼接后发往上游
+	upstream.Enqueue(fakeupstream.Script{Chunks: []string{"A cat."}})
+	resp := postJSON(t, srv.URL+"/v1/chat/completions", `{"model": "gpt-4o-mini", "messages": [{"role": "user", "content": `+parts+`}]}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	reqs := upstream.GPTRequests()
+	if len(reqs) != 1 {
+		t.Fatalf("upstream received %d requests, want 1", len(reqs))
+	}
+	if dialog := reqs[0].Messages[0].Message; !strings.Contains(dialog, "user:Describe this\nbriefly;") || strings.Contains(dialog, "base64") {
+		t.Errorf("dialog = %q", dialog)
+	}
+
+	// 不支持图片的模型返回指向具体片段的错误
+	resp = postJSON(t, srv.URL+"/v1/chat/completions", `{"model": "gpt-4", "messages": [{"role": "user", "content": `+parts+`}]}`)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("gpt-4: status = %d, want 400", resp.StatusCode)
+	}
+	var body struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("decode error body: %v", err)
+	}
+	if want := "messages[0].content[1]: model 'gpt-4' does not accept image input"; body.Error.Message != want {
+		t.Errorf("error message = %q, want %q", body.Error.Message, want)
+	}
+
+	for name, content := range map[string]string{
+		"unknown part type":       `[{"type": "input_audio", "input_audio": {"data": "", "format": "wav"}}]`,
+		"image without url":       `[{"type": "image_url", "image_url": {}}]`,
+		"neither string nor list": `42`,
+	} {
+		resp := postJSON(t, srv.URL+"/v1/chat/completions", `{"model": "gpt-4o-mini", "messages": [{"role": "user", "content": `+content+`}]}`)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", name, resp.StatusCode)
+		}
+	}
+	if n := len(upstream.GPTRequests()); n != 1 {
+		t.Errorf("upstream received %d requests, want 1", n)
+	}
+}
+
+func TestModelRouteChecksContentParts(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.EnableModelRoute = true
+	srv := newTestServer(t, cfg)
+	content := `[{"type": "text", "text": "What is this?"}, {"type": "image_url", "image_url": {"url": "https://example.com/cat.png"}}]`
+
+	// 模型路由转发的请求保留图片片段，仍按模型能力校验
+	resp := postJSON(t, srv.URL+"/gpt-4/v1/chat/completions", `{"messages": [{"role": "user", "content": `+content+`}]}`)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("gpt-4: status = %d, want 400", resp.StatusCode)
+	}
+	if n := len(upstream.GPTRequests()); n != 0 {
+		t.Errorf("upstream received %d requests, want 0", n)
+	}
+
+	upstream.Enqueue(fakeupstream.Script{Chunks: []string{"A cat."}})
+	resp = postJSON(t, srv.URL+"/gpt-4o/v1/chat/completions", `{"messages": [{"role": "user", "content": `+content+`}]}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("gpt-4o: status = %d, want 200", resp.StatusCode)
+	}
+	if reqs := upstream.GPTRequests(); len(reqs) != 1 || !strings.Contains(reqs[0].Messages[0].Message, "user:What is this?;") {
+		t.Errorf("upstream requests = %+v", reqs)
+	}
+
+	msg := model.ChatMessage{Role: model.RoleUser}
+	if err := json.Unmarshal([]byte(`{"role": "user", "content": `+content+`}`), &msg); err != nil {
+		t.Fatalf("unmarshal message: %v", err)
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatalf("marshal message: %v", err)
+	}
+	var decoded model.ChatMessage
+	if err := json.Unmarshal(data, &decoded); err != nil || !decoded.HasImages() || decoded.Content != "What is this?" {
+		t.Errorf("round trip lost content parts: %s", data)
+	}
+}
+
+// sseEvent 带事件名的 SSE 事件
+type sseEvent struct {
+	Name string
+	Data string
+}
+
+// readNamedSSE 读取 event: 和 data: 行组成的事件
+func readNamedSSE(t *testing.T, r io.Reader) []sseEvent {
+	t.Helper()
+	var events []sseEvent
+	var name string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if v, ok := strings.CutPrefix(line, "event: "); ok {
+			name = v
+		} else if v, ok := strings.CutPrefix(line, "data: "); ok {
+			events = append(events, sseEvent{Name: name, Data: v})
+			name = ""
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatalf("read SSE: %v", err)
+	}
+	return events
+}
+
+func TestAnthropicMessages(t *testing.T) {
+	srv := newTestServer(t, newTestConfig(t))
+
+	for _, tc := range []struct {
+		name, chunk, extra, text, stopReason string
+		stopSequence                         *string
+	}{
+		{"end_turn", "Hello there", "", "Hello there", model.AnthropicStopEndTurn, nil},
+		{"stop_sequence", "Hello STOP ignored", `"stop_sequences": ["END", "STOP"],`, "Hello ", model.AnthropicStopStopSequence, ptr("STOP")},
+	} {
+		upstream.Enqueue(fakeupstream.Script{Chunks: []string{tc.chunk}})
+		resp := postJSON(t, srv.URL+"/v1/messages", `{
+			"model": "claude-3-haiku@20240307", "max_tokens": 100, `+tc.extra+`
+			"system": "Be brief.",
+			"messages": [{"role": "user", "content": "hi"}]
+		}`)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: status = %d, want 200", tc.name, resp.StatusCode)
+		}
+		var body model.AnthropicMessagesResponse
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatalf("%s: decode response: %v", tc.name, err)
+		}
+		if body.Type != "message" || body.Role != model.RoleAssistant || len(body.Content) != 1 || body.Content[0].Text != tc.text {
+			t.Errorf("%s: response = %+v", tc.name, body)
+		}
+		if body.StopReason == nil || *body.StopReason != tc.stopReason {
+			t.Errorf("%s: stop_reason = %v, want %s", tc.name, body.StopReason, tc.stopReason)
+		}
+		if (body.StopSequence == nil) != (tc.stopSequence == nil) || (body.StopSequence != nil && *body.StopSequence != *tc.stopSequence) {
+			t.Errorf("%s: stop_sequence = %v, want %v", tc.name, body.StopSequence, tc.stopSequence)
+		}
+		if body.Usage == nil || body.Usage.InputTokens == 0 || body.Usage.OutputTokens == 0 {
+			t.Errorf("%s: usage = %+v", tc.name, body.Usage)
+		}
+	}
+	if reqs := upstream.VertexRequests(); len(reqs) != 2 || !strings.Contains(reqs[0].Args.Rules, "Be brief.") {
+		t.Errorf("upstream requests = %+v", reqs)
+	}
+
+	// 流式：事件顺序与官方接口一致，max_tokens 截断时 stop_reason 为 max_tokens
+	upstream.Reset()
+	upstream.Enqueue(fakeupstream.Script{Chunks: []string{"one two ", "three four five six seven"}, Terminate: true})
+	resp := postJSON(t, srv.URL+"/v1/messages", `{
+		"model": "claude-3-haiku@20240307", "max_tokens": 3, "stream": true,
+		"messages": [{"role": "user", "content": "count"}]
+	}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("stream: status = %d, want 200", resp.StatusCode)
+	}
+	events := readNamedSSE(t, resp.Body)
+	var names []string
+	var text strings.Builder
+	var final model.AnthropicStreamEvent
+	for _, event := range events {
+		if len(names) == 0 || names[len(names)-1] != event.Name {
+			names = append(names, event.Name)
+		}
+		var payload model.AnthropicStreamEvent
+		if err := json.Unmarshal([]byte(event.Data), &payload); err != nil {
+			t.Fatalf("decode event %q: %v", event.Data, err)
+		}
+		if payload.Type != event.Name {
+			t.Errorf("event %s carries type %q", event.Name, payload.Type)
+		}
+		switch event.Name {
+		case model.AnthropicEventContentBlockDelta:
+			text.WriteString(payload.Delta.Text)
+		case model.AnthropicEventMessageDelta:
+			final = payload
+		}
+	}
+	want := []string{
+		model.AnthropicEventMessageStart, model.AnthropicEventContentBlockStart, model.AnthropicEventPing,
+		model.AnthropicEventContentBlockDelta, model.AnthropicEventContentBlockStop,
+		model.AnthropicEventMessageDelta, model.AnthropicEventMessageStop,
+	}
+	if strings.Join(names, ",") != strings.Join(want, ",") {
+		t.Errorf("event sequence = %v, want %v", names, want)
+	}
+	if text.String() != "one two three " {
+		t.Errorf("stream text = %q, should be cut off by max_tokens", text.String())
+	}
+	if final.Delta == nil || final.Delta.StopReason == nil || *final.Delta.StopReason != model.AnthropicStopMaxTokens || final.Usage == nil || final.Usage.OutputTokens == 0 {
+		t.Errorf("message_delta = %+v", final)
+	}
+
+	// 流式：停止序列跨越数据块时 message_delta 带有 stop_sequence
+	upstream.Enqueue(fakeupstream.Script{Chunks: []string{"Hello <st", "op> more"}, Terminate: true})
+	resp = postJSON(t, srv.URL+"/v1/messages", `{
+		"model": "claude-3-haiku@20240307", "max_tokens": 100, "stream": true, "stop_sequences": ["<stop>"],
+		"messages": [{"role": "user", "content": "hi"}]
+	}`)
+	events = readNamedSSE(t, resp.Body)
+	if len(events) < 2 || events[len(events)-2].Name != model.AnthropicEventMessageDelta {
+		t.Fatalf("stream events = %+v", events)
+	}
+	if data := events[len(events)-2].Data; !strings.Contains(data, `"stop_reason":"stop_sequence"`) || !strings.Contains(data, `"stop_sequence":"\u003cstop\u003e"`) {
+		t.Errorf("message_delta = %s", data)
+	}
+
+	// 错误响应使用 Anthropic 的错误格式
+	for _, tc := range []struct {
+		body, errType string
+		status        int
+	}{
+		{`{"model": "claude-3-haiku@20240307", "messages": [{"role": "user", "content": "hi"}]}`, "invalid_request_error", http.StatusBadRequest},
+		{`{"model": "no-such-model", "max_tokens": 10, "messages": [{"role": "user", "content": "hi"}]}`, "not_found_error", http.StatusNotFound},
+		{`{"model": "no-such-model", "max_tokens": 10, "stream": true, "messages": [{"role": "user", "content": "hi"}]}`, "not_found_error", http.StatusNotFound},
+	} {
+		resp := postJSON(t, srv.URL+"/v1/messages", tc.body)
+		var body struct {
+			Type  string `json:"type"`
+			Error struct {
+				Type    string `json:"type"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatalf("decode error body: %v", err)
+		}
+		if resp.StatusCode != tc.status || body.Type != "error" || body.Error.Type != tc.errType || body.Error.Message == "" {
+			t.Errorf("%s: status = %d, body = %+v", tc.body, resp.StatusCode, body)
+		}
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func TestGeminiGenerateContent(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.APIKey = "secret"
+	srv := newTestServer(t, cfg)
+	const body = `{
+		"systemInstruction": {"parts": [{"text": "Be brief."}]},
+		"contents": [{"role": "user", "parts": [{"text": "hi"}]}],
+		"generationConfig": {"temperature": 0.5}
+	}`
+	// 合并流式数据块中的文本，返回文本和最后的 finishReason
+	collect := func(chunks []model.GeminiGenerateContentResponse) (string, string) {
+		var text strings.Builder
+		var finish string
+		for _, chunk := range chunks {
+			for _, candidate := range chunk.Candidates {
+				if candidate.Content != nil {
+					for _, part := range candidate.Content.Parts {
+						text.WriteString(part.Text)
+					}
+				}
+				if candidate.FinishReason != "" {
+					finish = candidate.FinishReason
+				}
+			}
+		}
+		return text.String(), finish
+	}
+
+	// 非流式：Google SDK 以 ?key= 传递密钥
+	upstream.Enqueue(fakeupstream.Script{Chunks: []string{"Hello!"}})
+	resp := postJSON(t, srv.URL+"/v1beta/models/gemini-1.5-pro:generateContent?key=secret", body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("generateContent: status = %d, want 200", resp.StatusCode)
+	}
+	var single model.GeminiGenerateContentResponse
+	if err := json.NewDecoder(resp.Body).Decode(&single); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if text, finish := collect([]model.GeminiGenerateContentResponse{single}); text != "Hello!" || finish != model.GeminiFinishStop {
+		t.Errorf("generateContent: text = %q, finishReason = %q", text, finish)
+	}
+	if c := single.Candidates[0]; c.Content.Role != model.GeminiRoleModel || single.UsageMetadata == nil || single.UsageMetadata.TotalTokenCount == 0 {
+		t.Errorf("generateContent: response = %+v", single)
+	}
+	if reqs := upstream.VertexRequests(); len(reqs) != 1 || reqs[0].Models != "gemini-1.5-pro" || !strings.Contains(reqs[0].Args.Rules, "Be brief.") {
+		t.Errorf("upstream requests = %+v", reqs)
+	}
+
+	// 流式 JSON 数组，使用 x-goog-api-key 头
+	upstream.Enqueue(fakeupstream.Script{Chunks: []string{"Hel", "lo"}, Terminate: true})
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/v1beta/models/gemini-1.5-pro:streamGenerateContent", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("x-goog-api-key", "secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("streamGenerateContent: %v", err)
+	}
+	defer resp.Body.Close()
+	var array []model.GeminiGenerateContentResponse
+	if err := json.NewDecoder(resp.Body).Decode(&array); err != nil {
+		t.Fatalf("stream should be a JSON array: %v", err)
+	}
+	if text, finish := collect(array); resp.Header.Get("Content-Type") != "application/json" || text != "Hello" || finish != model.GeminiFinishStop {
+		t.Errorf("stream: content type = %q, text = %q, finishReason = %q", resp.Header.Get("Content-Type"), text, finish)
+	}
+
+	// 流式 SSE
+	upstream.Enqueue(fakeupstream.Script{Chunks: []string{"Hel", "lo"}, Terminate: true})
+	resp = postJSON(t, srv.URL+"/v1beta/models/gemini-1.5-pro:streamGenerateContent?alt=sse&key=secret", body)
+	var events []model.GeminiGenerateContentResponse
+	for _, data := range readSSE(t, resp.Body) {
+		var chunk model.GeminiGenerateContentResponse
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			t.Fatalf("decode SSE chunk %q: %v", data, err)
+		}
+		events = append(events, chunk)
+	}
+	if text, finish := collect(events); !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") || text != "Hello" || finish != model.GeminiFinishStop {
+		t.Errorf("sse: content type = %q, text = %q, finishReason = %q", resp.Header.Get("Content-Type"), text, finish)
+	}
+
+	// 多个候选结果、错误的密钥返回 Google API 格式的错误；?key= 只在 Gemini 路由上生效
+	for _, tc := range []struct {
+		url, body, status string
+		code              int
+	}{
+		{"/v1beta/models/gemini-1.5-pro:generateContent?key=secret", `{"contents": [{"role": "user", "parts": [{"text": "hi"}]}], "generationConfig": {"candidateCount": 2}}`, "INVALID_ARGUMENT", http.StatusBadRequest},
+		{"/v1beta/models/gemini-1.5-pro:generateContent?key=wrong", body, "", http.StatusUnauthorized},
+		{"/v1beta/models/gemini-1.5-pro:generateContent", body, "", http.StatusUnauthorized},
+		{"/v1/chat/completions?key=secret", `{"model": "gpt-4o", "messages": [{"role": "user", "content": "hi"}]}`, "", http.StatusUnauthorized},
+	} {
+		resp := postJSON(t, srv.URL+tc.url, tc.body)
+		if resp.StatusCode != tc.code {
+			t.Errorf("%s: status = %d, want %d", tc.url, resp.StatusCode, tc.code)
+			continue
+		}
+		if tc.status == "" {
+			continue
+		}
+		var body struct {
+			Error struct {
+				Code    int    `json:"code"`
+				Message string `json:"message"`
+				Status  string `json:"status"`
+			} `json:"error"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatalf("decode error body: %v", err)
+		}
+		if body.Error.Code != tc.code || body.Error.Status != tc.status || !strings.Contains(body.Error.Message, "candidateCount") {
+			t.Errorf("%s: error = %+v", tc.url, body.Error)
+		}
+	}
+	if n := len(upstream.VertexRequests()) + len(upstream.GPTRequests()); n != 3 {
+		t.Errorf("upstream received %d requests, want 3", n)
+	}
+}
+
+func TestChatCompletionStreamRSTStream(t *testing.T) {
+	srv := newTestServer(t, newTestConfig(t))
+	upstream.Enqueue(fakeupstream.Script{
+		Chunks:    []string{"partial ", "answer"},
+		StreamErr: fakeupstream.ErrRSTStream,
+	})
+
+	resp := postJSON(t, srv.URL+"/v1/chat/completions", `{
+		"model": "claude-3-haiku@20240307",
+		"stream": true,
+		"messages": [{"role": "user", "content": "hi"}]
+	}`)
+
+	events := readSSE(t, resp.Body)
+	if len(events) != 4 || events[len(events)-1] != "[DONE]" {
+		t.Fatalf("unexpected events: %q", events)
+	}
+
+	var final model.ChatCompletionStreamResponse
+	if err := json.Unmarshal([]byte(events[2]), &final); err != nil {
+		t.Fatalf("decode final chunk: %v", err)
+	}
+	if final.Choices[0].FinishReason != model.FinishReasonStop || final.Usage == nil {
+		t.Errorf("RST_STREAM after content should still produce a final chunk, got %s", events[2])
+	}
+}
+
+func TestChatCompletionUpstreamError(t *testing.T) {
+	srv := newTestServer(t, newTestConfig(t))
+	upstream.Enqueue(fakeupstream.Script{Err: status.Error(codes.PermissionDenied, "denied")})
+
+	resp := postJSON(t, srv.URL+"/v1/chat/completions", `{
+		"model": "gpt-4",
+		"messages": [{"role": "user", "content": "hi"}]
+	}`)
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want 500", resp.StatusCode)
+	}
+	if code := decodeError(t, resp.Body); code != string(model.ErrInternalError) {
+		t.Errorf("error code = %q", code)
+	}
+}
+
+func TestChatCompletionUpstreamResponseCode(t *testing.T) {
+	srv := newTestServer(t, newTestConfig(t))
+	upstream.Enqueue(fakeupstream.Script{Chunks: []string{"busy"}, ResponseCode: 439})
+
+	resp := postJSON(t, srv.URL+"/v1/chat/completions", `{
+		"model": "gemini-1.5-pro",
+		"messages": [{"role": "user", "content": "hi"}]
+	}`)
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want 500", resp.StatusCode)
+	}
+}
+
+func TestChatCompletionUpstreamLatencyExceedsTimeout(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.Timeout = 1
+	srv := newTestServer(t, cfg)
+	upstream.Enqueue(fakeupstream.Script{Chunks: []string{"late"}, Latency: 3 * time.Second})
+
+	start := time.Now()
+	resp := postJSON(t, srv.URL+"/v1/chat/completions", `{
+		"model": "gpt-4o",
+		"messages": [{"role": "user", "content": "hi"}]
+	}`)
+	if resp.StatusCode == http.StatusOK {
+		t.Fatalf("request should fail when upstream exceeds the timeout")
+	}
+	if elapsed := time.Since(start); elapsed > 2500*time.Millisecond {
+		t.Errorf("request took %s, timeout was not enforced", elapsed)
+	}
+}
+
+func TestChatCompletionUnknownModel(t *testing.T) {
+	srv := newTestServer(t, newTestConfig(t))
+
+	resp := postJSON(t, srv.URL+"/v1/chat/completions", `{
+		"model": "no-such-model",
+		"messages": [{"role": "user", "content": "hi"}]
+	}`)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("status = %d, want 404", resp.StatusCode)
+	}
+	if code := decodeError(t, resp.Body); code != string(model.ErrModelNotFound) {
+		t.Errorf("error code = %q", code)
+	}
+	if n := len(upstream.GPTRequests()) + len(upstream.VertexRequests()); n != 0 {
+		t.Errorf("upstream should not be called, got %d requests", n)
+	}
+}
+
+func TestModelAliasesAndDeprecationRedirects(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	content := "gpt_grpc_addr: " + upstream.Addr() + "\n" +
+		"vertex_grpc_addr: " + upstream.Addr() + "\n" +
+		"grpc_plaintext: true\n" +
+		"max_retries: 1\n" +
+		"timeout: 5\n" +
+		"blacklist_mode: \"off\"\n" +
+		"blacklist_file: " + filepath.Join(dir, "blacklist.txt") + "\n" +
+		"model_aliases:\n" +
+		"  fast: gpt-4o-mini\n" +
+		"  smart: claude-3-5-sonnet-latest\n" +
+		"  legacy-chat:\n" +
+		"    target: gpt-4o\n" +
+		"    deprecated: true\n"
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	cfg, err := config.Load(path)
+	if err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	model.SetModelAliases(cfg.ModelAliases)
+	t.Cleanup(func() { model.SetModelAliases(nil) })
+	// 别名生效后重新加载同一份配置不应被误判为与已有模型重名
+	if _, err := config.Load(path); err != nil {
+		t.Fatalf("reload config: %v", err)
+	}
+	srv := newTestServer(t, cfg)
+
+	for _, tc := range []struct {
+		name, upstreamModel, redirect string
+	}{
+		{"fast", "gpt-4o-mini", ""},
+		{"gpt-4o-2024-08-06", "gpt-4o", ""},
+		{"smart", "claude-3-5-sonnet@20240620", ""},
+		{"legacy-chat", "gpt-4o", "gpt-4o"},
+		{"gpt-4-vision-preview", "gpt-4-turbo", "gpt-4-turbo"},
+		{"claude-2.1", "claude-3-5-sonnet@20240620", "claude-3-5-sonnet@20240620"},
+	} {
+		upstream.Reset()
+		upstream.Enqueue(fakeupstream.Script{Chunks: []string{"ok"}})
+		resp := postJSON(t, srv.URL+"/v1/chat/completions", `{"model": "`+tc.name+`", "messages": [{"role": "user", "content": "hi"}]}`)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: status = %d, want 200", tc.name, resp.StatusCode)
+		}
+		var got string
+		if reqs := upstream.GPTRequests(); len(reqs) == 1 {
+			got = reqs[0].Models
+		} else if reqs := upstream.VertexRequests(); len(reqs) == 1 {
+			got = reqs[0].Models
+		}
+		if got != tc.upstreamModel {
+			t.Errorf("%s: upstream model = %q, want %q", tc.name, got, tc.upstreamModel)
+		}
+		if got := resp.Header.Get("X-Model-Redirect"); got != tc.redirect {
+			t.Errorf("%s: X-Model-Redirect = %q, want %q", tc.name, got, tc.redirect)
+		}
+		if got, want := resp.Header.Get("Deprecation") == "true", tc.redirect != ""; got != want {
+			t.Errorf("%s: Deprecation = %q", tc.name, resp.Header.Get("Deprecation"))
+		}
+	}
+
+	// 流式请求同样在响应头中提示转发
+	upstream.Enqueue(fakeupstream.Script{Chunks: []string{"ok"}})
+	resp := postJSON(t, srv.URL+"/v1/chat/completions", `{"model": "legacy-chat", "stream": true, "messages": [{"role": "user", "content": "hi"}]}`)
+	readSSE(t, resp.Body)
+	if got := resp.Header.Get("X-Model-Redirect"); got != "gpt-4o" || resp.Header.Get("Deprecation") != "true" {
+		t.Errorf("stream: X-Model-Redirect = %q, Deprecation = %q", got, resp.Header.Get("Deprecation"))
+	}
+
+	resp, err = http.Get(srv.URL + "/v1/models")
+	if err != nil {
+		t.Fatalf("GET /v1/models: %v", err)
+	}
+	defer resp.Body.Close()
+	var list model.ModelsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		t.Fatalf("decode models: %v", err)
+	}
+	entries := make(map[string]model.Model)
+	for _, m := range list.Data {
+		entries[m.ID] = m
+	}
+	for id, want := range map[string]model.Model{
+		"gpt-4o":            {OwnedBy: "openai"},
+		"fast":              {OwnedBy: "openai", AliasOf: "gpt-4o-mini"},
+		"smart":             {OwnedBy: "anthropic", AliasOf: "claude-3-5-sonnet@20240620"},
+		"gpt-4o-2024-08-06": {OwnedBy: "openai", AliasOf: "gpt-4o"},
+		"legacy-chat":       {OwnedBy: "openai", AliasOf: "gpt-4o", Deprecated: true},
+		"claude-2.1":        {OwnedBy: "anthropic", AliasOf: "claude-3-5-sonnet@20240620", Deprecated: true},
+	} {
+		got, ok := entries[id]
+		if !ok {
+			t.Errorf("/v1/models is missing %s", id)
+			continue
+		}
+		if got.OwnedBy != want.OwnedBy || got.AliasOf != want.AliasOf || got.Deprecated != want.Deprecated {
+			t.Errorf("%s: owned_by = %q, alias_of = %q, deprecated = %v", id, got.OwnedBy, got.AliasOf, got.Deprecated)
+		}
+	}
+}
+
+func TestInvalidModelAliasesRejected(t *testing.T) {
+	for _, tc := range []struct {
+		alias, want string
+	}{
+		{"gpt-4o: gpt-4o-mini", "model_aliases.gpt-4o: alias shadows an existing model"},
+		{"claude-3-haiku-20240307: gpt-4o", "model_aliases.claude-3-haiku-20240307: alias shadows an existing model"},
+		{"fast: no-such-model", "model_aliases.fast: target model 'no-such-model' does not exist"},
+		{"fast: gpt-4o-mini\n  faster: fast", "model_aliases.faster: target model 'fast' does not exist"},
+		{"fast:\n    target: gpt-4o-mini\n    sunset: 2025-01-01", "field sunset not found"},
+	} {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		if err := os.WriteFile(path, []byte("model_aliases:\n  "+tc.alias+"\n"), 0644); err != nil {
+			t.Fatalf("write config: %v", err)
+		}
+		_, err := config.Load(path)
+		var verr *config.ValidationError
+		if !errors.As(err, &verr) || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%q: want a validation error containing %q, got %v", tc.alias, tc.want, err)
+		}
+	}
+}
+
+func TestChatCompletionContextTooLong(t *testing.T) {
+	srv := newTestServer(t, newTestConfig(t))
+
+	// gpt-4 的输入上限为 4100 token
+	prompt := strings.Repeat("word ", 5000)
+	for _, stream := range []bool{false, true} {
+		resp := postJSON(t, srv.URL+"/v1/chat/completions",
+			`{"model": "gpt-4", "stream": `+strconv.FormatBool(stream)+`, "messages": [{"role": "user", "content": "`+prompt+`"}]}`)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("stream=%v: status = %d, want 400", stream, resp.StatusCode)
+		}
+		var body struct {
+			Error struct {
+				Code    string `json:"code"`
+				Details struct {
+					PromptTokens   int `json:"prompt_tokens"`
+					MaxInputTokens int `json:"max_input_tokens"`
+				} `json:"details"`
+			} `json:"error"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatalf("stream=%v: decode error body: %v", stream, err)
+		}
+		if body.Error.Code != string(model.ErrContextTooLong) {
+			t.Errorf("stream=%v: error code = %q, want %q", stream, body.Error.Code, model.ErrContextTooLong)
+		}
+		if body.Error.Details.MaxInputTokens != 4100 || body.Error.Details.PromptTokens <= 4100 {
+			t.Errorf("stream=%v: details = %+v", stream, body.Error.Details)
+		}
+	}
+
+	resp := postJSON(t, srv.URL+"/v1/messages",
+		`{"model": "gpt-4", "max_tokens": 16, "messages": [{"role": "user", "content": "`+prompt+`"}]}`)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("messages: status = %d, want 400", resp.StatusCode)
+	}
+
+	if n := len(upstream.GPTRequests()) + len(upstream.VertexRequests()); n != 0 {
+		t.Errorf("upstream should not be called, got %d requests", n)
+	}
+}
+
+func TestChatCompletionTruncation(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.KeysFile = filepath.Join(t.TempDir(), "keys.json")
+	keysJSON := `{"keys": [
+		{"id": "ends", "name": "ends", "secret_hash": "` + keystore.HashSecret("sk-ends") + `", "enabled": true, "truncation": "keep_ends"}
+	]}`
+	if err := os.WriteFile(cfg.KeysFile, []byte(keysJSON), 0644); err != nil {
+		t.Fatalf("write keys: %v", err)
+	}
+	srv := newTestServer(t, cfg)
+
+	// gpt-4 的输入上限为 4100 token，三轮对话合计超出上限，去掉任意较长的一轮后可以放下
+	messages := `[
+		{"role": "system", "content": "be brief"},
+		{"role": "user", "content": "` + strings.Repeat("first ", 2000) + `"},
+		{"role": "assistant", "content": "` + strings.Repeat("answer ", 500) + `"},
+		{"role": "user", "content": "` + strings.Repeat("second ", 2000) + `"},
+		{"role": "assistant", "content": "ok"},
+		{"role": "user", "content": "last question"}
+	]`
+	send := func(strategy, body string) (*http.Response, string) {
+		t.Helper()
+		upstream.Reset()
+		upstream.Enqueue(fakeupstream.Script{Chunks: []string{"done"}})
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+"/v1/chat/completions", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer sk-ends")
+		if strategy != "" {
+			req.Header.Set(model.TruncationHeader, strategy)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("POST: %v", err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		// 拼接上游收到的系统消息和对话内容
+		var sent string
+		if reqs := upstream.GPTRequests(); len(reqs) == 1 {
+			for _, msg := range reqs[0].Messages {
+				sent += msg.Message
+			}
+		}
+		return resp, sent
+	}
+
+	// 请求头指定 drop_oldest，丢弃第一轮
+	resp, sent := send("drop_oldest", `{"model": "gpt-4", "messages": `+messages+`}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("drop_oldest: status = %d, want 200", resp.StatusCode)
+	}
+	if got := resp.Header.Get(model.TruncatedHeader); !strings.HasPrefix(got, "strategy=drop_oldest; dropped_messages=2; shortened_messages=0;") {
+		t.Errorf("drop_oldest: %s = %q", model.TruncatedHeader, got)
+	}
+	if !strings.HasPrefix(sent, "system:be brief;") || strings.Contains(sent, "first") || !strings.Contains(sent, "second") || !strings.Contains(sent, "last question") {
+		t.Errorf("drop_oldest: unexpected messages sent upstream")
+	}
+
+	// 密钥配置的 keep_ends，保留第一轮，丢弃中间一轮
+	resp, sent = send("", `{"model": "gpt-4", "stream": true, "messages": `+messages+`}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("keep_ends: status = %d, want 200", resp.StatusCode)
+	}
+	if got := resp.Header.Get(model.TruncatedHeader); !strings.HasPrefix(got, "strategy=keep_ends; dropped_messages=2;") {
+		t.Errorf("keep_ends: %s = %q", model.TruncatedHeader, got)
+	}
+	if !strings.HasPrefix(sent, "system:be brief;") || !strings.Contains(sent, "first") || strings.Contains(sent, "second") || !strings.Contains(sent, "last question") {
+		t.Errorf("keep_ends: unexpected messages sent upstream")
+	}
+
+	// 请求体指定 middle_out，删减单条过长消息的中间部分
+	long := strings.Repeat("head ", 3000) + strings.Repeat("tail ", 3000)
+	resp, sent = send("", `{"model": "gpt-4", "truncation": "middle_out", "messages": [{"role": "user", "content": "`+long+`"}]}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("middle_out: status = %d, want 200", resp.StatusCode)
+	}
+	if got := resp.Header.Get(model.TruncatedHeader); !strings.HasPrefix(got, "strategy=middle_out; dropped_messages=0; shortened_messages=1;") {
+		t.Errorf("middle_out: %s = %q", model.TruncatedHeader, got)
+	}
+	if !strings.HasPrefix(sent, "user:head ") || !strings.Contains(sent, "[...]") || !strings.HasSuffix(sent, "tail ;\r\n") {
+		t.Errorf("middle_out: unexpected messages sent upstream")
+	}
+
+	// none 关闭密钥配置的截断，未知策略返回 400
+	for strategy, want := range map[string]model.ErrorCode{"none": model.ErrContextTooLong, "bogus": model.ErrInvalidRequest} {
+		resp, _ := send(strategy, `{"model": "gpt-4", "messages": `+messages+`}`)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("%s: status = %d, want 400", strategy, resp.StatusCode)
+		}
+		if resp.Header.Get(model.TruncatedHeader) != "" {
+			t.Errorf("%s: unexpected %s header", strategy, model.TruncatedHeader)
+		}
+		if code := decodeError(t, resp.Body); code != string(want) {
+			t.Errorf("%s: error code = %q, want %q", strategy, code, want)
+		}
+	}
+}
+
+func TestChatCompletionRequiresAPIKey(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.APIKey = "secret"
+	srv := newTestServer(t, cfg)
+
+	resp := postJSON(t, srv.URL+"/v1/chat/completions", `{"model": "gpt-4o", "messages": []}`)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("status = %d, want 401", resp.StatusCode)
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/v1/chat/completions",
+		strings.NewReader(`{"model": "gpt-4o", "messages": [{"role": "user", "content": "hi"}]}`))
+	req.Header.Set("Authorization", "Bearer secret")
+	authed, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("POST: %v", err)
+	}
+	defer authed.Body.Close()
+	if authed.StatusCode != http.StatusOK {
+		t.Fatalf("authorized status = %d, want 200", authed.StatusCode)
+	}
+}
+
+func postWithKey(t *testing.T, url, key, body string) *http.Response {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+key)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("POST %s: %v", url, err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestAdminReloadAppliesNewAPIKey(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	writeConfig := func(apiKey, extra string) {
+		content := "api_key: " + apiKey + "\n" +
+			"admin_key: admin\n" +
+			"gpt_grpc_addr: " + upstream.Addr() + "\n" +
+			"vertex_grpc_addr: " + upstream.Addr() + "\n" +
+			"grpc_plaintext: true\n" +
+			"max_retries: 1\n" +
+			"timeout: 5\n" +
+			"blacklist_mode: \"off\"\n" +
+			"blacklist_file: " + filepath.Join(dir, "blacklist.txt") + "\n" + extra
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("write config: %v", err)
+		}
+	}
+
+	writeConfig("first", "")
+	cfg, err := config.Load(path)
+	if err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	srv := newTestServer(t, cfg)
+	const chatBody = `{"model": "gpt-4o", "messages": [{"role": "user", "content": "hi"}]}`
+
+	if resp := postWithKey(t, srv.URL+"/v1/chat/completions", "first", chatBody); resp.StatusCode != http.StatusOK {
+		t.Fatalf("status with initial key = %d, want 200", resp.StatusCode)
+	}
+
+	writeConfig("second", "port: \"9999\"\n")
+	resp := postWithKey(t, srv.URL+"/admin/reload", "admin", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("reload status = %d, want 200", resp.StatusCode)
+	}
+	var result config.ReloadResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatalf("decode reload result: %v", err)
+	}
+	if !result.Reloaded || strings.Join(result.Changed, ",") != "api_key" || strings.Join(result.RestartRequired, ",") != "port" {
+		t.Fatalf("reload result = %+v, want api_key changed and port restart required", result)
+	}
+
+	if resp := postWithKey(t, srv.URL+"/v1/chat/completions", "first", chatBody); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("status with old key = %d, want 401", resp.StatusCode)
+	}
+	if resp := postWithKey(t, srv.URL+"/v1/chat/completions", "second", chatBody); resp.StatusCode != http.StatusOK {
+		t.Fatalf("status with new key = %d, want 200", resp.StatusCode)
+	}
+
+	// 不合法的新配置被拒绝，当前配置保持不变
+	writeConfig("third", "blacklist_threshold: 0\n")
+	resp = postWithKey(t, srv.URL+"/admin/reload", "admin", "")
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("invalid reload status = %d, want 400", resp.StatusCode)
+	}
+	if code := decodeError(t, resp.Body); code != string(model.ErrInvalidConfig) {
+		t.Fatalf("error code = %q, want %q", code, model.ErrInvalidConfig)
+	}
+	if resp := postWithKey(t, srv.URL+"/v1/chat/completions", "second", chatBody); resp.StatusCode != http.StatusOK {
+		t.Fatalf("status after rejected reload = %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestMultiKeyScopesAndQuota(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.KeysFile = filepath.Join(t.TempDir(), "keys.json")
+	keysJSON := `{"keys": [
+		{"id": "svc", "name": "billing-service", "secret_hash": "` + keystore.HashSecret("sk-svc") + `",
+		 "allowed_models": ["gpt-4o-mini"], "allowed_routes": ["chat_completions"],
+		 "enabled": true, "quota": {"requests_per_day": 2}},
+		{"id": "old", "name": "retired", "secret_hash": "` + keystore.HashSecret("sk-old") + `", "enabled": false}
+	]}`
+	if err := os.WriteFile(cfg.KeysFile, []byte(keysJSON), 0644); err != nil {
+		t.Fatalf("write keys: %v", err)
+	}
+	srv := newTestServer(t, cfg)
+
+	chat := func(key, modelName string) *http.Response {
+		return postWithKey(t, srv.URL+"/v1/chat/completions", key,
+			`{"model": "`+modelName+`", "messages": [{"role": "user", "content": "hi"}]}`)
+	}
+
+	if resp := chat("sk-old", "gpt-4o-mini"); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("disabled key status = %d, want 401", resp.StatusCode)
+	}
+	if resp := postWithKey(t, srv.URL+"/v1/messages", "sk-svc", `{}`); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("disallowed route status = %d, want 403", resp.StatusCode)
+	}
+	if resp := chat("sk-svc", "gpt-4o"); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("disallowed model status = %d, want 403", resp.StatusCode)
+	}
+	if resp := chat("sk-svc", "gpt-4o-mini"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("allowed model status = %d, want 200", resp.StatusCode)
+	}
+
+	resp := chat("sk-svc", "gpt-4o-mini")
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("over quota status = %d, want 429", resp.StatusCode)
+	}
+	if code := decodeError(t, resp.Body); code != string(model.ErrQuotaExceeded) {
+		t.Fatalf("error code = %q, want %q", code, model.ErrQuotaExceeded)
+	}
+}
+
+func adminRequest(t *testing.T, method, url, body string) *http.Response {
+	t.Helper()
+	req, _ := http.NewRequest(method, url, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer admin")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, url, err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestAdminKeysLifecycle(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.AdminKey = "admin"
+	cfg.KeysFile = filepath.Join(t.TempDir(), "keys.json")
+	srv := newTestServer(t, cfg)
+	const chatBody = `{"model": "gpt-4o", "messages": [{"role": "user", "content": "hi"}]}`
+
+	type keyResponse struct {
+		ID      string `json:"id"`
+		Secret  string `json:"secret"`
+		Enabled bool   `json:"enabled"`
+	}
+	decodeKey := func(resp *http.Response) keyResponse {
+		t.Helper()
+		var k keyResponse
+		if err := json.NewDecoder(resp.Body).Decode(&k); err != nil {
+			t.Fatalf("decode key: %v", err)
+		}
+		return k
+	}
+
+	resp := adminRequest(t, http.MethodPost, srv.URL+"/admin/keys", `{"name": "alice"}`)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create status = %d, want 201", resp.StatusCode)
+	}
+	created := decodeKey(resp)
+	if created.ID == "" || !strings.HasPrefix(created.Secret, "sk-") {
+		t.Fatalf("created key = %+v, want id and sk- secret", created)
+	}
+	if resp := postWithKey(t, srv.URL+"/v1/chat/completions", created.Secret, chatBody); resp.StatusCode != http.StatusOK {
+		t.Fatalf("status with created key = %d, want 200", resp.StatusCode)
+	}
+
+	// 密钥文件中只保存摘要
+	data, err := os.ReadFile(cfg.KeysFile)
+	if err != nil {
+		t.Fatalf("read keys file: %v", err)
+	}
+	if strings.Contains(string(data), created.Secret) || !strings.Contains(string(data), keystore.HashSecret(created.Secret)) {
+		t.Fatalf("keys file should contain only the secret hash: %s", data)
+	}
+
+	// 列表中不返回明文密钥
+	resp = adminRequest(t, http.MethodGet, srv.URL+"/admin/keys", "")
+	var list struct {
+		Keys []keyResponse `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		t.Fatalf("decode list: %v", err)
+	}
+	if len(list.Keys) != 1 || list.Keys[0].ID != created.ID || list.Keys[0].Secret != "" {
+		t.Fatalf("list = %+v, want the created key without secret", list.Keys)
+	}
+
+	rotated := decodeKey(adminRequest(t, http.MethodPost, srv.URL+"/admin/keys/"+created.ID+"/rotate", ""))
+	if rotated.Secret == "" || rotated.Secret == created.Secret {
+		t.Fatalf("rotated secret = %q, want a new secret", rotated.Secret)
+	}
+	if resp := postWithKey(t, srv.URL+"/v1/chat/completions", created.Secret, chatBody); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("status with rotated-out key = %d, want 401", resp.StatusCode)
+	}
+	if resp := postWithKey(t, srv.URL+"/v1/chat/completions", rotated.Secret, chatBody); resp.StatusCode != http.StatusOK {
+		t.Fatalf("status with rotated key = %d, want 200", resp.StatusCode)
+	}
+
+	if disabled := decodeKey(adminRequest(t, http.MethodPost, srv.URL+"/admin/keys/"+created.ID+"/disable", "")); disabled.Enabled {
+		t.Fatalf("key still enabled after disable")
+	}
+	if resp := postWithKey(t, srv.URL+"/v1/chat/completions", rotated.Secret, chatBody); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("status with disabled key = %d, want 401", resp.StatusCode)
+	}
+
+	if resp := adminRequest(t, http.MethodDelete, srv.URL+"/admin/keys/"+created.ID, ""); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("delete status = %d, want 204", resp.StatusCode)
+	}
+	if resp := adminRequest(t, http.MethodGet, srv.URL+"/admin/keys/"+created.ID, ""); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("get deleted status = %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestUsageRecordedAndReported(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.AdminKey = "admin"
+	cfg.UsageDB = filepath.Join(t.TempDir(), "usage.db")
+	cfg.KeysFile = filepath.Join(t.TempDir(), "keys.json")
+	keysJSON := `{"keys": [{"id": "svc", "name": "billing-service", "secret_hash": "` + keystore.HashSecret("sk-svc") + `", "enabled": true}]}`
+	if err := os.WriteFile(cfg.KeysFile, []byte(keysJSON), 0644); err != nil {
+		t.Fatalf("write keys: %v", err)
+	}
+	srv := newTestServer(t, cfg)
+
+	upstream.Enqueue(fakeupstream.Script{Chunks: []string{"Hello"}})
+	if resp := postWithKey(t, srv.URL+"/v1/chat/completions", "sk-svc", `{"model": "gpt-4o", "messages": [{"role": "user", "content": "hi"}]}`); resp.StatusCode != http.StatusOK {
+		t.Fatalf("chat status = %d, want 200", resp.StatusCode)
+	}
+	upstream.Enqueue(fakeupstream.Script{Chunks: []string{"Hel", "lo"}, Terminate: true})
+	resp := postWithKey(t, srv.URL+"/v1/chat/completions", "sk-svc", `{"model": "gpt-4o", "stream": true, "messages": [{"role": "user", "content": "hi"}]}`)
+	readSSE(t, resp.Body)
+	upstream.Enqueue(fakeupstream.Script{Err: status.Error(codes.InvalidArgument, "bad request")})
+	postWithKey(t, srv.URL+"/v1/chat/completions", "sk-svc", `{"model": "gpt-4o-mini", "messages": [{"role": "user", "content": "hi"}]}`)
+
+	resp = adminRequest(t, http.MethodGet, srv.URL+"/admin/usage?group_by=key,model", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("usage status = %d, want 200", resp.StatusCode)
+	}
+	var report struct {
+		Summary []usage.Summary `json:"summary"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		t.Fatalf("decode usage: %v", err)
+	}
+	if len(report.Summary) != 2 {
+		t.Fatalf("summary = %+v, want one row per model", report.Summary)
+	}
+	gpt4o, mini := report.Summary[0], report.Summary[1]
+	if gpt4o.Model != "gpt-4o" || gpt4o.KeyID != "svc" || gpt4o.KeyName != "billing-service" || gpt4o.Day != "" {
+		t.Errorf("gpt-4o row = %+v", gpt4o)
+	}
+	if gpt4o.Requests != 2 || gpt4o.StreamRequests != 1 || gpt4o.Errors != 0 || gpt4o.PromptTokens == 0 || gpt4o.CompletionTokens == 0 {
+		t.Errorf("gpt-4o usage = %+v", gpt4o)
+	}
+	if mini.Model != "gpt-4o-mini" || mini.Requests != 1 || mini.Errors != 1 || mini.TotalTokens != 0 {
+		t.Errorf("gpt-4o-mini row = %+v", mini)
+	}
+
+	today := time.Now().UTC().Format("2006-01-02")
+	resp = adminRequest(t, http.MethodGet, srv.URL+"/admin/usage?format=csv&group_by=none&model=gpt-4o&from="+today+"&to="+today, "")
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/csv") {
+		t.Fatalf("content type = %q, want text/csv", ct)
+	}
+	rows, err := csv.NewReader(resp.Body).ReadAll()
+	if err != nil {
+		t.Fatalf("read csv: %v", err)
+	}
+	if len(rows) != 3 || rows[0][0] != "time" || rows[1][3] != "gpt-4o" || rows[2][5] != "true" {
+		t.Fatalf("csv rows = %v, want header and two gpt-4o records", rows)
+	}
+
+	if resp := adminRequest(t, http.MethodGet, srv.URL+"/admin/usage?group_by=week", ""); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("invalid group_by status = %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestTokenRateLimitPerKey(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.KeysFile = filepath.Join(t.TempDir(), "keys.json")
+	keysJSON := `{"keys": [
+		{"id": "small", "name": "small", "secret_hash": "` + keystore.HashSecret("sk-small") + `", "enabled": true, "quota": {"tokens_per_minute": 30}},
+		{"id": "other", "name": "other", "secret_hash": "` + keystore.HashSecret("sk-other") + `", "enabled": true}
+	]}`
+	if err := os.WriteFile(cfg.KeysFile, []byte(keysJSON), 0644); err != nil {
+		t.Fatalf("write keys: %v", err)
+	}
+	srv := newTestServer(t, cfg)
+
+	longPrompt := strings.Repeat("tell me a very long story about tokens ", 10)
+	chat := func(key string, stream bool) *http.Response {
+		return postWithKey(t, srv.URL+"/v1/chat/completions", key,
+			`{"model": "gpt-4o", "stream": `+strconv.FormatBool(stream)+`, "messages": [{"role": "user", "content": "`+longPrompt+`"}]}`)
+	}
+
+	// 额度满时允许超过限额的单个请求通过，之后需要等待额度恢复
+	upstream.Enqueue(fakeupstream.Script{Chunks: []string{"ok"}})
+	if resp := chat("sk-small", false); resp.StatusCode != http.StatusOK {
+		t.Fatalf("first request status = %d, want 200", resp.StatusCode)
+	}
+
+	for _, stream := range []bool{false, true} {
+		resp := chat("sk-small", stream)
+		if resp.StatusCode != http.StatusTooManyRequests {
+			t.Fatalf("stream=%v: status = %d, want 429", stream, resp.StatusCode)
+		}
+		if retryAfter, _ := strconv.Atoi(resp.Header.Get("Retry-After")); retryAfter < 1 {
+			t.Errorf("stream=%v: Retry-After = %q, want a positive number of seconds", stream, resp.Header.Get("Retry-After"))
+		}
+		if code := decodeError(t, resp.Body); code != string(model.ErrRateLimitExceeded) {
+			t.Errorf("stream=%v: error code = %q, want %q", stream, code, model.ErrRateLimitExceeded)
+		}
+	}
+
+	// 其他密钥不受影响
+	upstream.Enqueue(fakeupstream.Script{Chunks: []string{"ok"}})
+	if resp := chat("sk-other", false); resp.StatusCode != http.StatusOK {
+		t.Fatalf("other key status = %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestRateLimitHeaders(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.RateLimits = map[string]config.RateLimitRule{
+		"default": {Limit: 2, Window: time.Minute, Enabled: true},
+		"burst":   {Limit: 100, Window: time.Second, Enabled: true},
+	}
+	srv := newTestServer(t, cfg)
+
+	for _, want := range []string{"1", "0"} {
+		resp, err := http.Get(srv.URL + "/v1/models")
+		if err != nil {
+			t.Fatalf("GET /v1/models: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status = %d, want 200", resp.StatusCode)
+		}
+		if got := resp.Header.Get("X-RateLimit-Remaining"); got != want {
+			t.Errorf("X-RateLimit-Remaining = %q, want %q", got, want)
+		}
+		if got := resp.Header.Get("X-RateLimit-Limit"); got != "2" {
+			t.Errorf("X-RateLimit-Limit = %q, want 2", got)
+		}
+	}
+
+	resp, err := http.Get(srv.URL + "/v1/models")
+	if err != nil {
+		t.Fatalf("GET /v1/models: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want 429", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Retry-After"); got != "30" {
+		t.Errorf("Retry-After = %q, want 30", got)
+	}
+	if got := resp.Header.Get("X-RateLimit-Reset"); got != "60" {
+		t.Errorf("X-RateLimit-Reset = %q, want 60", got)
+	}
+}
+
+func TestConcurrencyLimit(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.Concurrency = config.ConcurrencyConfig{Global: 1}
+	srv := newTestServer(t, cfg)
+	queued := newTestConfig(t)
+	queued.Concurrency = config.ConcurrencyConfig{Global: 1, QueueSize: 1, QueueTimeout: 5 * time.Second}
+	const streamBody = `{"model": "gpt-4o", "stream": true, "messages": [{"role": "user", "content": "hi"}]}`
+
+	// 第一个流式请求在输出结束前一直占用名额
+	startSlowStream := func(url string) <-chan int {
+		upstream.Enqueue(fakeupstream.Script{Chunks: []string{"slow", "stream"}, Terminate: true, Latency: 300 * time.Millisecond})
+		done := make(chan int, 1)
+		go func() {
+			resp, err := http.Post(url+"/v1/chat/completions", "application/json", strings.NewReader(streamBody))
+			if err != nil {
+				done <- 0
+				return
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			done <- resp.StatusCode
+		}()
+		deadline := time.Now().Add(2 * time.Second)
+		for len(upstream.GPTRequests()) == 0 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		return done
+	}
+
+	done := startSlowStream(srv.URL)
+	resp := postJSON(t, srv.URL+"/v1/chat/completions", streamBody)
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("status while slot is taken = %d, want 429", resp.StatusCode)
+	}
+	if code := decodeError(t, resp.Body); code != string(model.ErrConcurrentLimit) {
+		t.Fatalf("error code = %q, want %q", code, model.ErrConcurrentLimit)
+	}
+	if status := <-done; status != http.StatusOK {
+		t.Fatalf("first stream status = %d, want 200", status)
+	}
+
+	// 开启排队后等待名额释放再处理
+	srv = newTestServer(t, queued)
+	done = startSlowStream(srv.URL)
+	upstream.Enqueue(fakeupstream.Script{Chunks: []string{"queued"}})
+	resp = postJSON(t, srv.URL+"/v1/chat/completions", `{"model": "gpt-4o", "messages": [{"role": "user", "content": "hi"}]}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("queued request status = %d, want 200", resp.StatusCode)
+	}
+	if status := <-done; status != http.StatusOK {
+		t.Fatalf("first stream status = %d, want 200", status)
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.EnableMetrics = true
+	cfg.MetricsKey = "scrape"
+	cfg.KeysFile = filepath.Join(t.TempDir(), "keys.json")
+	keysJSON := `{"keys": [{"id": "metrics-svc", "name": "metrics", "secret_hash": "` + keystore.HashSecret("sk-metrics") + `", "enabled": true}]}`
+	if err := os.WriteFile(cfg.KeysFile, []byte(keysJSON), 0644); err != nil {
+		t.Fatalf("write keys: %v", err)
+	}
+	srv := newTestServer(t, cfg)
+
+	upstream.Enqueue(fakeupstream.Script{Chunks: []string{"Hello"}})
+	if resp := postWithKey(t, srv.URL+"/v1/chat/completions", "sk-metrics", `{"model": "gpt-4o", "messages": [{"role": "user", "content": "hi"}]}`); resp.StatusCode != http.StatusOK {
+		t.Fatalf("chat status = %d, want 200", resp.StatusCode)
+	}
+	upstream.Enqueue(fakeupstream.Script{Chunks: []string{"Hel", "lo"}, Terminate: true})
+	resp := postWithKey(t, srv.URL+"/v1/chat/completions", "sk-metrics", `{"model": "gpt-4o", "stream": true, "messages": [{"role": "user", "content": "hi"}]}`)
+	readSSE(t, resp.Body)
+	postWithKey(t, srv.URL+"/v1/chat/completions", "sk-wrong", `{"model": "gpt-4o", "messages": [{"role": "user", "content": "hi"}]}`)
+
+	resp, err := http.Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("GET /metrics: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("metrics without key status = %d, want 401", resp.StatusCode)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/metrics", nil)
+	req.Header.Set("Authorization", "Bearer scrape")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET /metrics: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	text := string(body)
+
+	for _, want := range []string{
+		`pieces_http_requests_total{key="metrics-svc",model="gpt-4o",route="chat_completions",status="200"} 2`,
+		`pieces_http_requests_total{key="",model="",route="chat_completions",status="401"}`,
+		`pieces_http_request_duration_seconds_count{key="metrics-svc",model="gpt-4o",route="chat_completions",status="200"} 2`,
+		`pieces_upstream_requests_total{backend="` + model.BackendGPT + `",code="OK",method="predict"}`,
+		`pieces_upstream_requests_total{backend="` + model.BackendGPT + `",code="OK",method="predict_stream"}`,
+		`pieces_stream_time_to_first_token_seconds_count{model="gpt-4o"}`,
+		`pieces_stream_duration_seconds_count{model="gpt-4o"}`,
+		`pieces_tokens_total{key="metrics-svc",model="gpt-4o",type="completion"}`,
+		`pieces_pool_connections{backend="` + model.BackendGPT + `"}`,
+		`pieces_pool_wait_seconds_count{backend="` + model.BackendGPT + `"}`,
+		`pieces_blacklist_entries{type="ip"}`,
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("metrics missing %s", want)
+		}
+	}
+}
+
+func TestTracingSpansFollowClientTraceparent(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(noop.NewTracerProvider()) })
+	if _, err := tracing.Setup(config.TracingConfig{}, "test"); err != nil {
+		t.Fatalf("setup tracing: %v", err)
+	}
+
+	srv := newTestServer(t, newTestConfig(t))
+
+	upstream.Enqueue(fakeupstream.Script{Chunks: []string{"Hello"}})
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/v1/chat/completions",
+		strings.NewReader(`{"model": "gpt-4o", "messages": [{"role": "user", "content": "hi"}]}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("POST: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+
+	// 服务端 span 在处理器返回后结束，可能晚于客户端收到响应
+	var spans []sdktrace.ReadOnlySpan
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if spans = recorder.Ended(); len(spans) > 0 && spans[len(spans)-1].SpanKind() == trace.SpanKindServer {
+			break
+		}
+	}
+
+	counts := make(map[string]int)
+	for _, span := range spans {
+		if got := span.SpanContext().TraceID().String(); got != traceID {
+			t.Errorf("span %q trace id = %s, want %s", span.Name(), got, traceID)
+		}
+		if span.SpanKind() == trace.SpanKindServer && span.Parent().SpanID().String() != "00f067aa0ba902b7" {
+			t.Errorf("server span parent = %s, want the client span", span.Parent().SpanID())
+		}
+		counts[span.Name()]++
+	}
+	for name, want := range map[string]int{
+		"POST /v1/chat/completions": 1,
+		"chat.attempt":              1,
+		"pool.acquire":              1,
+		"runtime.aot.machine_learning.parents.gpt.GPTInferenceService/Predict": 1,
+	} {
+		if counts[name] != want {
+			t.Errorf("span %q count = %d, want %d (spans: %v)", name, counts[name], want, counts)
+		}
+	}
+}
+
+// syncBuffer 供日志和测试并发读写的缓冲区
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestRequestIDInHeadersErrorsAndLogs(t *testing.T) {
+	var logs syncBuffer
+	if err := logging.Setup(&logs, "json", "info"); err != nil {
+		t.Fatalf("setup logging: %v", err)
+	}
+	t.Cleanup(func() { middleware.InitLogger(&config.Config{}) })
+
+	srv := newTestServer(t, newTestConfig(t))
+	post := func(requestID string) (*http.Response, string) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+"/v1/chat/completions", strings.NewReader(`{"model": "no-such-model", "messages": [{"role": "user", "content": "hi"}]}`))
+		req.Header.Set("Content-Type", "application/json")
+		if requestID != "" {
+			req.Header.Set(logging.RequestIDHeader, requestID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("POST: %v", err)
+		}
+		defer resp.Body.Close()
+		var body struct {
+			RequestID string `json:"request_id"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatalf("decode error body: %v", err)
+		}
+		return resp, body.RequestID
+	}
+
+	// 客户端传入的请求 ID 原样返回并出现在访问日志中
+	resp, bodyID := post("client-req.42")
+	if got := resp.Header.Get(logging.RequestIDHeader); got != "client-req.42" {
+		t.Errorf("response %s = %q, want client-req.42", logging.RequestIDHeader, got)
+	}
+	if bodyID != "client-req.42" {
+		t.Errorf("error body request_id = %q, want client-req.42", bodyID)
+	}
+
+	var found bool
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var entry map[string]any
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("log line is not JSON: %q", line)
+		}
+		if entry["msg"] == "request" && entry["request_id"] == "client-req.42" {
+			found = true
+			if entry["level"] != "WARN" || entry["status"] != float64(http.StatusNotFound) || entry["model"] != "no-such-model" {
+				t.Errorf("access log = %v", entry)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("no access log line with request_id, logs:\n%s", logs.String())
+	}
+
+	// 不合法的请求 ID 被替换为新生成的 ID
+	resp, bodyID = post("bad id <script>")
+	generated := resp.Header.Get(logging.RequestIDHeader)
+	if generated == "" || generated == "bad id <script>" {
+		t.Fatalf("generated request ID = %q", generated)
+	}
+	if bodyID != generated {
+		t.Errorf("error body request_id = %q, want %q", bodyID, generated)
+	}
+}
+
+func TestAuditLogRedactsAndReassemblesStream(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.KeysFile = filepath.Join(t.TempDir(), "keys.json")
+	keysJSON := `{"keys": [
+		{"id": "team", "name": "team-a", "secret_hash": "` + keystore.HashSecret("sk-team") + `", "enabled": true},
+		{"id": "private", "name": "no-audit", "secret_hash": "` + keystore.HashSecret("sk-private") + `", "enabled": true, "disable_audit": true}
+	]}`
+	if err := os.WriteFile(cfg.KeysFile, []byte(keysJSON), 0644); err != nil {
+		t.Fatalf("write keys: %v", err)
+	}
+
+	redactor, err := audit.NewRedactor([]config.RedactRule{{Name: "email"}, {Name: "phone"}, {Name: "api_key"}, {Name: "ticket", Pattern: `TICKET-\d+`}})
+	if err != nil {
+		t.Fatalf("redactor: %v", err)
+	}
+	sink, err := audit.Open(t.TempDir(), redactor)
+	if err != nil {
+		t.Fatalf("open audit: %v", err)
+	}
+	t.Cleanup(func() { sink.Close() })
+
+	upstream.Reset()
+	keys, err := keystore.Open(cfg.KeysFile)
+	if err != nil {
+		t.Fatalf("open keys: %v", err)
+	}
+	srv := httptest.NewServer(newRouter(config.NewStore(cfg), keys, nil, sink))
+	t.Cleanup(srv.Close)
+
+	upstream.Enqueue(fakeupstream.Script{Chunks: []string{"Sure, I will call 13812345678"}})
+	resp := postWithKey(t, srv.URL+"/v1/chat/completions", "sk-team", `{"model": "gpt-4o", "messages": [{"role": "user", "content": "mail bob@example.com about TICKET-42"}]}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("chat status = %d, want 200", resp.StatusCode)
+	}
+	upstream.Enqueue(fakeupstream.Script{Chunks: []string{"Your key ", "is sk-abcdefghijklmnop1234"}, Terminate: true})
+	resp = postWithKey(t, srv.URL+"/v1/chat/completions", "sk-team", `{"model": "gpt-4o", "stream": true, "messages": [{"role": "user", "content": "what is my key"}]}`)
+	readSSE(t, resp.Body)
+	upstream.Enqueue(fakeupstream.Script{Chunks: []string{"secret"}})
+	postWithKey(t, srv.URL+"/v1/chat/completions", "sk-private", `{"model": "gpt-4o", "messages": [{"role": "user", "content": "off the record"}]}`)
+
+	sink.Flush()
+	data, err := os.ReadFile(sink.Path(time.Now().Format("2006-01-02")))
+	if err != nil {
+		t.Fatalf("read audit file: %v", err)
+	}
+	var records []audit.Record
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var rec audit.Record
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatalf("audit line is not JSON: %q", line)
+		}
+		records = append(records, rec)
+	}
+
+	// 设置了 disable_audit 的密钥不被记录
+	if len(records) != 2 {
+		t.Fatalf("audit records = %d, want 2: %s", len(records), data)
+	}
+	normal, stream := records[0], records[1]
+	if normal.KeyID != "team" || normal.Model != "gpt-4o" || normal.Status != http.StatusOK || normal.RequestID == "" || normal.Usage.TotalTokens == 0 {
+		t.Errorf("record = %+v", normal)
+	}
+	if got := normal.Messages[0].Content; got != "mail [EMAIL] about [REDACTED]" {
+		t.Errorf("redacted message = %q", got)
+	}
+	if normal.Completion != "Sure, I will call [PHONE]" {
+		t.Errorf("redacted completion = %q", normal.Completion)
+	}
+	if !stream.Stream || stream.Completion != "Your key is [API_KEY]" {
+		t.Errorf("stream record = %+v, want reassembled and redacted completion", stream)
+	}
+}
@@ -1,19 +1,26 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
-	"log"
+	"flag"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"pieces-os-go/internal/audit"
 	"pieces-os-go/internal/config"
 	"pieces-os-go/internal/handler"
+	"pieces-os-go/internal/keystore"
+	"pieces-os-go/internal/logging"
 	"pieces-os-go/internal/middleware"
 	"pieces-os-go/internal/model"
+	"pieces-os-go/internal/tracing"
+	"pieces-os-go/internal/usage"
 	"pieces-os-go/pkg/tokenizer"
-	"strings"
 	"sync"
+	"syscall"
 	"time"
-
-	"github.com/go-chi/chi/v5"
 )
 
 // 全局变量
@@ -76,152 +83,135 @@ func getFoolproofPaths(apiPrefix string) map[string]bool {
 	return foolproofPathsMap
 }
 
+// fatal 记录错误后退出
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
 // 辅助函数
 func writeError(w http.ResponseWriter, err *model.APIError) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(err.Status)
-	json.NewEncoder(w).Encode(map[string]interface{}{
+	body := map[string]interface{}{
 		"error": map[string]interface{}{
 			"message": err.Message,
 			"type":    "error",
 			"code":    err.Code,
 		},
-	})
+	}
+	if id := w.Header().Get(logging.RequestIDHeader); id != "" {
+		body["request_id"] = id
+	}
+	json.NewEncoder(w).Encode(body)
 }
 
 func main() {
 	// 打印版本信息
-	log.Printf("Starting Pieces-OS-Go Version: %s, BuildTime: %s", Version, BuildTime)
+	slog.Info("starting Pieces-OS-Go", "version", Version, "build_time", BuildTime)
 
 	if err := model.InitModels(); err != nil {
-		log.Fatalf("Failed to initialize models: %v", err)
+		fatal("failed to initialize models", err)
+	}
+	configFile := flag.String("config", os.Getenv("CONFIG_FILE"), "配置文件路径 (YAML 或 TOML)")
+	flag.Parse()
+
+	cfg, err := config.Load(*configFile)
+	if err != nil {
+		fatal("failed to load config", err)
 	}
-	cfg := config.Load()
-	if err := middleware.InitLogger(cfg.LogFile); err != nil {
-		log.Fatalf("Failed to initialize logger: %v", err)
+	model.SetModelAliases(cfg.ModelAliases)
+	if err := middleware.InitLogger(cfg); err != nil {
+		fatal("failed to initialize logger", err)
 	}
 	if err := tokenizer.InitTokenizers(); err != nil {
-		log.Fatalf("Failed to initialize tokenizers: %v", err)
+		fatal("failed to initialize tokenizers", err)
 	}
-	if cfg.EnableFoolproofRoute && cfg.APIPrefix == "" {
-		cfg.EnableFoolproofRoute = false
-		log.Printf("Warning: Foolproof routing is not supported when APIPrefix is empty, automatically disabled. Recommend using /v1 as prefix")
+	shutdownTracing, err := tracing.Setup(cfg.Tracing, Version)
+	if err != nil {
+		fatal("failed to initialize tracing", err)
 	}
 
-	r := chi.NewRouter()
-
-	// 创建RateLimiter实例
-	rateLimiter := middleware.NewRateLimiter(cfg)
-
-	// 添加全局中间件
-	r.Use(middleware.Logger(cfg))
-	r.Use(middleware.CORS)
-	r.Use(middleware.TimeoutMiddleware(cfg))
-	r.Use(rateLimiter.RateLimit)
-
-	// 创建处理器实例
-	chatHandler := handler.NewChatHandler(cfg)
-
-	// 自定义 404 处理器
-	r.NotFound(func(w http.ResponseWriter, r *http.Request) {
-		writeError(w, model.NewAPIError(model.ErrRouteNotFound, "Requested path not found", http.StatusNotFound))
-	})
-
-	// 自定义 405 处理器
-	r.MethodNotAllowed(func(w http.ResponseWriter, r *http.Request) {
-		writeError(w, model.NewAPIError(model.ErrMethodNotAllowed, "Method not allowed", http.StatusMethodNotAllowed))
-	})
-
-	// 健康检查路由
-	r.Get("/", handler.HealthCheck)
-	r.Get("/ping", handler.Ping)
+	keys, err := keystore.Open(cfg.KeysFile)
+	if err != nil {
+		fatal("failed to load API keys", err)
+	}
 
-	// API路由组
-	r.Route(cfg.APIPrefix, func(r chi.Router) {
-		// API认证中间件只应用于此路由组
-		if cfg.APIKey != "" {
-			r.Use(middleware.Auth(cfg.APIKey))
+	var records *usage.Store
+	if cfg.UsageDB != "" {
+		if records, err = usage.Open(cfg.UsageDB); err != nil {
+			fatal("failed to open usage database", err)
 		}
+	}
 
-		// 为 /chat/completions 添加特殊的限流中间件
-		r.Group(func(r chi.Router) {
-			r.Use(middleware.NewStrictRateLimiter(cfg).RateLimit)
-			r.Post("/chat/completions", chatHandler.HandleCompletion)
-		})
+	var auditLog *audit.Sink
+	if cfg.Audit.Enabled {
+		redactor, err := audit.NewRedactor(cfg.Audit.Redact)
+		if err != nil {
+			fatal("failed to compile audit redact rules", err)
+		}
+		if auditLog, err = audit.Open(cfg.Audit.Dir, redactor); err != nil {
+			fatal("failed to open audit log", err)
+		}
+	}
 
-		// 其他API endpoints保持原有的限流规则
-		r.Get("/models", handler.ListModels)
+	store := config.NewStore(cfg)
+	// 日志级别可随配置重载修改
+	store.OnReload(func(cfg *config.Config) {
+		if err := logging.SetLevel(cfg.LogLevel); err != nil {
+			slog.Error("failed to update log level", "error", err)
+		}
 	})
+	r := newRouter(store, keys, records, auditLog)
 
-	// 如果启用了模型路由，添加带模型名的路由
-	if cfg.EnableModelRoute {
-		for model := range model.SupportedModels {
-			// 使用标准化的模型名称作为路由
-			modelPath := "/" + model + cfg.APIPrefix
-			r.Route(modelPath, func(r chi.Router) {
-				if cfg.APIKey != "" {
-					r.Use(middleware.Auth(cfg.APIKey))
-				}
-				r.Post("/chat/completions", handler.WithModel(chatHandler.HandleCompletion, model))
-			})
-
-			// 如果是 Claude 模型，添加使用 "-" 格式的路由
-			if strings.HasPrefix(model, "claude-") && strings.Contains(model, "@") {
-				// 将 "@" 转换为 "-"
-				legacyModel := strings.Replace(model, "@", "-", 1)
-				legacyPath := "/" + legacyModel + cfg.APIPrefix
-				r.Route(legacyPath, func(r chi.Router) {
-					if cfg.APIKey != "" {
-						r.Use(middleware.Auth(cfg.APIKey))
-					}
-					r.Post("/chat/completions", handler.WithModel(chatHandler.HandleCompletion, legacyModel))
-				})
-			}
+	// 收到 SIGHUP 或配置文件变化时重载配置
+	go func() {
+		sighup := make(chan os.Signal, 1)
+		signal.Notify(sighup, syscall.SIGHUP)
+		for range sighup {
+			slog.Info("received SIGHUP, reloading config")
+			store.Reload()
 		}
+	}()
+	if cfg.ReloadInterval > 0 {
+		go store.Watch(cfg.ReloadInterval, nil)
 	}
 
-	// 防呆路由
-	if cfg.EnableFoolproofRoute {
-		// 遍历预定义的路径
-		for path := range getFoolproofPaths(cfg.APIPrefix) {
-			path := path // 创建新的变量作用域
-			r.Route(path, func(r chi.Router) {
-				// 添加认证中间件
-				if cfg.APIKey != "" {
-					r.Use(middleware.Auth(cfg.APIKey))
+	// 收到 SIGUSR1 时重新打开日志文件
+	if len(reopenSignals) > 0 {
+		go func() {
+			reopen := make(chan os.Signal, 1)
+			signal.Notify(reopen, reopenSignals...)
+			for range reopen {
+				if err := middleware.ReopenLogFile(); err != nil {
+					slog.Error("failed to reopen log file", "error", err)
+					continue
 				}
-
-				r.Post("/", func(w http.ResponseWriter, r *http.Request) {
-					standardPath := cfg.APIPrefix + "/chat/completions"
-					w.Header().Set("X-Warning", "Non-standard path, please use: "+standardPath)
-					chatHandler.HandleCompletion(w, r)
-				})
-			})
-		}
+				slog.Info("log file reopened")
+			}
+		}()
 	}
 
-	// 黑名单文件下载路由
-	r.Route("/admin", func(r chi.Router) {
-		// 使用管理密钥认证
-		if cfg.AdminKey != "" {
-			r.Use(middleware.AdminAuth(cfg.AdminKey))
+	// 退出前导出尚未发送的 span，并写入队列中剩余的用量和审计记录
+	go func() {
+		quit := make(chan os.Signal, 1)
+		signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+		<-quit
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := shutdownTracing(ctx); err != nil {
+			slog.Error("failed to flush traces", "error", err)
 		}
-
-		r.Get("/blacklist", func(w http.ResponseWriter, r *http.Request) {
-			// 检查请求IP是否在黑名单中
-			if rateLimiter.GetBlacklist().IsBlocked(middleware.GetRealIP(r)) {
-				http.Error(w, "Forbidden", http.StatusForbidden)
-				return
+		cancel()
+		if records != nil {
+			if err := records.Close(); err != nil {
+				slog.Error("failed to close usage database", "error", err)
 			}
-
-			// 设置文件下载头
-			w.Header().Set("Content-Disposition", "attachment; filename=blacklist.txt")
-			w.Header().Set("Content-Type", "text/plain")
-
-			// 读取并返回文件内容
-			http.ServeFile(w, r, cfg.BlacklistFile)
-		})
-	})
+		}
+		if auditLog != nil {
+			auditLog.Close()
+		}
+		os.Exit(0)
+	}()
 
 	// 每秒重置RPS计数器
 	go func() {
@@ -244,11 +234,12 @@ func main() {
 	// 分别打印服务器地址和API端点信息
 	serverAddr := ":" + cfg.Port
 	apiEndpoint := cfg.APIPrefix
-	log.Printf("Server starting on port %s", cfg.Port)
-	log.Printf("API endpoint available at %s", apiEndpoint)
-	log.Printf("本地可通过以下地址访问服务:")
-	log.Printf("- http://localhost%s/", serverAddr)
-	log.Printf("- http://127.0.0.1%s/", serverAddr)
-	log.Printf("- http://[::1]%s/", serverAddr)
-	log.Fatal(http.ListenAndServe(serverAddr, r))
+	slog.Info("server starting", "port", cfg.Port, "api_endpoint", apiEndpoint)
+	// 本地可通过以下地址访问服务
+	slog.Info("local addresses", "urls", []string{
+		"http://localhost" + serverAddr + "/",
+		"http://127.0.0.1" + serverAddr + "/",
+		"http://[::1]" + serverAddr + "/",
+	})
+	fatal("server stopped", http.ListenAndServe(serverAddr, r))
 }
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"pieces-os-go/internal/audit"
+	"pieces-os-go/internal/config"
+	"pieces-os-go/internal/handler"
+	"pieces-os-go/internal/keystore"
+	"pieces-os-go/internal/metrics"
+	"pieces-os-go/internal/middleware"
+	"pieces-os-go/internal/model"
+	"pieces-os-go/internal/ratelimit"
+	"pieces-os-go/internal/usage"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// newRouter 根据配置注册中间件和全部路由，records 为 nil 时不记录用量，auditLog 为 nil 时不记录审计日志
+// 路由结构在启动时确定，限流、认证等运行时配置在重载后通过回调更新
+func newRouter(store *config.Store, keys *keystore.Store, records *usage.Store, auditLog *audit.Sink) chi.Router {
+	cfg := store.Current()
+	r := chi.NewRouter()
+
+	// 创建RateLimiter实例
+	rateLimiter := middleware.NewRateLimiter(cfg)
+
+	// API认证始终挂载，未配置任何密钥时放行，便于重载时启用或更换密钥
+	apiAuth := middleware.NewKeyAuth(cfg.APIKey, keys)
+	// 用量记录和 token 限流放在认证之后，以便按密钥统计
+	recordUsage := middleware.UsageRecorder(records)
+	recordAudit := middleware.Audit(auditLog)
+	tokenLimit := middleware.TokenLimit(ratelimit.NewTokenLimiter(), store)
+	// 并发限制只作用于对话路由
+	concurrencyLimit := middleware.ConcurrencyLimit(ratelimit.NewConcurrencyLimiter(), store)
+
+	// 添加全局中间件
+	// 请求 ID 和链路追踪放在最外层，使之后的日志都带上 request_id 和 trace_id
+	r.Use(middleware.RequestID)
+	r.Use(middleware.Tracing)
+	r.Use(middleware.Logger(cfg))
+	r.Use(middleware.Metrics)
+	r.Use(middleware.CORS)
+	r.Use(middleware.TimeoutMiddleware(store))
+	r.Use(rateLimiter.RateLimit)
+
+	// 创建处理器实例
+	chatHandler := handler.NewChatHandler(cfg)
+
+	store.OnReload(func(cfg *config.Config) {
+		apiAuth.SetKey(cfg.APIKey)
+		if err := keys.Reload(); err != nil {
+			slog.Error("failed to reload keys file", "error", err)
+		}
+		rateLimiter.UpdateConfig(cfg)
+		chatHandler.UpdateConfig(cfg)
+		model.SetModelAliases(cfg.ModelAliases)
+	})
+
+	// 自定义 404 处理器
+	r.NotFound(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, model.NewAPIError(model.ErrRouteNotFound, "Requested path not found", http.StatusNotFound))
+	})
+
+	// 自定义 405 处理器
+	r.MethodNotAllowed(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, model.NewAPIError(model.ErrMethodNotAllowed, "Method not allowed", http.StatusMethodNotAllowed))
+	})
+
+	// 健康检查路由
+	r.Get("/", handler.HealthCheck)
+	r.Get("/ping", handler.Ping)
+
+	// Prometheus 指标
+	if cfg.EnableMetrics {
+		r.Group(func(r chi.Router) {
+			if cfg.MetricsKey != "" {
+				r.Use(middleware.AdminAuth(cfg.MetricsKey))
+			}
+			r.Method(http.MethodGet, "/metrics", metrics.Handler())
+		})
+	}
+
+	// API路由组
+	r.Route(cfg.APIPrefix, func(r chi.Router) {
+		// API认证中间件只应用于此路由组
+		r.Use(apiAuth.Middleware)
+		r.Use(recordUsage)
+		r.Use(recordAudit)
+		r.Use(tokenLimit)
+
+		// 按路由配置追加限流中间件，对话路由默认使用 strict 规则
+		r.Group(func(r chi.Router) {
+			r.Use(rateLimiter.ForRoute(cfg, config.RouteChatCompletions).RateLimit)
+			r.Use(concurrencyLimit)
+			r.Post("/chat/completions", chatHandler.HandleCompletion)
+		})
+		r.Group(func(r chi.Router) {
+			r.Use(rateLimiter.ForRoute(cfg, config.RouteMessages).RateLimit)
+			r.Use(concurrencyLimit)
+			r.Post("/messages", chatHandler.HandleMessages)
+		})
+		r.Group(func(r chi.Router) {
+			r.Use(rateLimiter.ForRoute(cfg, config.RouteModels).RateLimit)
+			r.Get("/models", handler.ListModels)
+		})
+	})
+
+	// Gemini 兼容路由，路径与 Google GenAI SDK 保持一致，不受 API 前缀影响
+	r.Route("/v1beta", func(r chi.Router) {
+		r.Use(apiAuth.Middleware)
+		r.Use(recordUsage)
+		r.Use(recordAudit)
+		r.Use(tokenLimit)
+		r.Use(rateLimiter.ForRoute(cfg, config.RouteGemini).RateLimit)
+		r.Use(concurrencyLimit)
+		r.Post("/models/{modelAction}", chatHandler.HandleGemini)
+	})
+
+	// 如果启用了模型路由，添加带模型名的路由
+	if cfg.EnableModelRoute {
+		for model := range model.SupportedModels {
+			// 使用标准化的模型名称作为路由
+			modelPath := "/" + model + cfg.APIPrefix
+			r.Route(modelPath, func(r chi.Router) {
+				r.Use(apiAuth.Middleware)
+				r.Use(recordUsage)
+				r.Use(recordAudit)
+				r.Use(tokenLimit)
+				r.Use(concurrencyLimit)
+				r.Post("/chat/completions", handler.WithModel(chatHandler.HandleCompletion, model))
+			})
+
+			// 如果是 Claude 模型，添加使用 "-" 格式的路由
+			if strings.HasPrefix(model, "claude-") && strings.Contains(model, "@") {
+				// 将 "@" 转换为 "-"
+				legacyModel := strings.Replace(model, "@", "-", 1)
+				legacyPath := "/" + legacyModel + cfg.APIPrefix
+				r.Route(legacyPath, func(r chi.Router) {
+					r.Use(apiAuth.Middleware)
+					r.Use(recordUsage)
+					r.Use(recordAudit)
+					r.Use(tokenLimit)
+					r.Use(concurrencyLimit)
+					r.Post("/chat/completions", handler.WithModel(chatHandler.HandleCompletion, legacyModel))
+				})
+			}
+		}
+	}
+
+	// 防呆路由
+	if cfg.EnableFoolproofRoute {
+		// 遍历预定义的路径
+		for path := range getFoolproofPaths(cfg.APIPrefix) {
+			path := path // 创建新的变量作用域
+			r.Route(path, func(r chi.Router) {
+				// 添加认证中间件
+				r.Use(apiAuth.Middleware)
+				r.Use(recordUsage)
+				r.Use(recordAudit)
+				r.Use(tokenLimit)
+				r.Use(concurrencyLimit)
+
+				r.Post("/", func(w http.ResponseWriter, r *http.Request) {
+					standardPath := cfg.APIPrefix + "/chat/completions"
+					w.Header().Set("X-Warning", "Non-standard path, please use: "+standardPath)
+					chatHandler.HandleCompletion(w, r)
+				})
+			})
+		}
+	}
+
+	// 黑名单文件下载路由
+	r.Route("/admin", func(r chi.Router) {
+		// 使用管理密钥认证
+		if cfg.AdminKey != "" {
+			r.Use(middleware.AdminAuth(cfg.AdminKey))
+		}
+
+		r.Get("/blacklist", func(w http.ResponseWriter, r *http.Request) {
+			// 检查请求IP是否在黑名单中
+			if rateLimiter.GetBlacklist().IsBlocked(middleware.GetRealIP(r)) {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+
+			// 设置文件下载头
+			w.Header().Set("Content-Disposition", "attachment; filename=blacklist.txt")
+			w.Header().Set("Content-Type", "text/plain")
+
+			// 读取并返回文件内容
+			http.ServeFile(w, r, cfg.BlacklistFile)
+		})
+
+		// 重新加载配置
+		r.Post("/reload", handler.HandleReload(store))
+
+		// 客户端密钥管理
+		keysHandler := handler.NewKeysHandler(keys)
+		r.Route("/keys", func(r chi.Router) {
+			r.Get("/", keysHandler.List)
+			r.Post("/", keysHandler.Create)
+			r.Get("/{id}", keysHandler.Get)
+			r.Delete("/{id}", keysHandler.Delete)
+			r.Post("/{id}/rotate", keysHandler.Rotate)
+			r.Post("/{id}/disable", keysHandler.Disable)
+			r.Post("/{id}/enable", keysHandler.Enable)
+		})
+
+		// 用量报表
+		if records != nil {
+			r.Get("/usage", handler.HandleUsage(records))
+		}
+	})
+
+	return r
+}
@@ -0,0 +1,11 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// reopenSignals 触发重新打开日志文件的信号，与外部 logrotate 的 postrotate 配合使用
+var reopenSignals = []os.Signal{syscall.SIGUSR1}
@@ -0,0 +1,6 @@
+package main
+
+import "os"
+
+// reopenSignals Windows 没有 SIGUSR1，不支持通过信号重新打开日志文件
+var reopenSignals []os.Signal
@@ -0,0 +1,87 @@
+// Package audit 记录经过网关的提示词和回复，用于合规审计
+// 记录在写入前按规则脱敏，每天一个 JSONL 文件
+package audit
+
+import (
+	"context"
+	"pieces-os-go/internal/model"
+	"sync"
+	"time"
+)
+
+// Record 一次模型调用的审计记录
+type Record struct {
+	Time       time.Time           `json:"time"`
+	RequestID  string              `json:"request_id,omitempty"`
+	KeyID      string              `json:"key_id,omitempty"` // 未启用认证时为空
+	KeyName    string              `json:"key_name,omitempty"`
+	Model      string              `json:"model"` // 到达模型时为标准化后的模型名，否则为请求中的模型名
+	Route      string              `json:"route"`
+	Stream     bool                `json:"stream"`
+	Status     int                 `json:"status"`
+	Messages   []model.ChatMessage `json:"messages"`
+	Completion string              `json:"completion"` // 流式响应为拼接后的完整内容
+	Usage      model.Usage         `json:"usage"`
+	LatencyMs  int64               `json:"latency_ms"`
+}
+
+// Entry 请求处理过程中由服务层填充的请求和回复内容
+// 流式回复在单独的 goroutine 中产生，因此需要加锁
+type Entry struct {
+	mu         sync.Mutex
+	model      string
+	messages   []model.ChatMessage
+	completion string
+}
+
+type entryKey struct{}
+
+// WithEntry 在请求上下文中创建审计条目
+func WithEntry(ctx context.Context) (context.Context, *Entry) {
+	e := &Entry{}
+	return context.WithValue(ctx, entryKey{}, e), e
+}
+
+// FromContext 返回请求上下文中的审计条目，未启用审计时返回 nil
+// Entry 的方法允许 nil 接收者，调用方无需判断
+func FromContext(ctx context.Context) *Entry {
+	e, _ := ctx.Value(entryKey{}).(*Entry)
+	return e
+}
+
+// SetRequest 记录请求的模型和消息，保存消息副本以免之后的处理修改内容
+func (e *Entry) SetRequest(req *model.ChatCompletionRequest) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.model = req.Model
+	e.messages = append([]model.ChatMessage{}, req.Messages...)
+}
+
+// SetCompletion 记录最终的回复内容
+func (e *Entry) SetCompletion(content string) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.completion = content
+}
+
+// Fill 将条目中的内容写入记录，请求未到达服务层时返回 false
+func (e *Entry) Fill(rec *Record) bool {
+	if e == nil {
+		return false
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.messages == nil {
+		return false
+	}
+	rec.Model = e.model
+	rec.Messages = e.messages
+	rec.Completion = e.completion
+	return true
+}
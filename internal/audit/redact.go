@@ -0,0 +1,53 @@
+package audit
+
+import (
+	"fmt"
+	"pieces-os-go/internal/config"
+	"regexp"
+)
+
+type redactRule struct {
+	re          *regexp.Regexp
+	replacement string
+}
+
+// Redactor 按顺序应用脱敏规则
+type Redactor struct {
+	rules []redactRule
+}
+
+// NewRedactor 编译脱敏规则，只填名称的规则使用同名内置规则
+func NewRedactor(rules []config.RedactRule) (*Redactor, error) {
+	r := &Redactor{}
+	for _, rule := range rules {
+		rule, err := config.ResolveRedactRule(rule)
+		if err != nil {
+			return nil, err
+		}
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("redact rule %q: %w", rule.Name, err)
+		}
+		r.rules = append(r.rules, redactRule{re: re, replacement: rule.Replacement})
+	}
+	return r, nil
+}
+
+// Redact 返回脱敏后的文本
+func (r *Redactor) Redact(s string) string {
+	if r == nil {
+		return s
+	}
+	for _, rule := range r.rules {
+		s = rule.re.ReplaceAllLiteralString(s, rule.replacement)
+	}
+	return s
+}
+
+// redactRecord 脱敏记录中的消息和回复，消息切片为副本，可直接修改
+func (r *Redactor) redactRecord(rec *Record) {
+	for i := range rec.Messages {
+		rec.Messages[i].Content = r.Redact(rec.Messages[i].Content)
+	}
+	rec.Completion = r.Redact(rec.Completion)
+}
@@ -0,0 +1,149 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const queueSize = 1024
+
+// Sink 将审计记录追加写入按天划分的 JSONL 文件
+// 记录先进入内存队列，由后台 goroutine 脱敏后写入，避免请求等待磁盘
+type Sink struct {
+	dir      string
+	redactor *Redactor
+	queue    chan Record
+	flushCh  chan chan struct{}
+	done     chan struct{}
+
+	mu     sync.RWMutex // 保护 closed，防止关闭后继续写入队列
+	closed bool
+
+	// 以下字段只由后台 goroutine 访问
+	file *os.File
+	day  string
+}
+
+// Open 创建审计目录并启动后台写入
+func Open(dir string, redactor *Redactor) (*Sink, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("create audit dir %s: %w", dir, err)
+	}
+	s := &Sink{
+		dir:      dir,
+		redactor: redactor,
+		queue:    make(chan Record, queueSize),
+		flushCh:  make(chan chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go s.run()
+	return s, nil
+}
+
+// Add 异步写入一条记录，队列已满时丢弃并记录日志
+func (s *Sink) Add(rec Record) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.queue <- rec:
+	default:
+		slog.Warn("audit queue is full, dropping record", "request_id", rec.RequestID, "key", rec.KeyID, "model", rec.Model)
+	}
+}
+
+// Flush 等待已入队的记录写入文件
+func (s *Sink) Flush() {
+	ack := make(chan struct{})
+	select {
+	case s.flushCh <- ack:
+		<-ack
+	case <-s.done:
+	}
+}
+
+// Close 写入队列中剩余的记录并关闭文件
+func (s *Sink) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.queue)
+	s.mu.Unlock()
+
+	<-s.done
+	return nil
+}
+
+// Path 返回指定日期 (YYYY-MM-DD) 的审计文件路径
+func (s *Sink) Path(day string) string {
+	return filepath.Join(s.dir, "audit-"+day+".jsonl")
+}
+
+func (s *Sink) run() {
+	defer close(s.done)
+	defer func() {
+		if s.file != nil {
+			s.file.Close()
+		}
+	}()
+
+	for {
+		select {
+		case rec, ok := <-s.queue:
+			if !ok {
+				return
+			}
+			s.write(rec)
+		case ack := <-s.flushCh:
+			for drained := false; !drained; {
+				select {
+				case rec, ok := <-s.queue:
+					if !ok {
+						drained = true
+						break
+					}
+					s.write(rec)
+				default:
+					drained = true
+				}
+			}
+			close(ack)
+		}
+	}
+}
+
+func (s *Sink) write(rec Record) {
+	s.redactor.redactRecord(&rec)
+	data, err := json.Marshal(rec)
+	if err != nil {
+		slog.Error("failed to encode audit record", "request_id", rec.RequestID, "error", err)
+		return
+	}
+
+	// 按记录时间的本地日期切换文件
+	if day := rec.Time.Local().Format("2006-01-02"); day != s.day {
+		if s.file != nil {
+			s.file.Close()
+			s.file = nil
+		}
+		file, err := os.OpenFile(s.Path(day), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			slog.Error("failed to open audit file", "error", err)
+			return
+		}
+		s.file = file
+		s.day = day
+	}
+	if _, err := s.file.Write(append(data, '\n')); err != nil {
+		slog.Error("failed to write audit record", "request_id", rec.RequestID, "error", err)
+	}
+}
@@ -1,50 +1,219 @@
 package config
 
 import (
-	"log"
+	"fmt"
+	"log/slog"
 	"math/rand"
 	"os"
 	"pieces-os-go/internal/model"
 	"strconv"
 	"strings"
 	"time"
-
-	"github.com/joho/godotenv"
 )
 
 type RateLimitRule struct {
-	Limit   int           `yaml:"limit"`
-	Window  time.Duration `yaml:"window"`
-	Enabled bool          `yaml:"enabled"`
+	Limit   int           `yaml:"limit" toml:"limit"`
+	Window  time.Duration `yaml:"window" toml:"window"`
+	Enabled bool          `yaml:"enabled" toml:"enabled"`
+}
+
+// RouteConfig 单个路由的覆盖配置，零值表示沿用全局配置
+type RouteConfig struct {
+	RateLimits     []string      `yaml:"rate_limits" toml:"rate_limits"`         // 该路由应用的限流规则名称
+	RequestTimeout time.Duration `yaml:"request_timeout" toml:"request_timeout"` // 覆盖普通请求超时时间
+	StreamTimeout  time.Duration `yaml:"stream_timeout" toml:"stream_timeout"`   // 覆盖流式请求超时时间
+}
+
+// TokenLimitConfig 每分钟 token 限额 (TPM)，0 表示不限制
+type TokenLimitConfig struct {
+	PerKey int `yaml:"per_key" toml:"per_key"` // 每个密钥的限额，可被密钥文件中的 tokens_per_minute 覆盖
+	PerIP  int `yaml:"per_ip" toml:"per_ip"`   // 每个 IP 的限额
+}
+
+// ConcurrencyConfig 同时处理中的对话请求数限制，0 表示不限制
+type ConcurrencyConfig struct {
+	PerKey       int           `yaml:"per_key" toml:"per_key"`             // 每个密钥，可被密钥文件中的 max_concurrent 覆盖
+	PerIP        int           `yaml:"per_ip" toml:"per_ip"`               // 每个 IP
+	Global       int           `yaml:"global" toml:"global"`               // 全部请求
+	QueueSize    int           `yaml:"queue_size" toml:"queue_size"`       // 达到限制时每个限制对象最多排队等待的请求数，0 表示直接拒绝
+	QueueTimeout time.Duration `yaml:"queue_timeout" toml:"queue_timeout"` // 排队等待的最长时间，0 表示等到请求超时
+}
+
+// LogRotateConfig 日志文件轮转配置，配置了 log_file 时生效，各项为 0 时表示不限制
+type LogRotateConfig struct {
+	MaxSize    int           `yaml:"max_size" toml:"max_size"`       // 单个文件的最大大小(MB)
+	Interval   time.Duration `yaml:"interval" toml:"interval"`       // 按时间轮转的间隔，24h 即每天零点轮转
+	MaxBackups int           `yaml:"max_backups" toml:"max_backups"` // 保留的旧文件数
+	MaxAge     time.Duration `yaml:"max_age" toml:"max_age"`         // 旧文件保留时长
+	Compress   bool          `yaml:"compress" toml:"compress"`       // 使用 gzip 压缩旧文件
+}
+
+// AuditConfig 审计日志配置，启用后记录每次模型调用的请求消息和回复
+type AuditConfig struct {
+	Enabled bool         `yaml:"enabled" toml:"enabled"`
+	Dir     string       `yaml:"dir" toml:"dir"`       // 审计文件目录，每天一个 audit-YYYY-MM-DD.jsonl
+	Redact  []RedactRule `yaml:"redact" toml:"redact"` // 写入前按顺序应用的脱敏规则
+}
+
+// RedactRule 正则脱敏规则，只填 name 时使用同名内置规则 (email、phone、api_key)
+type RedactRule struct {
+	Name        string `yaml:"name" toml:"name"`
+	Pattern     string `yaml:"pattern" toml:"pattern"`
+	Replacement string `yaml:"replacement" toml:"replacement"` // 为空时替换为 [REDACTED]
 }
 
+// builtinRedactRules 内置脱敏规则
+var builtinRedactRules = map[string]RedactRule{
+	"email": {
+		Pattern:     `[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`,
+		Replacement: "[EMAIL]",
+	},
+	"phone": {
+		Pattern:     `(?:\+\d{1,3}[ -]?)?(?:\b1[3-9]\d{9}\b|\(?\b\d{3}\)?[ -]?\d{3}[ -]\d{4}\b)`,
+		Replacement: "[PHONE]",
+	},
+	"api_key": {
+		Pattern:     `\b(?:sk|pk|rk)-[A-Za-z0-9_-]{16,}|\bAIza[0-9A-Za-z_-]{35}|\b(?:ghp|gho|github_pat)_[A-Za-z0-9_]{20,}|\bAKIA[0-9A-Z]{16}\b`,
+		Replacement: "[API_KEY]",
+	},
+}
+
+// ResolveRedactRule 补全只填名称的内置规则和默认替换文本
+func ResolveRedactRule(rule RedactRule) (RedactRule, error) {
+	if rule.Pattern == "" {
+		builtin, ok := builtinRedactRules[rule.Name]
+		if !ok {
+			return rule, fmt.Errorf("unknown builtin redact rule %q", rule.Name)
+		}
+		rule.Pattern = builtin.Pattern
+		if rule.Replacement == "" {
+			rule.Replacement = builtin.Replacement
+		}
+	}
+	if rule.Replacement == "" {
+		rule.Replacement = "[REDACTED]"
+	}
+	return rule, nil
+}
+
+// TracingConfig OpenTelemetry 链路追踪配置
+type TracingConfig struct {
+	Exporter    string  `yaml:"exporter" toml:"exporter"`         // otlp、stdout 或 file，为空时不导出
+	Endpoint    string  `yaml:"endpoint" toml:"endpoint"`         // OTLP gRPC 地址，为空时使用 OTEL_EXPORTER_OTLP_ENDPOINT 或 localhost:4317
+	Insecure    bool    `yaml:"insecure" toml:"insecure"`         // OTLP 使用明文连接
+	File        string  `yaml:"file" toml:"file"`                 // file 导出器写入的文件
+	SampleRatio float64 `yaml:"sample_ratio" toml:"sample_ratio"` // 采样比例，客户端传入的 traceparent 已采样时始终采样
+	ServiceName string  `yaml:"service_name" toml:"service_name"`
+}
+
+// 可在配置文件 routes 中配置的路由名称
+const (
+	RouteChatCompletions = "chat_completions" // {API_PREFIX}/chat/completions 及模型路由、防呆路由
+	RouteMessages        = "messages"         // {API_PREFIX}/messages
+	RouteGemini          = "gemini"           // /v1beta/models/{model}:{action}
+	RouteModels          = "models"           // {API_PREFIX}/models
+)
+
+// KnownRoutes 所有可配置的路由名称
+var KnownRoutes = []string{RouteChatCompletions, RouteMessages, RouteGemini, RouteModels}
+
 type Config struct {
-	Port                 string
-	APIKey               string
-	AdminKey             string
-	VertexGRPCAddr       string
-	GPTGRPCAddr          string
-	DefaultModel         string
-	MaxRetries           int
-	Timeout              int
-	Debug                bool
-	APIPrefix            string
-	LogFile              string
-	MinPoolSize          int                      `yaml:"min_pool_size"`          // 最小连接数
-	MaxPoolSize          int                      `yaml:"max_pool_size"`          // 最大连接数
-	ScaleInterval        time.Duration            `yaml:"scale_interval"`         // 扩缩容检查间隔
-	EnableModelRoute     bool                     `yaml:"enable_model_route"`     // 是否启用模型路由
-	EnableFoolproofRoute bool                     `yaml:"enable_foolproof_route"` // 是否启用防呆路由
-	RequestTimeout       time.Duration            `yaml:"request_timeout"`        // 普通请求超时时间
-	StreamTimeout        time.Duration            `yaml:"stream_timeout"`         // 流式请求超时时间
-	RateLimits           map[string]RateLimitRule `yaml:"rate_limits"`            // 多个限流规则
-	IPWhitelist          []string                 `yaml:"ip_whitelist"`           // IP白名单
-	IPBlacklist          []string                 `yaml:"ip_blacklist"`           // 配置的IP黑名单
-	BlacklistMode        string                   `yaml:"blacklist_mode"`         // 黑名单模式：off/single/subnet
-	BlacklistThreshold   int                      `yaml:"blacklist_threshold"`    // 触发自动拉黑的阈值
-	BlacklistFile        string                   `yaml:"blacklist_file"`         // 黑名单文件路径
-	IPv4Mask             int                      `yaml:"ipv4_mask"`              // 默认24
-	IPv6Mask             int                      `yaml:"ipv6_mask"`              // 默认48
+	Port                 string                          `yaml:"port" toml:"port"`
+	APIKey               string                          `yaml:"api_key" toml:"api_key"`
+	AdminKey             string                          `yaml:"admin_key" toml:"admin_key"`
+	VertexGRPCAddr       string                          `yaml:"vertex_grpc_addr" toml:"vertex_grpc_addr"`
+	GPTGRPCAddr          string                          `yaml:"gpt_grpc_addr" toml:"gpt_grpc_addr"`
+	GRPCPlaintext        bool                            `yaml:"grpc_plaintext" toml:"grpc_plaintext"` // 以明文方式连接上游，仅用于本地测试或内网代理
+	DefaultModel         string                          `yaml:"default_model" toml:"default_model"`
+	MaxRetries           int                             `yaml:"max_retries" toml:"max_retries"`
+	FormatRetries        int                             `yaml:"format_retries" toml:"format_retries"` // 输出不符合 response_format 时反馈错误重新生成的次数
+	Timeout              int                             `yaml:"timeout" toml:"timeout"`
+	Debug                bool                            `yaml:"debug" toml:"debug"`
+	APIPrefix            string                          `yaml:"api_prefix" toml:"api_prefix"`
+	LogFile              string                          `yaml:"log_file" toml:"log_file"`
+	LogLevel             string                          `yaml:"log_level" toml:"log_level"`                           // debug、info、warn、error，为空时按 debug 决定
+	LogFormat            string                          `yaml:"log_format" toml:"log_format"`                         // text 或 json
+	LogRotate            LogRotateConfig                 `yaml:"log_rotate" toml:"log_rotate"`                         // 日志文件轮转
+	Audit                AuditConfig                     `yaml:"audit" toml:"audit"`                                   // 审计日志
+	MinPoolSize          int                             `yaml:"min_pool_size" toml:"min_pool_size"`                   // 最小连接数
+	MaxPoolSize          int                             `yaml:"max_pool_size" toml:"max_pool_size"`                   // 最大连接数
+	ScaleInterval        time.Duration                   `yaml:"scale_interval" toml:"scale_interval"`                 // 扩缩容检查间隔
+	EnableModelRoute     bool                            `yaml:"enable_model_route" toml:"enable_model_route"`         // 是否启用模型路由
+	EnableFoolproofRoute bool                            `yaml:"enable_foolproof_route" toml:"enable_foolproof_route"` // 是否启用防呆路由
+	RequestTimeout       time.Duration                   `yaml:"request_timeout" toml:"request_timeout"`               // 普通请求超时时间
+	StreamTimeout        time.Duration                   `yaml:"stream_timeout" toml:"stream_timeout"`                 // 流式请求超时时间
+	RateLimits           map[string]RateLimitRule        `yaml:"rate_limits" toml:"rate_limits"`                       // 多个限流规则
+	IPWhitelist          []string                        `yaml:"ip_whitelist" toml:"ip_whitelist"`                     // IP白名单
+	IPBlacklist          []string                        `yaml:"ip_blacklist" toml:"ip_blacklist"`                     // 配置的IP黑名单
+	BlacklistMode        string                          `yaml:"blacklist_mode" toml:"blacklist_mode"`                 // 黑名单模式：off/single/subnet
+	BlacklistThreshold   int                             `yaml:"blacklist_threshold" toml:"blacklist_threshold"`       // 触发自动拉黑的阈值
+	BlacklistFile        string                          `yaml:"blacklist_file" toml:"blacklist_file"`                 // 黑名单文件路径
+	IPv4Mask             int                             `yaml:"ipv4_mask" toml:"ipv4_mask"`                           // 默认24
+	IPv6Mask             int                             `yaml:"ipv6_mask" toml:"ipv6_mask"`                           // 默认48
+	ModelAliases         map[string]model.ModelAlias     `yaml:"model_aliases" toml:"model_aliases"`                   // 模型别名 -> 目标模型
+	PromptTemplates      map[string]model.PromptTemplate `yaml:"prompt_templates" toml:"prompt_templates"`             // 模型名或后端名 -> 提示词模板
+	Routes               map[string]RouteConfig          `yaml:"routes" toml:"routes"`                                 // 按路由名称覆盖的配置
+	TokenLimits          TokenLimitConfig                `yaml:"token_limits" toml:"token_limits"`                     // 按 token 数限流
+	Concurrency          ConcurrencyConfig               `yaml:"concurrency" toml:"concurrency"`                       // 并发请求数限制
+	ReloadInterval       time.Duration                   `yaml:"reload_interval" toml:"reload_interval"`               // 检查配置文件变化的间隔，0表示不检查
+	KeysFile             string                          `yaml:"keys_file" toml:"keys_file"`                           // 多密钥认证的密钥文件路径，为空时不启用
+	UsageDB              string                          `yaml:"usage_db" toml:"usage_db"`                             // 用量记录数据库路径，为空时不记录
+	EnableMetrics        bool                            `yaml:"enable_metrics" toml:"enable_metrics"`                 // 是否提供 /metrics 接口，默认关闭
+	MetricsKey           string                          `yaml:"metrics_key" toml:"metrics_key"`                       // 访问 /metrics 所需的 Bearer 密钥，为空时不校验
+	Tracing              TracingConfig                   `yaml:"tracing" toml:"tracing"`                               // 链路追踪
+	ConfigFile           string                          `yaml:"-" toml:"-"`                                           // 加载的配置文件路径
+
+	adminKeyGenerated bool // ADMIN_KEY 是否为启动时随机生成
+}
+
+// Route 返回路由的覆盖配置，未配置时返回零值
+func (c *Config) Route(name string) RouteConfig {
+	return c.Routes[name]
+}
+
+// RouteRateLimits 返回路由引用的限流规则
+func (c *Config) RouteRateLimits(name string) map[string]RateLimitRule {
+	rules := make(map[string]RateLimitRule)
+	for _, ruleName := range c.Route(name).RateLimits {
+		if rule, ok := c.RateLimits[ruleName]; ok {
+			rules[ruleName] = rule
+		}
+	}
+	return rules
+}
+
+// GlobalRateLimits 返回未被任何路由引用的限流规则，这些规则对所有请求生效
+func (c *Config) GlobalRateLimits() map[string]RateLimitRule {
+	scoped := make(map[string]bool)
+	for _, route := range c.Routes {
+		for _, ruleName := range route.RateLimits {
+			scoped[ruleName] = true
+		}
+	}
+
+	rules := make(map[string]RateLimitRule)
+	for name, rule := range c.RateLimits {
+		if !scoped[name] {
+			rules[name] = rule
+		}
+	}
+	return rules
+}
+
+// RouteName 根据请求路径判断所属的可配置路由，无法识别时返回空字符串
+func RouteName(path string) string {
+	path = strings.TrimSuffix(path, "/")
+	switch {
+	case strings.HasPrefix(path, "/v1beta/models/"):
+		return RouteGemini
+	case strings.HasSuffix(path, "/completions"):
+		return RouteChatCompletions
+	case strings.HasSuffix(path, "/messages"):
+		return RouteMessages
+	case strings.HasSuffix(path, "/models"):
+		return RouteModels
+	}
+	return ""
 }
 
 // 添加新的辅助函数用于生成随机字符串
@@ -72,106 +241,247 @@ const (
 // 添加掩码验证函数
 func validateMask(mask int, min, max int, defaultValue int) int {
 	if mask < min || mask > max {
-		log.Printf("Warning: Invalid mask value %d, should be between %d and %d, using default value %d",
-			mask, min, max, defaultValue)
+		slog.Warn("invalid mask value, using default", "mask", mask, "min", min, "max", max, "default", defaultValue)
 		return defaultValue
 	}
 	return mask
 }
 
-func Load() *Config {
-	if err := godotenv.Load(); err != nil {
-		log.Println("Warning: .env file not found")
+// defaultConfig 返回内置默认配置
+func defaultConfig() *Config {
+	return &Config{
+		Port:           "8787",
+		VertexGRPCAddr: "runtime-native-io-vertex-inference-grpc-service-lmuw6mcn3q-ul.a.run.app:443",
+		GPTGRPCAddr:    "runtime-native-io-gpt-inference-grpc-service-lmuw6mcn3q-ul.a.run.app:443",
+		MaxRetries:     3,
+		FormatRetries:  2,
+		Timeout:        30,
+		APIPrefix:      "/v1",
+		MinPoolSize:    5,
+		MaxPoolSize:    20,
+		ScaleInterval:  30 * time.Second,
+		RequestTimeout: 30 * time.Second,
+		StreamTimeout:  300 * time.Second,
+		RateLimits: map[string]RateLimitRule{
+			"default": {Limit: 60, Window: 60 * time.Second, Enabled: true},
+			"strict":  {Limit: 10, Window: 60 * time.Second, Enabled: false},
+			"burst":   {Limit: 100, Window: time.Second, Enabled: false},
+		},
+		IPWhitelist:        []string{},
+		IPBlacklist:        []string{},
+		BlacklistMode:      "single",
+		BlacklistThreshold: 100,
+		BlacklistFile:      "blacklist.txt",
+		IPv4Mask:           DefaultIPv4Mask,
+		IPv6Mask:           DefaultIPv6Mask,
+		ModelAliases:       map[string]model.ModelAlias{},
+		Routes:             map[string]RouteConfig{},
+		ReloadInterval:     5 * time.Second,
+		KeysFile:           "",
+		UsageDB:            "",
+		EnableMetrics:      false,
+		LogRotate: LogRotateConfig{
+			MaxSize:    100,
+			MaxBackups: 10,
+		},
+		Audit: AuditConfig{
+			Dir:    "audit",
+			Redact: []RedactRule{{Name: "email"}, {Name: "phone"}, {Name: "api_key"}},
+		},
+		Tracing: TracingConfig{
+			File:        "traces.json",
+			SampleRatio: 1,
+			ServiceName: "pieces-os-go",
+		},
 	}
+}
 
-	defaultModel := getEnv("DEFAULT_MODEL", "")
+// Load 加载配置，优先级：环境变量 > 配置文件 > 默认值
+// path 为空时仅从环境变量加载
+func Load(path string) (*Config, error) {
+	cfg, err := load(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// 获取或生成ADMIN_KEY
+	if cfg.AdminKey == "" {
+		cfg.AdminKey = generateRandomString(32, 64)
+		cfg.adminKeyGenerated = true
+		slog.Info("generated random ADMIN_KEY", "admin_key", cfg.AdminKey)
+	}
+	if path != "" {
+		slog.Info("loaded config file", "path", path)
+	}
+	return cfg, nil
+}
+
+func load(path string) (*Config, error) {
+	loadDotenv()
+
+	cfg := defaultConfig()
+	if path != "" {
+		if err := loadFile(path, cfg); err != nil {
+			return nil, err
+		}
+		cfg.ConfigFile = path
+	}
+
+	applyEnv(cfg)
+	applyRouteDefaults(cfg)
+	normalize(cfg)
+	return cfg, nil
+}
+
+// applyEnv 使用环境变量覆盖配置，未设置的环境变量保持原值
+func applyEnv(cfg *Config) {
+	cfg.Port = getEnv("PORT", cfg.Port)
+	cfg.APIKey = getEnv("API_KEY", cfg.APIKey)
+	cfg.AdminKey = getEnv("ADMIN_KEY", cfg.AdminKey)
+	cfg.VertexGRPCAddr = getEnv("VERTEX_GRPC_ADDR", cfg.VertexGRPCAddr)
+	cfg.GPTGRPCAddr = getEnv("GPT_GRPC_ADDR", cfg.GPTGRPCAddr)
+	cfg.GRPCPlaintext = getEnvAsBool("GRPC_PLAINTEXT", cfg.GRPCPlaintext)
+	cfg.DefaultModel = getEnv("DEFAULT_MODEL", cfg.DefaultModel)
+	cfg.MaxRetries = getEnvAsInt("MAX_RETRIES", cfg.MaxRetries)
+	cfg.FormatRetries = getEnvAsInt("FORMAT_RETRIES", cfg.FormatRetries)
+	cfg.Timeout = getEnvAsInt("TIMEOUT", cfg.Timeout)
+	cfg.Debug = getEnvAsBool("DEBUG", cfg.Debug)
+	cfg.APIPrefix = getEnv("API_PREFIX", cfg.APIPrefix)
+	cfg.LogFile = getEnv("LOG_FILE", cfg.LogFile)
+	cfg.LogLevel = getEnv("LOG_LEVEL", cfg.LogLevel)
+	cfg.LogFormat = getEnv("LOG_FORMAT", cfg.LogFormat)
+	cfg.LogRotate.MaxSize = getEnvAsInt("LOG_MAX_SIZE", cfg.LogRotate.MaxSize)
+	cfg.LogRotate.Interval = getEnvAsSeconds("LOG_ROTATE_INTERVAL", cfg.LogRotate.Interval)
+	cfg.LogRotate.MaxBackups = getEnvAsInt("LOG_MAX_BACKUPS", cfg.LogRotate.MaxBackups)
+	cfg.LogRotate.MaxAge = getEnvAsSeconds("LOG_MAX_AGE", cfg.LogRotate.MaxAge)
+	cfg.LogRotate.Compress = getEnvAsBool("LOG_COMPRESS", cfg.LogRotate.Compress)
+	cfg.Audit.Enabled = getEnvAsBool("AUDIT_ENABLED", cfg.Audit.Enabled)
+	cfg.Audit.Dir = getEnv("AUDIT_DIR", cfg.Audit.Dir)
+	cfg.MinPoolSize = getEnvAsInt("MIN_POOL_SIZE", cfg.MinPoolSize)
+	cfg.MaxPoolSize = getEnvAsInt("MAX_POOL_SIZE", cfg.MaxPoolSize)
+	cfg.ScaleInterval = getEnvAsSeconds("SCALE_INTERVAL", cfg.ScaleInterval)
+	cfg.EnableModelRoute = getEnvAsBool("ENABLE_MODEL_ROUTE", cfg.EnableModelRoute)
+	cfg.EnableFoolproofRoute = getEnvAsBool("ENABLE_FOOLPROOF_ROUTE", cfg.EnableFoolproofRoute)
+	cfg.RequestTimeout = getEnvAsSeconds("REQUEST_TIMEOUT", cfg.RequestTimeout)
+	cfg.StreamTimeout = getEnvAsSeconds("STREAM_TIMEOUT", cfg.StreamTimeout)
+	cfg.IPWhitelist = getEnvAsStringSlice("IP_WHITELIST", cfg.IPWhitelist)
+	cfg.IPBlacklist = getEnvAsStringSlice("IP_BLACKLIST", cfg.IPBlacklist)
+	cfg.BlacklistMode = getEnv("BLACKLIST_MODE", cfg.BlacklistMode)
+	cfg.BlacklistThreshold = getEnvAsInt("BLACKLIST_THRESHOLD", cfg.BlacklistThreshold)
+	cfg.BlacklistFile = getEnv("BLACKLIST_FILE", cfg.BlacklistFile)
+	cfg.IPv4Mask = getEnvAsInt("IPV4_MASK", cfg.IPv4Mask)
+	cfg.IPv6Mask = getEnvAsInt("IPV6_MASK", cfg.IPv6Mask)
+	cfg.ReloadInterval = getEnvAsSeconds("CONFIG_RELOAD_INTERVAL", cfg.ReloadInterval)
+	cfg.KeysFile = getEnv("KEYS_FILE", cfg.KeysFile)
+	cfg.UsageDB = getEnv("USAGE_DB", cfg.UsageDB)
+	cfg.EnableMetrics = getEnvAsBool("ENABLE_METRICS", cfg.EnableMetrics)
+	cfg.MetricsKey = getEnv("METRICS_KEY", cfg.MetricsKey)
+	cfg.Tracing.Exporter = getEnv("TRACING_EXPORTER", cfg.Tracing.Exporter)
+	cfg.Tracing.Endpoint = getEnv("TRACING_ENDPOINT", cfg.Tracing.Endpoint)
+	cfg.Tracing.Insecure = getEnvAsBool("TRACING_INSECURE", cfg.Tracing.Insecure)
+	cfg.Tracing.File = getEnv("TRACING_FILE", cfg.Tracing.File)
+	cfg.Tracing.SampleRatio = getEnvAsFloat("TRACING_SAMPLE_RATIO", cfg.Tracing.SampleRatio)
+	cfg.Tracing.ServiceName = getEnv("OTEL_SERVICE_NAME", cfg.Tracing.ServiceName)
+	cfg.TokenLimits.PerKey = getEnvAsInt("TPM_PER_KEY", cfg.TokenLimits.PerKey)
+	cfg.TokenLimits.PerIP = getEnvAsInt("TPM_PER_IP", cfg.TokenLimits.PerIP)
+	cfg.Concurrency.PerKey = getEnvAsInt("MAX_CONCURRENT_PER_KEY", cfg.Concurrency.PerKey)
+	cfg.Concurrency.PerIP = getEnvAsInt("MAX_CONCURRENT_PER_IP", cfg.Concurrency.PerIP)
+	cfg.Concurrency.Global = getEnvAsInt("MAX_CONCURRENT", cfg.Concurrency.Global)
+	cfg.Concurrency.QueueSize = getEnvAsInt("CONCURRENCY_QUEUE_SIZE", cfg.Concurrency.QueueSize)
+	cfg.Concurrency.QueueTimeout = getEnvAsSeconds("CONCURRENCY_QUEUE_TIMEOUT", cfg.Concurrency.QueueTimeout)
+
+	// 内置限流规则仍可通过环境变量调整
+	applyRateLimitEnv(cfg.RateLimits, "default", "RATE_LIMIT")
+	applyRateLimitEnv(cfg.RateLimits, "strict", "STRICT_RATE_LIMIT")
+	applyRateLimitEnv(cfg.RateLimits, "burst", "BURST_RATE_LIMIT")
+}
+
+func applyRateLimitEnv(rules map[string]RateLimitRule, name, prefix string) {
+	rule := rules[name]
+	rule.Limit = getEnvAsInt(prefix, rule.Limit)
+	rule.Window = getEnvAsSeconds(prefix+"_WINDOW", rule.Window)
+	rule.Enabled = getEnvAsBool(prefix+"_ENABLED", rule.Enabled)
+	rules[name] = rule
+}
+
+// applyRouteDefaults 未配置限流规则的对话路由默认使用 strict 规则
+func applyRouteDefaults(cfg *Config) {
+	for _, name := range []string{RouteChatCompletions, RouteMessages, RouteGemini} {
+		route := cfg.Routes[name]
+		if route.RateLimits == nil {
+			route.RateLimits = []string{"strict"}
+		}
+		cfg.Routes[name] = route
+	}
+}
+
+// normalize 修正环境变量中的非法值，配置文件中的非法值已在加载时报错
+func normalize(cfg *Config) {
 	// 检查默认模型是否支持
-	if defaultModel != "" && !model.IsModelSupported(defaultModel) {
-		log.Printf("Warning: DEFAULT_MODEL '%s' is not supported, setting to empty", defaultModel)
-		defaultModel = ""
+	if cfg.DefaultModel != "" && !cfg.isModelSupported(cfg.DefaultModel) {
+		slog.Warn("DEFAULT_MODEL is not supported, setting to empty", "model", cfg.DefaultModel)
+		cfg.DefaultModel = ""
 	}
 
-	apiPrefix := getEnv("API_PREFIX", "/v1")
 	// 确保APIPrefix以/开头
-	if !strings.HasPrefix(apiPrefix, "/") {
-		apiPrefix = "/" + apiPrefix
-		log.Printf("Warning: APIPrefix should start with /, auto fixed to: %s", apiPrefix)
+	if !strings.HasPrefix(cfg.APIPrefix, "/") {
+		cfg.APIPrefix = "/" + cfg.APIPrefix
+		slog.Warn("APIPrefix should start with /, auto fixed", "api_prefix", cfg.APIPrefix)
 	}
 	// 确保APIPrefix不以/结尾
-	if strings.HasSuffix(apiPrefix, "/") {
-		apiPrefix = strings.TrimSuffix(apiPrefix, "/")
-		log.Printf("Warning: APIPrefix should not end with /, auto fixed to: %s", apiPrefix)
+	if strings.HasSuffix(cfg.APIPrefix, "/") {
+		cfg.APIPrefix = strings.TrimSuffix(cfg.APIPrefix, "/")
+		slog.Warn("APIPrefix should not end with /, auto fixed", "api_prefix", cfg.APIPrefix)
+	}
+	// 防呆路由依赖APIPrefix，在此关闭而不是启动时关闭，使重载前后的值一致
+	if cfg.EnableFoolproofRoute && cfg.APIPrefix == "" {
+		cfg.EnableFoolproofRoute = false
+		slog.Warn("foolproof routing is not supported when APIPrefix is empty, automatically disabled, recommend using /v1 as prefix")
 	}
 
-	// 获取或生成ADMIN_KEY
-	adminKey := getEnv("ADMIN_KEY", "")
-	if adminKey == "" {
-		adminKey = generateRandomString(32, 64)
-		log.Printf("Generated random ADMIN_KEY: %s", adminKey)
-	}
-
-	// 定义默认的限流规则
-	defaultRateLimits := map[string]RateLimitRule{
-		"default": {
-			Limit:   getEnvAsInt("RATE_LIMIT", 60),
-			Window:  time.Duration(getEnvAsInt("RATE_LIMIT_WINDOW", 60)) * time.Second,
-			Enabled: getEnvAsBool("RATE_LIMIT_ENABLED", true),
-		},
-		"strict": {
-			Limit:   getEnvAsInt("STRICT_RATE_LIMIT", 10),
-			Window:  time.Duration(getEnvAsInt("STRICT_RATE_LIMIT_WINDOW", 60)) * time.Second,
-			Enabled: getEnvAsBool("STRICT_RATE_LIMIT_ENABLED", false),
-		},
-		"burst": {
-			Limit:   getEnvAsInt("BURST_RATE_LIMIT", 100),
-			Window:  time.Duration(getEnvAsInt("BURST_RATE_LIMIT_WINDOW", 1)) * time.Second,
-			Enabled: getEnvAsBool("BURST_RATE_LIMIT_ENABLED", false),
-		},
+	// 未指定日志级别时由 DEBUG 决定
+	cfg.LogLevel = strings.ToLower(cfg.LogLevel)
+	if !isLogLevel(cfg.LogLevel) {
+		slog.Warn("LOG_LEVEL is not supported, using default", "level", cfg.LogLevel)
+		cfg.LogLevel = ""
+	}
+	if cfg.LogLevel == "" {
+		cfg.LogLevel = "info"
+		if cfg.Debug {
+			cfg.LogLevel = "debug"
+		}
+	}
+	if cfg.LogFormat != "text" && cfg.LogFormat != "json" {
+		if cfg.LogFormat != "" {
+			slog.Warn("LOG_FORMAT is not supported, using text", "format", cfg.LogFormat)
+		}
+		cfg.LogFormat = "text"
 	}
 
 	// 验证并设置掩码值
-	ipv4Mask := validateMask(
-		getEnvAsInt("IPV4_MASK", DefaultIPv4Mask),
-		MinIPv4Mask,
-		MaxIPv4Mask,
-		DefaultIPv4Mask,
-	)
-
-	ipv6Mask := validateMask(
-		getEnvAsInt("IPV6_MASK", DefaultIPv6Mask),
-		MinIPv6Mask,
-		MaxIPv6Mask,
-		DefaultIPv6Mask,
-	)
+	cfg.IPv4Mask = validateMask(cfg.IPv4Mask, MinIPv4Mask, MaxIPv4Mask, DefaultIPv4Mask)
+	cfg.IPv6Mask = validateMask(cfg.IPv6Mask, MinIPv6Mask, MaxIPv6Mask, DefaultIPv6Mask)
+}
 
-	return &Config{
-		Port:                 getEnv("PORT", "8787"),
-		APIKey:               getEnv("API_KEY", ""),
-		AdminKey:             adminKey,
-		VertexGRPCAddr:       getEnv("VERTEX_GRPC_ADDR", "runtime-native-io-vertex-inference-grpc-service-lmuw6mcn3q-ul.a.run.app:443"),
-		GPTGRPCAddr:          getEnv("GPT_GRPC_ADDR", "runtime-native-io-gpt-inference-grpc-service-lmuw6mcn3q-ul.a.run.app:443"),
-		DefaultModel:         defaultModel,
-		MaxRetries:           getEnvAsInt("MAX_RETRIES", 3),
-		Timeout:              getEnvAsInt("TIMEOUT", 30),
-		Debug:                getEnvAsBool("DEBUG", false),
-		APIPrefix:            apiPrefix,
-		LogFile:              getEnv("LOG_FILE", ""),
-		MinPoolSize:          getEnvAsInt("MIN_POOL_SIZE", 5),
-		MaxPoolSize:          getEnvAsInt("MAX_POOL_SIZE", 20),
-		ScaleInterval:        time.Duration(getEnvAsInt("SCALE_INTERVAL", 30)) * time.Second,
-		EnableModelRoute:     getEnvAsBool("ENABLE_MODEL_ROUTE", false),
-		EnableFoolproofRoute: getEnvAsBool("ENABLE_FOOLPROOF_ROUTE", false),
-		RequestTimeout:       time.Duration(getEnvAsInt("REQUEST_TIMEOUT", 30)) * time.Second,
-		StreamTimeout:        time.Duration(getEnvAsInt("STREAM_TIMEOUT", 300)) * time.Second,
-		RateLimits:           defaultRateLimits,
-		IPWhitelist:          getEnvAsStringSlice("IP_WHITELIST", []string{}),
-		IPBlacklist:          getEnvAsStringSlice("IP_BLACKLIST", []string{}),
-		BlacklistMode:        getEnv("BLACKLIST_MODE", "single"),
-		BlacklistThreshold:   getEnvAsInt("BLACKLIST_THRESHOLD", 100),
-		BlacklistFile:        getEnv("BLACKLIST_FILE", "blacklist.txt"),
-		IPv4Mask:             ipv4Mask,
-		IPv6Mask:             ipv6Mask,
+func isLogLevel(level string) bool {
+	switch level {
+	case "", "debug", "info", "warn", "error":
+		return true
 	}
+	return false
+}
+
+// isModelSupported 判断模型是否存在，允许使用配置中的别名和内置别名
+func (c *Config) isModelSupported(name string) bool {
+	if alias, ok := c.ModelAliases[name]; ok {
+		name = alias.Target
+	}
+	return isAliasTarget(name)
+}
+
+// isAliasTarget 判断名称是否为模型目录中的模型或内置别名，不使用当前生效的配置别名
+func isAliasTarget(name string) bool {
+	return model.IsCatalogModel(name) || model.IsBuiltinAlias(name)
 }
 
 func getEnv(key, defaultValue string) string {
@@ -199,6 +509,25 @@ func getEnvAsBool(key string, defaultValue bool) bool {
 	return defaultValue
 }
 
+func getEnvAsFloat(key string, defaultValue float64) float64 {
+	if value := os.Getenv(key); value != "" {
+		if floatVal, err := strconv.ParseFloat(value, 64); err == nil {
+			return floatVal
+		}
+	}
+	return defaultValue
+}
+
+// getEnvAsSeconds 读取以秒为单位的整数环境变量
+func getEnvAsSeconds(key string, defaultValue time.Duration) time.Duration {
+	if value := os.Getenv(key); value != "" {
+		if intVal, err := strconv.Atoi(value); err == nil {
+			return time.Duration(intVal) * time.Second
+		}
+	}
+	return defaultValue
+}
+
 func getEnvAsStringSlice(key string, defaultValue []string) []string {
 	if value := os.Getenv(key); value != "" {
 		parts := strings.Split(value, ",")
@@ -0,0 +1,348 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"pieces-os-go/internal/model"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Problem 配置文件中的单个错误
+type Problem struct {
+	Line    int    `json:"line,omitempty"` // 出错位置所在行，未知时为0
+	Path    string `json:"path,omitempty"` // 出错字段路径，如 rate_limits.default.limit
+	Message string `json:"message"`
+}
+
+// ValidationError 配置文件解析或校验失败，包含所有发现的错误
+type ValidationError struct {
+	File     string
+	Problems []Problem
+}
+
+func (e *ValidationError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "invalid config file %s:", e.File)
+	for _, p := range e.Problems {
+		b.WriteString("\n  ")
+		if p.Line > 0 {
+			fmt.Fprintf(&b, "line %d: ", p.Line)
+		}
+		if p.Path != "" {
+			fmt.Fprintf(&b, "%s: ", p.Path)
+		}
+		b.WriteString(p.Message)
+	}
+	return b.String()
+}
+
+// UnmarshalYAML 未显式指定 enabled 的规则默认启用，并拒绝未知字段
+func (r *RateLimitRule) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(value.Content); i += 2 {
+			key := value.Content[i]
+			switch key.Value {
+			case "limit", "window", "enabled":
+			default:
+				return &yaml.TypeError{Errors: []string{
+					fmt.Sprintf("line %d: field %s not found in type config.RateLimitRule", key.Line, key.Value),
+				}}
+			}
+		}
+	}
+
+	type plain RateLimitRule
+	rule := plain{Enabled: true}
+	if err := value.Decode(&rule); err != nil {
+		return err
+	}
+	*r = RateLimitRule(rule)
+	return nil
+}
+
+// loadFile 将 YAML 或 TOML 配置文件合并到 cfg 中并严格校验
+func loadFile(path string, cfg *Config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %v", err)
+	}
+
+	// 字段路径所在的行号，TOML 文件无法获取
+	lines := make(map[string]int)
+	if isTOML(path) {
+		if problems := decodeTOML(data, cfg); len(problems) > 0 {
+			return &ValidationError{File: path, Problems: problems}
+		}
+	} else {
+		var root yaml.Node
+		if err := yaml.Unmarshal(data, &root); err != nil {
+			return &ValidationError{File: path, Problems: yamlProblems(err)}
+		}
+
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+			return &ValidationError{File: path, Problems: yamlProblems(err)}
+		}
+		indexLines(&root, "", lines)
+	}
+
+	problems := validate(cfg)
+	if len(problems) == 0 {
+		return nil
+	}
+	for i := range problems {
+		problems[i].Line = lines[problems[i].Path]
+	}
+	sort.SliceStable(problems, func(i, j int) bool { return problems[i].Line < problems[j].Line })
+	return &ValidationError{File: path, Problems: problems}
+}
+
+// yamlProblems 将 yaml 库的错误拆分为带行号的错误列表
+func yamlProblems(err error) []Problem {
+	var messages []string
+	var typeErr *yaml.TypeError
+	if errors.As(err, &typeErr) {
+		messages = typeErr.Errors
+	} else {
+		messages = []string{strings.TrimPrefix(err.Error(), "yaml: ")}
+	}
+
+	problems := make([]Problem, 0, len(messages))
+	for _, msg := range messages {
+		p := Problem{Message: msg}
+		var line int
+		if n, _ := fmt.Sscanf(msg, "line %d:", &line); n == 1 {
+			p.Line = line
+			p.Message = strings.TrimSpace(msg[strings.Index(msg, ":")+1:])
+		}
+		problems = append(problems, p)
+	}
+	return problems
+}
+
+// indexLines 记录每个字段路径在文件中的行号
+func indexLines(node *yaml.Node, path string, lines map[string]int) {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for _, child := range node.Content {
+			indexLines(child, path, lines)
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i]
+			childPath := key.Value
+			if path != "" {
+				childPath = path + "." + key.Value
+			}
+			lines[childPath] = key.Line
+			indexLines(node.Content[i+1], childPath, lines)
+		}
+	case yaml.SequenceNode:
+		for i, item := range node.Content {
+			childPath := fmt.Sprintf("%s[%d]", path, i)
+			lines[childPath] = item.Line
+			indexLines(item, childPath, lines)
+		}
+	}
+}
+
+// validate 校验配置取值，返回的 Path 与 indexLines 的路径格式一致
+func validate(cfg *Config) []Problem {
+	var problems []Problem
+	add := func(path, format string, args ...any) {
+		problems = append(problems, Problem{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if port, err := strconv.Atoi(cfg.Port); err != nil || port < 1 || port > 65535 {
+		add("port", "must be a port number between 1 and 65535")
+	}
+	if cfg.APIPrefix != "" && (!strings.HasPrefix(cfg.APIPrefix, "/") || strings.HasSuffix(cfg.APIPrefix, "/")) {
+		add("api_prefix", "must start with / and must not end with /")
+	}
+	if cfg.MaxRetries < 1 {
+		add("max_retries", "must be at least 1")
+	}
+	if cfg.FormatRetries < 0 {
+		add("format_retries", "must not be negative")
+	}
+	if cfg.Timeout < 1 {
+		add("timeout", "must be at least 1 (seconds)")
+	}
+	if cfg.MinPoolSize < 1 {
+		add("min_pool_size", "must be at least 1")
+	}
+	if cfg.MaxPoolSize < cfg.MinPoolSize {
+		add("max_pool_size", "must not be less than min_pool_size (%d)", cfg.MinPoolSize)
+	}
+	if !isLogLevel(strings.ToLower(cfg.LogLevel)) {
+		add("log_level", "must be one of debug, info, warn, error")
+	}
+	switch cfg.LogFormat {
+	case "", "text", "json":
+	default:
+		add("log_format", "must be one of text, json")
+	}
+	checkDuration(add, "scale_interval", cfg.ScaleInterval, false)
+	checkDuration(add, "request_timeout", cfg.RequestTimeout, true)
+	checkDuration(add, "stream_timeout", cfg.StreamTimeout, true)
+	checkDuration(add, "reload_interval", cfg.ReloadInterval, true)
+
+	switch cfg.BlacklistMode {
+	case "off", "single", "subnet":
+	default:
+		add("blacklist_mode", "must be one of off, single, subnet")
+	}
+	if cfg.BlacklistThreshold < 1 {
+		add("blacklist_threshold", "must be at least 1")
+	}
+	if cfg.IPv4Mask < MinIPv4Mask || cfg.IPv4Mask > MaxIPv4Mask {
+		add("ipv4_mask", "must be between %d and %d", MinIPv4Mask, MaxIPv4Mask)
+	}
+	if cfg.IPv6Mask < MinIPv6Mask || cfg.IPv6Mask > MaxIPv6Mask {
+		add("ipv6_mask", "must be between %d and %d", MinIPv6Mask, MaxIPv6Mask)
+	}
+
+	for _, name := range sortedKeys(cfg.RateLimits) {
+		rule := cfg.RateLimits[name]
+		path := "rate_limits." + name
+		if rule.Limit < 1 {
+			add(path+".limit", "must be at least 1")
+		}
+		checkDuration(add, path+".window", rule.Window, false)
+	}
+
+	if cfg.TokenLimits.PerKey < 0 {
+		add("token_limits.per_key", "must not be negative")
+	}
+	if cfg.TokenLimits.PerIP < 0 {
+		add("token_limits.per_ip", "must not be negative")
+	}
+	for _, limit := range []struct {
+		path  string
+		value int
+	}{
+		{"concurrency.per_key", cfg.Concurrency.PerKey},
+		{"concurrency.per_ip", cfg.Concurrency.PerIP},
+		{"concurrency.global", cfg.Concurrency.Global},
+		{"concurrency.queue_size", cfg.Concurrency.QueueSize},
+		{"log_rotate.max_size", cfg.LogRotate.MaxSize},
+		{"log_rotate.max_backups", cfg.LogRotate.MaxBackups},
+	} {
+		if limit.value < 0 {
+			add(limit.path, "must not be negative")
+		}
+	}
+	checkDuration(add, "concurrency.queue_timeout", cfg.Concurrency.QueueTimeout, true)
+	checkDuration(add, "log_rotate.interval", cfg.LogRotate.Interval, true)
+	checkDuration(add, "log_rotate.max_age", cfg.LogRotate.MaxAge, true)
+
+	switch cfg.Tracing.Exporter {
+	case "", "otlp", "stdout":
+	case "file":
+		if cfg.Tracing.File == "" {
+			add("tracing.file", "must be set when tracing.exporter is file")
+		}
+	default:
+		add("tracing.exporter", "must be one of otlp, stdout, file or empty")
+	}
+	if cfg.Tracing.SampleRatio < 0 || cfg.Tracing.SampleRatio > 1 {
+		add("tracing.sample_ratio", "must be between 0 and 1")
+	}
+
+	if cfg.Audit.Enabled && cfg.Audit.Dir == "" {
+		add("audit.dir", "must be set when audit is enabled")
+	}
+	for i, rule := range cfg.Audit.Redact {
+		path := fmt.Sprintf("audit.redact[%d]", i)
+		rule, err := ResolveRedactRule(rule)
+		if err != nil {
+			add(path+".name", "must be one of email, phone, api_key when pattern is empty")
+			continue
+		}
+		if _, err := regexp.Compile(rule.Pattern); err != nil {
+			add(path+".pattern", "invalid regular expression: %v", err)
+		}
+	}
+
+	for _, alias := range sortedKeys(cfg.ModelAliases) {
+		target := cfg.ModelAliases[alias].Target
+		path := "model_aliases." + alias
+		if model.IsCatalogModel(alias) {
+			add(path, "alias shadows an existing model")
+		}
+		if !isAliasTarget(target) {
+			add(path, "target model '%s' does not exist", target)
+		}
+	}
+
+	for _, name := range sortedKeys(cfg.PromptTemplates) {
+		path := "prompt_templates." + name
+		if _, ok := model.SupportedModels[name]; !ok && name != model.BackendGPT && name != model.BackendVertex {
+			add(path, "must be a model id from the catalog or a backend name (%s, %s)", model.BackendGPT, model.BackendVertex)
+			continue
+		}
+		if _, err := cfg.PromptTemplates[name].Compile(name); err != nil {
+			add(path, "invalid template: %v", err)
+		}
+	}
+
+	if cfg.DefaultModel != "" && !cfg.isModelSupported(cfg.DefaultModel) {
+		add("default_model", "model '%s' does not exist", cfg.DefaultModel)
+	}
+
+	for _, name := range sortedKeys(cfg.Routes) {
+		route := cfg.Routes[name]
+		path := "routes." + name
+		if !isKnownRoute(name) {
+			add(path, "unknown route, must be one of %s", strings.Join(KnownRoutes, ", "))
+			continue
+		}
+		for i, ruleName := range route.RateLimits {
+			if _, ok := cfg.RateLimits[ruleName]; !ok {
+				add(fmt.Sprintf("%s.rate_limits[%d]", path, i), "rate limit rule '%s' is not defined", ruleName)
+			}
+		}
+		checkDuration(add, path+".request_timeout", route.RequestTimeout, true)
+		checkDuration(add, path+".stream_timeout", route.StreamTimeout, true)
+	}
+
+	return problems
+}
+
+// checkDuration 拒绝负数和小于1毫秒的时长
+func checkDuration(add func(path, format string, args ...any), path string, d time.Duration, allowZero bool) {
+	if d == 0 && allowZero {
+		return
+	}
+	if d < time.Millisecond {
+		add(path, "must be a positive duration with a unit, such as 30s or 5m")
+	}
+}
+
+func isKnownRoute(name string) bool {
+	for _, known := range KnownRoutes {
+		if name == known {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
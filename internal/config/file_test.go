@@ -0,0 +1,342 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"pieces-os-go/internal/model"
+)
+
+func TestMain(m *testing.M) {
+	if err := model.InitModels(); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+// writeConfig 在临时目录中写入配置文件并返回路径
+func writeConfig(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(strings.TrimLeft(content, "\n")), 0644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	return path
+}
+
+// loadProblems 加载配置文件，要求返回 ValidationError
+func loadProblems(t *testing.T, path string) []Problem {
+	t.Helper()
+	_, err := load(path)
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("load error = %v, want *ValidationError", err)
+	}
+	return validationErr.Problems
+}
+
+func TestLoadFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+	}{
+		{
+			name: "yaml",
+			file: "config.yaml",
+			content: `
+port: "9000"
+api_key: sk-file
+request_timeout: 30s
+model_aliases:
+  fast: gpt-4o-mini
+  old: {target: gpt-4o, deprecated: true}
+rate_limits:
+  claude-heavy:
+    limit: 10
+    window: 1m
+routes:
+  messages:
+    rate_limits: [claude-heavy]
+tracing:
+  service_name: gateway
+`,
+		},
+		{
+			name: "toml",
+			file: "config.toml",
+			content: `
+# 与 yaml 用例相同的配置
+port = "9000"
+api_key = 'sk-file'
+request_timeout = "30s"
+tracing.service_name = "gateway"
+
+[model_aliases]
+fast = "gpt-4o-mini"
+old = { target = "gpt-4o", deprecated = true }
+
+[rate_limits.claude-heavy]
+limit = 1_0
+window = "1m"
+
+[routes.messages]
+rate_limits = [
+  "claude-heavy", # 行内注释
+]
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := load(writeConfig(t, tt.file, tt.content))
+			if err != nil {
+				t.Fatalf("load: %v", err)
+			}
+			if cfg.Port != "9000" || cfg.APIKey != "sk-file" || cfg.RequestTimeout != 30*time.Second {
+				t.Errorf("port, api_key, request_timeout = %q, %q, %v", cfg.Port, cfg.APIKey, cfg.RequestTimeout)
+			}
+			if rule := cfg.RateLimits["claude-heavy"]; rule != (RateLimitRule{Limit: 10, Window: time.Minute, Enabled: true}) {
+				t.Errorf("rate_limits.claude-heavy = %+v", rule)
+			}
+			if _, ok := cfg.RateLimits["default"]; !ok {
+				t.Error("built-in rate limit rules should be kept")
+			}
+			if got := cfg.Routes[RouteMessages].RateLimits; len(got) != 1 || got[0] != "claude-heavy" {
+				t.Errorf("routes.messages.rate_limits = %v", got)
+			}
+			if got := cfg.Routes[RouteGemini].RateLimits; len(got) != 1 || got[0] != "strict" {
+				t.Errorf("routes.gemini.rate_limits = %v, want default [strict]", got)
+			}
+			want := map[string]model.ModelAlias{
+				"fast": {Target: "gpt-4o-mini"},
+				"old":  {Target: "gpt-4o", Deprecated: true},
+			}
+			for alias, entry := range want {
+				if cfg.ModelAliases[alias] != entry {
+					t.Errorf("model_aliases.%s = %+v, want %+v", alias, cfg.ModelAliases[alias], entry)
+				}
+			}
+			if cfg.Tracing.ServiceName != "gateway" || cfg.Tracing.SampleRatio != 1 {
+				t.Errorf("tracing = %+v, want service_name from file and default sample_ratio", cfg.Tracing)
+			}
+			if cfg.KeysFile != "" || cfg.UsageDB != "" {
+				t.Errorf("keys_file, usage_db = %q, %q, want disabled by default", cfg.KeysFile, cfg.UsageDB)
+			}
+		})
+	}
+}
+
+func TestLoadFileRejectsInvalidContent(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		want    []Problem // 只比较行号和路径，Message 为子串
+	}{
+		{
+			name: "yaml unknown field",
+			file: "config.yaml",
+			content: `
+port: "9000"
+rate_limt: 5
+`,
+			want: []Problem{{Line: 2, Message: "field rate_limt not found"}},
+		},
+		{
+			name: "yaml unknown rate limit field",
+			file: "config.yaml",
+			content: `
+rate_limits:
+  claude-heavy:
+    limit: 10
+    windw: 1m
+`,
+			want: []Problem{{Line: 4, Message: "field windw not found"}},
+		},
+		{
+			name: "yaml syntax error",
+			file: "config.yaml",
+			content: `
+port: "9000"
+routes: [
+`,
+			want: []Problem{{Line: 2, Message: "did not find expected node content"}},
+		},
+		{
+			name: "yaml invalid values",
+			file: "config.yaml",
+			content: `
+port: "0"
+rate_limits:
+  claude-heavy:
+    limit: 0
+    window: 1m
+`,
+			want: []Problem{
+				{Line: 1, Path: "port", Message: "must be a port number"},
+				{Line: 4, Path: "rate_limits.claude-heavy.limit", Message: "must be at least 1"},
+			},
+		},
+		{
+			name: "toml unknown field",
+			file: "config.toml",
+			content: `
+port = "9000"
+
+rate_limt = 5
+`,
+			want: []Problem{{Path: "rate_limt", Message: "unknown field"}},
+		},
+		{
+			name: "toml unknown field in table",
+			file: "config.toml",
+			content: `
+[rate_limits.claude-heavy]
+limit = 10
+
+windw = "1m"
+`,
+			want: []Problem{{Path: "rate_limits.claude-heavy.windw", Message: "unknown field"}},
+		},
+		{
+			name: "toml unknown table",
+			file: "config.toml",
+			content: `
+[tracng]
+exporter = "stdout"
+`,
+			want: []Problem{{Path: "tracng", Message: "unknown field"}},
+		},
+		{
+			name: "toml unknown model alias field",
+			file: "config.toml",
+			content: `
+[model_aliases]
+old = { target = "gpt-4o", deprecatd = true }
+`,
+			want: []Problem{{Line: 2, Path: "model_aliases.old", Message: "field deprecatd not found"}},
+		},
+		{
+			name: "toml type error",
+			file: "config.toml",
+			content: `
+port = "9000"
+[routes.messages]
+request_timeout = true
+`,
+			want: []Problem{{Line: 3, Message: "incompatible types"}},
+		},
+		{
+			name: "toml syntax error",
+			file: "config.toml",
+			content: `
+port = "9000"
+api_key = sk-unquoted
+`,
+			want: []Problem{{Line: 2, Path: "api_key", Message: "expected value"}},
+		},
+		{
+			// TOML 不允许整数有前导零
+			name: "toml leading zero",
+			file: "config.toml",
+			content: `
+timeout = 010
+`,
+			want: []Problem{{Line: 1, Path: "timeout", Message: "leading zeroes"}},
+		},
+		{
+			name: "toml duplicate key",
+			file: "config.toml",
+			content: `
+port = "9000"
+port = "9001"
+`,
+			want: []Problem{{Line: 2, Path: "port", Message: "already been defined"}},
+		},
+		{
+			name: "toml invalid values",
+			file: "config.toml",
+			content: `
+port = "0"
+
+[rate_limits.claude-heavy]
+window = "1m"
+limit = 0
+`,
+			want: []Problem{
+				{Path: "port", Message: "must be a port number"},
+				{Path: "rate_limits.claude-heavy.limit", Message: "must be at least 1"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			problems := loadProblems(t, writeConfig(t, tt.file, tt.content))
+			if len(problems) != len(tt.want) {
+				t.Fatalf("problems = %+v, want %d", problems, len(tt.want))
+			}
+			for i, want := range tt.want {
+				got := problems[i]
+				if got.Line != want.Line || got.Path != want.Path || !strings.Contains(got.Message, want.Message) {
+					t.Errorf("problem %d = %+v, want %+v", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestEnvOverridesFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+	}{
+		{name: "yaml", file: "config.yaml", content: "port: \"9000\"\napi_key: sk-file\nrate_limits:\n  strict:\n    limit: 7\n    window: 1m\n"},
+		{name: "toml", file: "config.toml", content: "port = \"9000\"\napi_key = \"sk-file\"\n[rate_limits.strict]\nlimit = 7\nwindow = \"1m\"\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("PORT", "9100")
+			t.Setenv("STRICT_RATE_LIMIT", "3")
+			cfg, err := load(writeConfig(t, tt.file, tt.content))
+			if err != nil {
+				t.Fatalf("load: %v", err)
+			}
+			// 环境变量优先，其余字段使用配置文件的值
+			if cfg.Port != "9100" {
+				t.Errorf("port = %q, want env value 9100", cfg.Port)
+			}
+			if cfg.APIKey != "sk-file" {
+				t.Errorf("api_key = %q, want file value", cfg.APIKey)
+			}
+			if rule := cfg.RateLimits["strict"]; rule.Limit != 3 || !rule.Enabled {
+				t.Errorf("rate_limits.strict = %+v, want env limit 3", rule)
+			}
+		})
+	}
+}
+
+func TestFoolproofRouteDisabledWithoutPrefix(t *testing.T) {
+	path := writeConfig(t, "config.yaml", "api_prefix: \"\"\nenable_foolproof_route: true\n")
+	cfg, err := load(path)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if cfg.EnableFoolproofRoute {
+		t.Fatal("enable_foolproof_route should be disabled when api_prefix is empty")
+	}
+
+	// 加载时已经关闭，重载不应报告需要重启
+	result, err := NewStore(cfg).Reload()
+	if err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if len(result.Changed) != 0 || len(result.RestartRequired) != 0 {
+		t.Errorf("reload result = %+v, want no changes", result)
+	}
+}
@@ -0,0 +1,215 @@
+package config
+
+import (
+	"log/slog"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+// restartFields 修改后需要重启才能生效的字段，热重载时沿用旧值
+var restartFields = map[string]bool{
+	"port":                   true,
+	"api_prefix":             true,
+	"admin_key":              true,
+	"vertex_grpc_addr":       true,
+	"gpt_grpc_addr":          true,
+	"grpc_plaintext":         true,
+	"log_file":               true,
+	"log_format":             true,
+	"log_rotate":             true,
+	"audit":                  true,
+	"min_pool_size":          true,
+	"max_pool_size":          true,
+	"scale_interval":         true,
+	"enable_model_route":     true,
+	"enable_foolproof_route": true,
+	"blacklist_file":         true,
+	"reload_interval":        true,
+	"keys_file":              true,
+	"usage_db":               true,
+	"enable_metrics":         true,
+	"metrics_key":            true,
+	"tracing":                true,
+}
+
+// ReloadResult 一次重载的结果，字段名使用配置文件中的名称
+type ReloadResult struct {
+	Reloaded        bool     `json:"reloaded"`                   // 是否应用了新配置
+	Changed         []string `json:"changed"`                    // 已生效的变更字段
+	RestartRequired []string `json:"restart_required,omitempty"` // 已修改但需要重启才能生效的字段
+}
+
+// Store 持有当前生效的配置，重载时整体原子替换
+type Store struct {
+	current  atomic.Pointer[Config]
+	mu       sync.Mutex // 串行化重载
+	handlers []func(cfg *Config)
+}
+
+// NewStore 创建配置存储
+func NewStore(cfg *Config) *Store {
+	s := &Store{}
+	s.current.Store(cfg)
+	return s
+}
+
+// Current 返回当前生效的配置，调用方不应修改返回值
+func (s *Store) Current() *Config {
+	return s.current.Load()
+}
+
+// OnReload 注册配置替换后的回调，回调按注册顺序同步执行
+func (s *Store) OnReload(fn func(cfg *Config)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers = append(s.handlers, fn)
+}
+
+// Reload 重新读取 .env、配置文件和环境变量，校验失败时保留当前配置
+func (s *Store) Reload() (*ReloadResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old := s.Current()
+	next, err := load(old.ConfigFile)
+	if err != nil {
+		slog.Error("config reload rejected", "error", err)
+		return nil, err
+	}
+
+	// 未配置管理密钥时沿用启动时生成的随机密钥
+	if next.AdminKey == "" && old.adminKeyGenerated {
+		next.AdminKey = old.AdminKey
+		next.adminKeyGenerated = true
+	}
+
+	result := &ReloadResult{Changed: []string{}}
+	oldValue := reflect.ValueOf(old).Elem()
+	nextValue := reflect.ValueOf(next).Elem()
+	for i := 0; i < oldValue.NumField(); i++ {
+		name := yamlName(oldValue.Type().Field(i))
+		if name == "" || reflect.DeepEqual(oldValue.Field(i).Interface(), nextValue.Field(i).Interface()) {
+			continue
+		}
+		if restartFields[name] {
+			result.RestartRequired = append(result.RestartRequired, name)
+			nextValue.Field(i).Set(oldValue.Field(i))
+			continue
+		}
+		result.Changed = append(result.Changed, name)
+	}
+
+	if len(result.Changed) == 0 {
+		if len(result.RestartRequired) > 0 {
+			slog.Warn("config fields changed but require a restart to take effect", "fields", result.RestartRequired)
+		} else {
+			slog.Info("config reloaded without changes")
+		}
+		return result, nil
+	}
+
+	s.current.Store(next)
+	for _, fn := range s.handlers {
+		fn(next)
+	}
+	result.Reloaded = true
+
+	slog.Info("config reloaded", "changed", result.Changed)
+	if len(result.RestartRequired) > 0 {
+		slog.Warn("config fields changed but require a restart to take effect", "fields", result.RestartRequired)
+	}
+	return result, nil
+}
+
+// Watch 按固定间隔检查配置文件和 .env 的修改时间，发生变化时自动重载，直到 stop 被关闭
+func (s *Store) Watch(interval time.Duration, stop <-chan struct{}) {
+	files := []string{".env"}
+	if path := s.Current().ConfigFile; path != "" {
+		files = append(files, path)
+	}
+
+	modTimes := make(map[string]time.Time)
+	for _, f := range files {
+		modTimes[f] = modTime(f)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			changed := false
+			for _, f := range files {
+				if t := modTime(f); !t.Equal(modTimes[f]) {
+					modTimes[f] = t
+					changed = true
+				}
+			}
+			if changed {
+				slog.Info("config file change detected, reloading")
+				s.Reload()
+			}
+		}
+	}
+}
+
+func modTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+func yamlName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+	if name == "-" {
+		return ""
+	}
+	return name
+}
+
+var (
+	dotenvMu   sync.Mutex
+	dotenvKeys map[string]bool // 由 .env 设置的环境变量，重载时允许被新的 .env 覆盖
+)
+
+// loadDotenv 将 .env 中的变量写入进程环境变量，真实的环境变量优先
+// 与 godotenv.Load 不同，重复调用时会应用 .env 中修改和删除的变量
+func loadDotenv() {
+	dotenvMu.Lock()
+	defer dotenvMu.Unlock()
+
+	values, err := godotenv.Read()
+	if err != nil {
+		if dotenvKeys == nil {
+			slog.Warn(".env file not found")
+		}
+		values = map[string]string{}
+	}
+	if dotenvKeys == nil {
+		dotenvKeys = make(map[string]bool)
+	}
+
+	for key := range dotenvKeys {
+		if _, ok := values[key]; !ok {
+			os.Unsetenv(key)
+			delete(dotenvKeys, key)
+		}
+	}
+	for key, value := range values {
+		if _, exists := os.LookupEnv(key); exists && !dotenvKeys[key] {
+			continue
+		}
+		os.Setenv(key, value)
+		dotenvKeys[key] = true
+	}
+}
@@ -0,0 +1,64 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// isTOML 按扩展名判断配置文件格式，其余扩展名按 YAML 解析
+func isTOML(path string) bool {
+	return strings.EqualFold(filepath.Ext(path), ".toml")
+}
+
+// decodeTOML 将 TOML 配置合并到 cfg 中，拒绝未知字段
+// TOML 库不提供字段所在的行号，语法和类型错误带有行号，未知字段只给出字段路径
+func decodeTOML(data []byte, cfg *Config) []Problem {
+	md, err := toml.NewDecoder(bytes.NewReader(data)).Decode(cfg)
+	if err != nil {
+		return []Problem{tomlProblem(err)}
+	}
+
+	var problems []Problem
+	undecoded := make(map[string]bool)
+	for _, key := range md.Undecoded() {
+		undecoded[key.String()] = true
+		// 未知的表只报告一次，不再列出其中的字段
+		if len(key) > 1 && undecoded[key[:len(key)-1].String()] {
+			continue
+		}
+		problems = append(problems, Problem{Path: key.String(), Message: "unknown field"})
+	}
+
+	// 与 YAML 相同，未显式指定 enabled 的限流规则默认启用
+	for name, rule := range cfg.RateLimits {
+		if md.IsDefined("rate_limits", name) && !md.IsDefined("rate_limits", name, "enabled") {
+			rule.Enabled = true
+			cfg.RateLimits[name] = rule
+		}
+	}
+	return problems
+}
+
+// tomlProblem 将 TOML 库的错误转换为带行号的错误
+func tomlProblem(err error) Problem {
+	var parseErr toml.ParseError
+	if errors.As(err, &parseErr) {
+		return Problem{Line: parseErr.Position.Line, Path: parseErr.LastKey, Message: parseErr.Message}
+	}
+
+	// 类型错误的格式为 toml: line N (last key "a.b"): message
+	msg := strings.TrimPrefix(err.Error(), "toml: ")
+	var p Problem
+	if n, _ := fmt.Sscanf(msg, "line %d", &p.Line); n == 1 {
+		if i := strings.Index(msg, "): "); i >= 0 {
+			msg = msg[i+len("): "):]
+		}
+	}
+	p.Message = msg
+	return p
+}
@@ -0,0 +1,273 @@
+// Package fakeupstream 提供进程内的 GPT/Vertex gRPC 假上游，用于端到端测试
+package fakeupstream
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	gptpb "pieces-os-go/pkg/proto/gpt"
+	vertexpb "pieces-os-go/pkg/proto/vertex"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ErrRSTStream 模拟上游以 RST_STREAM 中断流时客户端收到的错误
+var ErrRSTStream = status.Error(codes.Internal, "stream terminated by RST_STREAM with error code: INTERNAL_ERROR")
+
+// Script 描述一次调用的响应行为
+type Script struct {
+	Chunks       []string      // 依次返回的内容片段，一元调用时会被拼接为一条消息
+	ResponseCode int64         // 一元调用和普通数据块的响应码，默认 200
+	Terminate    bool          // 流式调用是否以 204 响应码结束，否则直接 EOF
+	FinalContent string        // 204 结束块中携带的内容
+	Err          error         // 在发送任何数据之前直接返回的 gRPC 错误
+	StreamErr    error         // 发送完 Chunks 后返回的错误，例如 ErrRSTStream
+	Latency      time.Duration // 每次响应或每个数据块之前的延迟
+}
+
+// Server 实现 GPTInferenceServiceServer，并通过 VertexService 提供 VertexInferenceServiceServer
+// 两个服务注册在同一个监听地址上，共用脚本队列
+type Server struct {
+	gptpb.UnimplementedGPTInferenceServiceServer
+
+	mu             sync.Mutex
+	scripts        []Script
+	defaultScript  Script
+	gptRequests    []*gptpb.Request
+	vertexRequests []*vertexpb.Requests
+
+	grpcServer *grpc.Server
+	listener   net.Listener
+}
+
+// New 创建假上游，默认返回一条 "ok" 并以 204 结束
+func New() *Server {
+	return &Server{
+		defaultScript: Script{Chunks: []string{"ok"}, Terminate: true},
+	}
+}
+
+// Start 在本地随机端口上以明文 gRPC 启动服务，返回监听地址
+func (s *Server) Start() (string, error) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+
+	s.listener = lis
+	s.grpcServer = grpc.NewServer()
+	gptpb.RegisterGPTInferenceServiceServer(s.grpcServer, s)
+	vertexpb.RegisterVertexInferenceServiceServer(s.grpcServer, s.VertexService())
+
+	go s.grpcServer.Serve(lis)
+	return lis.Addr().String(), nil
+}
+
+// Addr 返回监听地址
+func (s *Server) Addr() string {
+	if s.listener == nil {
+		return ""
+	}
+	return s.listener.Addr().String()
+}
+
+// Stop 立即停止服务
+func (s *Server) Stop() {
+	if s.grpcServer != nil {
+		s.grpcServer.Stop()
+	}
+}
+
+// Enqueue 追加按顺序消费的脚本，队列为空时使用默认脚本
+func (s *Server) Enqueue(scripts ...Script) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.scripts = append(s.scripts, scripts...)
+}
+
+// SetDefault 设置队列为空时使用的脚本
+func (s *Server) SetDefault(script Script) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.defaultScript = script
+}
+
+// Reset 清空脚本队列和请求记录
+func (s *Server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.scripts = nil
+	s.gptRequests = nil
+	s.vertexRequests = nil
+}
+
+// GPTRequests 返回收到的 GPT 请求
+func (s *Server) GPTRequests() []*gptpb.Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*gptpb.Request(nil), s.gptRequests...)
+}
+
+// VertexRequests 返回收到的 Vertex 请求
+func (s *Server) VertexRequests() []*vertexpb.Requests {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*vertexpb.Requests(nil), s.vertexRequests...)
+}
+
+func (s *Server) nextScript() Script {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.scripts) == 0 {
+		return s.defaultScript
+	}
+	script := s.scripts[0]
+	s.scripts = s.scripts[1:]
+	return script
+}
+
+func (script Script) code() int64 {
+	if script.ResponseCode == 0 {
+		return 200
+	}
+	return script.ResponseCode
+}
+
+// wait 注入延迟，调用方取消时提前返回错误
+func wait(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	select {
+	case <-time.After(d):
+		return nil
+	case <-ctx.Done():
+		return status.FromContextError(ctx.Err()).Err()
+	}
+}
+
+func (s *Server) Predict(ctx context.Context, req *gptpb.Request) (*gptpb.Response, error) {
+	s.mu.Lock()
+	s.gptRequests = append(s.gptRequests, req)
+	s.mu.Unlock()
+
+	script := s.nextScript()
+	if err := wait(ctx, script.Latency); err != nil {
+		return nil, err
+	}
+	if script.Err != nil {
+		return nil, script.Err
+	}
+	return gptResponse(uint64(script.code()), strings.Join(script.Chunks, "")), nil
+}
+
+func (s *Server) PredictWithStream(req *gptpb.Request, stream grpc.ServerStreamingServer[gptpb.Response]) error {
+	s.mu.Lock()
+	s.gptRequests = append(s.gptRequests, req)
+	s.mu.Unlock()
+
+	script := s.nextScript()
+	if script.Err != nil {
+		return script.Err
+	}
+
+	for _, chunk := range script.Chunks {
+		if err := wait(stream.Context(), script.Latency); err != nil {
+			return err
+		}
+		if err := stream.Send(gptResponse(uint64(script.code()), chunk)); err != nil {
+			return err
+		}
+	}
+	if script.StreamErr != nil {
+		return script.StreamErr
+	}
+	if script.Terminate {
+		return stream.Send(gptResponse(204, script.FinalContent))
+	}
+	return nil
+}
+
+func gptResponse(code uint64, content string) *gptpb.Response {
+	return &gptpb.Response{
+		ResponseCode: code,
+		Body: &gptpb.Body{
+			Id:     "chatcmpl-fakeupstream",
+			Object: "chat.completion",
+			Time:   uint64(time.Now().Unix()),
+			MessageWarpper: &gptpb.MessageWarpper{
+				Arg1:    1,
+				Message: &gptpb.Message{Role: 1, Message: content},
+			},
+		},
+	}
+}
+
+// vertexServer 避免 GPT 与 Vertex 服务的同名方法冲突
+type vertexServer struct {
+	vertexpb.UnimplementedVertexInferenceServiceServer
+	s *Server
+}
+
+// VertexService 返回 Vertex 服务实现
+func (s *Server) VertexService() vertexpb.VertexInferenceServiceServer {
+	return &vertexServer{s: s}
+}
+
+func (v *vertexServer) Predict(ctx context.Context, req *vertexpb.Requests) (*vertexpb.Response, error) {
+	v.s.mu.Lock()
+	v.s.vertexRequests = append(v.s.vertexRequests, req)
+	v.s.mu.Unlock()
+
+	script := v.s.nextScript()
+	if err := wait(ctx, script.Latency); err != nil {
+		return nil, err
+	}
+	if script.Err != nil {
+		return nil, script.Err
+	}
+	return vertexResponse(script.code(), strings.Join(script.Chunks, "")), nil
+}
+
+func (v *vertexServer) PredictWithStream(req *vertexpb.Requests, stream grpc.ServerStreamingServer[vertexpb.Response]) error {
+	v.s.mu.Lock()
+	v.s.vertexRequests = append(v.s.vertexRequests, req)
+	v.s.mu.Unlock()
+
+	script := v.s.nextScript()
+	if script.Err != nil {
+		return script.Err
+	}
+
+	for _, chunk := range script.Chunks {
+		if err := wait(stream.Context(), script.Latency); err != nil {
+			return err
+		}
+		if err := stream.Send(vertexResponse(script.code(), chunk)); err != nil {
+			return err
+		}
+	}
+	if script.StreamErr != nil {
+		return script.StreamErr
+	}
+	if script.Terminate {
+		return stream.Send(vertexResponse(204, script.FinalContent))
+	}
+	return nil
+}
+
+func vertexResponse(code int64, content string) *vertexpb.Response {
+	return &vertexpb.Response{
+		ResponseCode: code,
+		Args: &vertexpb.Args1{
+			Args: &vertexpb.Args2{
+				Args: &vertexpb.Messages{Unknown: 3, Message: content},
+			},
+		},
+	}
+}
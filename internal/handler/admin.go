@@ -0,0 +1,33 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"pieces-os-go/internal/config"
+	"pieces-os-go/internal/model"
+)
+
+// HandleReload 重新加载配置，返回生效的变更和需要重启的字段，新配置不合法时保留当前配置
+func HandleReload(store *config.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		result, err := store.Reload()
+		if err != nil {
+			var validationErr *config.ValidationError
+			if errors.As(err, &validationErr) {
+				writeError(w, model.NewAPIErrorWithDetails(
+					model.ErrInvalidConfig,
+					"New configuration rejected, current configuration is kept",
+					http.StatusBadRequest,
+					validationErr.Problems,
+				))
+				return
+			}
+			writeError(w, model.NewAPIError(model.ErrInternalError, err.Error(), http.StatusInternalServerError))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	}
+}
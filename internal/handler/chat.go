@@ -5,11 +5,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"pieces-os-go/internal/config"
+	"pieces-os-go/internal/logging"
 	"pieces-os-go/internal/model"
 	"pieces-os-go/internal/service"
+	"strconv"
 )
 
 type ChatHandler struct {
@@ -24,6 +26,11 @@ func NewChatHandler(cfg *config.Config) *ChatHandler {
 	}
 }
 
+// UpdateConfig 应用重载后的配置
+func (h *ChatHandler) UpdateConfig(cfg *config.Config) {
+	h.chatService.UpdateConfig(cfg)
+}
+
 func (h *ChatHandler) HandleCompletion(w http.ResponseWriter, r *http.Request) {
 	var req model.ChatCompletionRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -31,6 +38,7 @@ func (h *ChatHandler) HandleCompletion(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	applyTruncationHeader(r, &req)
 	if req.Stream {
 		h.handleStreamCompletion(w, r, &req)
 		return
@@ -54,25 +62,35 @@ func (h *ChatHandler) handleStreamCompletion(w http.ResponseWriter, r *http.Requ
 	}
 
 	stream, errChan := h.chatService.CreateCompletionStream(r.Context(), req)
+	setResponseHeaders(w, req)
+	written := false
+
+	// 尚未写入数据时以普通 HTTP 错误响应，便于客户端获取状态码和 Retry-After
+	fail := func(err error) {
+		apiErr := asAPIError(err)
+		if !written {
+			writeError(w, apiErr)
+			return
+		}
+		if err := writeSSEError(w, flusher, apiErr.Code, apiErr.Message); err != nil {
+			slog.WarnContext(r.Context(), "failed to write SSE error", "error", err)
+		}
+	}
 
 	for {
 		select {
 		case <-r.Context().Done():
 			// 处理连接关闭和上下文取消
-			log.Printf("Connection closed or context cancelled: %v", r.Context().Err())
+			slog.InfoContext(r.Context(), "client connection closed", "error", r.Context().Err())
 			return
 
-		case err := <-errChan:
+		case err, ok := <-errChan:
+			if !ok {
+				errChan = nil
+				continue
+			}
 			if err != nil {
-				if apiErr, ok := err.(*model.APIError); ok {
-					if err := writeSSEError(w, flusher, apiErr.Code, apiErr.Message); err != nil {
-						log.Printf("Failed to write SSE error: %v", err)
-					}
-				} else {
-					if err := writeSSEError(w, flusher, model.ErrInternalError, err.Error()); err != nil {
-						log.Printf("Failed to write SSE error: %v", err)
-					}
-				}
+				fail(err)
 				return
 			}
 
@@ -82,9 +100,13 @@ func (h *ChatHandler) handleStreamCompletion(w http.ResponseWriter, r *http.Requ
 				if r.Context().Err() != nil {
 					return
 				}
+				if err := pendingError(errChan); err != nil {
+					fail(err)
+					return
+				}
 				// 流正常结束
-				if err := writeSSEChunk(w, flusher, "[DONE]"); err != nil {
-					log.Printf("Failed to write final SSE chunk: %v", err)
+				if err := writeSSEDone(w, flusher); err != nil {
+					slog.WarnContext(r.Context(), "failed to write final SSE chunk", "error", err)
 				}
 				return
 			}
@@ -95,17 +117,28 @@ func (h *ChatHandler) handleStreamCompletion(w http.ResponseWriter, r *http.Requ
 					return
 				}
 				if err := writeSSEChunk(w, flusher, chunk); err != nil {
-					log.Printf("Failed to write SSE chunk: %v", err)
+					slog.WarnContext(r.Context(), "failed to write SSE chunk", "error", err)
 					return
 				}
+				written = true
 			}
 		}
 	}
 }
 
+// pendingError 在数据通道关闭后取出尚未处理的错误
+// 服务层总是先关闭错误通道再关闭数据通道，因此不会阻塞
+func pendingError(errChan <-chan error) error {
+	if errChan == nil {
+		return nil
+	}
+	return <-errChan
+}
+
 // 处理普通请求
 func (h *ChatHandler) handleNormalCompletion(w http.ResponseWriter, r *http.Request, req *model.ChatCompletionRequest) {
 	resp, err := h.chatService.CreateCompletion(r.Context(), req)
+	setResponseHeaders(w, req)
 	if err != nil {
 		if apiErr, ok := err.(*model.APIError); ok {
 			writeError(w, apiErr)
@@ -120,15 +153,54 @@ func (h *ChatHandler) handleNormalCompletion(w http.ResponseWriter, r *http.Requ
 
 // 辅助函数
 func writeError(w http.ResponseWriter, err *model.APIError) {
+	body := map[string]interface{}{
+		"message": err.Message,
+		"type":    "error",
+		"code":    err.Code,
+	}
+	if err.Details != nil {
+		body["details"] = err.Details
+	}
+
+	setRetryAfter(w, err)
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(err.Status)
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"error": map[string]interface{}{
-			"message": err.Message,
-			"type":    "error",
-			"code":    err.Code,
-		},
-	})
+	json.NewEncoder(w).Encode(withRequestID(w, map[string]interface{}{
+		"error": body,
+	}))
+}
+
+// applyTruncationHeader 请求头中的截断策略优先于请求体的 truncation 字段
+func applyTruncationHeader(r *http.Request, req *model.ChatCompletionRequest) {
+	if strategy := r.Header.Get(model.TruncationHeader); strategy != "" {
+		req.Truncation = strategy
+	}
+}
+
+// setResponseHeaders 在响应头中说明提示词的截断内容和已下线模型的转发目标，需在写入响应前调用
+func setResponseHeaders(w http.ResponseWriter, req *model.ChatCompletionRequest) {
+	if req.Truncated != nil {
+		w.Header().Set(model.TruncatedHeader, req.Truncated.String())
+	}
+	if req.Redirected != "" {
+		w.Header().Set(model.DeprecationHeader, "true")
+		w.Header().Set(model.ModelRedirectHeader, req.Redirected)
+	}
+}
+
+// withRequestID 在错误响应体中附加请求 ID，便于用户反馈问题时定位日志
+func withRequestID(w http.ResponseWriter, body map[string]interface{}) map[string]interface{} {
+	if id := w.Header().Get(logging.RequestIDHeader); id != "" {
+		body["request_id"] = id
+	}
+	return body
+}
+
+// setRetryAfter 错误带有重试等待时间时设置 Retry-After 响应头
+func setRetryAfter(w http.ResponseWriter, err *model.APIError) {
+	if seconds := err.RetryAfterSeconds(); seconds > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	}
 }
 
 // 修改辅助函数，增加错误返回
@@ -137,12 +209,12 @@ func writeSSEError(w http.ResponseWriter, flusher http.Flusher, code model.Error
 		return fmt.Errorf("flusher is nil")
 	}
 
-	errResp := map[string]interface{}{
+	errResp := withRequestID(w, map[string]interface{}{
 		"error": map[string]interface{}{
 			"message": message,
 			"code":    code,
 		},
-	}
+	})
 	data, err := json.Marshal(errResp)
 	if err != nil {
 		return fmt.Errorf("failed to marshal error response: %v", err)
@@ -175,6 +247,20 @@ func writeSSEChunk(w http.ResponseWriter, flusher http.Flusher, chunk interface{
 	return nil
 }
 
+// writeSSEDone 写入 OpenAI 流式响应的结束标记，标记本身不是 JSON
+func writeSSEDone(w http.ResponseWriter, flusher http.Flusher) error {
+	if flusher == nil {
+		return fmt.Errorf("flusher is nil, cannot write SSE chunk")
+	}
+
+	if _, err := fmt.Fprint(w, "data: [DONE]\n\n"); err != nil {
+		return err
+	}
+
+	flusher.Flush()
+	return nil
+}
+
 func writeJSON(w http.ResponseWriter, status int, v interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
@@ -182,27 +268,32 @@ func writeJSON(w http.ResponseWriter, status int, v interface{}) {
 }
 
 // WithModel 包装处理函数，为请求预设模型
+// 只改写请求体中的 model 字段，其余字段原样转发，避免 tool_choice、内容片段等经过结构体重新编码后改变
 func WithModel(h http.HandlerFunc, modelName string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		var req model.ChatCompletionRequest
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		var fields map[string]json.RawMessage
+		if err := json.NewDecoder(r.Body).Decode(&fields); err != nil {
+			writeError(w, model.NewAPIError(model.ErrInvalidRequest, err.Error(), http.StatusBadRequest))
 			return
 		}
+		if fields == nil {
+			fields = make(map[string]json.RawMessage)
+		}
 
 		// 如果请求体中没有指定模型或模型不合法，使用URL中的模型
-		if req.Model == "" || !model.IsModelSupported(model.NormalizeModelName(req.Model)) {
-			req.Model = modelName
+		var reqModel string
+		if raw, ok := fields["model"]; ok {
+			json.Unmarshal(raw, &reqModel)
+		}
+		if reqModel == "" || !model.IsModelSupported(model.NormalizeModelName(reqModel)) {
+			encoded, _ := json.Marshal(modelName)
+			fields["model"] = encoded
 		}
 
 		// 重新编码请求体
-		newBody, err := json.Marshal(req)
+		newBody, err := json.Marshal(fields)
 		if err != nil {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(map[string]string{"error": "无法处理请求"})
+			writeError(w, model.NewAPIError(model.ErrInternalError, "Failed to rewrite request body", http.StatusInternalServerError))
 			return
 		}
 
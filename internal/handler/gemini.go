@@ -0,0 +1,301 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"pieces-os-go/internal/model"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// HandleGemini 处理 Gemini 的 generateContent / streamGenerateContent 请求
+// 路由格式为 /v1beta/models/{model}:{action}
+func (h *ChatHandler) HandleGemini(w http.ResponseWriter, r *http.Request) {
+	modelName, action, ok := strings.Cut(chi.URLParam(r, "modelAction"), ":")
+	if !ok || modelName == "" {
+		writeGeminiError(w, model.NewAPIError(model.ErrRouteNotFound, "Requested path not found", http.StatusNotFound))
+		return
+	}
+	if action != model.GeminiActionGenerateContent && action != model.GeminiActionStreamGenerateContent {
+		writeGeminiError(w, model.NewAPIError(model.ErrRouteNotFound, fmt.Sprintf("Unsupported method '%s'", action), http.StatusNotFound))
+		return
+	}
+
+	var req model.GeminiGenerateContentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeGeminiError(w, model.NewAPIError(model.ErrInvalidRequest, err.Error(), http.StatusBadRequest))
+		return
+	}
+
+	chatReq, apiErr := buildChatRequestFromGemini(&req, modelName)
+	if apiErr != nil {
+		writeGeminiError(w, apiErr)
+		return
+	}
+
+	applyTruncationHeader(r, chatReq)
+	if action == model.GeminiActionStreamGenerateContent {
+		chatReq.Stream = true
+		h.handleGeminiStream(w, r, chatReq, modelName, r.URL.Query().Get("alt") == "sse")
+		return
+	}
+
+	resp, err := h.chatService.CreateCompletion(r.Context(), chatReq)
+	setResponseHeaders(w, chatReq)
+	if err != nil {
+		writeGeminiError(w, asAPIError(err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, buildGeminiResponse(resp, modelName))
+}
+
+// 处理 Gemini 流式请求
+// alt=sse 时按 SSE 输出，否则与官方接口一致输出逐步写入的 JSON 数组
+func (h *ChatHandler) handleGeminiStream(w http.ResponseWriter, r *http.Request, chatReq *model.ChatCompletionRequest, modelName string, sse bool) {
+	flusher, ok := w.(http.Flusher)
+	if !ok || flusher == nil {
+		writeGeminiError(w, model.NewAPIError(model.ErrInternalError, "Streaming not supported", http.StatusInternalServerError))
+		return
+	}
+
+	stream, errChan := h.chatService.CreateCompletionStream(r.Context(), chatReq)
+	setResponseHeaders(w, chatReq)
+	written := 0
+
+	writeChunk := func(chunk *model.GeminiGenerateContentResponse) error {
+		data, err := json.Marshal(chunk)
+		if err != nil {
+			return err
+		}
+
+		if written == 0 {
+			if sse {
+				w.Header().Set("Content-Type", "text/event-stream")
+				w.Header().Set("Cache-Control", "no-cache")
+				w.Header().Set("Connection", "keep-alive")
+			} else {
+				w.Header().Set("Content-Type", "application/json")
+			}
+		}
+
+		switch {
+		case sse:
+			_, err = fmt.Fprintf(w, "data: %s\r\n\r\n", data)
+		case written == 0:
+			_, err = fmt.Fprintf(w, "[%s", data)
+		default:
+			_, err = fmt.Fprintf(w, ",\r\n%s", data)
+		}
+		if err != nil {
+			return err
+		}
+
+		written++
+		flusher.Flush()
+		return nil
+	}
+
+	fail := func(err error) {
+		apiErr := asAPIError(err)
+		if written == 0 {
+			writeGeminiError(w, apiErr)
+			return
+		}
+		data, _ := json.Marshal(geminiErrorBody(w, apiErr))
+		if sse {
+			fmt.Fprintf(w, "data: %s\r\n\r\n", data)
+		} else {
+			fmt.Fprintf(w, ",\r\n%s]", data)
+		}
+		flusher.Flush()
+	}
+
+	for {
+		select {
+		case <-r.Context().Done():
+			slog.InfoContext(r.Context(), "client connection closed", "error", r.Context().Err())
+			return
+
+		case err, ok := <-errChan:
+			if !ok {
+				errChan = nil
+				continue
+			}
+			if err == nil {
+				continue
+			}
+			fail(err)
+			return
+
+		case chunk, ok := <-stream:
+			if !ok {
+				if r.Context().Err() != nil {
+					return
+				}
+				if err := pendingError(errChan); err != nil {
+					fail(err)
+					return
+				}
+				if written == 0 {
+					if err := writeChunk(&model.GeminiGenerateContentResponse{ModelVersion: modelName}); err != nil {
+						slog.WarnContext(r.Context(), "failed to write final SSE chunk", "error", err)
+						return
+					}
+				}
+				if !sse {
+					fmt.Fprint(w, "]")
+					flusher.Flush()
+				}
+				return
+			}
+
+			if chunk == nil {
+				continue
+			}
+			if err := writeChunk(buildGeminiStreamChunk(chunk, modelName)); err != nil {
+				slog.WarnContext(r.Context(), "failed to write SSE chunk", "error", err)
+				return
+			}
+		}
+	}
+}
+
+// buildChatRequestFromGemini 将 Gemini 请求转换为内部统一的聊天补全请求
+func buildChatRequestFromGemini(req *model.GeminiGenerateContentRequest, modelName string) (*model.ChatCompletionRequest, *model.APIError) {
+	if len(req.Contents) == 0 {
+		return nil, model.NewAPIError(model.ErrInvalidRequest, "contents is not specified", http.StatusBadRequest)
+	}
+
+	chatReq := &model.ChatCompletionRequest{
+		Model:    modelName,
+		Messages: make([]model.ChatMessage, 0, len(req.Contents)+1),
+	}
+	if cfg := req.GenerationConfig; cfg != nil {
+		if cfg.CandidateCount > 1 {
+			return nil, model.NewAPIError(model.ErrInvalidRequest, "generationConfig.candidateCount: only 1 candidate is supported", http.StatusBadRequest)
+		}
+		if cfg.Temperature != nil {
+			chatReq.Temperature = *cfg.Temperature
+		}
+		if cfg.TopP != nil {
+			chatReq.TopP = *cfg.TopP
+		}
+		chatReq.MaxTokens = cfg.MaxOutputTokens
+		chatReq.Stop = cfg.StopSequences
+	}
+
+	if req.SystemInstruction != nil {
+		system, err := req.SystemInstruction.Text()
+		if err != nil {
+			return nil, model.NewAPIError(model.ErrInvalidRequest, "systemInstruction."+err.Error(), http.StatusBadRequest)
+		}
+		chatReq.Messages = append(chatReq.Messages, model.ChatMessage{Role: model.RoleSystem, Content: system})
+	}
+
+	for i, content := range req.Contents {
+		var role model.Role
+		switch content.Role {
+		case "", model.GeminiRoleUser:
+			role = model.RoleUser
+		case model.GeminiRoleModel:
+			role = model.RoleAssistant
+		default:
+			return nil, model.NewAPIError(model.ErrInvalidRequest,
+				fmt.Sprintf("contents[%d].role: must be 'user' or 'model'", i), http.StatusBadRequest)
+		}
+
+		text, err := content.Text()
+		if err != nil {
+			return nil, model.NewAPIError(model.ErrInvalidRequest,
+				fmt.Sprintf("contents[%d].%s", i, err.Error()), http.StatusBadRequest)
+		}
+		chatReq.Messages = append(chatReq.Messages, model.ChatMessage{Role: role, Content: text})
+	}
+
+	return chatReq, nil
+}
+
+// buildGeminiResponse 将内部聊天补全响应转换为 Gemini 格式
+func buildGeminiResponse(resp *model.ChatCompletionResponse, modelName string) *model.GeminiGenerateContentResponse {
+	candidates := make([]*model.GeminiCandidate, 0, len(resp.Choices))
+	for _, choice := range resp.Choices {
+		var text string
+		if choice.Message != nil {
+			text = choice.Message.Content
+		}
+		candidates = append(candidates, &model.GeminiCandidate{
+			Content: &model.GeminiContent{
+				Role:  model.GeminiRoleModel,
+				Parts: []model.GeminiPart{{Text: text}},
+			},
+			FinishReason: model.GeminiFinishReason(choice.FinishReason),
+			Index:        choice.Index,
+		})
+	}
+
+	return &model.GeminiGenerateContentResponse{
+		Candidates:    candidates,
+		UsageMetadata: geminiUsage(resp.Usage),
+		ModelVersion:  modelName,
+	}
+}
+
+// buildGeminiStreamChunk 将内部流式数据块转换为 Gemini 格式
+func buildGeminiStreamChunk(chunk *model.ChatCompletionStreamResponse, modelName string) *model.GeminiGenerateContentResponse {
+	candidates := make([]*model.GeminiCandidate, 0, len(chunk.Choices))
+	for _, choice := range chunk.Choices {
+		var text string
+		if choice.Delta != nil {
+			text = choice.Delta.Content
+		}
+		candidate := &model.GeminiCandidate{
+			Content: &model.GeminiContent{
+				Role:  model.GeminiRoleModel,
+				Parts: []model.GeminiPart{{Text: text}},
+			},
+			Index: choice.Index,
+		}
+		if choice.FinishReason != "" {
+			candidate.FinishReason = model.GeminiFinishReason(choice.FinishReason)
+		}
+		candidates = append(candidates, candidate)
+	}
+
+	return &model.GeminiGenerateContentResponse{
+		Candidates:    candidates,
+		UsageMetadata: geminiUsage(chunk.Usage),
+		ModelVersion:  modelName,
+	}
+}
+
+func geminiUsage(usage *model.Usage) *model.GeminiUsageMetadata {
+	if usage == nil {
+		return nil
+	}
+	return &model.GeminiUsageMetadata{
+		PromptTokenCount:     usage.PromptTokens,
+		CandidatesTokenCount: usage.CompletionTokens,
+		TotalTokenCount:      usage.TotalTokens,
+	}
+}
+
+// geminiErrorBody 构造 Google API 格式的错误响应体
+func geminiErrorBody(w http.ResponseWriter, err *model.APIError) map[string]interface{} {
+	return withRequestID(w, map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    err.Status,
+			"message": err.Message,
+			"status":  model.GeminiErrorStatus(err.Status),
+		},
+	})
+}
+
+// writeGeminiError 以 Google API 格式写入错误响应
+func writeGeminiError(w http.ResponseWriter, err *model.APIError) {
+	setRetryAfter(w, err)
+	writeJSON(w, err.Status, geminiErrorBody(w, err))
+}
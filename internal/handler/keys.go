@@ -0,0 +1,183 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"pieces-os-go/internal/config"
+	"pieces-os-go/internal/keystore"
+	"pieces-os-go/internal/model"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// KeysHandler 客户端密钥管理接口
+type KeysHandler struct {
+	keys *keystore.Store
+}
+
+func NewKeysHandler(keys *keystore.Store) *KeysHandler {
+	return &KeysHandler{keys: keys}
+}
+
+// keyView 管理接口返回的密钥信息，不包含密钥摘要
+type keyView struct {
+	ID            string                   `json:"id"`
+	Name          string                   `json:"name"`
+	AllowedModels []string                 `json:"allowed_models,omitempty"`
+	AllowedRoutes []string                 `json:"allowed_routes,omitempty"`
+	ExpiresAt     *time.Time               `json:"expires_at,omitempty"`
+	Enabled       bool                     `json:"enabled"`
+	Quota         keystore.Quota           `json:"quota"`
+	DisableAudit  bool                     `json:"disable_audit,omitempty"`
+	Truncation    model.TruncationStrategy `json:"truncation,omitempty"`
+	CreatedAt     time.Time                `json:"created_at"`
+	UsageToday    struct {
+		Requests int   `json:"requests"`
+		Tokens   int64 `json:"tokens"`
+	} `json:"usage_today"`
+	Secret string `json:"secret,omitempty"` // 明文密钥，仅在创建和轮换时返回一次
+}
+
+func newKeyView(k *keystore.Key, secret string) keyView {
+	v := keyView{
+		ID:            k.ID,
+		Name:          k.Name,
+		AllowedModels: k.AllowedModels,
+		AllowedRoutes: k.AllowedRoutes,
+		ExpiresAt:     k.ExpiresAt,
+		Enabled:       k.Enabled,
+		Quota:         k.Quota,
+		DisableAudit:  k.DisableAudit,
+		Truncation:    k.Truncation,
+		CreatedAt:     k.CreatedAt,
+		Secret:        secret,
+	}
+	v.UsageToday.Requests, v.UsageToday.Tokens = k.UsageToday(time.Now())
+	return v
+}
+
+// List 列出所有密钥
+func (h *KeysHandler) List(w http.ResponseWriter, r *http.Request) {
+	views := []keyView{}
+	for _, k := range h.keys.List() {
+		views = append(views, newKeyView(k, ""))
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"keys": views})
+}
+
+// Get 查询单个密钥
+func (h *KeysHandler) Get(w http.ResponseWriter, r *http.Request) {
+	k, err := h.keys.Get(chi.URLParam(r, "id"))
+	if err != nil {
+		writeError(w, keyStoreError(err))
+		return
+	}
+	writeJSON(w, http.StatusOK, newKeyView(k, ""))
+}
+
+// Create 创建密钥，响应中包含仅返回一次的明文密钥
+func (h *KeysHandler) Create(w http.ResponseWriter, r *http.Request) {
+	var spec keystore.KeySpec
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&spec); err != nil {
+		writeError(w, model.NewAPIError(model.ErrInvalidRequest, err.Error(), http.StatusBadRequest))
+		return
+	}
+	if apiErr := validateKeySpec(&spec); apiErr != nil {
+		writeError(w, apiErr)
+		return
+	}
+
+	k, secret, err := h.keys.Create(spec)
+	if err != nil {
+		writeError(w, keyStoreError(err))
+		return
+	}
+	writeJSON(w, http.StatusCreated, newKeyView(k, secret))
+}
+
+// Rotate 轮换密钥，旧的明文密钥立即失效
+func (h *KeysHandler) Rotate(w http.ResponseWriter, r *http.Request) {
+	k, secret, err := h.keys.Rotate(chi.URLParam(r, "id"))
+	if err != nil {
+		writeError(w, keyStoreError(err))
+		return
+	}
+	writeJSON(w, http.StatusOK, newKeyView(k, secret))
+}
+
+// Disable 禁用密钥
+func (h *KeysHandler) Disable(w http.ResponseWriter, r *http.Request) {
+	h.setEnabled(w, r, false)
+}
+
+// Enable 重新启用密钥
+func (h *KeysHandler) Enable(w http.ResponseWriter, r *http.Request) {
+	h.setEnabled(w, r, true)
+}
+
+func (h *KeysHandler) setEnabled(w http.ResponseWriter, r *http.Request, enabled bool) {
+	k, err := h.keys.SetEnabled(chi.URLParam(r, "id"), enabled)
+	if err != nil {
+		writeError(w, keyStoreError(err))
+		return
+	}
+	writeJSON(w, http.StatusOK, newKeyView(k, ""))
+}
+
+// Delete 删除密钥
+func (h *KeysHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	if err := h.keys.Delete(chi.URLParam(r, "id")); err != nil {
+		writeError(w, keyStoreError(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// validateKeySpec 校验创建密钥的参数
+func validateKeySpec(spec *keystore.KeySpec) *model.APIError {
+	spec.Name = strings.TrimSpace(spec.Name)
+	if spec.Name == "" {
+		return model.NewAPIError(model.ErrInvalidRequest, "name is required", http.StatusBadRequest)
+	}
+	for _, m := range spec.AllowedModels {
+		if !strings.HasSuffix(m, "*") && !model.IsModelSupported(m) {
+			return model.NewAPIError(model.ErrInvalidRequest, fmt.Sprintf("allowed_models: model '%s' does not exist", m), http.StatusBadRequest)
+		}
+	}
+	for _, route := range spec.AllowedRoutes {
+		known := false
+		for _, name := range config.KnownRoutes {
+			known = known || route == name
+		}
+		if !known {
+			return model.NewAPIError(model.ErrInvalidRequest,
+				fmt.Sprintf("allowed_routes: unknown route '%s', must be one of %s", route, strings.Join(config.KnownRoutes, ", ")),
+				http.StatusBadRequest)
+		}
+	}
+	if spec.ExpiresAt != nil && !spec.ExpiresAt.After(time.Now()) {
+		return model.NewAPIError(model.ErrInvalidRequest, "expires_at must be in the future", http.StatusBadRequest)
+	}
+	if _, err := model.ParseTruncationStrategy(string(spec.Truncation)); err != nil {
+		return model.NewAPIError(model.ErrInvalidRequest, "truncation: "+err.Error(), http.StatusBadRequest)
+	}
+	if spec.Quota.RequestsPerDay < 0 || spec.Quota.TokensPerDay < 0 || spec.Quota.TokensPerMinute < 0 || spec.Quota.MaxConcurrent < 0 {
+		return model.NewAPIError(model.ErrInvalidRequest, "quota values must not be negative", http.StatusBadRequest)
+	}
+	return nil
+}
+
+func keyStoreError(err error) *model.APIError {
+	switch {
+	case errors.Is(err, keystore.ErrKeyNotFound):
+		return model.NewAPIError(model.ErrDataNotFound, err.Error(), http.StatusNotFound)
+	default:
+		return model.NewAPIError(model.ErrInternalError, err.Error(), http.StatusInternalServerError)
+	}
+}
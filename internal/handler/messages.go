@@ -0,0 +1,328 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"pieces-os-go/internal/model"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// HandleMessages 处理 Anthropic Messages API 请求
+func (h *ChatHandler) HandleMessages(w http.ResponseWriter, r *http.Request) {
+	var req model.AnthropicMessagesRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeAnthropicError(w, model.NewAPIError(model.ErrInvalidRequest, err.Error(), http.StatusBadRequest))
+		return
+	}
+
+	chatReq, apiErr := buildChatRequestFromAnthropic(&req)
+	if apiErr != nil {
+		writeAnthropicError(w, apiErr)
+		return
+	}
+
+	applyTruncationHeader(r, chatReq)
+	if req.Stream {
+		h.handleMessagesStream(w, r, &req, chatReq)
+		return
+	}
+
+	resp, err := h.chatService.CreateCompletion(r.Context(), chatReq)
+	setResponseHeaders(w, chatReq)
+	if err != nil {
+		writeAnthropicError(w, asAPIError(err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, buildAnthropicResponse(resp, req.Model))
+}
+
+// 处理 Anthropic 流式请求
+func (h *ChatHandler) handleMessagesStream(w http.ResponseWriter, r *http.Request, req *model.AnthropicMessagesRequest, chatReq *model.ChatCompletionRequest) {
+	flusher, ok := w.(http.Flusher)
+	if !ok || flusher == nil {
+		writeAnthropicError(w, model.NewAPIError(model.ErrInternalError, "Streaming not supported", http.StatusInternalServerError))
+		return
+	}
+
+	inputTokens := h.chatService.CountPromptTokens(chatReq)
+	stream, errChan := h.chatService.CreateCompletionStream(r.Context(), chatReq)
+	setResponseHeaders(w, chatReq)
+	if chatReq.Truncated != nil {
+		inputTokens = chatReq.Truncated.PromptTokens
+	}
+
+	messageID := generateAnthropicMessageID()
+	blockIndex := 0
+	outputTokens := 0
+	stopReason := model.AnthropicStopEndTurn
+	var stopSequence *string
+	started := false
+
+	// 收到第一个数据块后再写入 SSE 头，以便上游立即失败时仍可返回普通错误响应
+	start := func() error {
+		started = true
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+
+		events := []model.AnthropicStreamEvent{
+			{
+				Type: model.AnthropicEventMessageStart,
+				Message: &model.AnthropicMessagesResponse{
+					ID:      messageID,
+					Type:    "message",
+					Role:    model.RoleAssistant,
+					Content: []model.AnthropicContentBlock{},
+					Model:   req.Model,
+					Usage:   &model.AnthropicUsage{InputTokens: inputTokens},
+				},
+			},
+			{
+				Type:         model.AnthropicEventContentBlockStart,
+				Index:        &blockIndex,
+				ContentBlock: &model.AnthropicContentBlock{Type: model.AnthropicBlockText},
+			},
+			{Type: model.AnthropicEventPing},
+		}
+		for _, event := range events {
+			if err := writeAnthropicEvent(w, flusher, event.Type, event); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	fail := func(err error) {
+		apiErr := asAPIError(err)
+		if !started {
+			writeAnthropicError(w, apiErr)
+			return
+		}
+		if err := writeAnthropicEvent(w, flusher, model.AnthropicEventError, anthropicErrorBody(w, apiErr)); err != nil {
+			slog.WarnContext(r.Context(), "failed to write SSE error", "error", err)
+		}
+	}
+
+	for {
+		select {
+		case <-r.Context().Done():
+			slog.InfoContext(r.Context(), "client connection closed", "error", r.Context().Err())
+			return
+
+		case err, ok := <-errChan:
+			if !ok {
+				errChan = nil
+				continue
+			}
+			if err == nil {
+				continue
+			}
+			fail(err)
+			return
+
+		case chunk, ok := <-stream:
+			if !ok {
+				if r.Context().Err() != nil {
+					return
+				}
+				if err := pendingError(errChan); err != nil {
+					fail(err)
+					return
+				}
+				if !started {
+					if err := start(); err != nil {
+						slog.WarnContext(r.Context(), "failed to write SSE chunk", "error", err)
+						return
+					}
+				}
+
+				events := []model.AnthropicStreamEvent{
+					{Type: model.AnthropicEventContentBlockStop, Index: &blockIndex},
+					{
+						Type:  model.AnthropicEventMessageDelta,
+						Delta: &model.AnthropicStreamDelta{StopReason: &stopReason, StopSequence: stopSequence},
+						Usage: &model.AnthropicUsage{OutputTokens: outputTokens},
+					},
+					{Type: model.AnthropicEventMessageStop},
+				}
+				for _, event := range events {
+					if err := writeAnthropicEvent(w, flusher, event.Type, event); err != nil {
+						slog.WarnContext(r.Context(), "failed to write final SSE chunk", "error", err)
+						return
+					}
+				}
+				return
+			}
+
+			if chunk == nil {
+				continue
+			}
+			if !started {
+				if err := start(); err != nil {
+					slog.WarnContext(r.Context(), "failed to write SSE chunk", "error", err)
+					return
+				}
+			}
+
+			for _, choice := range chunk.Choices {
+				if choice.Delta != nil && choice.Delta.Content != "" {
+					event := model.AnthropicStreamEvent{
+						Type:  model.AnthropicEventContentBlockDelta,
+						Index: &blockIndex,
+						Delta: &model.AnthropicStreamDelta{Type: "text_delta", Text: choice.Delta.Content},
+					}
+					if err := writeAnthropicEvent(w, flusher, event.Type, event); err != nil {
+						slog.WarnContext(r.Context(), "failed to write SSE chunk", "error", err)
+						return
+					}
+				}
+				if choice.FinishReason != "" {
+					stopReason = model.AnthropicStopReason(choice.FinishReason, choice.StopSequence)
+					stopSequence = optionalString(choice.StopSequence)
+				}
+			}
+			if chunk.Usage != nil {
+				outputTokens = chunk.Usage.CompletionTokens
+			}
+		}
+	}
+}
+
+// buildChatRequestFromAnthropic 将 Anthropic 请求转换为内部统一的聊天补全请求
+func buildChatRequestFromAnthropic(req *model.AnthropicMessagesRequest) (*model.ChatCompletionRequest, *model.APIError) {
+	if req.Model == "" {
+		return nil, model.NewAPIError(model.ErrInvalidRequest, "model: field required", http.StatusBadRequest)
+	}
+	if req.MaxTokens <= 0 {
+		return nil, model.NewAPIError(model.ErrInvalidRequest, "max_tokens: must be greater than 0", http.StatusBadRequest)
+	}
+	if len(req.Messages) == 0 {
+		return nil, model.NewAPIError(model.ErrInvalidRequest, "messages: at least one message is required", http.StatusBadRequest)
+	}
+
+	chatReq := &model.ChatCompletionRequest{
+		Model:     req.Model,
+		Messages:  make([]model.ChatMessage, 0, len(req.Messages)+1),
+		Stream:    req.Stream,
+		MaxTokens: req.MaxTokens,
+		Stop:      req.StopSequences,
+	}
+	if req.Temperature != nil {
+		chatReq.Temperature = *req.Temperature
+	}
+	if req.TopP != nil {
+		chatReq.TopP = *req.TopP
+	}
+
+	if len(req.System) > 0 {
+		system, err := req.System.Text()
+		if err != nil {
+			return nil, model.NewAPIError(model.ErrInvalidRequest, "system: "+err.Error(), http.StatusBadRequest)
+		}
+		chatReq.Messages = append(chatReq.Messages, model.ChatMessage{Role: model.RoleSystem, Content: system})
+	}
+
+	for i, msg := range req.Messages {
+		if msg.Role != model.RoleUser && msg.Role != model.RoleAssistant {
+			return nil, model.NewAPIError(model.ErrInvalidRequest,
+				fmt.Sprintf("messages.%d.role: must be 'user' or 'assistant'", i), http.StatusBadRequest)
+		}
+		content, err := msg.Content.Text()
+		if err != nil {
+			return nil, model.NewAPIError(model.ErrInvalidRequest,
+				fmt.Sprintf("messages.%d.content: %s", i, err.Error()), http.StatusBadRequest)
+		}
+		chatReq.Messages = append(chatReq.Messages, model.ChatMessage{Role: msg.Role, Content: content})
+	}
+
+	return chatReq, nil
+}
+
+// buildAnthropicResponse 将内部聊天补全响应转换为 Anthropic 格式
+func buildAnthropicResponse(resp *model.ChatCompletionResponse, modelName string) *model.AnthropicMessagesResponse {
+	var text string
+	stopReason := model.AnthropicStopEndTurn
+	var stopSequence *string
+	if len(resp.Choices) > 0 && resp.Choices[0].Message != nil {
+		text = resp.Choices[0].Message.Content
+		if resp.Choices[0].FinishReason != "" {
+			stopReason = model.AnthropicStopReason(resp.Choices[0].FinishReason, resp.Choices[0].StopSequence)
+			stopSequence = optionalString(resp.Choices[0].StopSequence)
+		}
+	}
+
+	usage := &model.AnthropicUsage{}
+	if resp.Usage != nil {
+		usage.InputTokens = resp.Usage.PromptTokens
+		usage.OutputTokens = resp.Usage.CompletionTokens
+	}
+
+	return &model.AnthropicMessagesResponse{
+		ID:           generateAnthropicMessageID(),
+		Type:         "message",
+		Role:         model.RoleAssistant,
+		Content:      []model.AnthropicContentBlock{{Type: model.AnthropicBlockText, Text: text}},
+		Model:        modelName,
+		StopReason:   &stopReason,
+		StopSequence: stopSequence,
+		Usage:        usage,
+	}
+}
+
+// optionalString 空字符串返回 nil，用于编码为 null 的可选字段
+func optionalString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+// generateAnthropicMessageID 生成 Anthropic 风格的消息 ID
+func generateAnthropicMessageID() string {
+	return "msg_" + strings.ReplaceAll(uuid.New().String(), "-", "")[:24]
+}
+
+// asAPIError 将任意错误转换为 APIError
+func asAPIError(err error) *model.APIError {
+	if apiErr, ok := err.(*model.APIError); ok {
+		return apiErr
+	}
+	return model.NewAPIError(model.ErrInternalError, err.Error(), http.StatusInternalServerError)
+}
+
+// anthropicErrorBody 构造 Anthropic 格式的错误响应体
+func anthropicErrorBody(w http.ResponseWriter, err *model.APIError) map[string]interface{} {
+	return withRequestID(w, map[string]interface{}{
+		"type": "error",
+		"error": map[string]interface{}{
+			"type":    model.AnthropicErrorType(err.Status),
+			"message": err.Message,
+		},
+	})
+}
+
+// writeAnthropicError 以 Anthropic 格式写入错误响应
+func writeAnthropicError(w http.ResponseWriter, err *model.APIError) {
+	setRetryAfter(w, err)
+	writeJSON(w, err.Status, anthropicErrorBody(w, err))
+}
+
+// writeAnthropicEvent 写入带事件名的 SSE 数据
+func writeAnthropicEvent(w http.ResponseWriter, flusher http.Flusher, event string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data); err != nil {
+		return err
+	}
+
+	flusher.Flush()
+	return nil
+}
@@ -17,6 +17,8 @@ func ListModels(w http.ResponseWriter, r *http.Request) {
 	for _, model := range model.SupportedModels {
 		models = append(models, model)
 	}
+	// 别名排在模型之后，以 alias_of 标明目标模型
+	models = append(models, model.AliasModels()...)
 
 	response := model.ModelsResponse{
 		Object: "list",
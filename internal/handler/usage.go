@@ -0,0 +1,165 @@
+package handler
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"pieces-os-go/internal/model"
+	"pieces-os-go/internal/usage"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	dateLayout          = "2006-01-02"
+	defaultUsageDays    = 30
+	groupByNone         = "none"
+	usageFormatJSON     = "json"
+	usageFormatCSV      = "csv"
+	defaultUsageGroupBy = "day,key,model"
+)
+
+// HandleUsage 查询用量，支持按日期范围、密钥和模型过滤，按维度汇总并导出为 JSON 或 CSV
+// 参数: from/to (YYYY-MM-DD，UTC，包含两端)、key、model、group_by (day,key,model 的组合或 none)、format (json/csv)
+func HandleUsage(store *usage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+
+		filter, apiErr := parseUsageRange(q.Get("from"), q.Get("to"))
+		if apiErr != nil {
+			writeError(w, apiErr)
+			return
+		}
+		filter.KeyID = q.Get("key")
+		filter.Model = q.Get("model")
+		if filter.Model != "" {
+			filter.Model = model.NormalizeModelName(filter.Model)
+		}
+
+		groupBy, apiErr := parseGroupBy(q.Get("group_by"))
+		if apiErr != nil {
+			writeError(w, apiErr)
+			return
+		}
+
+		format := q.Get("format")
+		if format == "" {
+			format = usageFormatJSON
+		}
+		if format != usageFormatJSON && format != usageFormatCSV {
+			writeError(w, model.NewAPIError(model.ErrInvalidRequest, "format must be json or csv", http.StatusBadRequest))
+			return
+		}
+
+		records, err := store.Query(filter)
+		if err != nil {
+			writeError(w, model.NewAPIError(model.ErrInternalError, err.Error(), http.StatusInternalServerError))
+			return
+		}
+
+		from := filter.From.Format(dateLayout)
+		to := filter.To.AddDate(0, 0, -1).Format(dateLayout)
+		if format == usageFormatCSV {
+			w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=usage_%s_%s.csv", from, to))
+			if groupBy == nil {
+				writeRecordsCSV(w, records)
+			} else {
+				writeSummaryCSV(w, usage.Aggregate(records, groupBy))
+			}
+			return
+		}
+
+		resp := map[string]interface{}{"from": from, "to": to}
+		if groupBy == nil {
+			resp["records"] = records
+		} else {
+			resp["group_by"] = groupBy
+			resp["summary"] = usage.Aggregate(records, groupBy)
+		}
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
+
+// parseUsageRange 解析日期范围，默认为截至今天的最近 30 天
+func parseUsageRange(fromStr, toStr string) (usage.Filter, *model.APIError) {
+	var f usage.Filter
+	to := time.Now().UTC().Truncate(24 * time.Hour)
+	if toStr != "" {
+		t, err := time.Parse(dateLayout, toStr)
+		if err != nil {
+			return f, model.NewAPIError(model.ErrInvalidRequest, "to must be a date in YYYY-MM-DD format", http.StatusBadRequest)
+		}
+		to = t
+	}
+	from := to.AddDate(0, 0, -(defaultUsageDays - 1))
+	if fromStr != "" {
+		t, err := time.Parse(dateLayout, fromStr)
+		if err != nil {
+			return f, model.NewAPIError(model.ErrInvalidRequest, "from must be a date in YYYY-MM-DD format", http.StatusBadRequest)
+		}
+		from = t
+	}
+	if from.After(to) {
+		return f, model.NewAPIError(model.ErrInvalidRequest, "from must not be after to", http.StatusBadRequest)
+	}
+
+	f.From = from
+	f.To = to.AddDate(0, 0, 1) // 包含结束日期当天
+	return f, nil
+}
+
+// parseGroupBy 解析聚合维度，返回 nil 表示导出原始记录
+func parseGroupBy(value string) ([]string, *model.APIError) {
+	if value == "" {
+		value = defaultUsageGroupBy
+	}
+	if value == groupByNone {
+		return nil, nil
+	}
+
+	groupBy := []string{}
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		known := false
+		for _, name := range usage.GroupFields {
+			known = known || field == name
+		}
+		if !known {
+			return nil, model.NewAPIError(model.ErrInvalidRequest,
+				fmt.Sprintf("group_by: unknown field '%s', must be a combination of %s or %s", field, strings.Join(usage.GroupFields, ", "), groupByNone),
+				http.StatusBadRequest)
+		}
+		groupBy = append(groupBy, field)
+	}
+	return groupBy, nil
+}
+
+func writeSummaryCSV(w http.ResponseWriter, summaries []usage.Summary) {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"day", "key_id", "key_name", "model", "requests", "stream_requests", "errors", "prompt_tokens", "completion_tokens", "total_tokens", "avg_latency_ms"})
+	for _, s := range summaries {
+		cw.Write([]string{
+			s.Day, s.KeyID, s.KeyName, s.Model,
+			strconv.Itoa(s.Requests), strconv.Itoa(s.StreamRequests), strconv.Itoa(s.Errors),
+			strconv.FormatInt(s.PromptTokens, 10), strconv.FormatInt(s.CompletionTokens, 10), strconv.FormatInt(s.TotalTokens, 10),
+			strconv.FormatInt(s.AvgLatencyMs, 10),
+		})
+	}
+	cw.Flush()
+}
+
+func writeRecordsCSV(w http.ResponseWriter, records []usage.Record) {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"time", "key_id", "key_name", "model", "route", "stream", "status", "prompt_tokens", "completion_tokens", "total_tokens", "latency_ms"})
+	for _, rec := range records {
+		cw.Write([]string{
+			rec.Time.UTC().Format(time.RFC3339Nano), rec.KeyID, rec.KeyName, rec.Model, rec.Route,
+			strconv.FormatBool(rec.Stream), strconv.Itoa(rec.Status),
+			strconv.Itoa(rec.PromptTokens), strconv.Itoa(rec.CompletionTokens), strconv.Itoa(rec.TotalTokens),
+			strconv.FormatInt(rec.LatencyMs, 10),
+		})
+	}
+	cw.Flush()
+}
@@ -0,0 +1,526 @@
+// Package jsonschema 实现结构化输出所需的 JSON Schema 子集校验
+// 支持 type、enum、const、properties、required、additionalProperties、items、
+// 长度和数值范围、pattern、anyOf/oneOf/allOf 以及指向 $defs/definitions 的本地 $ref，
+// 其余关键字（description、format 等）忽略
+package jsonschema
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// maxRefDepth $ref 的最大展开深度，避免自引用的定义无限递归
+const maxRefDepth = 64
+
+// Schema 编译后的 schema
+type Schema struct {
+	root *node
+	defs map[string]*node // "#/$defs/name" 或 "#/definitions/name" -> 定义
+}
+
+type node struct {
+	ref string
+
+	types    []string // 为空切片时不允许任何值
+	enum     []any
+	cnst     any
+	hasConst bool
+
+	properties           map[string]*node
+	required             []string
+	additionalProperties *node // 为 nil 时允许任意属性
+	noAdditional         bool  // additionalProperties: false
+	items                *node
+
+	minLength, maxLength *int
+	minItems, maxItems   *int
+	minimum, maximum     *float64
+	exclusiveMin         *float64
+	exclusiveMax         *float64
+	pattern              *regexp.Regexp
+
+	anyOf, oneOf, allOf []*node
+}
+
+// Compile 解析 schema，schema 格式不正确时返回错误
+func Compile(raw json.RawMessage) (*Schema, error) {
+	var doc any
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %v", err)
+	}
+
+	s := &Schema{defs: make(map[string]*node)}
+	if obj, ok := doc.(map[string]any); ok {
+		for _, key := range []string{"$defs", "definitions"} {
+			defs, ok := obj[key].(map[string]any)
+			if !ok {
+				continue
+			}
+			for name, def := range defs {
+				n, err := compileNode(def, key+"/"+name)
+				if err != nil {
+					return nil, err
+				}
+				s.defs["#/"+key+"/"+name] = n
+			}
+		}
+	}
+
+	root, err := compileNode(doc, "")
+	if err != nil {
+		return nil, err
+	}
+	s.root = root
+	if err := s.checkRefs(root, make(map[*node]bool)); err != nil {
+		return nil, err
+	}
+	for _, def := range s.defs {
+		if err := s.checkRefs(def, make(map[*node]bool)); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Validate 校验 JSON 文本，返回第一个不符合 schema 的位置
+func (s *Schema) Validate(data []byte) error {
+	var v any
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return fmt.Errorf("invalid JSON: %v", err)
+	}
+	if dec.More() {
+		return fmt.Errorf("invalid JSON: unexpected data after the top-level value")
+	}
+	return s.validate(s.root, v, "$", 0)
+}
+
+func compileNode(v any, path string) (*node, error) {
+	where := func() string {
+		if path == "" {
+			return "schema"
+		}
+		return "schema at " + path
+	}
+
+	if b, ok := v.(bool); ok {
+		// true 允许任意值，false 不允许任何值
+		if b {
+			return &node{}, nil
+		}
+		return &node{types: []string{}}, nil
+	}
+	obj, ok := v.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%s: must be an object", where())
+	}
+
+	n := &node{}
+	if ref, ok := obj["$ref"].(string); ok {
+		n.ref = ref
+	}
+
+	switch t := obj["type"].(type) {
+	case nil:
+	case string:
+		n.types = []string{t}
+	case []any:
+		n.types = make([]string, 0, len(t))
+		for _, item := range t {
+			name, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s: type must be a string or an array of strings", where())
+			}
+			n.types = append(n.types, name)
+		}
+	default:
+		return nil, fmt.Errorf("%s: type must be a string or an array of strings", where())
+	}
+	for _, t := range n.types {
+		switch t {
+		case "object", "array", "string", "number", "integer", "boolean", "null":
+		default:
+			return nil, fmt.Errorf("%s: unknown type '%s'", where(), t)
+		}
+	}
+
+	if enum, ok := obj["enum"]; ok {
+		values, ok := enum.([]any)
+		if !ok {
+			return nil, fmt.Errorf("%s: enum must be an array", where())
+		}
+		n.enum = values
+	}
+	if c, ok := obj["const"]; ok {
+		n.cnst, n.hasConst = c, true
+	}
+
+	if props, ok := obj["properties"]; ok {
+		m, ok := props.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("%s: properties must be an object", where())
+		}
+		n.properties = make(map[string]*node, len(m))
+		for name, prop := range m {
+			child, err := compileNode(prop, path+"/properties/"+name)
+			if err != nil {
+				return nil, err
+			}
+			n.properties[name] = child
+		}
+	}
+	if req, ok := obj["required"]; ok {
+		names, ok := req.([]any)
+		if !ok {
+			return nil, fmt.Errorf("%s: required must be an array of strings", where())
+		}
+		for _, name := range names {
+			s, ok := name.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s: required must be an array of strings", where())
+			}
+			n.required = append(n.required, s)
+		}
+	}
+	switch ap := obj["additionalProperties"].(type) {
+	case nil:
+	case bool:
+		n.noAdditional = !ap
+	default:
+		child, err := compileNode(ap, path+"/additionalProperties")
+		if err != nil {
+			return nil, err
+		}
+		n.additionalProperties = child
+	}
+	if items, ok := obj["items"]; ok {
+		child, err := compileNode(items, path+"/items")
+		if err != nil {
+			return nil, err
+		}
+		n.items = child
+	}
+
+	ints := []struct {
+		key string
+		dst **int
+	}{
+		{"minLength", &n.minLength}, {"maxLength", &n.maxLength},
+		{"minItems", &n.minItems}, {"maxItems", &n.maxItems},
+	}
+	for _, f := range ints {
+		if v, ok := obj[f.key]; ok {
+			num, ok := v.(json.Number)
+			i, err := strconv.Atoi(string(num))
+			if !ok || err != nil || i < 0 {
+				return nil, fmt.Errorf("%s: %s must be a non-negative integer", where(), f.key)
+			}
+			*f.dst = &i
+		}
+	}
+	floats := []struct {
+		key string
+		dst **float64
+	}{
+		{"minimum", &n.minimum}, {"maximum", &n.maximum},
+		{"exclusiveMinimum", &n.exclusiveMin}, {"exclusiveMaximum", &n.exclusiveMax},
+	}
+	for _, f := range floats {
+		if v, ok := obj[f.key]; ok {
+			num, ok := v.(json.Number)
+			x, err := num.Float64()
+			if !ok || err != nil {
+				return nil, fmt.Errorf("%s: %s must be a number", where(), f.key)
+			}
+			*f.dst = &x
+		}
+	}
+	if p, ok := obj["pattern"]; ok {
+		s, ok := p.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s: pattern must be a string", where())
+		}
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid pattern: %v", where(), err)
+		}
+		n.pattern = re
+	}
+
+	combos := []struct {
+		key string
+		dst *[]*node
+	}{
+		{"anyOf", &n.anyOf}, {"oneOf", &n.oneOf}, {"allOf", &n.allOf},
+	}
+	for _, c := range combos {
+		v, ok := obj[c.key]
+		if !ok {
+			continue
+		}
+		list, ok := v.([]any)
+		if !ok || len(list) == 0 {
+			return nil, fmt.Errorf("%s: %s must be a non-empty array", where(), c.key)
+		}
+		for i, item := range list {
+			child, err := compileNode(item, fmt.Sprintf("%s/%s/%d", path, c.key, i))
+			if err != nil {
+				return nil, err
+			}
+			*c.dst = append(*c.dst, child)
+		}
+	}
+	return n, nil
+}
+
+// checkRefs 确认所有 $ref 都指向已定义的 $defs 或 definitions
+func (s *Schema) checkRefs(n *node, seen map[*node]bool) error {
+	if n == nil || seen[n] {
+		return nil
+	}
+	seen[n] = true
+	if n.ref != "" && n.ref != "#" && s.defs[n.ref] == nil {
+		return fmt.Errorf("schema: unresolved $ref '%s', only '#', '#/$defs/...' and '#/definitions/...' are supported", n.ref)
+	}
+	children := []*node{n.additionalProperties, n.items}
+	for _, child := range n.properties {
+		children = append(children, child)
+	}
+	children = append(children, n.anyOf...)
+	children = append(children, n.oneOf...)
+	children = append(children, n.allOf...)
+	for _, child := range children {
+		if err := s.checkRefs(child, seen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Schema) validate(n *node, v any, path string, depth int) error {
+	if n.ref != "" {
+		if depth >= maxRefDepth {
+			return fmt.Errorf("%s: $ref nesting is too deep", path)
+		}
+		target := s.root
+		if n.ref != "#" {
+			target = s.defs[n.ref]
+		}
+		if err := s.validate(target, v, path, depth+1); err != nil {
+			return err
+		}
+	}
+
+	if n.types != nil && !matchesType(n.types, v) {
+		if len(n.types) == 0 {
+			return fmt.Errorf("%s: no value is allowed here", path)
+		}
+		return fmt.Errorf("%s: expected %s, got %s", path, strings.Join(n.types, " or "), typeOf(v))
+	}
+	if n.enum != nil {
+		found := false
+		for _, e := range n.enum {
+			if equal(e, v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: must be one of %s", path, compact(n.enum))
+		}
+	}
+	if n.hasConst && !equal(n.cnst, v) {
+		return fmt.Errorf("%s: must be %s", path, compact(n.cnst))
+	}
+
+	switch val := v.(type) {
+	case map[string]any:
+		for _, name := range n.required {
+			if _, ok := val[name]; !ok {
+				return fmt.Errorf("%s: missing required property '%s'", path, name)
+			}
+		}
+		names := make([]string, 0, len(val))
+		for name := range val {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			child := path + "." + name
+			if prop, ok := n.properties[name]; ok {
+				if err := s.validate(prop, val[name], child, depth); err != nil {
+					return err
+				}
+			} else if n.noAdditional {
+				return fmt.Errorf("%s: unexpected property '%s'", path, name)
+			} else if n.additionalProperties != nil {
+				if err := s.validate(n.additionalProperties, val[name], child, depth); err != nil {
+					return err
+				}
+			}
+		}
+
+	case []any:
+		if n.minItems != nil && len(val) < *n.minItems {
+			return fmt.Errorf("%s: must contain at least %d items", path, *n.minItems)
+		}
+		if n.maxItems != nil && len(val) > *n.maxItems {
+			return fmt.Errorf("%s: must contain at most %d items", path, *n.maxItems)
+		}
+		if n.items != nil {
+			for i, item := range val {
+				if err := s.validate(n.items, item, fmt.Sprintf("%s[%d]", path, i), depth); err != nil {
+					return err
+				}
+			}
+		}
+
+	case string:
+		length := len([]rune(val))
+		if n.minLength != nil && length < *n.minLength {
+			return fmt.Errorf("%s: must be at least %d characters", path, *n.minLength)
+		}
+		if n.maxLength != nil && length > *n.maxLength {
+			return fmt.Errorf("%s: must be at most %d characters", path, *n.maxLength)
+		}
+		if n.pattern != nil && !n.pattern.MatchString(val) {
+			return fmt.Errorf("%s: must match pattern %s", path, n.pattern)
+		}
+
+	case json.Number:
+		x, _ := val.Float64()
+		switch {
+		case n.minimum != nil && x < *n.minimum:
+			return fmt.Errorf("%s: must be >= %v", path, *n.minimum)
+		case n.maximum != nil && x > *n.maximum:
+			return fmt.Errorf("%s: must be <= %v", path, *n.maximum)
+		case n.exclusiveMin != nil && x <= *n.exclusiveMin:
+			return fmt.Errorf("%s: must be > %v", path, *n.exclusiveMin)
+		case n.exclusiveMax != nil && x >= *n.exclusiveMax:
+			return fmt.Errorf("%s: must be < %v", path, *n.exclusiveMax)
+		}
+	}
+
+	for _, sub := range n.allOf {
+		if err := s.validate(sub, v, path, depth); err != nil {
+			return err
+		}
+	}
+	if n.anyOf != nil {
+		var first error
+		for _, sub := range n.anyOf {
+			err := s.validate(sub, v, path, depth)
+			if err == nil {
+				first = nil
+				break
+			}
+			if first == nil {
+				first = err
+			}
+		}
+		if first != nil {
+			return fmt.Errorf("%s: does not match any of the allowed schemas (first mismatch: %v)", path, first)
+		}
+	}
+	if n.oneOf != nil {
+		matched := 0
+		for _, sub := range n.oneOf {
+			if s.validate(sub, v, path, depth) == nil {
+				matched++
+			}
+		}
+		if matched != 1 {
+			return fmt.Errorf("%s: must match exactly one of the allowed schemas, matched %d", path, matched)
+		}
+	}
+	return nil
+}
+
+func matchesType(types []string, v any) bool {
+	actual := typeOf(v)
+	for _, t := range types {
+		if t == actual || (t == "number" && actual == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+// typeOf 返回值的 JSON 类型，没有小数部分的数字为 integer
+func typeOf(v any) string {
+	switch val := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case json.Number:
+		if x, err := val.Float64(); err == nil && x == math.Trunc(x) && !math.IsInf(x, 0) {
+			return "integer"
+		}
+		return "number"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// equal 比较两个 JSON 值，数字按数值比较
+func equal(a, b any) bool {
+	if x, ok := a.(json.Number); ok {
+		y, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		fx, errx := x.Float64()
+		fy, erry := y.Float64()
+		return errx == nil && erry == nil && fx == fy
+	}
+	switch x := a.(type) {
+	case []any:
+		y, ok := b.([]any)
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for i := range x {
+			if !equal(x[i], y[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]any:
+		y, ok := b.(map[string]any)
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for k, xv := range x {
+			yv, ok := y[k]
+			if !ok || !equal(xv, yv) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func compact(v any) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
@@ -0,0 +1,477 @@
+// Package keystore 管理客户端 API 密钥，密钥以 SHA-256 摘要形式保存在 JSON 文件中
+package keystore
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"pieces-os-go/internal/model"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrKeyNotFound          = errors.New("API key not found")
+	ErrNoKeysFile           = errors.New("keys file is not configured")
+	ErrKeyDisabled          = errors.New("API key is disabled")
+	ErrKeyExpired           = errors.New("API key has expired")
+	ErrRequestQuotaExceeded = errors.New("daily request quota exceeded")
+	ErrTokenQuotaExceeded   = errors.New("daily token quota exceeded")
+)
+
+// Quota 配额，0 表示不限制，每日配额按 UTC 自然日重置
+type Quota struct {
+	RequestsPerDay  int   `json:"requests_per_day,omitempty"`
+	TokensPerDay    int64 `json:"tokens_per_day,omitempty"`
+	TokensPerMinute int   `json:"tokens_per_minute,omitempty"` // 覆盖配置中的 token_limits.per_key
+	MaxConcurrent   int   `json:"max_concurrent,omitempty"`    // 覆盖配置中的 concurrency.per_key
+}
+
+// Key 客户端 API 密钥
+type Key struct {
+	ID            string                   `json:"id"`
+	Name          string                   `json:"name"`
+	SecretHash    string                   `json:"secret_hash"`              // 密钥的 SHA-256 十六进制摘要
+	AllowedModels []string                 `json:"allowed_models,omitempty"` // 允许使用的模型，支持 * 后缀通配，为空表示不限制
+	AllowedRoutes []string                 `json:"allowed_routes,omitempty"` // 允许访问的路由名称，为空表示不限制
+	ExpiresAt     *time.Time               `json:"expires_at,omitempty"`
+	Enabled       bool                     `json:"enabled"`
+	Quota         Quota                    `json:"quota"`
+	DisableAudit  bool                     `json:"disable_audit,omitempty"` // 不记录该密钥的审计日志
+	Truncation    model.TruncationStrategy `json:"truncation,omitempty"`    // 提示词超出模型输入上限时的截断策略
+	CreatedAt     time.Time                `json:"created_at"`
+
+	usage *usage // 当日用量，重载后按 ID 沿用
+}
+
+type usage struct {
+	mu       sync.Mutex
+	day      string
+	requests int
+	tokens   int64
+}
+
+// reset 跨天时清零，调用方需持有锁
+func (u *usage) reset(now time.Time) {
+	if day := now.UTC().Format("2006-01-02"); day != u.day {
+		u.day = day
+		u.requests = 0
+		u.tokens = 0
+	}
+}
+
+// Validate 检查密钥是否启用且未过期
+func (k *Key) Validate(now time.Time) error {
+	if !k.Enabled {
+		return ErrKeyDisabled
+	}
+	if k.ExpiresAt != nil && !now.Before(*k.ExpiresAt) {
+		return ErrKeyExpired
+	}
+	return nil
+}
+
+// AllowsModel 判断密钥是否允许使用该模型
+func (k *Key) AllowsModel(name string) bool {
+	if len(k.AllowedModels) == 0 {
+		return true
+	}
+	name = model.NormalizeModelName(name)
+	for _, allowed := range k.AllowedModels {
+		if prefix, ok := strings.CutSuffix(allowed, "*"); ok {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		} else if model.NormalizeModelName(allowed) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsRoute 判断密钥是否允许访问该路由
+func (k *Key) AllowsRoute(route string) bool {
+	if len(k.AllowedRoutes) == 0 {
+		return true
+	}
+	for _, allowed := range k.AllowedRoutes {
+		if allowed == route {
+			return true
+		}
+	}
+	return false
+}
+
+// ChargeRequest 计入一次请求，超出请求配额或 token 配额已用尽时返回错误且不计数
+func (k *Key) ChargeRequest(now time.Time) error {
+	k.usage.mu.Lock()
+	defer k.usage.mu.Unlock()
+
+	k.usage.reset(now)
+	if k.Quota.RequestsPerDay > 0 && k.usage.requests >= k.Quota.RequestsPerDay {
+		return ErrRequestQuotaExceeded
+	}
+	if k.Quota.TokensPerDay > 0 && k.usage.tokens >= k.Quota.TokensPerDay {
+		return ErrTokenQuotaExceeded
+	}
+	k.usage.requests++
+	return nil
+}
+
+// ChargeTokens 计入请求完成后实际消耗的 token
+func (k *Key) ChargeTokens(now time.Time, tokens int) {
+	k.usage.mu.Lock()
+	defer k.usage.mu.Unlock()
+
+	k.usage.reset(now)
+	k.usage.tokens += int64(tokens)
+}
+
+// UsageToday 返回当日已用的请求数和 token 数
+func (k *Key) UsageToday(now time.Time) (requests int, tokens int64) {
+	k.usage.mu.Lock()
+	defer k.usage.mu.Unlock()
+
+	k.usage.reset(now)
+	return k.usage.requests, k.usage.tokens
+}
+
+// NewStaticKey 创建不在密钥文件中的内置密钥，用于兼容单一 API_KEY
+func NewStaticKey(id string) *Key {
+	return &Key{ID: id, Name: id, Enabled: true, usage: &usage{}}
+}
+
+// HashSecret 返回密钥明文的 SHA-256 十六进制摘要
+func HashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// Store 文件存储的密钥集合
+type Store struct {
+	mu     sync.RWMutex
+	path   string
+	keys   map[string]*Key // 按 ID 索引
+	byHash map[string]*Key // 按密钥摘要索引
+}
+
+type fileFormat struct {
+	Keys []*Key `json:"keys"`
+}
+
+// Open 从文件加载密钥，文件不存在时返回空集合，path 为空时不读写文件
+func Open(path string) (*Store, error) {
+	s := &Store{
+		path:   path,
+		keys:   make(map[string]*Key),
+		byHash: make(map[string]*Key),
+	}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload 重新读取密钥文件，当日用量按密钥 ID 沿用
+func (s *Store) Reload() error {
+	if s.path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		data = nil
+	} else if err != nil {
+		return fmt.Errorf("failed to read keys file: %v", err)
+	}
+
+	var file fileFormat
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &file); err != nil {
+			return fmt.Errorf("failed to parse keys file %s: %v", s.path, err)
+		}
+	}
+
+	keys := make(map[string]*Key, len(file.Keys))
+	byHash := make(map[string]*Key, len(file.Keys))
+	for i, k := range file.Keys {
+		if k.ID == "" || k.SecretHash == "" {
+			return fmt.Errorf("keys file %s: key #%d must have id and secret_hash", s.path, i+1)
+		}
+		if _, exists := keys[k.ID]; exists {
+			return fmt.Errorf("keys file %s: duplicate key id '%s'", s.path, k.ID)
+		}
+		if _, err := model.ParseTruncationStrategy(string(k.Truncation)); err != nil {
+			return fmt.Errorf("keys file %s: key '%s': %v", s.path, k.ID, err)
+		}
+		k.SecretHash = strings.ToLower(k.SecretHash)
+		if _, exists := byHash[k.SecretHash]; exists {
+			return fmt.Errorf("keys file %s: key '%s' reuses the secret of another key", s.path, k.ID)
+		}
+		keys[k.ID] = k
+		byHash[k.SecretHash] = k
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, k := range keys {
+		if old, ok := s.keys[id]; ok {
+			k.usage = old.usage
+		} else {
+			k.usage = &usage{}
+		}
+	}
+	s.keys = keys
+	s.byHash = byHash
+	return nil
+}
+
+// Lookup 根据密钥明文查找密钥
+func (s *Store) Lookup(secret string) (*Key, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	k, ok := s.byHash[HashSecret(secret)]
+	return k, ok
+}
+
+// Len 返回密钥数量
+func (s *Store) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.keys)
+}
+
+// KeySpec 创建密钥时可指定的属性
+type KeySpec struct {
+	Name          string                   `json:"name"`
+	AllowedModels []string                 `json:"allowed_models,omitempty"`
+	AllowedRoutes []string                 `json:"allowed_routes,omitempty"`
+	ExpiresAt     *time.Time               `json:"expires_at,omitempty"`
+	Quota         Quota                    `json:"quota"`
+	DisableAudit  bool                     `json:"disable_audit,omitempty"`
+	Truncation    model.TruncationStrategy `json:"truncation,omitempty"`
+}
+
+// List 按创建时间返回所有密钥
+func (s *Store) List() []*Key {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := make([]*Key, 0, len(s.keys))
+	for _, k := range s.keys {
+		list = append(list, k)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].CreatedAt.Equal(list[j].CreatedAt) {
+			return list[i].CreatedAt.Before(list[j].CreatedAt)
+		}
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
+
+// Get 按 ID 获取密钥
+func (s *Store) Get(id string) (*Key, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	k, ok := s.keys[id]
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	return k, nil
+}
+
+// Create 创建并持久化新密钥，返回的明文密钥不会被保存
+func (s *Store) Create(spec KeySpec) (*Key, string, error) {
+	id, err := randomHex(6)
+	if err != nil {
+		return nil, "", err
+	}
+	secret, err := newSecret()
+	if err != nil {
+		return nil, "", err
+	}
+
+	k := &Key{
+		ID:            "key_" + id,
+		Name:          spec.Name,
+		SecretHash:    HashSecret(secret),
+		AllowedModels: spec.AllowedModels,
+		AllowedRoutes: spec.AllowedRoutes,
+		ExpiresAt:     spec.ExpiresAt,
+		Enabled:       true,
+		Quota:         spec.Quota,
+		DisableAudit:  spec.DisableAudit,
+		Truncation:    spec.Truncation,
+		CreatedAt:     time.Now().UTC(),
+		usage:         &usage{},
+	}
+	if err := s.mutate(func(keys map[string]*Key) error {
+		keys[k.ID] = k
+		return nil
+	}); err != nil {
+		return nil, "", err
+	}
+	return k, secret, nil
+}
+
+// Rotate 为密钥生成新的明文密钥，旧密钥立即失效
+func (s *Store) Rotate(id string) (*Key, string, error) {
+	secret, err := newSecret()
+	if err != nil {
+		return nil, "", err
+	}
+
+	var rotated *Key
+	err = s.mutate(func(keys map[string]*Key) error {
+		k, ok := keys[id]
+		if !ok {
+			return ErrKeyNotFound
+		}
+		copied := *k
+		copied.SecretHash = HashSecret(secret)
+		keys[id] = &copied
+		rotated = &copied
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return rotated, secret, nil
+}
+
+// SetEnabled 启用或禁用密钥
+func (s *Store) SetEnabled(id string, enabled bool) (*Key, error) {
+	var updated *Key
+	err := s.mutate(func(keys map[string]*Key) error {
+		k, ok := keys[id]
+		if !ok {
+			return ErrKeyNotFound
+		}
+		copied := *k
+		copied.Enabled = enabled
+		keys[id] = &copied
+		updated = &copied
+		return nil
+	})
+	return updated, err
+}
+
+// Delete 删除密钥
+func (s *Store) Delete(id string) error {
+	return s.mutate(func(keys map[string]*Key) error {
+		if _, ok := keys[id]; !ok {
+			return ErrKeyNotFound
+		}
+		delete(keys, id)
+		return nil
+	})
+}
+
+// mutate 在密钥集合的副本上执行修改，写入文件成功后再替换内存中的集合
+// 密钥对象按写时复制处理，已被请求持有的旧对象不会被修改
+func (s *Store) mutate(fn func(keys map[string]*Key) error) error {
+	if s.path == "" {
+		return ErrNoKeysFile
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := make(map[string]*Key, len(s.keys))
+	for id, k := range s.keys {
+		keys[id] = k
+	}
+	if err := fn(keys); err != nil {
+		return err
+	}
+
+	byHash := make(map[string]*Key, len(keys))
+	for _, k := range keys {
+		byHash[k.SecretHash] = k
+	}
+	if err := s.save(keys); err != nil {
+		return err
+	}
+	s.keys = keys
+	s.byHash = byHash
+	return nil
+}
+
+// save 先写入同目录下的临时文件再重命名，避免进程中断时留下不完整的密钥文件
+func (s *Store) save(keys map[string]*Key) error {
+	file := fileFormat{Keys: make([]*Key, 0, len(keys))}
+	for _, k := range keys {
+		file.Keys = append(file.Keys, k)
+	}
+	sort.Slice(file.Keys, func(i, j int) bool { return file.Keys[i].ID < file.Keys[j].ID })
+
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to save keys file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to save keys file: %v", err)
+	}
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to save keys file: %v", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to save keys file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to save keys file: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("failed to save keys file: %v", err)
+	}
+	return nil
+}
+
+// newSecret 生成 sk- 前缀的随机明文密钥
+func newSecret() (string, error) {
+	h, err := randomHex(24)
+	if err != nil {
+		return "", err
+	}
+	return "sk-" + h, nil
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+type ctxKey struct{}
+
+// WithKey 将已认证的密钥放入请求上下文
+func WithKey(ctx context.Context, k *Key) context.Context {
+	return context.WithValue(ctx, ctxKey{}, k)
+}
+
+// FromContext 返回请求上下文中已认证的密钥，未认证时返回 nil
+func FromContext(ctx context.Context) *Key {
+	k, _ := ctx.Value(ctxKey{}).(*Key)
+	return k
+}
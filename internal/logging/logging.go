@@ -0,0 +1,97 @@
+// Package logging 基于 log/slog 的结构化日志
+// 使用带 context 的 slog 函数时，日志会自动带上请求 ID 和链路追踪 ID
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// RequestIDHeader 请求和响应中携带请求 ID 的头
+const RequestIDHeader = "X-Request-ID"
+
+var level = new(slog.LevelVar)
+
+// Setup 设置全局日志的输出、格式 (text/json) 和级别 (debug/info/warn/error)
+// 标准库 log 的输出也会经由 slog 以 info 级别输出
+func Setup(w io.Writer, format, lvl string) error {
+	if err := SetLevel(lvl); err != nil {
+		return err
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	switch format {
+	case "", "text":
+		handler = slog.NewTextHandler(w, opts)
+	case "json":
+		handler = slog.NewJSONHandler(w, opts)
+	default:
+		return fmt.Errorf("unknown log format: %s", format)
+	}
+	slog.SetDefault(slog.New(contextHandler{handler}))
+	return nil
+}
+
+// SetLevel 修改日志级别，对之后的日志立即生效
+func SetLevel(lvl string) error {
+	parsed, err := ParseLevel(lvl)
+	if err != nil {
+		return err
+	}
+	level.Set(parsed)
+	return nil
+}
+
+// ParseLevel 解析日志级别名称，为空时为 info
+func ParseLevel(lvl string) (slog.Level, error) {
+	var parsed slog.Level
+	if lvl == "" {
+		return slog.LevelInfo, nil
+	}
+	if err := parsed.UnmarshalText([]byte(strings.ToUpper(lvl))); err != nil {
+		return 0, fmt.Errorf("unknown log level: %s", lvl)
+	}
+	return parsed, nil
+}
+
+type requestIDKey struct{}
+
+// WithRequestID 将请求 ID 存入上下文
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID 返回上下文中的请求 ID，没有时为空
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// contextHandler 从上下文中取出请求 ID 和链路 ID 附加到每条日志
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := RequestID(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		r.AddAttrs(slog.String("trace_id", sc.TraceID().String()))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
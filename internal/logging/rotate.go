@@ -0,0 +1,305 @@
+package logging
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupTimeFormat 旧日志文件名中的时间格式，不含冒号以兼容 Windows
+const backupTimeFormat = "2006-01-02T15-04-05.000"
+
+// RotateOptions 日志文件轮转选项，各项为 0 时表示不限制
+type RotateOptions struct {
+	MaxSize    int64         // 单个文件的最大字节数
+	Interval   time.Duration // 按时间轮转的间隔，按本地时间对齐，24h 即每天零点轮转
+	MaxBackups int           // 保留的旧文件数
+	MaxAge     time.Duration // 旧文件保留时长
+	Compress   bool          // 使用 gzip 压缩旧文件
+}
+
+// File 按大小和时间轮转的日志文件，可并发写入
+// 轮转时将当前文件重命名为 name-<时间>.ext，压缩和清理旧文件在后台进行
+type File struct {
+	path string
+	opts RotateOptions
+	now  func() time.Time
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	next   time.Time // 下次按时间轮转的时刻
+	closed bool
+
+	mill chan struct{}
+	done chan struct{}
+}
+
+// OpenFile 以追加模式打开日志文件，并在后台清理超出保留限制的旧文件
+func OpenFile(path string, opts RotateOptions) (*File, error) {
+	return openFile(path, opts, time.Now)
+}
+
+func openFile(path string, opts RotateOptions, now func() time.Time) (*File, error) {
+	f := &File{
+		path: path,
+		opts: opts,
+		now:  now,
+		mill: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	go f.millLoop()
+	f.triggerMill()
+	return f, nil
+}
+
+func (f *File) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	f.file = file
+	f.size = info.Size()
+	if f.opts.Interval > 0 {
+		// 已有内容时按最后写入时间计算，重启后跨过轮转时刻的文件会在下次写入时轮转
+		start := f.now()
+		if f.size > 0 {
+			start = info.ModTime()
+		}
+		f.next = nextBoundary(start, f.opts.Interval)
+	}
+	return nil
+}
+
+// Write 写入日志，需要时先轮转
+func (f *File) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed || f.file == nil {
+		return 0, os.ErrClosed
+	}
+	if f.shouldRotate(len(p)) {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// shouldRotate 空文件不轮转，避免产生空的旧文件
+func (f *File) shouldRotate(n int) bool {
+	if f.opts.Interval > 0 {
+		if now := f.now(); !now.Before(f.next) {
+			if f.size > 0 {
+				return true
+			}
+			f.next = nextBoundary(now, f.opts.Interval)
+		}
+	}
+	return f.opts.MaxSize > 0 && f.size > 0 && f.size+int64(n) > f.opts.MaxSize
+}
+
+func (f *File) rotate() error {
+	if f.file != nil {
+		f.file.Close()
+		f.file = nil
+	}
+	if err := os.Rename(f.path, backupName(f.path, f.now())); err != nil && !os.IsNotExist(err) {
+		// 重命名失败时继续写入原文件，不丢失日志
+		fmt.Fprintf(os.Stderr, "failed to rotate log file: %v\n", err)
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+	f.triggerMill()
+	return nil
+}
+
+// Reopen 关闭并重新打开日志文件，用于外部 logrotate 移走文件之后
+func (f *File) Reopen() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return os.ErrClosed
+	}
+	if f.file != nil {
+		f.file.Close()
+		f.file = nil
+	}
+	return f.open()
+}
+
+// Close 关闭文件并等待后台的压缩和清理完成
+func (f *File) Close() error {
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		return nil
+	}
+	f.closed = true
+	var err error
+	if f.file != nil {
+		err = f.file.Close()
+		f.file = nil
+	}
+	close(f.mill)
+	f.mu.Unlock()
+
+	<-f.done
+	return err
+}
+
+func (f *File) triggerMill() {
+	select {
+	case f.mill <- struct{}{}:
+	default:
+	}
+}
+
+func (f *File) millLoop() {
+	defer close(f.done)
+	for range f.mill {
+		if err := f.millOnce(); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to clean up rotated log files: %v\n", err)
+		}
+	}
+}
+
+// millOnce 删除超出数量或时长限制的旧文件，再压缩剩余的未压缩文件
+func (f *File) millOnce() error {
+	backups, err := f.backups()
+	if err != nil {
+		return err
+	}
+
+	now := f.now()
+	var keep []backup
+	for i, b := range backups {
+		if (f.opts.MaxBackups > 0 && i >= f.opts.MaxBackups) || (f.opts.MaxAge > 0 && now.Sub(b.time) > f.opts.MaxAge) {
+			if err := os.Remove(b.path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+		keep = append(keep, b)
+	}
+
+	if !f.opts.Compress {
+		return nil
+	}
+	for _, b := range keep {
+		if b.compressed {
+			continue
+		}
+		if err := compressFile(b.path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type backup struct {
+	path       string
+	time       time.Time
+	compressed bool
+}
+
+// backups 返回当前日志文件的所有旧文件，按时间从新到旧排序
+func (f *File) backups() ([]backup, error) {
+	dir := filepath.Dir(f.path)
+	prefix, ext := splitName(f.path)
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var backups []backup
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		name, compressed := strings.CutSuffix(entry.Name(), ".gz")
+		stamp, ok := strings.CutPrefix(name, prefix+"-")
+		if !ok {
+			continue
+		}
+		if stamp, ok = strings.CutSuffix(stamp, ext); !ok {
+			continue
+		}
+		t, err := time.ParseInLocation(backupTimeFormat, stamp, time.Local)
+		if err != nil {
+			continue
+		}
+		backups = append(backups, backup{path: filepath.Join(dir, entry.Name()), time: t, compressed: compressed})
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].time.After(backups[j].time)
+	})
+	return backups, nil
+}
+
+// compressFile 将文件压缩为同名 .gz 文件后删除原文件
+func compressFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(dst)
+	_, err = io.Copy(gz, src)
+	if closeErr := gz.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+
+	src.Close()
+	return os.Remove(path)
+}
+
+// splitName 将 dir/app.log 拆分为 app 和 .log
+func splitName(path string) (prefix, ext string) {
+	base := filepath.Base(path)
+	ext = filepath.Ext(base)
+	return strings.TrimSuffix(base, ext), ext
+}
+
+func backupName(path string, t time.Time) string {
+	prefix, ext := splitName(path)
+	return filepath.Join(filepath.Dir(path), prefix+"-"+t.Format(backupTimeFormat)+ext)
+}
+
+// nextBoundary 返回 t 之后按本地时间对齐的下一个轮转时刻
+func nextBoundary(t time.Time, interval time.Duration) time.Time {
+	_, offset := t.Zone()
+	shift := time.Duration(offset) * time.Second
+	return t.Add(shift).Truncate(interval).Add(interval - shift)
+}
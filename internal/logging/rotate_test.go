@@ -0,0 +1,159 @@
+package logging
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock 由测试设置的时钟，后台清理也会读取，因此需要加锁
+type fakeClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = t
+}
+
+func openTestFile(t *testing.T, opts RotateOptions, clock *fakeClock) (*File, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "app.log")
+	f, err := openFile(path, opts, clock.now)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f, path
+}
+
+// backupNames 返回目录中除当前日志文件外的文件名
+func backupNames(t *testing.T, path string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatalf("read dir: %v", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		if entry.Name() != filepath.Base(path) {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestFileRotatesBySizeAndKeepsBackups(t *testing.T) {
+	start := time.Date(2024, 11, 20, 10, 0, 0, 0, time.Local)
+	clock := &fakeClock{t: start}
+	f, path := openTestFile(t, RotateOptions{MaxSize: 10, MaxBackups: 2, Compress: true}, clock)
+
+	for i, line := range []string{"line-one\n", "line-two\n", "line-three\n", "line-four\n"} {
+		clock.set(start.Add(time.Duration(i) * time.Second))
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	f.Close() // 等待后台压缩和清理完成
+
+	current, _ := os.ReadFile(path)
+	if string(current) != "line-four\n" {
+		t.Errorf("current file = %q, want the last line", current)
+	}
+
+	// 三次轮转只保留最新的两个旧文件，且都已压缩
+	names := backupNames(t, path)
+	want := []string{"app-2024-11-20T10-00-02.000.log.gz", "app-2024-11-20T10-00-03.000.log.gz"}
+	if strings.Join(names, ",") != strings.Join(want, ",") {
+		t.Fatalf("backups = %v, want %v", names, want)
+	}
+	file, err := os.Open(filepath.Join(filepath.Dir(path), want[1]))
+	if err != nil {
+		t.Fatalf("open backup: %v", err)
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatalf("gzip reader: %v", err)
+	}
+	if content, _ := io.ReadAll(gz); string(content) != "line-three\n" {
+		t.Errorf("newest backup = %q, want line-three", content)
+	}
+}
+
+func TestFileRotatesByInterval(t *testing.T) {
+	clock := &fakeClock{t: time.Date(2024, 11, 20, 23, 59, 58, 0, time.Local)}
+	f, path := openTestFile(t, RotateOptions{Interval: 24 * time.Hour}, clock)
+	f.Write([]byte("before midnight\n"))
+	clock.set(time.Date(2024, 11, 20, 23, 59, 59, 0, time.Local))
+	f.Write([]byte("still today\n"))
+	clock.set(time.Date(2024, 11, 21, 0, 0, 0, 0, time.Local))
+	f.Write([]byte("after midnight\n")) // 跨过零点，轮转
+	f.Close()
+
+	names := backupNames(t, path)
+	if len(names) != 1 || names[0] != "app-2024-11-21T00-00-00.000.log" {
+		t.Fatalf("backups = %v, want one rotated at midnight", names)
+	}
+	old, _ := os.ReadFile(filepath.Join(filepath.Dir(path), names[0]))
+	if string(old) != "before midnight\nstill today\n" {
+		t.Errorf("rotated file = %q", old)
+	}
+	current, _ := os.ReadFile(path)
+	if string(current) != "after midnight\n" {
+		t.Errorf("current file = %q", current)
+	}
+}
+
+func TestFileReopenAfterExternalRotation(t *testing.T) {
+	f, path := openTestFile(t, RotateOptions{}, &fakeClock{t: time.Now()})
+	f.Write([]byte("first\n"))
+
+	// 模拟 logrotate 移走文件后发送 SIGUSR1
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+	if err := f.Reopen(); err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	f.Write([]byte("second\n"))
+
+	if moved, _ := os.ReadFile(path + ".1"); string(moved) != "first\n" {
+		t.Errorf("moved file = %q", moved)
+	}
+	if current, _ := os.ReadFile(path); string(current) != "second\n" {
+		t.Errorf("reopened file = %q", current)
+	}
+}
+
+func TestOpenFileAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	if err := os.WriteFile(path, []byte("previous run\n"), 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	f, err := OpenFile(path, RotateOptions{})
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	f.Write([]byte("this run\n"))
+	f.Close()
+
+	if content, _ := os.ReadFile(path); string(content) != "previous run\nthis run\n" {
+		t.Errorf("file = %q, previous logs should be kept", content)
+	}
+}
@@ -0,0 +1,180 @@
+// Package metrics 以 Prometheus 文本格式导出服务指标
+// 指标注册在包内独立的 Registry 上，其他包只调用这里的记录函数，不直接依赖 Prometheus 客户端
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "pieces"
+
+var (
+	registry = prometheus.NewRegistry()
+
+	// 对话请求耗时较长，桶的上限覆盖流式超时
+	requestBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 20, 30, 60, 120, 300}
+	ttftBuckets    = []float64{0.1, 0.25, 0.5, 1, 2, 3, 5, 10, 20, 30}
+	waitBuckets    = []float64{0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 2.5, 5}
+
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by route, model, status and API key.",
+	}, []string{"route", "model", "status", "key"})
+
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by route, model, status and API key.",
+		Buckets:   requestBuckets,
+	}, []string{"route", "model", "status", "key"})
+
+	upstreamRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_requests_total",
+		Help:      "Upstream gRPC calls by backend, method and status code.",
+	}, []string{"backend", "method", "code"})
+
+	upstreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "upstream_request_duration_seconds",
+		Help:      "Upstream gRPC call duration by backend, method and status code, streams are measured until the last chunk.",
+		Buckets:   requestBuckets,
+	}, []string{"backend", "method", "code"})
+
+	upstreamRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_retries_total",
+		Help:      "Retried upstream calls by model.",
+	}, []string{"model"})
+
+	poolWait = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "pool_wait_seconds",
+		Help:      "Time spent waiting for a connection from the upstream connection pool.",
+		Buckets:   waitBuckets,
+	}, []string{"backend"})
+
+	poolTimeouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "pool_wait_timeouts_total",
+		Help:      "Requests that gave up waiting for an upstream connection.",
+	}, []string{"backend"})
+
+	streamTTFT = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "stream_time_to_first_token_seconds",
+		Help:      "Time from the upstream stream request to the first content chunk.",
+		Buckets:   ttftBuckets,
+	}, []string{"model"})
+
+	streamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "stream_duration_seconds",
+		Help:      "Total duration of upstream streams.",
+		Buckets:   requestBuckets,
+	}, []string{"model"})
+
+	tokens = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tokens_total",
+		Help:      "Prompt and completion tokens by model and API key.",
+	}, []string{"model", "key", "type"})
+
+	rejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rate_limit_rejections_total",
+		Help:      "Requests rejected by a limiter (request, token, concurrency, quota, blacklist) and rule.",
+	}, []string{"limiter", "rule"})
+
+	timeouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "timeouts_total",
+		Help:      "Requests answered with a timeout error, by request type.",
+	}, []string{"type"})
+)
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequests, httpDuration,
+		upstreamRequests, upstreamDuration, upstreamRetries,
+		poolWait, poolTimeouts,
+		streamTTFT, streamDuration,
+		tokens, rejections, timeouts,
+		sources,
+	)
+}
+
+// Handler 返回 /metrics 的处理器
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// ObserveRequest 记录一次 HTTP 请求，未到达模型或未认证时 model、key 为空
+func ObserveRequest(route, model, key string, status int, d time.Duration) {
+	code := strconv.Itoa(status)
+	httpRequests.WithLabelValues(route, model, code, key).Inc()
+	httpDuration.WithLabelValues(route, model, code, key).Observe(d.Seconds())
+}
+
+// ObserveUpstream 记录一次上游 gRPC 调用，code 为 gRPC 状态码名称
+func ObserveUpstream(backend, method, code string, d time.Duration) {
+	upstreamRequests.WithLabelValues(backend, method, code).Inc()
+	upstreamDuration.WithLabelValues(backend, method, code).Observe(d.Seconds())
+}
+
+// IncRetry 记录一次上游重试
+func IncRetry(model string) {
+	upstreamRetries.WithLabelValues(model).Inc()
+}
+
+// ObservePoolWait 记录从连接池获取连接的等待时间，timedOut 表示最终未获取到连接
+func ObservePoolWait(backend string, d time.Duration, timedOut bool) {
+	poolWait.WithLabelValues(backend).Observe(d.Seconds())
+	if timedOut {
+		poolTimeouts.WithLabelValues(backend).Inc()
+	}
+}
+
+// ObserveTTFT 记录流式请求的首个内容块延迟
+func ObserveTTFT(model string, d time.Duration) {
+	streamTTFT.WithLabelValues(model).Observe(d.Seconds())
+}
+
+// ObserveStream 记录流式请求的总时长
+func ObserveStream(model string, d time.Duration) {
+	streamDuration.WithLabelValues(model).Observe(d.Seconds())
+}
+
+// AddTokens 累加模型用量
+func AddTokens(model, key string, prompt, completion int) {
+	tokens.WithLabelValues(model, key, "prompt").Add(float64(prompt))
+	tokens.WithLabelValues(model, key, "completion").Add(float64(completion))
+}
+
+// Limiter 名称，用于 rate_limit_rejections_total 的 limiter 标签
+const (
+	LimiterRequest     = "request"
+	LimiterToken       = "token"
+	LimiterConcurrency = "concurrency"
+	LimiterQuota       = "quota"
+	LimiterBlacklist   = "blacklist"
+)
+
+// IncRejection 记录一次限流拒绝
+func IncRejection(limiter, rule string) {
+	rejections.WithLabelValues(limiter, rule).Inc()
+}
+
+// IncTimeout 记录一次超时响应，kind 为 request 或 stream
+func IncTimeout(kind string) {
+	timeouts.WithLabelValues(kind).Inc()
+}
@@ -0,0 +1,80 @@
+package metrics
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// PoolStats 上游连接池的当前状态
+type PoolStats struct {
+	Size int // 已创建的连接数
+	Idle int // 池中空闲的连接数
+}
+
+// BlacklistStats 黑名单的当前状态
+type BlacklistStats struct {
+	IPs       int
+	Subnets   int
+	Violators int // 有违规记录但尚未拉黑的 IP 数
+}
+
+var (
+	poolSizeDesc  = prometheus.NewDesc(namespace+"_pool_connections", "Connections created by the upstream connection pool.", []string{"backend"}, nil)
+	poolIdleDesc  = prometheus.NewDesc(namespace+"_pool_idle_connections", "Idle connections in the upstream connection pool.", []string{"backend"}, nil)
+	blacklistDesc = prometheus.NewDesc(namespace+"_blacklist_entries", "Blacklisted IPs and subnets.", []string{"type"}, nil)
+	violatorsDesc = prometheus.NewDesc(namespace+"_blacklist_violators", "IPs with recorded rate limit violations.", nil, nil)
+
+	sources = &sourceCollector{pools: make(map[string]func() PoolStats)}
+)
+
+// sourceCollector 在抓取时读取连接池和黑名单的当前状态
+// 同一来源重复设置时以最后一次为准，测试中多次创建服务也不会重复注册
+type sourceCollector struct {
+	mu        sync.Mutex
+	pools     map[string]func() PoolStats
+	blacklist func() BlacklistStats
+}
+
+// SetPoolSource 设置后端连接池状态的来源
+func SetPoolSource(backend string, fn func() PoolStats) {
+	sources.mu.Lock()
+	defer sources.mu.Unlock()
+	sources.pools[backend] = fn
+}
+
+// SetBlacklistSource 设置黑名单状态的来源
+func SetBlacklistSource(fn func() BlacklistStats) {
+	sources.mu.Lock()
+	defer sources.mu.Unlock()
+	sources.blacklist = fn
+}
+
+func (c *sourceCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- poolSizeDesc
+	ch <- poolIdleDesc
+	ch <- blacklistDesc
+	ch <- violatorsDesc
+}
+
+func (c *sourceCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	pools := make(map[string]func() PoolStats, len(c.pools))
+	for backend, fn := range c.pools {
+		pools[backend] = fn
+	}
+	blacklist := c.blacklist
+	c.mu.Unlock()
+
+	for backend, fn := range pools {
+		stats := fn()
+		ch <- prometheus.MustNewConstMetric(poolSizeDesc, prometheus.GaugeValue, float64(stats.Size), backend)
+		ch <- prometheus.MustNewConstMetric(poolIdleDesc, prometheus.GaugeValue, float64(stats.Idle), backend)
+	}
+	if blacklist != nil {
+		stats := blacklist()
+		ch <- prometheus.MustNewConstMetric(blacklistDesc, prometheus.GaugeValue, float64(stats.IPs), "ip")
+		ch <- prometheus.MustNewConstMetric(blacklistDesc, prometheus.GaugeValue, float64(stats.Subnets), "subnet")
+		ch <- prometheus.MustNewConstMetric(violatorsDesc, prometheus.GaugeValue, float64(stats.Violators))
+	}
+}
@@ -0,0 +1,61 @@
+package middleware
+
+import (
+	"net/http"
+	"pieces-os-go/internal/audit"
+	"pieces-os-go/internal/config"
+	"pieces-os-go/internal/keystore"
+	"pieces-os-go/internal/logging"
+	"pieces-os-go/internal/model"
+	"pieces-os-go/internal/usage"
+	"time"
+)
+
+// Audit 记录对话请求的消息和回复，需放在认证中间件之后以获取密钥
+// sink 为 nil 时不记录，密钥设置了 disable_audit 时跳过
+func Audit(sink *audit.Sink) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if sink == nil {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := keystore.FromContext(r.Context())
+			if key != nil && key.DisableAudit {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			start := time.Now()
+			wrapped := wrapResponseWriter(w)
+			ctx, entry := audit.WithEntry(r.Context())
+			ctx, usageEntry := usage.EnsureEntry(ctx)
+			next.ServeHTTP(wrapped, r.WithContext(ctx))
+
+			rec := audit.Record{
+				Time:      start,
+				RequestID: logging.RequestID(ctx),
+				Route:     config.RouteName(r.URL.Path),
+				Status:    wrapped.status,
+				LatencyMs: time.Since(start).Milliseconds(),
+			}
+			if !entry.Fill(&rec) {
+				return
+			}
+			var u usage.Record
+			if usageEntry.Fill(&u) {
+				rec.Model = u.Model
+				rec.Stream = u.Stream
+				rec.Usage = model.Usage{
+					PromptTokens:     u.PromptTokens,
+					CompletionTokens: u.CompletionTokens,
+					TotalTokens:      u.TotalTokens,
+				}
+			}
+			if key != nil {
+				rec.KeyID = key.ID
+				rec.KeyName = key.Name
+			}
+			sink.Add(rec)
+		})
+	}
+}
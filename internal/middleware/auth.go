@@ -1,41 +1,132 @@
 package middleware
 
 import (
+	"crypto/subtle"
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"pieces-os-go/internal/config"
+	"pieces-os-go/internal/keystore"
+	"pieces-os-go/internal/logging"
+	"pieces-os-go/internal/metrics"
 	"pieces-os-go/internal/model"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
-func Auth(apiKey string) func(http.Handler) http.Handler {
-	return func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			if apiKey == "" {
-				next.ServeHTTP(w, r)
-				return
-			}
-
-			auth := r.Header.Get("Authorization")
-			if auth == "" {
-				writeError(w, model.NewAPIError(model.ErrUnauthorized, "Missing authentication information", http.StatusUnauthorized))
-				return
-			}
+// KeyAuth API认证中间件，同时支持单一的 API_KEY 和密钥文件中的多个密钥
+// 两者都未配置时不校验
+type KeyAuth struct {
+	apiKey     atomic.Value // string
+	keys       *keystore.Store
+	defaultKey *keystore.Key // API_KEY 对应的内置密钥
+}
 
-			const prefix = "Bearer "
-			if !strings.HasPrefix(auth, prefix) {
-				writeError(w, model.NewAPIError(model.ErrUnauthorized, "Invalid authentication format", http.StatusUnauthorized))
-				return
-			}
+// NewKeyAuth 创建API认证中间件，keys 可以为 nil
+func NewKeyAuth(apiKey string, keys *keystore.Store) *KeyAuth {
+	a := &KeyAuth{
+		keys:       keys,
+		defaultKey: keystore.NewStaticKey("default"),
+	}
+	a.SetKey(apiKey)
+	return a
+}
 
-			token := auth[len(prefix):]
-			if token != apiKey {
-				writeError(w, model.NewAPIError(model.ErrUnauthorized, "Invalid API key", http.StatusUnauthorized))
-				return
-			}
+// SetKey 替换API密钥，对之后的请求生效
+func (a *KeyAuth) SetKey(apiKey string) {
+	a.apiKey.Store(apiKey)
+}
 
+func (a *KeyAuth) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		apiKey := a.apiKey.Load().(string)
+		if apiKey == "" && (a.keys == nil || a.keys.Len() == 0) {
 			next.ServeHTTP(w, r)
-		})
+			return
+		}
+
+		token, apiErr := extractAPIKey(r)
+		if apiErr != nil {
+			writeError(w, apiErr)
+			return
+		}
+
+		key, apiErr := a.authenticate(token, config.RouteName(r.URL.Path))
+		if apiErr != nil {
+			writeError(w, apiErr)
+			return
+		}
+
+		if info := requestInfoFrom(r.Context()); info != nil {
+			info.setKey(key)
+		}
+		next.ServeHTTP(w, r.WithContext(keystore.WithKey(r.Context(), key)))
+	})
+}
+
+// authenticate 校验密钥状态、路由权限并计入请求配额
+func (a *KeyAuth) authenticate(token, route string) (*keystore.Key, *model.APIError) {
+	var key *keystore.Key
+	if apiKey := a.apiKey.Load().(string); apiKey != "" && subtle.ConstantTimeCompare([]byte(token), []byte(apiKey)) == 1 {
+		key = a.defaultKey
+	} else if a.keys != nil {
+		key, _ = a.keys.Lookup(token)
+	}
+	if key == nil {
+		return nil, model.NewAPIError(model.ErrUnauthorized, "Invalid API key", http.StatusUnauthorized)
+	}
+
+	now := time.Now()
+	switch err := key.Validate(now); err {
+	case nil:
+	case keystore.ErrKeyExpired:
+		return nil, model.NewAPIError(model.ErrTokenExpired, err.Error(), http.StatusUnauthorized)
+	default:
+		return nil, model.NewAPIError(model.ErrUnauthorized, err.Error(), http.StatusUnauthorized)
+	}
+
+	if route != "" && !key.AllowsRoute(route) {
+		return nil, model.NewAPIError(model.ErrForbidden, fmt.Sprintf("API key is not allowed to access route '%s'", route), http.StatusForbidden)
 	}
+
+	if err := key.ChargeRequest(now); err != nil {
+		rule := "requests_per_day"
+		if err == keystore.ErrTokenQuotaExceeded {
+			rule = "tokens_per_day"
+		}
+		metrics.IncRejection(metrics.LimiterQuota, rule)
+		return nil, model.NewAPIError(model.ErrQuotaExceeded, err.Error(), http.StatusTooManyRequests)
+	}
+	return key, nil
+}
+
+// extractAPIKey 从请求中提取客户端密钥
+// 优先使用 OpenAI 风格的 Authorization: Bearer，其次兼容 Anthropic 的 x-api-key 和 Gemini 的 x-goog-api-key
+// Gemini 路由还接受 Google SDK 和官方示例使用的 ?key= 查询参数
+func extractAPIKey(r *http.Request) (string, *model.APIError) {
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		const prefix = "Bearer "
+		if !strings.HasPrefix(auth, prefix) {
+			return "", model.NewAPIError(model.ErrUnauthorized, "Invalid authentication format", http.StatusUnauthorized)
+		}
+		return auth[len(prefix):], nil
+	}
+
+	for _, h := range []string{"X-Api-Key", "X-Goog-Api-Key"} {
+		if key := r.Header.Get(h); key != "" {
+			return key, nil
+		}
+	}
+
+	if config.RouteName(r.URL.Path) == config.RouteGemini {
+		if key := r.URL.Query().Get("key"); key != "" {
+			return key, nil
+		}
+	}
+
+	return "", model.NewAPIError(model.ErrUnauthorized, "Missing authentication information", http.StatusUnauthorized)
 }
 
 // AdminAuth 创建管理接口认证中间件
@@ -61,13 +152,24 @@ func AdminAuth(adminKey string) func(http.Handler) http.Handler {
 
 // 添加辅助函数
 func writeError(w http.ResponseWriter, err *model.APIError) {
+	if seconds := err.RetryAfterSeconds(); seconds > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(err.Status)
-	json.NewEncoder(w).Encode(map[string]interface{}{
+	json.NewEncoder(w).Encode(withRequestID(w, map[string]interface{}{
 		"error": map[string]interface{}{
 			"message": err.Message,
 			"type":    "error",
 			"code":    err.Code,
 		},
-	})
+	}))
+}
+
+// withRequestID 在错误响应体中附加请求 ID，便于用户反馈问题时定位日志
+func withRequestID(w http.ResponseWriter, body map[string]interface{}) map[string]interface{} {
+	if id := w.Header().Get(logging.RequestIDHeader); id != "" {
+		body["request_id"] = id
+	}
+	return body
 }
@@ -2,13 +2,15 @@ package middleware
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"os"
 	"pieces-os-go/internal/config"
+	"pieces-os-go/internal/metrics"
 	"pieces-os-go/internal/model"
 	"strings"
 	"sync"
@@ -45,14 +47,12 @@ type BlacklistStats struct {
 // 添加掩码验证方法
 func (bm *BlacklistManager) validateMasks() {
 	if bm.ipv4Mask < config.MinIPv4Mask || bm.ipv4Mask > config.MaxIPv4Mask {
-		log.Printf("Warning: Invalid IPv4 mask %d, using default %d",
-			bm.ipv4Mask, config.DefaultIPv4Mask)
+		slog.Warn("invalid IPv4 mask, using default", "mask", bm.ipv4Mask, "default", config.DefaultIPv4Mask)
 		bm.ipv4Mask = config.DefaultIPv4Mask
 	}
 
 	if bm.ipv6Mask < config.MinIPv6Mask || bm.ipv6Mask > config.MaxIPv6Mask {
-		log.Printf("Warning: Invalid IPv6 mask %d, using default %d",
-			bm.ipv6Mask, config.DefaultIPv6Mask)
+		slog.Warn("invalid IPv6 mask, using default", "mask", bm.ipv6Mask, "default", config.DefaultIPv6Mask)
 		bm.ipv6Mask = config.DefaultIPv6Mask
 	}
 }
@@ -94,19 +94,37 @@ func NewBlacklistManager(cfg *config.Config) *BlacklistManager {
 	return bm
 }
 
+// loadFromFile 从文件加载自动生成的黑名单，调用方需持有写锁或在初始化阶段调用
 func (bm *BlacklistManager) loadFromFile() error {
-	file, err := os.OpenFile(bm.blacklistFile, os.O_CREATE|os.O_RDONLY, 0644)
+	data, err := os.ReadFile(bm.blacklistFile)
+	if os.IsNotExist(err) {
+		file, err := os.OpenFile(bm.blacklistFile, os.O_CREATE|os.O_RDONLY, 0644)
+		if err != nil {
+			return err
+		}
+		return file.Close()
+	}
 	if err != nil {
 		return err
 	}
-	defer file.Close()
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		var entry BlacklistEntry
-		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
-			continue
+	// saveToFile 写入的是 JSON 数组，同时兼容每行一条记录的格式
+	var entries []BlacklistEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		entries = nil
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			var entry BlacklistEntry
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err == nil {
+				entries = append(entries, entry)
+			}
 		}
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	}
+
+	for _, entry := range entries {
 		if entry.Type == "subnet" {
 			_, ipnet, err := net.ParseCIDR(entry.IP)
 			if err == nil {
@@ -116,13 +134,34 @@ func (bm *BlacklistManager) loadFromFile() error {
 			bm.blacklist[entry.IP] = true
 		}
 	}
-	return scanner.Err()
+	return nil
 }
 
-func (bm *BlacklistManager) saveToFile() error {
-	bm.mu.RLock()
-	defer bm.mu.RUnlock()
+// UpdateConfig 应用新的黑名单配置，并重新加载黑名单文件，违规计数保留
+func (bm *BlacklistManager) UpdateConfig(cfg *config.Config) {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
 
+	bm.threshold = cfg.BlacklistThreshold
+	bm.mode = cfg.BlacklistMode
+	bm.ipv4Mask = cfg.IPv4Mask
+	bm.ipv6Mask = cfg.IPv6Mask
+	bm.validateMasks()
+
+	bm.blacklist = make(map[string]bool)
+	bm.subnetList = make(map[string]*net.IPNet)
+	bm.configuredIPs = make(map[string]bool)
+	for _, ip := range cfg.IPBlacklist {
+		bm.configuredIPs[ip] = true
+		bm.blacklist[ip] = true
+	}
+	if err := bm.loadFromFile(); err != nil {
+		slog.Error("failed to reload blacklist file", "error", err)
+	}
+}
+
+// saveToFile 调用方需持有锁
+func (bm *BlacklistManager) saveToFile() error {
 	file, err := os.Create(bm.blacklistFile)
 	if err != nil {
 		return err
@@ -247,13 +286,13 @@ func (bm *BlacklistManager) IsBlocked(ipStr string) bool {
 }
 
 func (bm *BlacklistManager) RecordViolation(ip string) {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+
 	if bm.mode == "off" {
 		return
 	}
 
-	bm.mu.Lock()
-	defer bm.mu.Unlock()
-
 	bm.violations[ip]++
 	if bm.violations[ip] >= bm.threshold {
 		if bm.mode == "subnet" {
@@ -299,6 +338,16 @@ func (bm *BlacklistManager) GetStats() BlacklistStats {
 	return stats
 }
 
+// metricsStats 返回导出到 /metrics 的黑名单统计，TotalBlocked 中包含单个 IP
+func (bm *BlacklistManager) metricsStats() metrics.BlacklistStats {
+	stats := bm.GetStats()
+	return metrics.BlacklistStats{
+		IPs:       stats.TotalBlocked,
+		Subnets:   stats.BlockedSubnets,
+		Violators: stats.ActiveViolators,
+	}
+}
+
 // 添加清理过期违规记录的方法
 func (bm *BlacklistManager) cleanupViolations() {
 	bm.mu.Lock()
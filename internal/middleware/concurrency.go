@@ -0,0 +1,70 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"pieces-os-go/internal/config"
+	"pieces-os-go/internal/keystore"
+	"pieces-os-go/internal/metrics"
+	"pieces-os-go/internal/model"
+	"pieces-os-go/internal/ratelimit"
+	"time"
+)
+
+const globalSlotID = "global"
+
+// ConcurrencyLimit 限制按密钥、IP 和全局同时处理中的对话请求数，流式请求在输出结束前一直占用名额
+// 需放在认证中间件之后，限制从当前配置读取，重载后对新请求立即生效
+func ConcurrencyLimit(limiter *ratelimit.ConcurrencyLimiter, store *config.Store) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			cfg := store.Current().Concurrency
+
+			var slots []ratelimit.Slot
+			if key := keystore.FromContext(r.Context()); key != nil {
+				limit := cfg.PerKey
+				if key.Quota.MaxConcurrent > 0 {
+					limit = key.Quota.MaxConcurrent
+				}
+				slots = append(slots, ratelimit.Slot{ID: "key:" + key.ID, Limit: limit})
+			}
+			slots = append(slots,
+				ratelimit.Slot{ID: "ip:" + GetRealIP(r), Limit: cfg.PerIP},
+				ratelimit.Slot{ID: globalSlotID, Limit: cfg.Global},
+			)
+
+			release, err := limiter.Acquire(r.Context(), slots, cfg.QueueSize, cfg.QueueTimeout)
+			if err != nil {
+				var concurrencyErr *ratelimit.ConcurrencyError
+				if errors.As(err, &concurrencyErr) && concurrencyErr.Reason == ratelimit.Canceled {
+					// 客户端断开或请求超时，由超时中间件负责响应
+					return
+				}
+				metrics.IncRejection(metrics.LimiterConcurrency, ratelimit.Scope(concurrencyErr.Slot.ID))
+				apiErr := model.NewAPIError(model.ErrConcurrentLimit, concurrencyMessage(concurrencyErr), http.StatusTooManyRequests)
+				apiErr.RetryAfter = time.Second
+				writeError(w, apiErr)
+				return
+			}
+			defer release()
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func concurrencyMessage(err *ratelimit.ConcurrencyError) string {
+	scope := "for the server"
+	switch ratelimit.Scope(err.Slot.ID) {
+	case "key":
+		scope = "per API key"
+	case "ip":
+		scope = "per IP"
+	}
+	message := fmt.Sprintf("Too many concurrent requests, limit is %d %s", err.Slot.Limit, scope)
+	if err.Reason == ratelimit.QueueTimeout {
+		message += " (timed out waiting in queue)"
+	}
+	return message
+}
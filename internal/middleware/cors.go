@@ -11,10 +11,10 @@ func CORS(next http.Handler) http.Handler {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 
 		// 允许的请求方法
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
 
 		// 允许的请求头
-		w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, X-Api-Key, Anthropic-Version, X-Goog-Api-Key, X-Truncation")
 
 		// 允许凭证
 		w.Header().Set("Access-Control-Allow-Credentials", "true")
@@ -29,7 +29,7 @@ func CORS(next http.Handler) http.Handler {
 		}
 
 		// 检查请求方法是否允许
-		if r.Method != "GET" && r.Method != "POST" && r.Method != "OPTIONS" {
+		if r.Method != "GET" && r.Method != "POST" && r.Method != "DELETE" && r.Method != "OPTIONS" {
 			writeError(w, model.NewAPIError(model.ErrMethodNotAllowed, "Method not allowed", http.StatusMethodNotAllowed))
 			return
 		}
@@ -1,12 +1,11 @@
 package middleware
 
 import (
-	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
-	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"strings"
@@ -15,37 +14,89 @@ import (
 
 	"pieces-os-go/internal/config"
 	"pieces-os-go/internal/handler"
+	"pieces-os-go/internal/keystore"
+	"pieces-os-go/internal/logging"
 )
 
-var (
-	logWriter io.Writer = os.Stdout
-	bufWriter *bufio.Writer
-	logMutex  sync.Mutex
-)
-
-// InitLogger 初始化日志输出
-func InitLogger(logFile string) error {
-	logMutex.Lock()
-	defer logMutex.Unlock()
+// logFile 配置了日志文件时打开的文件，未配置时为 nil
+var logFile *logging.File
+
+// InitLogger 按配置初始化日志的输出、格式和级别
+// 配置了日志文件时同时输出到标准输出和文件，文件以追加模式打开并按配置轮转
+func InitLogger(cfg *config.Config) error {
+	var w io.Writer = os.Stdout
+	if cfg.LogFile != "" {
+		rotate := cfg.LogRotate
+		file, err := logging.OpenFile(cfg.LogFile, logging.RotateOptions{
+			MaxSize:    int64(rotate.MaxSize) << 20,
+			Interval:   rotate.Interval,
+			MaxBackups: rotate.MaxBackups,
+			MaxAge:     rotate.MaxAge,
+			Compress:   rotate.Compress,
+		})
+		if err != nil {
+			return err
+		}
+		logFile = file
+		w = io.MultiWriter(os.Stdout, file)
+	}
+	return logging.Setup(w, cfg.LogFormat, cfg.LogLevel)
+}
 
-	if logFile == "" {
-		logWriter = os.Stdout
-		bufWriter = bufio.NewWriter(logWriter)
+// ReopenLogFile 重新打开日志文件，供外部 logrotate 移走文件后调用
+func ReopenLogFile() error {
+	if logFile == nil {
 		return nil
 	}
+	return logFile.Reopen()
+}
 
-	// 以截断模式打开文件(O_TRUNC),这样会清除原有内容
-	file, err := os.OpenFile(logFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
-	if err != nil {
-		return err
+// requestInfo 由内层中间件填充、供日志、指标和追踪中间件输出的请求信息
+// 超时中间件会在单独的 goroutine 中执行处理器，因此需要加锁
+type requestInfo struct {
+	mu      sync.Mutex
+	keyID   string
+	keyName string
+}
+
+type requestInfoKey struct{}
+
+func requestInfoFrom(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(*requestInfo)
+	return info
+}
+
+// ensureRequestInfo 返回上下文中的请求信息，没有时创建并存入上下文
+func ensureRequestInfo(ctx context.Context) (context.Context, *requestInfo) {
+	if info := requestInfoFrom(ctx); info != nil {
+		return ctx, info
 	}
+	info := &requestInfo{}
+	return context.WithValue(ctx, requestInfoKey{}, info), info
+}
 
-	logWriter = io.MultiWriter(os.Stdout, file)
-	bufWriter = bufio.NewWriter(logWriter)
-	log.SetOutput(bufWriter)
-	return nil
+func (i *requestInfo) setKey(key *keystore.Key) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.keyID = key.ID
+	i.keyName = key.Name
 }
 
+// key 返回认证通过的密钥 ID，未认证时为空
+func (i *requestInfo) key() string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.keyID
+}
+
+// name 返回认证通过的密钥名称，未认证时为空
+func (i *requestInfo) name() string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.keyName
+}
+
+// Logger 输出访问日志，4xx 以 warn、5xx 以 error 级别记录
 func Logger(cfg *config.Config) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -59,34 +110,46 @@ func Logger(cfg *config.Config) func(http.Handler) http.Handler {
 			handler.IncrementCounter(strings.HasPrefix(r.URL.Path, cfg.APIPrefix))
 
 			// 获取请求体中的模型信息
-			var modelInfo string
-			if r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/completions") {
+			var modelName string
+			if r.Method == "POST" && (strings.HasSuffix(r.URL.Path, "/completions") || strings.HasSuffix(r.URL.Path, "/messages")) {
 				var requestBody struct {
 					Model string `json:"model"`
 				}
 				if body, err := io.ReadAll(r.Body); err == nil {
 					r.Body = io.NopCloser(bytes.NewBuffer(body)) // 重新设置 body 以供后续读取
 					if err := json.Unmarshal(body, &requestBody); err == nil {
-						modelInfo = fmt.Sprintf(" model=%s", requestBody.Model)
+						modelName = requestBody.Model
 					}
 				}
+			} else if r.Method == "POST" && strings.HasPrefix(r.URL.Path, "/v1beta/models/") {
+				// Gemini 请求的模型名位于路径中
+				modelName, _, _ = strings.Cut(strings.TrimPrefix(r.URL.Path, "/v1beta/models/"), ":")
 			}
 
-			next.ServeHTTP(wrapped, r)
-
-			logMutex.Lock()
-			logger := log.New(bufWriter, "", log.LstdFlags)
-			logger.Printf(
-				"%s %s%s IP=%s Status=%d Duration=%s",
-				r.Method,
-				r.RequestURI,
-				modelInfo,
-				realIP,
-				wrapped.status,
-				time.Since(start),
-			)
-			bufWriter.Flush()
-			logMutex.Unlock()
+			ctx, info := ensureRequestInfo(r.Context())
+			next.ServeHTTP(wrapped, r.WithContext(ctx))
+
+			level := slog.LevelInfo
+			switch {
+			case wrapped.status >= http.StatusInternalServerError:
+				level = slog.LevelError
+			case wrapped.status >= http.StatusBadRequest:
+				level = slog.LevelWarn
+			}
+			attrs := []slog.Attr{
+				slog.String("method", r.Method),
+				slog.String("uri", redactURI(r)),
+				slog.String("ip", realIP),
+				slog.Int("status", wrapped.status),
+				slog.Int64("duration_ms", time.Since(start).Milliseconds()),
+			}
+			if modelName != "" {
+				attrs = append(attrs, slog.String("model", modelName))
+			}
+			if name := info.name(); name != "" {
+				attrs = append(attrs, slog.String("key", name))
+			}
+			slog.LogAttrs(ctx, level, "request", attrs...)
 		})
 	}
 }
@@ -131,3 +194,13 @@ func (rw *responseWriter) Flush() {
 // 	}
 // 	return nil, nil, http.ErrNotSupported
 // }
+
+// redactURI 返回用于日志的请求 URI，隐藏 Gemini 风格 ?key= 查询参数中的密钥
+func redactURI(r *http.Request) string {
+	query := r.URL.Query()
+	if !query.Has("key") {
+		return r.RequestURI
+	}
+	query.Set("key", "[REDACTED]")
+	return r.URL.Path + "?" + query.Encode()
+}
@@ -0,0 +1,28 @@
+package middleware
+
+import (
+	"net/http"
+	"pieces-os-go/internal/config"
+	"pieces-os-go/internal/metrics"
+	"pieces-os-go/internal/usage"
+	"time"
+)
+
+// Metrics 记录每个请求的路由、模型、状态码、密钥和耗时
+// 需放在超时中间件之前以记录超时响应，模型和密钥由内层的服务层和认证中间件填充
+func Metrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		wrapped := wrapResponseWriter(w)
+
+		ctx, entry := usage.EnsureEntry(r.Context())
+		ctx, info := ensureRequestInfo(ctx)
+		next.ServeHTTP(wrapped, r.WithContext(ctx))
+
+		route := config.RouteName(r.URL.Path)
+		if route == "" {
+			route = "other"
+		}
+		metrics.ObserveRequest(route, entry.Model(), info.key(), wrapped.status, time.Since(start))
+	})
+}
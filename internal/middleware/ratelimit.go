@@ -1,71 +1,114 @@
 package middleware
 
 import (
+	"fmt"
 	"net"
 	"net/http"
 	"pieces-os-go/internal/config"
+	"pieces-os-go/internal/keystore"
+	"pieces-os-go/internal/metrics"
 	"pieces-os-go/internal/model"
+	"pieces-os-go/internal/ratelimit"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 )
 
-type visitor struct {
-	firstSeen time.Time
-	counts    map[string]int
-}
-
 type RateLimiter struct {
-	visitors  map[string]*visitor
+	limiter   *ratelimit.Limiter
 	mu        sync.Mutex
-	rules     map[string]config.RateLimitRule
+	route     string // 为空表示全局限流器
+	rules     []ratelimit.Rule
 	whitelist map[string]bool
 	blacklist *BlacklistManager
+	children  []*RateLimiter // 由 ForRoute 创建的路由限流器
 }
 
 func NewRateLimiter(cfg *config.Config) *RateLimiter {
-	whitelist := make(map[string]bool)
-	for _, ip := range cfg.IPWhitelist {
-		whitelist[strings.TrimSpace(ip)] = true
-	}
-
 	rl := &RateLimiter{
-		visitors:  make(map[string]*visitor),
-		rules:     cfg.RateLimits,
-		whitelist: whitelist,
+		limiter:   ratelimit.NewLimiter(),
+		rules:     buildRules(cfg.GlobalRateLimits()),
+		whitelist: buildWhitelist(cfg),
 		blacklist: NewBlacklistManager(cfg),
 	}
+	metrics.SetBlacklistSource(rl.blacklist.metricsStats)
 
-	// 每小时清理一次过期记录
+	// 定期清理额度已恢复的限流状态，清理不影响限流结果
 	go func() {
-		ticker := time.NewTicker(time.Hour)
+		ticker := time.NewTicker(time.Minute)
 		defer ticker.Stop()
 		for range ticker.C {
 			rl.cleanup()
+			for _, child := range rl.routeLimiters() {
+				child.cleanup()
+			}
 		}
 	}()
 
 	return rl
 }
 
-// NewStrictRateLimiter 创建一个只应用严格规则的限流器
-func NewStrictRateLimiter(cfg *config.Config) *RateLimiter {
-	whitelist := make(map[string]bool)
-	for _, ip := range cfg.IPWhitelist {
-		whitelist[strings.TrimSpace(ip)] = true
+// ForRoute 创建一个只应用路由所引用规则的限流器，与全局限流器共用黑名单
+func (rl *RateLimiter) ForRoute(cfg *config.Config, route string) *RateLimiter {
+	child := &RateLimiter{
+		limiter:   ratelimit.NewLimiter(),
+		route:     route,
+		rules:     buildRules(cfg.RouteRateLimits(route)),
+		whitelist: buildWhitelist(cfg),
+		blacklist: rl.blacklist,
 	}
 
-	// 只使用严格规则
-	strictRules := map[string]config.RateLimitRule{
-		"strict": cfg.RateLimits["strict"],
+	rl.mu.Lock()
+	rl.children = append(rl.children, child)
+	rl.mu.Unlock()
+	return child
+}
+
+// UpdateConfig 应用新的限流规则、白名单和黑名单配置，已有的限流状态保留
+func (rl *RateLimiter) UpdateConfig(cfg *config.Config) {
+	rl.mu.Lock()
+	if rl.route == "" {
+		rl.rules = buildRules(cfg.GlobalRateLimits())
+	} else {
+		rl.rules = buildRules(cfg.RouteRateLimits(rl.route))
 	}
+	rl.whitelist = buildWhitelist(cfg)
+	rl.mu.Unlock()
 
-	return &RateLimiter{
-		visitors:  make(map[string]*visitor),
-		rules:     strictRules,
-		whitelist: whitelist,
-		blacklist: NewBlacklistManager(cfg),
+	for _, child := range rl.routeLimiters() {
+		child.UpdateConfig(cfg)
+	}
+	if rl.route == "" {
+		rl.blacklist.UpdateConfig(cfg)
+	}
+}
+
+func (rl *RateLimiter) routeLimiters() []*RateLimiter {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return append([]*RateLimiter(nil), rl.children...)
+}
+
+// buildRules 返回按名称排序的已启用规则
+func buildRules(rules map[string]config.RateLimitRule) []ratelimit.Rule {
+	var result []ratelimit.Rule
+	for name, rule := range rules {
+		if rule.Enabled && rule.Limit > 0 && rule.Window > 0 {
+			result = append(result, ratelimit.Rule{Name: name, Limit: rule.Limit, Window: rule.Window})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+func buildWhitelist(cfg *config.Config) map[string]bool {
+	whitelist := make(map[string]bool)
+	for _, ip := range cfg.IPWhitelist {
+		whitelist[strings.TrimSpace(ip)] = true
 	}
+	return whitelist
 }
 
 func (rl *RateLimiter) RateLimit(next http.Handler) http.Handler {
@@ -74,55 +117,63 @@ func (rl *RateLimiter) RateLimit(next http.Handler) http.Handler {
 
 		// 检查是否在黑名单中
 		if rl.blacklist.IsBlocked(ip) {
+			metrics.IncRejection(metrics.LimiterBlacklist, "ip")
 			writeError(w, model.NewAPIError(model.ErrIPBlocked, "IP has been blocked", http.StatusForbidden))
 			return
 		}
 
-		// 检查白名单
-		if rl.whitelist[ip] {
+		rl.mu.Lock()
+		rules, whitelisted := rl.rules, rl.whitelist[ip]
+		rl.mu.Unlock()
+
+		// 白名单中的IP不受限流规则限制
+		if whitelisted || len(rules) == 0 {
 			next.ServeHTTP(w, r)
 			return
 		}
 
-		rl.mu.Lock()
-		v, exists := rl.visitors[ip]
-		if !exists {
-			v = &visitor{
-				firstSeen: time.Now(),
-				counts:    make(map[string]int),
-			}
-			rl.visitors[ip] = v
+		// 已认证的请求按密钥计数，否则按IP计数
+		identity := ip
+		if key := keystore.FromContext(r.Context()); key != nil {
+			identity = "key:" + key.ID
 		}
 
-		// 检查所有启用的规则
-		for ruleName, rule := range rl.rules {
-			if !rule.Enabled {
-				continue
-			}
-
-			// 检查是否需要重置计数器
-			if time.Since(v.firstSeen) > rule.Window {
-				v.firstSeen = time.Now()
-				v.counts = make(map[string]int)
-			}
-
-			// 检查是否超过限制
-			if v.counts[ruleName] >= rule.Limit {
-				rl.mu.Unlock()
-				// 记录违规
-				rl.blacklist.RecordViolation(ip)
-				writeError(w, model.NewAPIError(model.ErrRateLimitExceeded, "Rate limit exceeded", http.StatusTooManyRequests))
-				return
-			}
-
-			v.counts[ruleName]++
+		result := rl.limiter.Allow(identity, rules, time.Now())
+		setRateLimitHeaders(w, result)
+		if !result.Allowed {
+			// 记录违规
+			rl.blacklist.RecordViolation(ip)
+			metrics.IncRejection(metrics.LimiterRequest, result.Rule)
+			apiErr := model.NewAPIError(model.ErrRateLimitExceeded,
+				fmt.Sprintf("Rate limit exceeded for rule '%s', retry after %d seconds", result.Rule, ceilSeconds(result.RetryAfter)),
+				http.StatusTooManyRequests)
+			apiErr.RetryAfter = result.RetryAfter
+			writeError(w, apiErr)
+			return
 		}
 
-		rl.mu.Unlock()
 		next.ServeHTTP(w, r)
 	})
 }
 
+// setRateLimitHeaders 写入 X-RateLimit-* 响应头，时间以秒为单位
+// 全局和路由限流器都会写入，保留剩余额度较少的一方
+func setRateLimitHeaders(w http.ResponseWriter, result ratelimit.Result) {
+	h := w.Header()
+	if existing := h.Get("X-RateLimit-Remaining"); existing != "" {
+		if remaining, err := strconv.Atoi(existing); err == nil && remaining <= result.Remaining {
+			return
+		}
+	}
+	h.Set("X-RateLimit-Limit", strconv.Itoa(result.Limit))
+	h.Set("X-RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	h.Set("X-RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
+
 // GetRealIP 获取真实IP地址，支持IPv4和IPv6
 func GetRealIP(r *http.Request) string {
 	// 按优先级尝试获取真实IP
@@ -153,22 +204,7 @@ func (rl *RateLimiter) GetBlacklist() *BlacklistManager {
 	return rl.blacklist
 }
 
-// 添加清理过期访问者的方法
+// cleanup 清理额度已完全恢复的限流状态
 func (rl *RateLimiter) cleanup() {
-	rl.mu.Lock()
-	defer rl.mu.Unlock()
-
-	now := time.Now()
-	for ip, v := range rl.visitors {
-		// 清理超过最大窗口期的记录
-		maxWindow := time.Duration(0)
-		for _, rule := range rl.rules {
-			if rule.Window > maxWindow {
-				maxWindow = rule.Window
-			}
-		}
-		if now.Sub(v.firstSeen) > maxWindow {
-			delete(rl.visitors, ip)
-		}
-	}
+	rl.limiter.Cleanup(time.Now())
 }
@@ -0,0 +1,40 @@
+package middleware
+
+import (
+	"net/http"
+	"pieces-os-go/internal/logging"
+
+	"github.com/google/uuid"
+)
+
+// maxRequestIDLength 客户端传入请求 ID 的最大长度
+const maxRequestIDLength = 128
+
+// RequestID 沿用客户端传入的 X-Request-ID，没有或不合法时生成新的 ID
+// 请求 ID 写入响应头并存入上下文，之后带 context 的日志都会带上它，需放在最外层
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(logging.RequestIDHeader)
+		if !validRequestID(id) {
+			id = uuid.New().String()
+		}
+		w.Header().Set(logging.RequestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(logging.WithRequestID(r.Context(), id)))
+	})
+}
+
+// validRequestID 只接受长度有限的字母、数字和 . _ : -，避免日志注入
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '.', c == '_', c == ':', c == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"net/http"
 	"pieces-os-go/internal/config"
+	"pieces-os-go/internal/metrics"
 	"pieces-os-go/internal/model"
 	"sync/atomic"
 	"time"
@@ -26,16 +27,25 @@ func GetTimeoutStats() TimeoutStats {
 	}
 }
 
-func TimeoutMiddleware(cfg *config.Config) func(http.Handler) http.Handler {
+func TimeoutMiddleware(store *config.Store) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			cfg := store.Current()
 			var timeout time.Duration
 			isStreamRequest := r.Header.Get("Accept") == "text/event-stream"
 
+			// 路由单独配置的超时时间优先
+			route := cfg.Route(config.RouteName(r.URL.Path))
 			if isStreamRequest {
 				timeout = cfg.StreamTimeout
+				if route.StreamTimeout > 0 {
+					timeout = route.StreamTimeout
+				}
 			} else {
 				timeout = cfg.RequestTimeout
+				if route.RequestTimeout > 0 {
+					timeout = route.RequestTimeout
+				}
 			}
 
 			if timeout == 0 {
@@ -62,9 +72,11 @@ func TimeoutMiddleware(cfg *config.Config) func(http.Handler) http.Handler {
 					if !rw.written {
 						if isStreamRequest {
 							atomic.AddInt64(&stats.streamTimeouts, 1)
+							metrics.IncTimeout("stream")
 							writeTimeoutError(w, model.ErrStreamTimeout, "Stream timeout")
 						} else {
 							atomic.AddInt64(&stats.normalTimeouts, 1)
+							metrics.IncTimeout("request")
 							writeTimeoutError(w, model.ErrRequestTimeout, "Request timeout")
 						}
 					}
@@ -97,14 +109,21 @@ func (w *timeoutResponseWriter) Write(b []byte) (int, error) {
 	return w.ResponseWriter.Write(b)
 }
 
+// Flush 实现 http.Flusher 接口，否则流式响应在设置了超时时间时无法输出
+func (w *timeoutResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
 func writeTimeoutError(w http.ResponseWriter, code model.ErrorCode, message string) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusGatewayTimeout)
-	json.NewEncoder(w).Encode(map[string]interface{}{
+	json.NewEncoder(w).Encode(withRequestID(w, map[string]interface{}{
 		"error": map[string]interface{}{
 			"message": message,
 			"type":    "timeout_error",
 			"code":    code,
 		},
-	})
+	}))
 }
@@ -0,0 +1,33 @@
+package middleware
+
+import (
+	"net/http"
+	"pieces-os-go/internal/config"
+	"pieces-os-go/internal/keystore"
+	"pieces-os-go/internal/ratelimit"
+)
+
+// TokenLimit 按密钥和 IP 创建 token 限流额度预留，由服务层在调用上游前预扣
+// 处理器返回时按已记录的用量结算，客户端提前断开后服务层才记录的用量在记录时直接扣除
+// 需放在认证中间件之后，限额从当前配置读取，重载后立即生效
+func TokenLimit(limiter *ratelimit.TokenLimiter, store *config.Store) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			cfg := store.Current()
+
+			var limits []ratelimit.Limit
+			if key := keystore.FromContext(r.Context()); key != nil {
+				tpm := cfg.TokenLimits.PerKey
+				if key.Quota.TokensPerMinute > 0 {
+					tpm = key.Quota.TokensPerMinute
+				}
+				limits = append(limits, ratelimit.Limit{ID: "key:" + key.ID, TPM: tpm})
+			}
+			limits = append(limits, ratelimit.Limit{ID: "ip:" + GetRealIP(r), TPM: cfg.TokenLimits.PerIP})
+
+			ctx, res := limiter.Begin(r.Context(), limits...)
+			defer res.Finish()
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package middleware
+
+import (
+	"net/http"
+	"pieces-os-go/internal/logging"
+	"pieces-os-go/internal/tracing"
+	"pieces-os-go/internal/usage"
+
+	"github.com/go-chi/chi/v5"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracing 为每个请求创建服务端 span，客户端传入 traceparent 时沿用其链路
+// 需放在请求 ID 中间件之后、日志中间件之前，使访问日志带上 trace_id
+// 模型和密钥由内层的服务层和认证中间件填充后记录到 span 上
+func Tracing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, entry := usage.EnsureEntry(r.Context())
+		ctx, info := ensureRequestInfo(ctx)
+		ctx = otel.GetTextMapPropagator().Extract(ctx, propagation.HeaderCarrier(r.Header))
+		ctx, span := tracing.Tracer().Start(ctx, r.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.URLPath(r.URL.Path),
+				semconv.ClientAddress(GetRealIP(r)),
+			),
+		)
+		if id := logging.RequestID(ctx); id != "" {
+			span.SetAttributes(attribute.String("request.id", id))
+		}
+		defer span.End()
+
+		wrapped := wrapResponseWriter(w)
+		next.ServeHTTP(wrapped, r.WithContext(ctx))
+
+		if rctx := chi.RouteContext(r.Context()); rctx != nil {
+			if pattern := rctx.RoutePattern(); pattern != "" {
+				span.SetName(r.Method + " " + pattern)
+				span.SetAttributes(semconv.HTTPRoute(pattern))
+			}
+		}
+		span.SetAttributes(semconv.HTTPResponseStatusCode(wrapped.status))
+		if model := entry.Model(); model != "" {
+			span.SetAttributes(attribute.String("llm.model", model))
+		}
+		if key := info.key(); key != "" {
+			span.SetAttributes(attribute.String("api_key.id", key))
+		}
+		if wrapped.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(wrapped.status))
+		}
+	})
+}
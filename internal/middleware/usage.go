@@ -0,0 +1,40 @@
+package middleware
+
+import (
+	"net/http"
+	"pieces-os-go/internal/config"
+	"pieces-os-go/internal/keystore"
+	"pieces-os-go/internal/usage"
+	"time"
+)
+
+// UsageRecorder 记录到达模型的请求的用量，需放在认证中间件之后以获取密钥
+// store 为 nil 时不记录
+func UsageRecorder(store *usage.Store) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if store == nil {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			wrapped := wrapResponseWriter(w)
+			ctx, entry := usage.EnsureEntry(r.Context())
+			next.ServeHTTP(wrapped, r.WithContext(ctx))
+
+			rec := usage.Record{
+				Time:      start,
+				Route:     config.RouteName(r.URL.Path),
+				Status:    wrapped.status,
+				LatencyMs: time.Since(start).Milliseconds(),
+			}
+			if !entry.Fill(&rec) {
+				return
+			}
+			if key := keystore.FromContext(r.Context()); key != nil {
+				rec.KeyID = key.ID
+				rec.KeyName = key.Name
+			}
+			store.Add(rec)
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package model
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// ModelRedirectHeader 请求的模型已下线、被转发到其他模型时，在响应中说明实际使用的模型
+	ModelRedirectHeader = "X-Model-Redirect"
+	// DeprecationHeader 请求的模型已下线时设置为 true
+	DeprecationHeader = "Deprecation"
+)
+
+// ModelAlias 模型别名指向的模型
+type ModelAlias struct {
+	Target     string `yaml:"target" toml:"target"`
+	Deprecated bool   `yaml:"deprecated" toml:"deprecated"` // 别名是已下线的模型，请求照常转发到 Target，并在响应头中提示
+}
+
+var (
+	builtinAliases map[string]ModelAlias // 模型目录中的内置别名
+
+	modelAliases   map[string]ModelAlias // 内置别名与配置的别名合并后的别名表
+	modelAliasesMu sync.RWMutex
+)
+
+// UnmarshalYAML 兼容 `别名: 目标模型` 的简写，并拒绝未知字段
+func (a *ModelAlias) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		return value.Decode(&a.Target)
+	}
+	if value.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(value.Content); i += 2 {
+			key := value.Content[i]
+			switch key.Value {
+			case "target", "deprecated":
+			default:
+				return &yaml.TypeError{Errors: []string{
+					fmt.Sprintf("line %d: field %s not found in type model.ModelAlias", key.Line, key.Value),
+				}}
+			}
+		}
+	}
+
+	type plain ModelAlias
+	return value.Decode((*plain)(a))
+}
+
+// UnmarshalTOML 与 UnmarshalYAML 相同，兼容简写并拒绝未知字段
+func (a *ModelAlias) UnmarshalTOML(data any) error {
+	switch v := data.(type) {
+	case string:
+		a.Target = v
+		return nil
+	case map[string]any:
+		for key, value := range v {
+			var ok bool
+			switch key {
+			case "target":
+				a.Target, ok = value.(string)
+			case "deprecated":
+				a.Deprecated, ok = value.(bool)
+			default:
+				return fmt.Errorf("field %s not found in type model.ModelAlias", key)
+			}
+			if !ok {
+				return fmt.Errorf("invalid value for %s: %v", key, value)
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("model alias must be a model name or a table with target and deprecated, got %v", data)
+	}
+}
+
+// SetModelAliases 设置配置的别名，与模型目录中的内置别名合并，配置的别名优先
+// 目标为内置别名时解析为其指向的模型
+func SetModelAliases(aliases map[string]ModelAlias) {
+	table := make(map[string]ModelAlias, len(builtinAliases)+len(aliases))
+	for alias, entry := range builtinAliases {
+		table[alias] = entry
+	}
+	for alias, entry := range aliases {
+		if builtin, ok := builtinAliases[entry.Target]; ok {
+			entry.Target = builtin.Target
+		}
+		table[alias] = entry
+	}
+
+	modelAliasesMu.Lock()
+	defer modelAliasesMu.Unlock()
+	modelAliases = table
+}
+
+// LookupAlias 返回名称对应的别名，名称不是别名时返回 false
+func LookupAlias(name string) (ModelAlias, bool) {
+	modelAliasesMu.RLock()
+	defer modelAliasesMu.RUnlock()
+	entry, ok := modelAliases[name]
+	return entry, ok
+}
+
+// resolveAlias 返回别名对应的目标模型，非别名原样返回
+func resolveAlias(m string) string {
+	if entry, ok := LookupAlias(m); ok {
+		return entry.Target
+	}
+	return m
+}
+
+// IsCatalogModel 判断模型目录中是否有该模型，不解析别名
+func IsCatalogModel(name string) bool {
+	_, exists := SupportedModels[normalizeDateSuffix(name)]
+	return exists
+}
+
+// IsBuiltinAlias 判断名称是否为模型目录中的内置别名
+func IsBuiltinAlias(name string) bool {
+	_, exists := builtinAliases[name]
+	return exists
+}
+
+// AliasModels 返回按名称排序的别名条目，条目的其余字段与目标模型相同
+func AliasModels() []Model {
+	modelAliasesMu.RLock()
+	defer modelAliasesMu.RUnlock()
+
+	models := make([]Model, 0, len(modelAliases))
+	for alias, entry := range modelAliases {
+		target, exists := SupportedModels[normalizeDateSuffix(entry.Target)]
+		if !exists {
+			continue
+		}
+		target.AliasOf = target.ID
+		target.ID = alias
+		target.Deprecated = entry.Deprecated
+		models = append(models, target)
+	}
+	sort.Slice(models, func(i, j int) bool { return models[i].ID < models[j].ID })
+	return models
+}
@@ -0,0 +1,156 @@
+package model
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Anthropic 内容块类型
+const (
+	AnthropicBlockText = "text"
+)
+
+// Anthropic 停止原因
+const (
+	AnthropicStopEndTurn      = "end_turn"
+	AnthropicStopMaxTokens    = "max_tokens"
+	AnthropicStopStopSequence = "stop_sequence"
+)
+
+// Anthropic 流式事件类型
+const (
+	AnthropicEventMessageStart      = "message_start"
+	AnthropicEventContentBlockStart = "content_block_start"
+	AnthropicEventPing              = "ping"
+	AnthropicEventContentBlockDelta = "content_block_delta"
+	AnthropicEventContentBlockStop  = "content_block_stop"
+	AnthropicEventMessageDelta      = "message_delta"
+	AnthropicEventMessageStop       = "message_stop"
+	AnthropicEventError             = "error"
+)
+
+// AnthropicMessagesRequest Anthropic Messages API 的请求参数结构
+type AnthropicMessagesRequest struct {
+	Model         string             `json:"model"`
+	Messages      []AnthropicMessage `json:"messages"`
+	System        AnthropicContent   `json:"system,omitempty"`
+	MaxTokens     int                `json:"max_tokens"`
+	Stream        bool               `json:"stream"`
+	Temperature   *float64           `json:"temperature,omitempty"`
+	TopP          *float64           `json:"top_p,omitempty"`
+	TopK          int                `json:"top_k,omitempty"`
+	StopSequences []string           `json:"stop_sequences,omitempty"`
+	Metadata      map[string]any     `json:"metadata,omitempty"`
+}
+
+// AnthropicMessage Anthropic 格式的单条消息
+type AnthropicMessage struct {
+	Role    Role             `json:"role"`
+	Content AnthropicContent `json:"content"`
+}
+
+// AnthropicContentBlock Anthropic 内容块
+type AnthropicContentBlock struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+// AnthropicContent 兼容字符串和内容块数组两种写法
+type AnthropicContent []AnthropicContentBlock
+
+// UnmarshalJSON 字符串会被转换为单个 text 内容块
+func (c *AnthropicContent) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*c = AnthropicContent{{Type: AnthropicBlockText, Text: text}}
+		return nil
+	}
+
+	var blocks []AnthropicContentBlock
+	if err := json.Unmarshal(data, &blocks); err != nil {
+		return fmt.Errorf("content must be a string or an array of content blocks")
+	}
+	*c = blocks
+	return nil
+}
+
+// Text 拼接所有 text 内容块，遇到不支持的内容块类型时返回错误
+func (c AnthropicContent) Text() (string, error) {
+	parts := make([]string, 0, len(c))
+	for _, block := range c {
+		if block.Type != AnthropicBlockText {
+			return "", fmt.Errorf("content block type '%s' is not supported", block.Type)
+		}
+		parts = append(parts, block.Text)
+	}
+	return strings.Join(parts, "\n"), nil
+}
+
+// AnthropicUsage Anthropic 格式的用量信息
+type AnthropicUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+// AnthropicMessagesResponse Anthropic Messages API 的响应结构
+type AnthropicMessagesResponse struct {
+	ID           string                  `json:"id"`
+	Type         string                  `json:"type"`
+	Role         Role                    `json:"role"`
+	Content      []AnthropicContentBlock `json:"content"`
+	Model        string                  `json:"model"`
+	StopReason   *string                 `json:"stop_reason"`
+	StopSequence *string                 `json:"stop_sequence"`
+	Usage        *AnthropicUsage         `json:"usage"`
+}
+
+// AnthropicStreamDelta 流式事件中的增量内容
+type AnthropicStreamDelta struct {
+	Type         string  `json:"type,omitempty"`
+	Text         string  `json:"text,omitempty"`
+	StopReason   *string `json:"stop_reason,omitempty"`
+	StopSequence *string `json:"stop_sequence,omitempty"`
+}
+
+// AnthropicStreamEvent Anthropic 流式事件
+type AnthropicStreamEvent struct {
+	Type         string                     `json:"type"`
+	Message      *AnthropicMessagesResponse `json:"message,omitempty"`
+	Index        *int                       `json:"index,omitempty"`
+	ContentBlock *AnthropicContentBlock     `json:"content_block,omitempty"`
+	Delta        *AnthropicStreamDelta      `json:"delta,omitempty"`
+	Usage        *AnthropicUsage            `json:"usage,omitempty"`
+}
+
+// AnthropicStopReason 将 OpenAI 的 finish_reason 转换为 Anthropic 的 stop_reason，stopSequence 为匹配到的停止序列
+func AnthropicStopReason(reason FinishReason, stopSequence string) string {
+	switch {
+	case reason == FinishReasonLength:
+		return AnthropicStopMaxTokens
+	case stopSequence != "":
+		return AnthropicStopStopSequence
+	default:
+		return AnthropicStopEndTurn
+	}
+}
+
+// AnthropicErrorType 将 HTTP 状态码映射为 Anthropic 的错误类型
+func AnthropicErrorType(status int) string {
+	switch status {
+	case 400, 413:
+		return "invalid_request_error"
+	case 401:
+		return "authentication_error"
+	case 403:
+		return "permission_error"
+	case 404:
+		return "not_found_error"
+	case 429:
+		return "rate_limit_error"
+	case 503, 529:
+		return "overloaded_error"
+	default:
+		return "api_error"
+	}
+}
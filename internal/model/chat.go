@@ -1,5 +1,11 @@
 package model
 
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
 // Role 定义聊天角色类型
 type Role string
 
@@ -20,19 +26,126 @@ const (
 )
 
 // ChatMessage 聊天消息的基本结构,包含角色和内容
+// 请求中的 content 可以是字符串或内容片段数组，上游只接受文本，Content 始终为纯文本
 type ChatMessage struct {
-	Role    Role   `json:"role"`
-	Content string `json:"content"`
-	Name    string `json:"name,omitempty"`
+	Role       Role       `json:"role"`
+	Content    string     `json:"content"`
+	Name       string     `json:"name,omitempty"`
+	ToolCalls  []ToolCall `json:"tool_calls,omitempty"`   // 助手消息中的工具调用
+	ToolCallID string     `json:"tool_call_id,omitempty"` // 工具结果消息对应的调用 ID
+
+	Parts []ContentPart `json:"-"` // content 为片段数组时的原始片段，Content 为其中文本片段的拼接
 }
 
 // ChatCompletionRequest 聊天补全API的请求参数结构
+// 上游协议只能传递 temperature 和 top_p，max_tokens、stop、n、工具调用和 response_format 由网关执行，
+// presence_penalty、frequency_penalty、seed 和 user 只做校验
 type ChatCompletionRequest struct {
-	Model       string        `json:"model"`
-	Messages    []ChatMessage `json:"messages"`
-	Stream      bool          `json:"stream"`
-	Temperature float64       `json:"temperature"`
-	TopP        float64       `json:"top_p"`
+	Model               string          `json:"model"`
+	Messages            []ChatMessage   `json:"messages"`
+	Stream              bool            `json:"stream"`
+	Temperature         float64         `json:"temperature"`
+	TopP                float64         `json:"top_p"`
+	MaxTokens           int             `json:"max_tokens,omitempty"`
+	MaxCompletionTokens int             `json:"max_completion_tokens,omitempty"` // 新版 SDK 使用的 max_tokens，同时指定时优先
+	Stop                StopSequences   `json:"stop,omitempty"`
+	N                   int             `json:"n,omitempty"`
+	PresencePenalty     float64         `json:"presence_penalty,omitempty"`
+	FrequencyPenalty    float64         `json:"frequency_penalty,omitempty"`
+	Seed                *int64          `json:"seed,omitempty"`
+	User                string          `json:"user,omitempty"`
+	Tools               []Tool          `json:"tools,omitempty"`
+	ToolChoice          *ToolChoice     `json:"tool_choice,omitempty"`
+	ResponseFormat      *ResponseFormat `json:"response_format,omitempty"`
+	Truncation          string          `json:"truncation,omitempty"` // 扩展字段，提示词过长时的截断策略
+
+	Truncated  *TruncationReport `json:"-"` // 提示词被截断时的截断结果
+	Redirected string            `json:"-"` // 请求的模型已下线时实际使用的模型
+}
+
+const (
+	// MaxChoices n 的最大值，每个选项对应一次上游调用
+	MaxChoices = 8
+	// MaxStopSequences stop 最多包含的停止序列数
+	MaxStopSequences = 4
+)
+
+// StopSequences 停止序列，兼容 OpenAI 的字符串和字符串数组两种写法
+type StopSequences []string
+
+func (s *StopSequences) UnmarshalJSON(data []byte) error {
+	var one *string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*s = nil
+		if one != nil {
+			*s = StopSequences{*one}
+		}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return fmt.Errorf("stop: must be a string or an array of strings")
+	}
+	*s = many
+	return nil
+}
+
+// OutputLimit 返回补全内容的 token 上限，为 0 时不限制
+func (r *ChatCompletionRequest) OutputLimit() int {
+	if r.MaxCompletionTokens > 0 {
+		return r.MaxCompletionTokens
+	}
+	return r.MaxTokens
+}
+
+// Choices 返回需要生成的选项数
+func (r *ChatCompletionRequest) Choices() int {
+	if r.N > 1 {
+		return r.N
+	}
+	return 1
+}
+
+// Validate 校验请求参数的取值范围
+func (r *ChatCompletionRequest) Validate() *APIError {
+	invalid := func(format string, args ...interface{}) *APIError {
+		return NewAPIError(ErrInvalidRequest, fmt.Sprintf(format, args...), http.StatusBadRequest)
+	}
+
+	switch {
+	case r.Temperature < 0 || r.Temperature > 2:
+		return invalid("temperature: must be between 0 and 2")
+	case r.TopP < 0 || r.TopP > 1:
+		return invalid("top_p: must be between 0 and 1")
+	// 0 与未设置相同，表示不限制
+	case r.MaxTokens < 0:
+		return invalid("max_tokens: must not be negative")
+	case r.MaxCompletionTokens < 0:
+		return invalid("max_completion_tokens: must not be negative")
+	case r.N < 0 || r.N > MaxChoices:
+		return invalid("n: must be between 1 and %d", MaxChoices)
+	case r.PresencePenalty < -2 || r.PresencePenalty > 2:
+		return invalid("presence_penalty: must be between -2 and 2")
+	case r.FrequencyPenalty < -2 || r.FrequencyPenalty > 2:
+		return invalid("frequency_penalty: must be between -2 and 2")
+	case len(r.Stop) > MaxStopSequences:
+		return invalid("stop: at most %d sequences are allowed", MaxStopSequences)
+	}
+	for i, stop := range r.Stop {
+		if stop == "" {
+			return invalid("stop[%d]: must not be empty", i)
+		}
+	}
+	if err := r.validateContent(); err != nil {
+		return invalid("%s", err.Error())
+	}
+	if err := r.validateTools(); err != nil {
+		return invalid("%s", err.Error())
+	}
+	if err := r.validateResponseFormat(); err != nil {
+		return invalid("%s", err.Error())
+	}
+	return nil
 }
 
 // ChatCompletionResponse 聊天补全API的响应结构
@@ -50,7 +163,8 @@ type FinishReason string
 
 // 预定义的 FinishReason 值
 var (
-	FinishReasonStop FinishReason = "stop"
+	FinishReasonStop   FinishReason = "stop"
+	FinishReasonLength FinishReason = "length"
 )
 
 // Choice 聊天补全响应中的选项内容
@@ -58,6 +172,7 @@ type Choice struct {
 	Index        int          `json:"index"`
 	Message      *ChatMessage `json:"message"`
 	FinishReason FinishReason `json:"finish_reason,omitempty"`
+	StopSequence string       `json:"-"` // 因请求的停止序列结束时匹配到的序列，用于 Anthropic 接口的 stop_sequence
 }
 
 // Usage 聊天补全响应中的使用情况
@@ -82,10 +197,12 @@ type ChatCompletionStreamChoice struct {
 	Index        int                        `json:"index"`
 	Delta        *ChatCompletionStreamDelta `json:"delta"`
 	FinishReason FinishReason               `json:"finish_reason,omitempty"`
+	StopSequence string                     `json:"-"` // 同 Choice.StopSequence
 }
 
 // ChatCompletionStreamDelta 流式响应中的增量内容
 type ChatCompletionStreamDelta struct {
-	Role    Role   `json:"role,omitempty"`
-	Content string `json:"content,omitempty"`
+	Role      Role       `json:"role,omitempty"`
+	Content   string     `json:"content,omitempty"`
+	ToolCalls []ToolCall `json:"tool_calls,omitempty"`
 }
@@ -0,0 +1,102 @@
+package model
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// 内容片段的类型
+const (
+	ContentPartText     = "text"
+	ContentPartImageURL = "image_url"
+)
+
+// ContentPart OpenAI 消息内容数组中的片段
+type ContentPart struct {
+	Type     string    `json:"type"`
+	Text     string    `json:"text,omitempty"`
+	ImageURL *ImageURL `json:"image_url,omitempty"`
+}
+
+// ImageURL 图片片段的地址，可以是 URL 或 data URI
+type ImageURL struct {
+	URL    string `json:"url"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// UnmarshalJSON content 兼容字符串和内容片段数组两种写法
+// 片段数组中的文本片段按顺序以换行拼接为 Content，原始片段保存在 Parts 中，由 Validate 和服务层按模型能力校验
+func (m *ChatMessage) UnmarshalJSON(data []byte) error {
+	type plain ChatMessage
+	var raw struct {
+		plain
+		Content json.RawMessage `json:"content"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*m = ChatMessage(raw.plain)
+
+	content := raw.Content
+	if len(content) == 0 || string(content) == "null" {
+		return nil
+	}
+	if err := json.Unmarshal(content, &m.Content); err == nil {
+		return nil
+	}
+	if err := json.Unmarshal(content, &m.Parts); err != nil {
+		return fmt.Errorf("content must be a string or an array of content parts")
+	}
+	texts := make([]string, 0, len(m.Parts))
+	for _, part := range m.Parts {
+		if part.Type == ContentPartText {
+			texts = append(texts, part.Text)
+		}
+	}
+	m.Content = strings.Join(texts, "\n")
+	return nil
+}
+
+// MarshalJSON 有原始片段时将 content 编码为片段数组，使请求重新编码后不丢失图片片段
+func (m ChatMessage) MarshalJSON() ([]byte, error) {
+	type plain ChatMessage
+	if len(m.Parts) == 0 {
+		return json.Marshal(plain(m))
+	}
+	return json.Marshal(struct {
+		plain
+		Content []ContentPart `json:"content"`
+	}{plain(m), m.Parts})
+}
+
+// HasImages 消息中是否包含图片片段
+func (m *ChatMessage) HasImages() bool {
+	for _, part := range m.Parts {
+		if part.Type == ContentPartImageURL {
+			return true
+		}
+	}
+	return false
+}
+
+// validateContent 校验内容片段的类型和格式，图片片段只能出现在用户消息中
+func (r *ChatCompletionRequest) validateContent() error {
+	for i, msg := range r.Messages {
+		for j, part := range msg.Parts {
+			switch part.Type {
+			case ContentPartText:
+			case ContentPartImageURL:
+				if part.ImageURL == nil || part.ImageURL.URL == "" {
+					return fmt.Errorf("messages[%d].content[%d].image_url.url: required for image_url parts", i, j)
+				}
+				if msg.Role != RoleUser {
+					return fmt.Errorf("messages[%d].content[%d]: image parts are only allowed in user messages", i, j)
+				}
+			default:
+				return fmt.Errorf("messages[%d].content[%d].type: '%s' is not supported, must be 'text' or 'image_url'", i, j, part.Type)
+			}
+		}
+	}
+	return nil
+}
@@ -1,6 +1,9 @@
 package model
 
-import "fmt"
+import (
+	"fmt"
+	"time"
+)
 
 type ErrorCode string
 
@@ -25,6 +28,7 @@ const (
 	ErrModelOverload  ErrorCode = "model_overload"   // 模型过载
 	ErrContextTooLong ErrorCode = "context_too_long" // 上下文过长
 	ErrContentFilter  ErrorCode = "content_filter"   // 内容被过滤
+	ErrInvalidOutput  ErrorCode = "invalid_output"   // 模型输出不符合 response_format
 
 	// 超时相关错误
 	ErrRequestTimeout    ErrorCode = "request_timeout"    // 请求超时
@@ -50,6 +54,9 @@ const (
 	ErrSystemOverload    ErrorCode = "system_overload"    // 系统过载
 	ErrMaintenanceMode   ErrorCode = "maintenance_mode"   // 维护模式
 	ErrResourceExhausted ErrorCode = "resource_exhausted" // 资源耗尽
+
+	// 配置相关错误
+	ErrInvalidConfig ErrorCode = "invalid_config" // 配置校验失败
 )
 
 // HTTP状态码映射
@@ -61,7 +68,9 @@ var ErrorStatusMap = map[ErrorCode]int{
 	ErrMethodNotAllowed:   405,
 	ErrTooManyRequests:    429,
 	ErrRateLimitExceeded:  429,
+	ErrContextTooLong:     400,
 	ErrInternalError:      500,
+	ErrInvalidOutput:      502,
 	ErrServiceUnavailable: 503,
 	ErrGatewayTimeout:     504,
 	ErrRequestTimeout:     504,
@@ -73,6 +82,8 @@ type APIError struct {
 	Message string    `json:"message"`           // 错误消息
 	Status  int       `json:"-"`                 // HTTP 状态码
 	Details any       `json:"details,omitempty"` // 详细错误信息(可选)
+
+	RetryAfter time.Duration `json:"-"` // 建议的重试等待时间，非零时写入 Retry-After 响应头
 }
 
 func (e *APIError) Error() string {
@@ -108,3 +119,11 @@ func GetErrorStatus(code ErrorCode) int {
 	}
 	return 500 // 默认返回500
 }
+
+// RetryAfterSeconds 返回向上取整的重试等待秒数，用于 Retry-After 响应头
+func (e *APIError) RetryAfterSeconds() int {
+	if e.RetryAfter <= 0 {
+		return 0
+	}
+	return int((e.RetryAfter + time.Second - 1) / time.Second)
+}
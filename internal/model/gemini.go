@@ -0,0 +1,121 @@
+package model
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Gemini 接口动作
+const (
+	GeminiActionGenerateContent       = "generateContent"
+	GeminiActionStreamGenerateContent = "streamGenerateContent"
+)
+
+// Gemini 角色
+const (
+	GeminiRoleUser  = "user"
+	GeminiRoleModel = "model"
+)
+
+// Gemini 结束原因
+const (
+	GeminiFinishStop      = "STOP"
+	GeminiFinishMaxTokens = "MAX_TOKENS"
+)
+
+// GeminiGenerateContentRequest Gemini generateContent 的请求参数结构
+type GeminiGenerateContentRequest struct {
+	Contents          []GeminiContent         `json:"contents"`
+	SystemInstruction *GeminiContent          `json:"systemInstruction,omitempty"`
+	GenerationConfig  *GeminiGenerationConfig `json:"generationConfig,omitempty"`
+	SafetySettings    json.RawMessage         `json:"safetySettings,omitempty"`
+}
+
+// GeminiContent Gemini 格式的单条内容
+type GeminiContent struct {
+	Role  string       `json:"role,omitempty"`
+	Parts []GeminiPart `json:"parts"`
+}
+
+// GeminiPart Gemini 内容片段，目前仅支持文本
+type GeminiPart struct {
+	Text       string          `json:"text"`
+	InlineData json.RawMessage `json:"inlineData,omitempty"`
+	FileData   json.RawMessage `json:"fileData,omitempty"`
+}
+
+// Text 拼接所有文本片段，遇到非文本片段时返回错误
+func (c *GeminiContent) Text() (string, error) {
+	texts := make([]string, 0, len(c.Parts))
+	for i, part := range c.Parts {
+		if len(part.InlineData) > 0 || len(part.FileData) > 0 {
+			return "", fmt.Errorf("parts[%d]: only text parts are supported", i)
+		}
+		texts = append(texts, part.Text)
+	}
+	return strings.Join(texts, ""), nil
+}
+
+// GeminiGenerationConfig Gemini 生成参数
+type GeminiGenerationConfig struct {
+	Temperature     *float64 `json:"temperature,omitempty"`
+	TopP            *float64 `json:"topP,omitempty"`
+	TopK            int      `json:"topK,omitempty"`
+	MaxOutputTokens int      `json:"maxOutputTokens,omitempty"`
+	StopSequences   []string `json:"stopSequences,omitempty"`
+	CandidateCount  int      `json:"candidateCount,omitempty"`
+}
+
+// GeminiGenerateContentResponse Gemini generateContent 的响应结构，流式响应的每个数据块也使用该结构
+type GeminiGenerateContentResponse struct {
+	Candidates    []*GeminiCandidate   `json:"candidates"`
+	UsageMetadata *GeminiUsageMetadata `json:"usageMetadata,omitempty"`
+	ModelVersion  string               `json:"modelVersion,omitempty"`
+}
+
+// GeminiCandidate Gemini 响应中的候选结果
+type GeminiCandidate struct {
+	Content      *GeminiContent `json:"content"`
+	FinishReason string         `json:"finishReason,omitempty"`
+	Index        int            `json:"index"`
+}
+
+// GeminiUsageMetadata Gemini 格式的用量信息
+type GeminiUsageMetadata struct {
+	PromptTokenCount     int `json:"promptTokenCount"`
+	CandidatesTokenCount int `json:"candidatesTokenCount"`
+	TotalTokenCount      int `json:"totalTokenCount"`
+}
+
+// GeminiFinishReason 将 OpenAI 的 finish_reason 转换为 Gemini 的 finishReason
+func GeminiFinishReason(reason FinishReason) string {
+	switch reason {
+	case FinishReasonLength:
+		return GeminiFinishMaxTokens
+	default:
+		return GeminiFinishStop
+	}
+}
+
+// GeminiErrorStatus 将 HTTP 状态码映射为 Google API 的错误状态
+func GeminiErrorStatus(status int) string {
+	switch status {
+	case 400:
+		return "INVALID_ARGUMENT"
+	case 401:
+		return "UNAUTHENTICATED"
+	case 403:
+		return "PERMISSION_DENIED"
+	case 404:
+		return "NOT_FOUND"
+	case 429:
+		return "RESOURCE_EXHAUSTED"
+	case 503:
+		return "UNAVAILABLE"
+	case 504:
+		return "DEADLINE_EXCEEDED"
+	default:
+		return "INTERNAL"
+	}
+}
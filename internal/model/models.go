@@ -15,6 +15,47 @@ type Model struct {
 	Created int64                  `json:"created"`
 	OwnedBy string                 `json:"owned_by"`
 	Details map[string]interface{} `json:"details,omitempty"`
+	Backend string                 `json:"-"` // 处理该模型的上游后端名称
+
+	MaxTokens    TokenLimits       `json:"-"` // 模型目录中的上下文窗口，同时以 details.max_tokens 输出
+	Capabilities ModelCapabilities `json:"-"` // 模型目录中的输入能力，同时以 details.capabilities 输出
+
+	AliasOf    string `json:"alias_of,omitempty"`   // 别名条目指向的模型
+	Deprecated bool   `json:"deprecated,omitempty"` // 别名是已下线的模型，请求会被转发到 AliasOf
+}
+
+// ModelCapabilities 模型支持的输入类型
+// 上游协议只能传递文本，vision 只决定图片片段是被丢弃还是被拒绝
+type ModelCapabilities struct {
+	Vision bool `json:"vision"`
+}
+
+// TokenLimits 模型的 token 上限，为 0 时表示未知
+type TokenLimits struct {
+	Total  int `json:"total"`
+	Input  int `json:"input"`
+	Output int `json:"output"`
+}
+
+// InputLimit 返回提示词允许的最大 token 数，未单独配置输入上限时使用总上限
+func (l TokenLimits) InputLimit() int {
+	if l.Input > 0 {
+		return l.Input
+	}
+	return l.Total
+}
+
+// 内置的上游后端名称
+const (
+	BackendGPT    = "gpt"
+	BackendVertex = "vertex"
+)
+
+// providerBackends 模型目录未显式指定后端时，按提供商选择默认后端
+var providerBackends = map[string]string{
+	"openai":    BackendGPT,
+	"google":    BackendVertex,
+	"anthropic": BackendVertex,
 }
 
 type ModelsResponse struct {
@@ -118,6 +159,7 @@ func InitModels() error {
 	var err error
 	initModelsOnce.Do(func() {
 		SupportedModels = make(map[string]Model)
+		builtinAliases = make(map[string]ModelAlias)
 
 		// 读取模型配置文件
 		data, readErr := assets.Assets.ReadFile("cloud_model.json")
@@ -131,14 +173,14 @@ func InitModels() error {
 				Created struct {
 					Value string `json:"value"`
 				} `json:"created"`
-				Name      string `json:"name"`
-				Unique    string `json:"unique"`
-				Provider  string `json:"provider"`
-				MaxTokens struct {
-					Total  int `json:"total"`
-					Input  int `json:"input"`
-					Output int `json:"output"`
-				} `json:"maxTokens"`
+				Name         string            `json:"name"`
+				Unique       string            `json:"unique"`
+				Provider     string            `json:"provider"`
+				Backend      string            `json:"backend"`
+				MaxTokens    TokenLimits       `json:"maxTokens"`
+				Capabilities ModelCapabilities `json:"capabilities"`
+				Aliases      []string          `json:"aliases"`  // 该模型的其他名称，如带日期的快照名
+				Replaces     []string          `json:"replaces"` // 已下线、转发到该模型的模型
 			} `json:"iterable"`
 		}
 
@@ -153,33 +195,66 @@ func InitModels() error {
 
 			// 构建details
 			details := map[string]interface{}{
-				"name":       item.Name,
-				"max_tokens": item.MaxTokens,
+				"name":         item.Name,
+				"max_tokens":   item.MaxTokens,
+				"capabilities": item.Capabilities,
+			}
+
+			// 确定上游后端
+			provider := strings.ToLower(item.Provider)
+			backend := item.Backend
+			if backend == "" {
+				backend = providerBackends[provider]
+			}
+			if backend == "" {
+				err = fmt.Errorf("模型 %s 未配置上游后端", item.Unique)
+				return
 			}
 
 			model := Model{
 				ID:      item.Unique,
 				Object:  "model",
 				Created: createdTime.Unix(),
-				OwnedBy: strings.ToLower(item.Provider),
+				OwnedBy: provider,
 				Details: details,
+				Backend: backend,
+
+				MaxTokens:    item.MaxTokens,
+				Capabilities: item.Capabilities,
 			}
 
 			SupportedModels[item.Unique] = model
+
+			// 别名在 Replaces 中时为已下线的模型
+			aliases := make(map[string]bool, len(item.Aliases)+len(item.Replaces))
+			for _, alias := range item.Aliases {
+				aliases[alias] = false
+			}
+			for _, alias := range item.Replaces {
+				aliases[alias] = true
+			}
+			for alias, deprecated := range aliases {
+				if _, exists := builtinAliases[alias]; exists {
+					err = fmt.Errorf("模型别名 %s 重复", alias)
+					return
+				}
+				builtinAliases[alias] = ModelAlias{Target: item.Unique, Deprecated: deprecated}
+			}
 		}
+
+		for alias := range builtinAliases {
+			if _, exists := SupportedModels[normalizeDateSuffix(alias)]; exists {
+				err = fmt.Errorf("模型别名 %s 与已有模型重名", alias)
+				return
+			}
+		}
+		SetModelAliases(nil)
 	})
 	return err
 }
 
 func IsModelSupported(modelName string) bool {
-	if strings.HasPrefix(modelName, "claude-") && strings.Contains(modelName, "-") && !strings.Contains(modelName, "@") {
-		parts := strings.Split(modelName, "-")
-		lastPart := parts[len(parts)-1]
-		if len(lastPart) == 8 && IsNumeric(lastPart) {
-			modelName = strings.Join(parts[:len(parts)-1], "-") + "@" + lastPart
-		}
-	}
-	_, exists := SupportedModels[modelName]
+	_, exists := SupportedModels[NormalizeModelName(modelName)]
 	return exists
 }
 
@@ -192,13 +267,28 @@ func IsNumeric(s string) bool {
 	return true
 }
 
-func IsGPTModel(model string) bool {
-	// 判断是否为 GPT 模型
-	return strings.HasPrefix(model, "gpt-")
+// BackendOf 返回处理该模型的上游后端名称，模型不存在时返回空字符串
+func BackendOf(modelName string) string {
+	return SupportedModels[NormalizeModelName(modelName)].Backend
+}
+
+// MaxTokensOf 返回模型的 token 上限，模型不存在时为零值
+func MaxTokensOf(modelName string) TokenLimits {
+	return SupportedModels[NormalizeModelName(modelName)].MaxTokens
 }
 
-// NormalizeModelName 标准化模型名称
+// CapabilitiesOf 返回模型支持的输入类型，模型不存在时为零值
+func CapabilitiesOf(modelName string) ModelCapabilities {
+	return SupportedModels[NormalizeModelName(modelName)].Capabilities
+}
+
+// NormalizeModelName 标准化模型名称，先解析别名，再转换 Claude 模型的日期后缀
 func NormalizeModelName(m string) string {
+	return normalizeDateSuffix(resolveAlias(m))
+}
+
+// normalizeDateSuffix 转换 Claude 模型的日期后缀，不解析别名
+func normalizeDateSuffix(m string) string {
 	// 如果是 Claude 模型且包含 "-" 而不是 "@"，转换为带 "@" 的格式
 	if strings.HasPrefix(m, "claude-") && !strings.Contains(m, "@") {
 		parts := strings.Split(m, "-")
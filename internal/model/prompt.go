@@ -0,0 +1,131 @@
+package model
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// DefaultPromptEscape 未配置 escape 时对消息内容的替换，去掉回车使内容中不会出现内置模板的 ";\r\n" 分隔符
+var DefaultPromptEscape = map[string]string{
+	"\r\n": "\n",
+	"\r":   "\n",
+}
+
+// PromptTemplate 将对话渲染为上游文本的模板，System 和 Dialog 为 text/template 模板，分别渲染上游的系统提示词和对话内容
+// 两个模板都可以使用 PromptData 中的全部字段，把系统消息放进对话时 System 模板留空即可
+type PromptTemplate struct {
+	System string            `yaml:"system" toml:"system"`
+	Dialog string            `yaml:"dialog" toml:"dialog"`
+	Escape map[string]string `yaml:"escape" toml:"escape"` // 渲染前对消息内容做的替换，未配置时使用 DefaultPromptEscape，配置为 {} 时不替换
+}
+
+// PromptData 模板可以使用的数据，所有内容都已按 Escape 替换
+type PromptData struct {
+	Model    string
+	System   []string        // 系统消息的内容
+	Messages []PromptMessage // 非系统消息
+	Turns    []PromptMessage // 相邻的同角色消息以换行合并后的非系统消息
+}
+
+// PromptMessage 模板中的一条消息
+type PromptMessage struct {
+	Role    Role
+	Content string
+}
+
+// RenderedPrompt 渲染结果
+type RenderedPrompt struct {
+	System string
+	Dialog string
+}
+
+// CompiledPrompt 编译后的提示词模板
+type CompiledPrompt struct {
+	system *template.Template
+	dialog *template.Template
+	escape *strings.Replacer
+}
+
+var promptFuncs = template.FuncMap{
+	"join": strings.Join,
+}
+
+// Compile 解析模板，name 用于错误信息
+func (t PromptTemplate) Compile(name string) (*CompiledPrompt, error) {
+	if t.Dialog == "" {
+		return nil, fmt.Errorf("dialog: must not be empty")
+	}
+	system, err := template.New(name + ".system").Funcs(promptFuncs).Parse(t.System)
+	if err != nil {
+		return nil, fmt.Errorf("system: %v", err)
+	}
+	dialog, err := template.New(name + ".dialog").Funcs(promptFuncs).Parse(t.Dialog)
+	if err != nil {
+		return nil, fmt.Errorf("dialog: %v", err)
+	}
+
+	escape := t.Escape
+	if escape == nil {
+		escape = DefaultPromptEscape
+	}
+	// 较长的序列优先替换，结果与 map 的遍历顺序无关
+	from := make([]string, 0, len(escape))
+	for seq := range escape {
+		if seq == "" {
+			return nil, fmt.Errorf("escape: sequences must not be empty")
+		}
+		from = append(from, seq)
+	}
+	sort.Slice(from, func(i, j int) bool {
+		if len(from[i]) != len(from[j]) {
+			return len(from[i]) > len(from[j])
+		}
+		return from[i] < from[j]
+	})
+	pairs := make([]string, 0, 2*len(from))
+	for _, seq := range from {
+		pairs = append(pairs, seq, escape[seq])
+	}
+
+	compiled := &CompiledPrompt{system: system, dialog: dialog, escape: strings.NewReplacer(pairs...)}
+	// 字段名写错等错误在执行时才会出现，编译时用示例对话试渲染一次
+	if _, err := compiled.Render(name, samplePrompt); err != nil {
+		return nil, err
+	}
+	return compiled, nil
+}
+
+var samplePrompt = []ChatMessage{
+	{Role: RoleSystem, Content: "system"},
+	{Role: RoleUser, Content: "user"},
+	{Role: RoleAssistant, Content: "assistant"},
+}
+
+// Render 渲染对话
+func (p *CompiledPrompt) Render(modelName string, messages []ChatMessage) (RenderedPrompt, error) {
+	data := PromptData{Model: modelName}
+	for _, msg := range messages {
+		content := p.escape.Replace(msg.Content)
+		if msg.Role == RoleSystem {
+			data.System = append(data.System, content)
+			continue
+		}
+		data.Messages = append(data.Messages, PromptMessage{Role: msg.Role, Content: content})
+		if last := len(data.Turns) - 1; last >= 0 && data.Turns[last].Role == msg.Role {
+			data.Turns[last].Content += "\n" + content
+		} else {
+			data.Turns = append(data.Turns, PromptMessage{Role: msg.Role, Content: content})
+		}
+	}
+
+	var system, dialog strings.Builder
+	if err := p.system.Execute(&system, data); err != nil {
+		return RenderedPrompt{}, err
+	}
+	if err := p.dialog.Execute(&dialog, data); err != nil {
+		return RenderedPrompt{}, err
+	}
+	return RenderedPrompt{System: system.String(), Dialog: dialog.String()}, nil
+}
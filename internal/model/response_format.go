@@ -0,0 +1,65 @@
+package model
+
+import (
+	"encoding/json"
+	"fmt"
+	"pieces-os-go/internal/jsonschema"
+	"regexp"
+)
+
+// response_format 的类型
+const (
+	ResponseFormatText       = "text"        // 普通文本，不做校验
+	ResponseFormatJSONObject = "json_object" // 输出必须是 JSON 对象
+	ResponseFormatJSONSchema = "json_schema" // 输出必须符合指定的 JSON Schema
+)
+
+var schemaNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// ResponseFormat 请求的输出格式
+type ResponseFormat struct {
+	Type       string            `json:"type"`
+	JSONSchema *JSONSchemaFormat `json:"json_schema,omitempty"`
+}
+
+// JSONSchemaFormat json_schema 类型的输出格式定义
+type JSONSchemaFormat struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Schema      json.RawMessage `json:"schema,omitempty"`
+	Strict      bool            `json:"strict,omitempty"` // 接受但不影响校验，输出始终按 schema 严格校验
+}
+
+// StructuredOutput 是否要求 JSON 输出，需要在网关侧校验
+func (r *ChatCompletionRequest) StructuredOutput() bool {
+	return r.ResponseFormat != nil && r.ResponseFormat.Type != ResponseFormatText
+}
+
+// validateResponseFormat 校验 response_format，json_schema 的 schema 必须能够编译
+func (r *ChatCompletionRequest) validateResponseFormat() error {
+	format := r.ResponseFormat
+	if format == nil {
+		return nil
+	}
+	switch format.Type {
+	case ResponseFormatText, ResponseFormatJSONObject:
+		return nil
+	case ResponseFormatJSONSchema:
+	default:
+		return fmt.Errorf("response_format.type: must be one of text, json_object, json_schema")
+	}
+
+	if format.JSONSchema == nil {
+		return fmt.Errorf("response_format.json_schema: required when type is 'json_schema'")
+	}
+	if !schemaNamePattern.MatchString(format.JSONSchema.Name) {
+		return fmt.Errorf("response_format.json_schema.name: must be 1-64 characters of a-z, A-Z, 0-9, _ and -")
+	}
+	if len(format.JSONSchema.Schema) == 0 {
+		return nil
+	}
+	if _, err := jsonschema.Compile(format.JSONSchema.Schema); err != nil {
+		return fmt.Errorf("response_format.json_schema.schema: %v", err)
+	}
+	return nil
+}
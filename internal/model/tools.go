@@ -0,0 +1,145 @@
+package model
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+)
+
+// RoleTool 工具调用结果消息的角色
+const RoleTool Role = "tool"
+
+// FinishReasonToolCalls 模型请求调用工具时的结束原因
+var FinishReasonToolCalls FinishReason = "tool_calls"
+
+// ToolTypeFunction 目前唯一支持的工具类型
+const ToolTypeFunction = "function"
+
+// tool_choice 的取值
+const (
+	ToolChoiceNone     = "none"     // 不调用工具
+	ToolChoiceAuto     = "auto"     // 由模型决定是否调用
+	ToolChoiceRequired = "required" // 至少调用一个工具
+	ToolChoiceFunction = "function" // 调用指定的工具
+)
+
+var toolNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// Tool 请求中可供模型调用的工具
+type Tool struct {
+	Type     string             `json:"type"`
+	Function FunctionDefinition `json:"function"`
+}
+
+// FunctionDefinition 函数工具的定义，parameters 为 JSON Schema
+type FunctionDefinition struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"`
+}
+
+// ToolCall 助手消息中的工具调用，流式响应中通过 Index 区分同一回复中的多个调用
+type ToolCall struct {
+	Index    *int         `json:"index,omitempty"`
+	ID       string       `json:"id"`
+	Type     string       `json:"type"`
+	Function FunctionCall `json:"function"`
+}
+
+// FunctionCall 函数调用的名称和 JSON 编码的参数
+type FunctionCall struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+// ToolChoice 兼容 OpenAI tool_choice 的字符串和 {"type": "function", "function": {"name": ...}} 两种写法
+type ToolChoice struct {
+	Mode     string // none、auto、required 或 function
+	Function string // Mode 为 function 时指定的工具名称
+}
+
+func (c *ToolChoice) UnmarshalJSON(data []byte) error {
+	var mode string
+	if err := json.Unmarshal(data, &mode); err == nil {
+		*c = ToolChoice{Mode: mode}
+		return nil
+	}
+	var named struct {
+		Type     string `json:"type"`
+		Function struct {
+			Name string `json:"name"`
+		} `json:"function"`
+	}
+	if err := json.Unmarshal(data, &named); err != nil || named.Type != ToolTypeFunction {
+		return fmt.Errorf("tool_choice: must be a string or an object with type 'function'")
+	}
+	*c = ToolChoice{Mode: ToolChoiceFunction, Function: named.Function.Name}
+	return nil
+}
+
+// MarshalJSON 按 OpenAI 的写法编码，function 模式编码为对象，其余编码为字符串
+func (c ToolChoice) MarshalJSON() ([]byte, error) {
+	if c.Mode != ToolChoiceFunction {
+		return json.Marshal(c.Mode)
+	}
+	var named struct {
+		Type     string `json:"type"`
+		Function struct {
+			Name string `json:"name"`
+		} `json:"function"`
+	}
+	named.Type = ToolTypeFunction
+	named.Function.Name = c.Function
+	return json.Marshal(named)
+}
+
+// ToolMode 返回生效的 tool_choice，没有工具时总是 none，未指定时为 auto
+func (r *ChatCompletionRequest) ToolMode() ToolChoice {
+	if len(r.Tools) == 0 {
+		return ToolChoice{Mode: ToolChoiceNone}
+	}
+	if r.ToolChoice != nil {
+		return *r.ToolChoice
+	}
+	return ToolChoice{Mode: ToolChoiceAuto}
+}
+
+// validateTools 校验工具定义、tool_choice 和工具结果消息
+func (r *ChatCompletionRequest) validateTools() error {
+	names := make(map[string]bool, len(r.Tools))
+	for i, tool := range r.Tools {
+		if tool.Type != ToolTypeFunction {
+			return fmt.Errorf("tools[%d].type: must be 'function'", i)
+		}
+		if !toolNamePattern.MatchString(tool.Function.Name) {
+			return fmt.Errorf("tools[%d].function.name: must be 1-64 characters of a-z, A-Z, 0-9, _ and -", i)
+		}
+		if names[tool.Function.Name] {
+			return fmt.Errorf("tools[%d].function.name: duplicate tool '%s'", i, tool.Function.Name)
+		}
+		names[tool.Function.Name] = true
+	}
+
+	if choice := r.ToolChoice; choice != nil {
+		// 与 OpenAI 一致，没有 tools 时只允许 none
+		if len(r.Tools) == 0 && choice.Mode != ToolChoiceNone {
+			return fmt.Errorf("tool_choice: only allowed when tools are specified")
+		}
+		switch choice.Mode {
+		case ToolChoiceNone, ToolChoiceAuto, ToolChoiceRequired:
+		case ToolChoiceFunction:
+			if !names[choice.Function] {
+				return fmt.Errorf("tool_choice: tool '%s' is not defined in tools", choice.Function)
+			}
+		default:
+			return fmt.Errorf("tool_choice: must be one of none, auto, required or a function")
+		}
+	}
+
+	for i, msg := range r.Messages {
+		if msg.Role == RoleTool && msg.ToolCallID == "" {
+			return fmt.Errorf("messages[%d].tool_call_id: required for tool messages", i)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package model
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// TruncationHeader 请求中指定截断策略的头，优先于请求体的 truncation 字段和密钥配置
+	TruncationHeader = "X-Truncation"
+	// TruncatedHeader 提示词被截断时在响应中说明截断内容的头
+	TruncatedHeader = "X-Truncated"
+)
+
+// TruncationStrategy 提示词超出模型输入上限时的截断策略
+type TruncationStrategy string
+
+const (
+	TruncateNone       TruncationStrategy = "none"        // 不截断，直接返回 context_too_long
+	TruncateDropOldest TruncationStrategy = "drop_oldest" // 从最早的对话轮次开始丢弃
+	TruncateKeepEnds   TruncationStrategy = "keep_ends"   // 保留第一轮和尽可能多的最近轮次，丢弃中间的轮次
+	TruncateMiddleOut  TruncationStrategy = "middle_out"  // 从最长的消息中间删除内容
+)
+
+// TruncationStrategies 所有可用的截断策略
+var TruncationStrategies = []TruncationStrategy{TruncateNone, TruncateDropOldest, TruncateKeepEnds, TruncateMiddleOut}
+
+// ParseTruncationStrategy 解析截断策略名称，为空时返回空策略表示未指定
+func ParseTruncationStrategy(s string) (TruncationStrategy, error) {
+	if s == "" {
+		return "", nil
+	}
+	for _, strategy := range TruncationStrategies {
+		if TruncationStrategy(s) == strategy {
+			return strategy, nil
+		}
+	}
+	names := make([]string, len(TruncationStrategies))
+	for i, strategy := range TruncationStrategies {
+		names[i] = string(strategy)
+	}
+	return "", fmt.Errorf("unknown truncation strategy '%s', must be one of %s", s, strings.Join(names, ", "))
+}
+
+// TruncationReport 截断结果，系统消息始终保留
+type TruncationReport struct {
+	Strategy          TruncationStrategy
+	DroppedMessages   int // 丢弃的消息数
+	ShortenedMessages int // 被删减内容的消息数
+	OriginalTokens    int // 截断前的提示词 token 数
+	PromptTokens      int // 截断后的提示词 token 数
+}
+
+// String 返回写入 X-Truncated 响应头的内容
+func (r *TruncationReport) String() string {
+	return fmt.Sprintf("strategy=%s; dropped_messages=%d; shortened_messages=%d; original_tokens=%d; prompt_tokens=%d",
+		r.Strategy, r.DroppedMessages, r.ShortenedMessages, r.OriginalTokens, r.PromptTokens)
+}
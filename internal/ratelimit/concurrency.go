@@ -0,0 +1,177 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Slot 一个并发限制对象及其最大并发数
+type Slot struct {
+	ID    string // 例如 key:<id>、ip:<addr>、global
+	Limit int
+}
+
+// RejectReason 并发请求被拒绝的原因
+type RejectReason int
+
+const (
+	QueueFull    RejectReason = iota + 1 // 排队人数已满
+	QueueTimeout                         // 排队超时
+	Canceled                             // 排队期间请求被取消
+)
+
+// ConcurrencyError 并发限制导致请求被拒绝
+type ConcurrencyError struct {
+	Slot   Slot // 导致拒绝的限制对象
+	Reason RejectReason
+}
+
+func (e *ConcurrencyError) Error() string {
+	switch e.Reason {
+	case QueueTimeout:
+		return "timed out waiting for a concurrency slot"
+	case Canceled:
+		return "request canceled while waiting for a concurrency slot"
+	default:
+		return "too many concurrent requests"
+	}
+}
+
+type counter struct {
+	inFlight int
+	waiting  int
+}
+
+// ConcurrencyLimiter 限制同时处理中的请求数，达到限制时可在有界队列中等待
+// 一个请求同时占用多个限制对象（密钥、IP、全局），只有全部有空位时才一次性占用，避免持有部分名额等待
+type ConcurrencyLimiter struct {
+	mu       sync.Mutex
+	counters map[string]*counter
+	released chan struct{} // 有名额释放时关闭并替换，用于唤醒排队的请求
+}
+
+func NewConcurrencyLimiter() *ConcurrencyLimiter {
+	return &ConcurrencyLimiter{
+		counters: make(map[string]*counter),
+		released: make(chan struct{}),
+	}
+}
+
+// Acquire 占用所有限制对象的名额，返回释放函数
+// Limit 不大于 0 的限制对象会被忽略；名额不足时最多有 queueSize 个请求排队，timeout 为 0 时一直等到 ctx 结束
+func (l *ConcurrencyLimiter) Acquire(ctx context.Context, slots []Slot, queueSize int, timeout time.Duration) (func(), error) {
+	active := make([]Slot, 0, len(slots))
+	for _, slot := range slots {
+		if slot.Limit > 0 {
+			active = append(active, slot)
+		}
+	}
+	if len(active) == 0 {
+		return func() {}, nil
+	}
+
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	for {
+		l.mu.Lock()
+		full := l.fullSlots(active)
+		if len(full) == 0 {
+			for _, slot := range active {
+				l.counter(slot.ID).inFlight++
+			}
+			l.mu.Unlock()
+			return l.releaseFunc(active), nil
+		}
+
+		for _, slot := range full {
+			if l.counter(slot.ID).waiting >= queueSize {
+				l.mu.Unlock()
+				return nil, &ConcurrencyError{Slot: slot, Reason: QueueFull}
+			}
+		}
+		for _, slot := range full {
+			l.counter(slot.ID).waiting++
+		}
+		released := l.released
+		l.mu.Unlock()
+
+		var reason RejectReason
+		select {
+		case <-released:
+		case <-deadline:
+			reason = QueueTimeout
+		case <-ctx.Done():
+			reason = Canceled
+		}
+
+		l.mu.Lock()
+		for _, slot := range full {
+			l.counter(slot.ID).waiting--
+			l.prune(slot.ID)
+		}
+		l.mu.Unlock()
+		if reason != 0 {
+			return nil, &ConcurrencyError{Slot: full[0], Reason: reason}
+		}
+	}
+}
+
+// InFlight 返回限制对象当前处理中的请求数
+func (l *ConcurrencyLimiter) InFlight(id string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if c, ok := l.counters[id]; ok {
+		return c.inFlight
+	}
+	return 0
+}
+
+// fullSlots 返回已达到限制的对象，调用方需持有锁
+func (l *ConcurrencyLimiter) fullSlots(slots []Slot) []Slot {
+	var full []Slot
+	for _, slot := range slots {
+		if c, ok := l.counters[slot.ID]; ok && c.inFlight >= slot.Limit {
+			full = append(full, slot)
+		}
+	}
+	return full
+}
+
+// counter 返回限制对象的计数器，调用方需持有锁
+func (l *ConcurrencyLimiter) counter(id string) *counter {
+	c, ok := l.counters[id]
+	if !ok {
+		c = &counter{}
+		l.counters[id] = c
+	}
+	return c
+}
+
+// prune 删除空闲的计数器，调用方需持有锁
+func (l *ConcurrencyLimiter) prune(id string) {
+	if c, ok := l.counters[id]; ok && c.inFlight == 0 && c.waiting == 0 {
+		delete(l.counters, id)
+	}
+}
+
+func (l *ConcurrencyLimiter) releaseFunc(slots []Slot) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			for _, slot := range slots {
+				l.counter(slot.ID).inFlight--
+				l.prune(slot.ID)
+			}
+			close(l.released)
+			l.released = make(chan struct{})
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestConcurrencyLimiterAllOrNothing(t *testing.T) {
+	l := NewConcurrencyLimiter()
+	global := Slot{ID: "global", Limit: 10}
+	keyA := Slot{ID: "key:a", Limit: 1}
+
+	release, err := l.Acquire(context.Background(), []Slot{keyA, global}, 0, 0)
+	if err != nil {
+		t.Fatalf("first acquire: %v", err)
+	}
+
+	// 密钥名额已满时被拒绝，且不会占用全局名额
+	_, err = l.Acquire(context.Background(), []Slot{keyA, global}, 0, 0)
+	var concurrencyErr *ConcurrencyError
+	if !errors.As(err, &concurrencyErr) || concurrencyErr.Reason != QueueFull || concurrencyErr.Slot.ID != "key:a" {
+		t.Fatalf("second acquire error = %v, want queue full on key:a", err)
+	}
+	if n := l.InFlight("global"); n != 1 {
+		t.Fatalf("global in flight = %d, want 1", n)
+	}
+
+	release()
+	release() // 重复释放无效
+	if n := l.InFlight("key:a"); n != 0 {
+		t.Fatalf("key in flight after release = %d, want 0", n)
+	}
+}
+
+func TestConcurrencyLimiterQueue(t *testing.T) {
+	l := NewConcurrencyLimiter()
+	slot := Slot{ID: "global", Limit: 1}
+
+	release, _ := l.Acquire(context.Background(), []Slot{slot}, 1, 0)
+
+	// 队列已有一个请求时，后来的请求直接被拒绝
+	acquired := make(chan func())
+	go func() {
+		next, err := l.Acquire(context.Background(), []Slot{slot}, 1, time.Second)
+		if err != nil {
+			t.Errorf("queued acquire: %v", err)
+		}
+		acquired <- next
+	}()
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		l.mu.Lock()
+		waiting := l.counters["global"].waiting
+		l.mu.Unlock()
+		if waiting == 1 {
+			break
+		}
+	}
+	if _, err := l.Acquire(context.Background(), []Slot{slot}, 1, time.Second); err == nil {
+		t.Fatalf("acquire with a full queue should fail")
+	}
+
+	release()
+	next := <-acquired
+	if next == nil {
+		t.Fatalf("queued request did not get the slot")
+	}
+
+	_, err := l.Acquire(context.Background(), []Slot{slot}, 1, 20*time.Millisecond)
+	var concurrencyErr *ConcurrencyError
+	if !errors.As(err, &concurrencyErr) || concurrencyErr.Reason != QueueTimeout {
+		t.Fatalf("acquire error = %v, want queue timeout", err)
+	}
+	next()
+}
@@ -0,0 +1,144 @@
+package ratelimit
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+const shardCount = 64
+
+// Rule 请求数限流规则，窗口内最多允许 Limit 个请求
+type Rule struct {
+	Name   string
+	Limit  int
+	Window time.Duration
+}
+
+// interval 两个请求之间的平均间隔
+func (r Rule) interval() time.Duration {
+	return r.Window / time.Duration(r.Limit)
+}
+
+// Result 一次限流判断的结果，对应 X-RateLimit-* 响应头
+// 多条规则时取剩余额度最少的规则，拒绝时取需要等待最久的规则
+type Result struct {
+	Allowed    bool
+	Rule       string
+	Limit      int
+	Remaining  int
+	Reset      time.Duration // 额度完全恢复所需的时间
+	RetryAfter time.Duration // 被拒绝时需要等待的时间
+}
+
+type stateKey struct {
+	rule     string
+	identity string
+}
+
+type shard struct {
+	mu  sync.Mutex
+	tat map[stateKey]time.Time // 理论到达时间 (theoretical arrival time)
+}
+
+// Limiter 基于 GCRA 的请求数限流器
+// 每条规则对每个限流对象独立维护状态，允许在窗口内一次性用完全部额度，之后按平均间隔恢复
+// 状态按限流对象分片加锁，同一对象的多条规则在同一分片内原子判断
+type Limiter struct {
+	shards [shardCount]shard
+}
+
+func NewLimiter() *Limiter {
+	l := &Limiter{}
+	for i := range l.shards {
+		l.shards[i].tat = make(map[stateKey]time.Time)
+	}
+	return l
+}
+
+func (l *Limiter) shard(identity string) *shard {
+	h := fnv.New32a()
+	h.Write([]byte(identity))
+	return &l.shards[h.Sum32()%shardCount]
+}
+
+// Allow 判断限流对象的一个请求是否被所有规则允许，只有全部规则允许时才计数
+func (l *Limiter) Allow(identity string, rules []Rule, now time.Time) Result {
+	if len(rules) == 0 {
+		return Result{Allowed: true}
+	}
+
+	s := l.shard(identity)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	newTATs := make([]time.Time, len(rules))
+	var denied, best Result
+	for i, rule := range rules {
+		key := stateKey{rule: rule.Name, identity: identity}
+		tat := s.tat[key]
+		if tat.Before(now) {
+			tat = now
+		}
+		newTATs[i] = tat.Add(rule.interval())
+
+		// 新的理论到达时间超出一个窗口时拒绝
+		if allowAt := newTATs[i].Add(-rule.Window); now.Before(allowAt) {
+			if wait := allowAt.Sub(now); wait > denied.RetryAfter {
+				denied = Result{
+					Rule:       rule.Name,
+					Limit:      rule.Limit,
+					Remaining:  0,
+					Reset:      tat.Sub(now),
+					RetryAfter: wait,
+				}
+			}
+			continue
+		}
+
+		remaining := int((rule.Window - newTATs[i].Sub(now)) / rule.interval())
+		if i == 0 || remaining < best.Remaining {
+			best = Result{
+				Allowed:   true,
+				Rule:      rule.Name,
+				Limit:     rule.Limit,
+				Remaining: remaining,
+				Reset:     newTATs[i].Sub(now),
+			}
+		}
+	}
+	if denied.RetryAfter > 0 {
+		return denied
+	}
+
+	for i, rule := range rules {
+		s.tat[stateKey{rule: rule.Name, identity: identity}] = newTATs[i]
+	}
+	return best
+}
+
+// Cleanup 删除额度已完全恢复的状态，删除后的行为与保留时相同
+func (l *Limiter) Cleanup(now time.Time) {
+	for i := range l.shards {
+		s := &l.shards[i]
+		s.mu.Lock()
+		for key, tat := range s.tat {
+			if !tat.After(now) {
+				delete(s.tat, key)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// Len 返回当前保存的状态数量
+func (l *Limiter) Len() int {
+	n := 0
+	for i := range l.shards {
+		s := &l.shards[i]
+		s.mu.Lock()
+		n += len(s.tat)
+		s.mu.Unlock()
+	}
+	return n
+}
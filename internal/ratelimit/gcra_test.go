@@ -0,0 +1,141 @@
+package ratelimit
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var (
+	defaultRule = Rule{Name: "default", Limit: 60, Window: time.Minute}
+	burstRule   = Rule{Name: "burst", Limit: 5, Window: time.Second}
+)
+
+func TestLimiterRulesAreIndependent(t *testing.T) {
+	l := NewLimiter()
+	rules := []Rule{burstRule, defaultRule}
+	now := time.Unix(1700000000, 0)
+
+	// 每秒打满 burst 规则，一分钟内 default 规则的 60 次额度应当被耗尽，而不会被 burst 的窗口重置
+	allowed := 0
+	for second := 0; second < 30; second++ {
+		for i := 0; i < burstRule.Limit; i++ {
+			if l.Allow("ip", rules, now.Add(time.Duration(second)*time.Second)).Allowed {
+				allowed++
+			}
+		}
+	}
+	// default 规则在第 0 到 29 秒之间恢复 29 次额度，共 60 + 29 次
+	if allowed != 89 {
+		t.Fatalf("allowed = %d, want 89", allowed)
+	}
+
+	res := l.Allow("ip", rules, now.Add(29*time.Second))
+	if res.Allowed || res.Rule != "default" || res.RetryAfter <= 0 {
+		t.Fatalf("result = %+v, want denied by default rule with retry after", res)
+	}
+	if res := l.Allow("other", rules, now); !res.Allowed {
+		t.Fatalf("other identity should not be limited: %+v", res)
+	}
+}
+
+func TestLimiterRemainingAndReset(t *testing.T) {
+	l := NewLimiter()
+	rule := Rule{Name: "r", Limit: 3, Window: 3 * time.Second}
+	now := time.Unix(1700000000, 0)
+
+	for i, want := range []int{2, 1, 0} {
+		res := l.Allow("ip", []Rule{rule}, now)
+		if !res.Allowed || res.Remaining != want || res.Limit != 3 {
+			t.Fatalf("request %d: result = %+v, want allowed with remaining %d", i, res, want)
+		}
+	}
+	res := l.Allow("ip", []Rule{rule}, now)
+	if res.Allowed || res.RetryAfter != time.Second || res.Reset != 3*time.Second {
+		t.Fatalf("over limit: result = %+v, want retry after 1s and reset 3s", res)
+	}
+
+	// 被拒绝的请求不消耗额度
+	if res := l.Allow("ip", []Rule{rule}, now.Add(time.Second)); !res.Allowed || res.Remaining != 0 {
+		t.Fatalf("after 1s: result = %+v, want allowed with remaining 0", res)
+	}
+
+	l.Cleanup(now.Add(3 * time.Second))
+	if l.Len() != 1 {
+		t.Fatalf("state removed before it was fully replenished")
+	}
+	l.Cleanup(now.Add(4 * time.Second))
+	if l.Len() != 0 {
+		t.Fatalf("states = %d after cleanup, want 0", l.Len())
+	}
+}
+
+func TestLimiterDeniedRuleDoesNotChargeOthers(t *testing.T) {
+	l := NewLimiter()
+	tight := Rule{Name: "tight", Limit: 1, Window: time.Minute}
+	now := time.Unix(1700000000, 0)
+
+	l.Allow("ip", []Rule{tight, defaultRule}, now)
+	for i := 0; i < 10; i++ {
+		l.Allow("ip", []Rule{tight, defaultRule}, now)
+	}
+	if res := l.Allow("ip", []Rule{defaultRule}, now); res.Remaining != defaultRule.Limit-2 {
+		t.Fatalf("default remaining = %d, want %d", res.Remaining, defaultRule.Limit-2)
+	}
+}
+
+func TestLimiterConcurrentExactLimit(t *testing.T) {
+	l := NewLimiter()
+	rule := Rule{Name: "r", Limit: 100, Window: time.Hour}
+	now := time.Now()
+
+	var allowed atomic.Int64
+	var wg sync.WaitGroup
+	for g := 0; g < 50; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				if l.Allow("shared", []Rule{rule}, now).Allowed {
+					allowed.Add(1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := allowed.Load(); got != int64(rule.Limit) {
+		t.Fatalf("allowed = %d under concurrent load, want exactly %d", got, rule.Limit)
+	}
+}
+
+func BenchmarkLimiterParallel(b *testing.B) {
+	l := NewLimiter()
+	rules := []Rule{burstRule, defaultRule}
+	identities := make([]string, 1024)
+	for i := range identities {
+		identities[i] = fmt.Sprintf("10.0.%d.%d", i/256, i%256)
+	}
+
+	var next atomic.Int64
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			l.Allow(identities[next.Add(1)%int64(len(identities))], rules, time.Now())
+		}
+	})
+}
+
+func BenchmarkLimiterParallelSingleIdentity(b *testing.B) {
+	l := NewLimiter()
+	rules := []Rule{burstRule, defaultRule}
+
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			l.Allow("shared", rules, time.Now())
+		}
+	})
+}
@@ -0,0 +1,210 @@
+// Package ratelimit 提供按 token 数计算的限流，供服务层在调用上游前预扣额度
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"pieces-os-go/internal/metrics"
+	"pieces-os-go/internal/model"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// 空闲超过该时间且额度已恢复满的令牌桶会被清理
+	bucketIdleTimeout = 10 * time.Minute
+	cleanupInterval   = time.Minute
+)
+
+// Limit 一个限流对象及其每分钟 token 限额
+type Limit struct {
+	ID  string // 例如 key:<id>、ip:<addr>
+	TPM int
+}
+
+// Scope 返回限流对象 ID 的类型前缀，例如 key、ip、global，用于错误信息和指标标签
+func Scope(id string) string {
+	scope, _, _ := strings.Cut(id, ":")
+	return scope
+}
+
+// tokenBucket 容量为每分钟限额、按秒平滑恢复的令牌桶，余额允许为负以记录超出预估的用量
+type tokenBucket struct {
+	tokens   float64
+	capacity float64
+	last     time.Time
+}
+
+func (b *tokenBucket) refill(now time.Time, tpm int) {
+	b.capacity = float64(tpm)
+	b.tokens = math.Min(b.capacity, b.tokens+now.Sub(b.last).Seconds()*b.capacity/60)
+	b.last = now
+}
+
+// wait 返回余额恢复到 need 所需的时间
+func (b *tokenBucket) wait(need float64) time.Duration {
+	if b.tokens >= need {
+		return 0
+	}
+	return time.Duration((need - b.tokens) / (b.capacity / 60) * float64(time.Second))
+}
+
+// TokenLimiter 按每分钟 token 数 (TPM) 限流
+// 请求开始时按预估的提示词 token 预扣额度，结束后按实际用量多退少补
+type TokenLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+func NewTokenLimiter() *TokenLimiter {
+	l := &TokenLimiter{buckets: make(map[string]*tokenBucket)}
+	go l.cleanup()
+	return l
+}
+
+func (l *TokenLimiter) cleanup() {
+	for {
+		time.Sleep(cleanupInterval)
+		now := time.Now()
+		l.mu.Lock()
+		for id, b := range l.buckets {
+			if now.Sub(b.last) > bucketIdleTimeout && b.tokens+now.Sub(b.last).Seconds()*b.capacity/60 >= b.capacity {
+				delete(l.buckets, id)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// bucket 返回限流对象的令牌桶，调用方需持有锁
+func (l *TokenLimiter) bucket(limit Limit, now time.Time) *tokenBucket {
+	b, ok := l.buckets[limit.ID]
+	if !ok {
+		b = &tokenBucket{tokens: float64(limit.TPM), last: now}
+		l.buckets[limit.ID] = b
+	}
+	b.refill(now, limit.TPM)
+	return b
+}
+
+// Begin 为一次请求创建额度预留并放入上下文，limits 中 TPM 不大于 0 的项会被忽略
+func (l *TokenLimiter) Begin(ctx context.Context, limits ...Limit) (context.Context, *Reservation) {
+	res := &Reservation{limiter: l}
+	for _, limit := range limits {
+		if limit.TPM > 0 {
+			res.limits = append(res.limits, limit)
+		}
+	}
+	if len(res.limits) == 0 {
+		return ctx, nil
+	}
+	return context.WithValue(ctx, reservationKey{}, res), res
+}
+
+// Reservation 一次请求的 token 额度预留
+// 方法允许 nil 接收者，未启用 token 限流时调用方无需判断
+type Reservation struct {
+	limiter *TokenLimiter
+	limits  []Limit
+
+	mu       sync.Mutex
+	reserved int
+	actual   int
+	finished bool
+}
+
+type reservationKey struct{}
+
+// FromContext 返回请求上下文中的额度预留，未启用 token 限流时返回 nil
+func FromContext(ctx context.Context) *Reservation {
+	res, _ := ctx.Value(reservationKey{}).(*Reservation)
+	return res
+}
+
+// Acquire 预扣 n 个 token，任一限流对象额度不足时返回 429 错误并给出重试等待时间
+// 超过限额的单个请求需要等到额度完全恢复后才能通过
+func (r *Reservation) Acquire(n int) error {
+	if r == nil || n <= 0 {
+		return nil
+	}
+	l := r.limiter
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	var wait time.Duration
+	var exceeded Limit
+	for _, limit := range r.limits {
+		b := l.bucket(limit, now)
+		if d := b.wait(math.Min(float64(n), b.capacity)); d > wait {
+			wait, exceeded = d, limit
+		}
+	}
+	if wait > 0 {
+		metrics.IncRejection(metrics.LimiterToken, Scope(exceeded.ID))
+		return &model.APIError{
+			Code: model.ErrRateLimitExceeded,
+			Message: fmt.Sprintf("Token rate limit exceeded: request needs about %d tokens, limit is %d tokens per minute",
+				n, exceeded.TPM),
+			Status:     http.StatusTooManyRequests,
+			RetryAfter: wait,
+		}
+	}
+
+	for _, limit := range r.limits {
+		l.buckets[limit.ID].tokens -= float64(n)
+	}
+	r.mu.Lock()
+	r.reserved += n
+	r.mu.Unlock()
+	return nil
+}
+
+// Charge 记录上游返回的实际用量
+// 客户端提前断开时 Finish 可能先于用量记录执行，此后到达的用量直接从额度中扣除，不会漏记
+func (r *Reservation) Charge(n int) {
+	if r == nil || n <= 0 {
+		return
+	}
+	r.mu.Lock()
+	r.actual += n
+	finished := r.finished
+	r.mu.Unlock()
+	if finished {
+		r.settle(n)
+	}
+}
+
+// Finish 按已记录的实际用量与预扣额度的差值结算，未产生用量的请求退还全部预扣额度
+func (r *Reservation) Finish() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	if r.finished {
+		r.mu.Unlock()
+		return
+	}
+	r.finished = true
+	delta := r.actual - r.reserved
+	r.mu.Unlock()
+	r.settle(delta)
+}
+
+// settle 从所有限流对象的额度中扣除 delta 个 token，delta 为负时退还
+func (r *Reservation) settle(delta int) {
+	if delta == 0 {
+		return
+	}
+	l := r.limiter
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	for _, limit := range r.limits {
+		b := l.bucket(limit, now)
+		b.tokens = math.Min(b.capacity, b.tokens-float64(delta))
+	}
+}
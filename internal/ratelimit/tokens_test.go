@@ -0,0 +1,71 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+)
+
+// remaining 返回限流对象当前的余额，忽略测试期间的恢复
+func remaining(l *TokenLimiter, id string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int(l.buckets[id].tokens)
+}
+
+func TestReservationSettlesActualUsage(t *testing.T) {
+	tests := []struct {
+		name   string
+		run    func(res *Reservation)
+		remain int
+	}{
+		{
+			name: "refund unused reservation",
+			run: func(res *Reservation) {
+				res.Acquire(100)
+				res.Charge(30)
+				res.Finish()
+			},
+			remain: 970,
+		},
+		{
+			name: "charge usage above reservation",
+			run: func(res *Reservation) {
+				res.Acquire(100)
+				res.Charge(250)
+				res.Finish()
+			},
+			remain: 750,
+		},
+		{
+			// 客户端提前断开时中间件先结算，服务层之后才记录用量
+			name: "charge usage recorded after finish",
+			run: func(res *Reservation) {
+				res.Acquire(100)
+				res.Finish()
+				res.Charge(40)
+				res.Charge(20)
+			},
+			remain: 940,
+		},
+		{
+			name: "finish twice",
+			run: func(res *Reservation) {
+				res.Acquire(100)
+				res.Charge(50)
+				res.Finish()
+				res.Finish()
+			},
+			remain: 950,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := &TokenLimiter{buckets: make(map[string]*tokenBucket)}
+			_, res := l.Begin(context.Background(), Limit{ID: "key:a", TPM: 1000})
+			tt.run(res)
+			if got := remaining(l, "key:a"); got < tt.remain || got > tt.remain+1 {
+				t.Errorf("remaining = %d, want %d", got, tt.remain)
+			}
+		})
+	}
+}
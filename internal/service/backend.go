@@ -0,0 +1,114 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"pieces-os-go/internal/config"
+	"pieces-os-go/internal/model"
+	"sort"
+	"sync"
+
+	"google.golang.org/grpc"
+)
+
+// Backend 上游推理协议的抽象
+// 新增上游协议时只需实现该接口并调用 RegisterBackend 注册，无需修改处理器和重试逻辑
+type Backend interface {
+	// Name 后端名称，与模型目录中的 backend 对应
+	Name() string
+	// Addr 从配置中获取上游 gRPC 地址
+	Addr(cfg *config.Config) string
+	// PromptTemplate 未配置 prompt_templates 时使用的内置模板
+	PromptTemplate() model.PromptTemplate
+	// BuildRequest 将聊天请求和按模板渲染的对话转换为上游 gRPC 请求
+	BuildRequest(req *model.ChatCompletionRequest, prompt model.RenderedPrompt) (any, error)
+	// Predict 发起一元调用
+	Predict(ctx context.Context, conn grpc.ClientConnInterface, grpcReq any) (any, error)
+	// PredictStream 发起流式调用
+	PredictStream(ctx context.Context, conn grpc.ClientConnInterface, grpcReq any) (ChunkStream, error)
+	// DecodeChunk 将上游响应解码为统一的数据块
+	DecodeChunk(resp any) (*Chunk, error)
+	// CountPromptTokens 计算提示词的token数量
+	CountPromptTokens(req *model.ChatCompletionRequest) int
+	// CountCompletionTokens 计算用量统计中补全内容的token数量
+	CountCompletionTokens(req *model.ChatCompletionRequest, content string) int
+	// CountTextTokens 计算文本本身的token数量，不含用量统计中的固定开销，用于执行 max_tokens
+	CountTextTokens(req *model.ChatCompletionRequest, content string) int
+}
+
+// Chunk 上游响应解码后的统一结构，一元响应和流式数据块共用
+type Chunk struct {
+	ID           string // 上游返回的响应ID，可能为空
+	Created      int64  // 上游返回的时间戳，可能为0
+	Content      string // 本次返回的文本内容
+	ResponseCode int64  // 上游响应状态码
+}
+
+// Done 上游使用 204 响应码表示流结束
+func (c *Chunk) Done() bool {
+	return c.ResponseCode == 204
+}
+
+// ChunkStream 上游流式响应
+type ChunkStream interface {
+	Recv() (any, error)
+}
+
+// streamAdapter 将强类型的 gRPC 流适配为 ChunkStream
+type streamAdapter[T any] struct {
+	stream grpc.ServerStreamingClient[T]
+}
+
+func (s streamAdapter[T]) Recv() (any, error) {
+	resp, err := s.stream.Recv()
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+var (
+	backends   = make(map[string]Backend)
+	backendsMu sync.RWMutex
+)
+
+// RegisterBackend 注册上游后端，同名后端会被覆盖
+func RegisterBackend(b Backend) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	backends[b.Name()] = b
+}
+
+// GetBackend 按名称获取已注册的后端
+func GetBackend(name string) (Backend, bool) {
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+	b, ok := backends[name]
+	return b, ok
+}
+
+// registeredBackends 按名称顺序返回所有已注册的后端
+func registeredBackends() []Backend {
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+
+	list := make([]Backend, 0, len(backends))
+	for _, b := range backends {
+		list = append(list, b)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name() < list[j].Name() })
+	return list
+}
+
+// backendForModel 根据模型目录查找处理该模型的后端
+func backendForModel(modelName string) (Backend, error) {
+	name := model.BackendOf(modelName)
+	if name == "" {
+		return nil, fmt.Errorf("no backend configured for model: %s", modelName)
+	}
+	b, ok := GetBackend(name)
+	if !ok {
+		return nil, fmt.Errorf("backend '%s' is not registered", name)
+	}
+	return b, nil
+}
@@ -0,0 +1,108 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"pieces-os-go/internal/config"
+	"pieces-os-go/internal/model"
+
+	gptpb "pieces-os-go/pkg/proto/gpt"
+	"pieces-os-go/pkg/tokenizer"
+
+	"google.golang.org/grpc"
+)
+
+// gptBackend GPT 推理服务
+type gptBackend struct{}
+
+func init() {
+	RegisterBackend(gptBackend{})
+}
+
+func (gptBackend) Name() string {
+	return model.BackendGPT
+}
+
+func (gptBackend) Addr(cfg *config.Config) string {
+	return cfg.GPTGRPCAddr
+}
+
+// PromptTemplate 每条系统消息和对话消息各占一行，以 "角色:内容;\r\n" 拼接
+func (gptBackend) PromptTemplate() model.PromptTemplate {
+	return model.PromptTemplate{
+		System: `{{range .System}}system:{{.}};{{"\r\n"}}{{end}}`,
+		Dialog: `{{range .Messages}}{{.Role}}:{{.Content}};{{"\r\n"}}{{end}}`,
+	}
+}
+
+func (gptBackend) BuildRequest(req *model.ChatCompletionRequest, prompt model.RenderedPrompt) (any, error) {
+	messages := []*gptpb.Message{}
+	if prompt.System != "" {
+		messages = append(messages, &gptpb.Message{
+			Role:    0,
+			Message: prompt.System,
+		})
+	}
+	if prompt.Dialog != "" {
+		messages = append(messages, &gptpb.Message{
+			Role:    1,
+			Message: prompt.Dialog,
+		})
+	}
+
+	return &gptpb.Request{
+		Models:      req.Model,
+		Messages:    messages,
+		Temperature: req.Temperature,
+		TopP:        req.TopP,
+	}, nil
+}
+
+func (gptBackend) Predict(ctx context.Context, conn grpc.ClientConnInterface, grpcReq any) (any, error) {
+	r, ok := grpcReq.(*gptpb.Request)
+	if !ok {
+		return nil, fmt.Errorf("failed to build GPT request")
+	}
+	return gptpb.NewGPTInferenceServiceClient(conn).Predict(ctx, r)
+}
+
+func (gptBackend) PredictStream(ctx context.Context, conn grpc.ClientConnInterface, grpcReq any) (ChunkStream, error) {
+	r, ok := grpcReq.(*gptpb.Request)
+	if !ok {
+		return nil, fmt.Errorf("failed to build GPT request")
+	}
+	stream, err := gptpb.NewGPTInferenceServiceClient(conn).PredictWithStream(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	return streamAdapter[gptpb.Response]{stream: stream}, nil
+}
+
+func (gptBackend) DecodeChunk(resp any) (*Chunk, error) {
+	r, ok := resp.(*gptpb.Response)
+	if !ok || r == nil {
+		return nil, fmt.Errorf("received nil response")
+	}
+
+	chunk := &Chunk{ResponseCode: int64(r.ResponseCode)}
+	if r.Body != nil {
+		chunk.ID = r.Body.Id
+		chunk.Created = int64(r.Body.Time)
+		if r.Body.MessageWarpper != nil && r.Body.MessageWarpper.Message != nil {
+			chunk.Content = r.Body.MessageWarpper.Message.Message
+		}
+	}
+	return chunk, nil
+}
+
+func (gptBackend) CountPromptTokens(req *model.ChatCompletionRequest) int {
+	return tokenizer.NumTokensFromMessages(req.Messages, req.Model)
+}
+
+func (b gptBackend) CountCompletionTokens(req *model.ChatCompletionRequest, content string) int {
+	return b.CountTextTokens(req, content)
+}
+
+func (gptBackend) CountTextTokens(req *model.ChatCompletionRequest, content string) int {
+	return tokenizer.NumTokensFromText(content, req.Model)
+}
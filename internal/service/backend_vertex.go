@@ -0,0 +1,144 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"pieces-os-go/internal/config"
+	"pieces-os-go/internal/model"
+	"strings"
+
+	vertexpb "pieces-os-go/pkg/proto/vertex"
+	"pieces-os-go/pkg/tokenizer"
+
+	"google.golang.org/grpc"
+)
+
+// vertexBackend Vertex 推理服务，承载 Claude、Gemini 和 PaLM 系列模型
+type vertexBackend struct{}
+
+func init() {
+	RegisterBackend(vertexBackend{})
+}
+
+func (vertexBackend) Name() string {
+	return model.BackendVertex
+}
+
+func (vertexBackend) Addr(cfg *config.Config) string {
+	return cfg.VertexGRPCAddr
+}
+
+// PromptTemplate 系统消息合并后放在 rules 中，相邻的同角色消息合并为一轮，每轮以 "角色:内容;\r\n" 拼接
+func (vertexBackend) PromptTemplate() model.PromptTemplate {
+	return model.PromptTemplate{
+		System: `{{with join .System "\n"}}system:{{.}};{{"\r\n"}}{{end}}`,
+		Dialog: `{{range .Turns}}{{.Role}}:{{.Content}};{{"\r\n"}}{{end}}`,
+	}
+}
+
+func (vertexBackend) BuildRequest(req *model.ChatCompletionRequest, prompt model.RenderedPrompt) (any, error) {
+	return &vertexpb.Requests{
+		Models: model.NormalizeModelName(req.Model),
+		Args: &vertexpb.Args{
+			Messages: &vertexpb.Messages{
+				Unknown: 1,
+				Message: prompt.Dialog,
+			},
+			Rules: prompt.System,
+		},
+	}, nil
+}
+
+func (vertexBackend) Predict(ctx context.Context, conn grpc.ClientConnInterface, grpcReq any) (any, error) {
+	r, ok := grpcReq.(*vertexpb.Requests)
+	if !ok {
+		return nil, fmt.Errorf("failed to build Vertex request")
+	}
+	return vertexpb.NewVertexInferenceServiceClient(conn).Predict(ctx, r)
+}
+
+func (vertexBackend) PredictStream(ctx context.Context, conn grpc.ClientConnInterface, grpcReq any) (ChunkStream, error) {
+	r, ok := grpcReq.(*vertexpb.Requests)
+	if !ok {
+		return nil, fmt.Errorf("failed to build Vertex request")
+	}
+	stream, err := vertexpb.NewVertexInferenceServiceClient(conn).PredictWithStream(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	return streamAdapter[vertexpb.Response]{stream: stream}, nil
+}
+
+func (vertexBackend) DecodeChunk(resp any) (*Chunk, error) {
+	r, ok := resp.(*vertexpb.Response)
+	if !ok || r == nil {
+		return nil, fmt.Errorf("received nil response")
+	}
+
+	chunk := &Chunk{ResponseCode: r.ResponseCode}
+	if r.Args != nil && r.Args.Args != nil && r.Args.Args.Args != nil {
+		chunk.Content = r.Args.Args.Args.Message
+	}
+	return chunk, nil
+}
+
+func (vertexBackend) CountPromptTokens(req *model.ChatCompletionRequest) int {
+	params := buildTokenCountParams(req.Messages)
+	promptTokens, err := tokenizer.NumTokensFromClaudeMessages(&params)
+	if err != nil {
+		slog.Warn("failed to count prompt tokens", "error", err)
+		return 0
+	}
+	return promptTokens
+}
+
+// CountCompletionTokens 用量统计中额外计入固定的3个token
+func (b vertexBackend) CountCompletionTokens(req *model.ChatCompletionRequest, content string) int {
+	return b.CountTextTokens(req, content) + 3
+}
+
+func (vertexBackend) CountTextTokens(req *model.ChatCompletionRequest, content string) int {
+	tokens, err := tokenizer.CountTokens(content)
+	if err != nil {
+		slog.Warn("failed to count completion tokens", "error", err)
+		return 0
+	}
+	return tokens
+}
+
+// 辅助函数用于构建 TokenCountParams
+func buildTokenCountParams(messages []model.ChatMessage) tokenizer.TokenCountParams {
+	var systemMessages []string
+	var conversations []model.ChatMessage
+	var currentMessage model.ChatMessage
+
+	// 先分离系统消息
+	for _, msg := range messages {
+		if msg.Role == model.RoleSystem {
+			systemMessages = append(systemMessages, msg.Content)
+		} else {
+			// 处理非系统消息
+			if currentMessage.Role == "" {
+				currentMessage = msg
+			} else if currentMessage.Role == msg.Role {
+				// 合并相同角色的连续消息
+				currentMessage.Content += "\n" + msg.Content
+			} else {
+				// 角色变化，保存当前消息并开始新消息
+				conversations = append(conversations, currentMessage)
+				currentMessage = msg
+			}
+		}
+	}
+
+	// 添加最后一条消息
+	if currentMessage.Role != "" {
+		conversations = append(conversations, currentMessage)
+	}
+
+	return tokenizer.TokenCountParams{
+		Messages: conversations,
+		System:   strings.Join(systemMessages, "\n"),
+	}
+}
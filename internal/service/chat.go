@@ -4,19 +4,30 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
+	"net/http"
+	"pieces-os-go/internal/audit"
 	"pieces-os-go/internal/config"
+	"pieces-os-go/internal/keystore"
+	"pieces-os-go/internal/metrics"
 	"pieces-os-go/internal/model"
+	"pieces-os-go/internal/ratelimit"
+	"pieces-os-go/internal/tracing"
+	"pieces-os-go/internal/usage"
+	"sync/atomic"
 	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
 type ChatService struct {
 	grpcService *GRPCService
-	config      *config.Config
+	config      atomic.Pointer[config.Config]
 }
 
 func NewChatService(cfg *config.Config) *ChatService {
@@ -29,36 +40,70 @@ func NewChatService(cfg *config.Config) *ChatService {
 		panic("failed to create gRPC service")
 	}
 
-	return &ChatService{
-		grpcService: grpcService,
-		config:      cfg,
-	}
+	s := &ChatService{grpcService: grpcService}
+	s.config.Store(cfg)
+	return s
+}
+
+// UpdateConfig 应用重载后的配置，对之后的请求生效
+func (s *ChatService) UpdateConfig(cfg *config.Config) {
+	s.config.Store(cfg)
+	s.grpcService.UpdateConfig(cfg)
 }
 
 func (s *ChatService) CreateCompletion(ctx context.Context, req *model.ChatCompletionRequest) (*model.ChatCompletionResponse, error) {
-	ctx, cancel := context.WithTimeout(ctx, time.Duration(s.config.Timeout)*time.Second)
+	cfg := s.config.Load()
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(cfg.Timeout)*time.Second)
 	defer cancel()
 
+	audit.FromContext(ctx).SetRequest(req)
+	if err := s.admit(ctx, req); err != nil {
+		return nil, err
+	}
+
+	resp, err := s.complete(ctx, req)
+	if err == nil && req.StructuredOutput() {
+		resp, err = s.conformFormat(ctx, req, resp)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Choices) > 0 && resp.Choices[0].Message != nil {
+		audit.FromContext(ctx).SetCompletion(resp.Choices[0].Message.Content)
+	}
+	return resp, nil
+}
+
+// complete 发送非流式请求，可重试的错误按指数退避重试，成功时记录用量
+func (s *ChatService) complete(ctx context.Context, req *model.ChatCompletionRequest) (*model.ChatCompletionResponse, error) {
+	cfg := s.config.Load()
 	var resp *model.ChatCompletionResponse
 	var lastErr error
 
 	// 使用指数退避重试策略
-	for i := 0; i < s.config.MaxRetries; i++ {
-		resp, lastErr = s.grpcService.SendCompletion(ctx, req)
+	for i := 0; i < cfg.MaxRetries; i++ {
+		resp, lastErr = s.sendAttempt(ctx, req, i+1)
 
 		// 如果成功或遇到不可重试的错误,直接返回
 		if lastErr == nil || !s.shouldRetry(lastErr) {
+			if lastErr == nil {
+				recordUsage(ctx, req.Model, resp.Usage)
+			}
 			return resp, lastErr
 		}
 
 		// 计算退避时间
 		backoff := time.Duration(1<<uint(i)) * time.Second
+		_, span := tracing.Tracer().Start(ctx, "retry.backoff", trace.WithAttributes(attribute.String("retry.backoff", backoff.String())))
 
 		select {
 		case <-ctx.Done():
+			span.End()
 			return nil, ctx.Err()
 		case <-time.After(backoff):
-			log.Printf("重试 RPC 调用，尝试次数: %d, 错误: %v", i+1, lastErr)
+			span.End()
+			slog.WarnContext(ctx, "retrying upstream call", "attempt", i+1, "error", lastErr)
+			metrics.IncRetry(req.Model)
 			continue
 		}
 	}
@@ -66,14 +111,60 @@ func (s *ChatService) CreateCompletion(ctx context.Context, req *model.ChatCompl
 	return nil, fmt.Errorf("达到最大重试次数: %v", lastErr)
 }
 
+// sendAttempt 发送一次非流式请求，每次尝试对应一个 span
+func (s *ChatService) sendAttempt(ctx context.Context, req *model.ChatCompletionRequest, attempt int) (*model.ChatCompletionResponse, error) {
+	ctx, span := tracing.Tracer().Start(ctx, "chat.attempt", trace.WithAttributes(attribute.Int("retry.attempt", attempt)))
+	defer span.End()
+
+	resp, err := s.grpcService.SendCompletion(ctx, req)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(otelcodes.Error, err.Error())
+	}
+	return resp, err
+}
+
 func (s *ChatService) CreateCompletionStream(ctx context.Context, req *model.ChatCompletionRequest) (<-chan *model.ChatCompletionStreamResponse, <-chan error) {
 	responses := make(chan *model.ChatCompletionStreamResponse)
 	errors := make(chan error, 1)
 
+	usage.FromContext(ctx).SetStream()
+	audit.FromContext(ctx).SetRequest(req)
+	if err := s.admit(ctx, req); err != nil {
+		errors <- err
+		close(errors)
+		close(responses)
+		return responses, errors
+	}
+
 	go func() {
 		defer close(responses)
 		defer close(errors)
 
+		// 结构化输出需要完整校验后才能输出，生成完毕后再按流式格式发送
+		if req.StructuredOutput() {
+			resp, err := s.complete(ctx, req)
+			if err == nil {
+				resp, err = s.conformFormat(ctx, req, resp)
+			}
+			if err != nil {
+				errors <- err
+				return
+			}
+			if len(resp.Choices) > 0 && resp.Choices[0].Message != nil {
+				audit.FromContext(ctx).SetCompletion(resp.Choices[0].Message.Content)
+			}
+			for _, chunk := range streamChunks(resp) {
+				select {
+				case <-ctx.Done():
+					errors <- ctx.Err()
+					return
+				case responses <- chunk:
+				}
+			}
+			return
+		}
+
 		stream, err := s.grpcService.SendCompletionStream(ctx, req)
 		if err != nil {
 			errors <- err
@@ -81,6 +172,7 @@ func (s *ChatService) CreateCompletionStream(ctx context.Context, req *model.Cha
 		}
 
 		for resp := range stream {
+			recordUsage(ctx, req.Model, resp.Usage)
 			select {
 			case <-ctx.Done():
 				errors <- ctx.Err()
@@ -93,6 +185,123 @@ func (s *ChatService) CreateCompletionStream(ctx context.Context, req *model.Cha
 	return responses, errors
 }
 
+// recordUsage 将用量计入请求所用密钥的每日 token 配额、用量记录和指标
+func recordUsage(ctx context.Context, modelName string, u *model.Usage) {
+	if u == nil {
+		return
+	}
+	var keyID string
+	if key := keystore.FromContext(ctx); key != nil {
+		key.ChargeTokens(time.Now(), u.TotalTokens)
+		keyID = key.ID
+	}
+	metrics.AddTokens(modelName, keyID, u.PromptTokens, u.CompletionTokens)
+	usage.FromContext(ctx).AddTokens(u)
+	ratelimit.FromContext(ctx).Charge(u.TotalTokens)
+}
+
+// admit 在连接上游前校验请求参数、将工具调用和输出格式要求改写为文本、检查提示词是否超出模型的输入上限，并按提示词 token 数预扣 token 限流额度
+// 实际用量在请求结束后结算
+func (s *ChatService) admit(ctx context.Context, req *model.ChatCompletionRequest) error {
+	if apiErr := req.Validate(); apiErr != nil {
+		return apiErr
+	}
+	markRedirect(ctx, req)
+	if err := applyToolPrompt(req); err != nil {
+		return model.NewAPIError(model.ErrInvalidRequest, err.Error(), http.StatusBadRequest)
+	}
+	applyFormatPrompt(req)
+	strategy, err := truncationStrategy(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	modelName, tokens := s.grpcService.countPrompt(req)
+	if err := stripImages(ctx, req, modelName); err != nil {
+		return err
+	}
+	limit := model.MaxTokensOf(modelName).InputLimit()
+	if limit > 0 && tokens > limit && strategy != "" && strategy != model.TruncateNone {
+		tokens = s.grpcService.truncatePrompt(req, strategy, limit, tokens)
+	}
+	if limit > 0 && tokens > limit {
+		return model.NewAPIErrorWithDetails(
+			model.ErrContextTooLong,
+			fmt.Sprintf("This model's maximum input length is %d tokens, but the prompt contains %d tokens", limit, tokens),
+			http.StatusBadRequest,
+			map[string]interface{}{
+				"model":            modelName,
+				"prompt_tokens":    tokens,
+				"max_input_tokens": limit,
+			},
+		)
+	}
+	return ratelimit.FromContext(ctx).Acquire(tokens)
+}
+
+// markRedirect 请求的模型已下线时记录转发到的模型，由接口层写入响应头
+func markRedirect(ctx context.Context, req *model.ChatCompletionRequest) {
+	alias, ok := model.LookupAlias(req.Model)
+	if !ok || !alias.Deprecated {
+		return
+	}
+	req.Redirected = model.NormalizeModelName(req.Model)
+	slog.WarnContext(ctx, "deprecated model redirected", "model", req.Model, "target", req.Redirected)
+}
+
+// stripImages 按模型能力处理图片片段：上游只接受文本，支持图片的模型丢弃图片片段，其余模型拒绝请求
+// 提示词只包含文本片段，丢弃图片不影响 token 计数
+func stripImages(ctx context.Context, req *model.ChatCompletionRequest, modelName string) error {
+	if modelName == "" {
+		return nil
+	}
+	vision := model.CapabilitiesOf(modelName).Vision
+	stripped := 0
+	for i := range req.Messages {
+		msg := &req.Messages[i]
+		if !msg.HasImages() {
+			continue
+		}
+		parts := make([]model.ContentPart, 0, len(msg.Parts))
+		for j, part := range msg.Parts {
+			if part.Type != model.ContentPartImageURL {
+				parts = append(parts, part)
+				continue
+			}
+			if !vision {
+				return model.NewAPIError(model.ErrInvalidRequest,
+					fmt.Sprintf("messages[%d].content[%d]: model '%s' does not accept image input", i, j, req.Model),
+					http.StatusBadRequest)
+			}
+			stripped++
+		}
+		msg.Parts = parts
+	}
+	if stripped > 0 {
+		slog.InfoContext(ctx, "image parts stripped, upstream accepts text only", "model", modelName, "images", stripped)
+	}
+	return nil
+}
+
+// truncationStrategy 返回请求使用的截断策略，请求指定的策略优先于密钥配置
+func truncationStrategy(ctx context.Context, req *model.ChatCompletionRequest) (model.TruncationStrategy, error) {
+	strategy, err := model.ParseTruncationStrategy(req.Truncation)
+	if err != nil {
+		return "", model.NewAPIError(model.ErrInvalidRequest, err.Error(), http.StatusBadRequest)
+	}
+	if strategy == "" {
+		if key := keystore.FromContext(ctx); key != nil {
+			strategy = key.Truncation
+		}
+	}
+	return strategy, nil
+}
+
+// CountPromptTokens 计算请求提示词的token数量，用于需要预先返回用量的协议
+func (s *ChatService) CountPromptTokens(req *model.ChatCompletionRequest) int {
+	return s.grpcService.CountPromptTokens(req)
+}
+
 func (s *ChatService) shouldRetry(err error) bool {
 	if err == nil {
 		return false
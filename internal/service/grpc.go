@@ -4,38 +4,44 @@ import (
 	"context"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
+	"pieces-os-go/internal/audit"
 	"pieces-os-go/internal/config"
+	"pieces-os-go/internal/keystore"
+	"pieces-os-go/internal/metrics"
 	"pieces-os-go/internal/model"
+	"pieces-os-go/internal/tracing"
+	"pieces-os-go/internal/usage"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	gptpb "pieces-os-go/pkg/proto/gpt"
-	vertexpb "pieces-os-go/pkg/proto/vertex"
-	"pieces-os-go/pkg/tokenizer"
-
 	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/connectivity"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/keepalive"
 	"google.golang.org/grpc/status"
 )
 
 type GRPCService struct {
-	config     *config.Config
-	vertexPool *ConnectionPool
-	gptPool    *ConnectionPool
-	connMutex  sync.RWMutex
+	config    atomic.Pointer[config.Config]
+	prompts   atomic.Pointer[map[string]*model.CompiledPrompt] // 按模型名或后端名索引的提示词模板
+	pools     map[string]*ConnectionPool                       // 按后端名称索引的连接池
+	connMutex sync.RWMutex
 }
 
 type ConnectionPool struct {
 	connections chan *grpc.ClientConn
 	addr        string
+	plaintext   bool  // 是否使用明文连接
 	minSize     int   // 最小连接数
 	maxSize     int   // 最大连接数
 	currentSize int32 // 当前连接数
@@ -44,21 +50,70 @@ type ConnectionPool struct {
 
 func NewGRPCService(cfg *config.Config) *GRPCService {
 	service := &GRPCService{
-		config: cfg,
+		pools: make(map[string]*ConnectionPool),
 	}
+	service.config.Store(cfg)
+	service.prompts.Store(compilePrompts(cfg))
 
-	// 初始化连接池
-	if cfg.VertexGRPCAddr != "" {
-		service.vertexPool = newConnectionPool(cfg.VertexGRPCAddr, 5, 20) // 最小5个,最大20个
-	}
-	if cfg.GPTGRPCAddr != "" {
-		service.gptPool = newConnectionPool(cfg.GPTGRPCAddr, 5, 20)
+	// 为每个已注册且配置了地址的后端初始化连接池
+	for _, backend := range registeredBackends() {
+		if addr := backend.Addr(cfg); addr != "" {
+			pool := newConnectionPool(addr, cfg.GRPCPlaintext, 5, 20) // 最小5个,最大20个
+			service.pools[backend.Name()] = pool
+			metrics.SetPoolSource(backend.Name(), pool.stats)
+		}
 	}
 
 	return service
 }
 
-func newConnectionPool(addr string, minSize, maxSize int) *ConnectionPool {
+// UpdateConfig 应用重载后的配置，上游地址和连接池大小需要重启才能生效
+func (s *GRPCService) UpdateConfig(cfg *config.Config) {
+	s.config.Store(cfg)
+	s.prompts.Store(compilePrompts(cfg))
+}
+
+// compilePrompts 编译各后端的内置模板和配置中的 prompt_templates，配置中的模板按模型名或后端名覆盖内置模板
+func compilePrompts(cfg *config.Config) *map[string]*model.CompiledPrompt {
+	prompts := make(map[string]*model.CompiledPrompt)
+	for _, backend := range registeredBackends() {
+		compiled, err := backend.PromptTemplate().Compile(backend.Name())
+		if err != nil {
+			slog.Error("invalid builtin prompt template", "backend", backend.Name(), "error", err)
+			continue
+		}
+		prompts[backend.Name()] = compiled
+	}
+	for name, tmpl := range cfg.PromptTemplates {
+		// 配置校验已拒绝无法编译的模板
+		compiled, err := tmpl.Compile(name)
+		if err != nil {
+			slog.Error("invalid prompt template, using the builtin one", "name", name, "error", err)
+			continue
+		}
+		prompts[name] = compiled
+	}
+	return &prompts
+}
+
+// buildRequest 按模型的提示词模板渲染对话并构建上游请求，模型没有单独的模板时使用后端的模板
+func (s *GRPCService) buildRequest(backend Backend, req *model.ChatCompletionRequest) (any, error) {
+	prompts := *s.prompts.Load()
+	tmpl, ok := prompts[req.Model]
+	if !ok {
+		tmpl = prompts[backend.Name()]
+	}
+	if tmpl == nil {
+		return nil, fmt.Errorf("no prompt template for model: %s", req.Model)
+	}
+	prompt, err := tmpl.Render(req.Model, req.Messages)
+	if err != nil {
+		return nil, fmt.Errorf("render prompt template: %v", err)
+	}
+	return backend.BuildRequest(req, prompt)
+}
+
+func newConnectionPool(addr string, plaintext bool, minSize, maxSize int) *ConnectionPool {
 	if minSize <= 0 {
 		minSize = 5 // 默认最小连接数
 	}
@@ -69,6 +124,7 @@ func newConnectionPool(addr string, minSize, maxSize int) *ConnectionPool {
 	pool := &ConnectionPool{
 		connections: make(chan *grpc.ClientConn, maxSize),
 		addr:        addr,
+		plaintext:   plaintext,
 		minSize:     minSize,
 		maxSize:     maxSize,
 		currentSize: 0,
@@ -76,7 +132,7 @@ func newConnectionPool(addr string, minSize, maxSize int) *ConnectionPool {
 
 	// 预创建最小数量的连接
 	for i := 0; i < minSize; i++ {
-		if conn, err := createNewConnection(addr); err == nil {
+		if conn, err := createNewConnection(addr, plaintext); err == nil {
 			pool.connections <- conn
 			atomic.AddInt32(&pool.currentSize, 1)
 		}
@@ -88,36 +144,39 @@ func newConnectionPool(addr string, minSize, maxSize int) *ConnectionPool {
 	return pool
 }
 
-func (s *GRPCService) getConnection(addr string) (*grpc.ClientConn, error) {
+func (s *GRPCService) getConnection(ctx context.Context, backend string) (*ConnectionPool, *grpc.ClientConn, error) {
 	s.connMutex.RLock()
 	defer s.connMutex.RUnlock()
 
-	var pool *ConnectionPool
-
-	if addr == s.config.VertexGRPCAddr {
-		pool = s.vertexPool
-	} else if addr == s.config.GPTGRPCAddr {
-		pool = s.gptPool
+	pool := s.pools[backend]
+	if pool == nil {
+		return nil, nil, fmt.Errorf("no pool available for backend: %s", backend)
 	}
 
-	if pool == nil {
-		return nil, fmt.Errorf("no pool available for address: %s", addr)
+	start := time.Now()
+	_, span := tracing.Tracer().Start(ctx, "pool.acquire", trace.WithAttributes(attribute.String("backend", backend)))
+	defer span.End()
+	acquired := func(source string) {
+		span.SetAttributes(attribute.String("pool.source", source))
+		metrics.ObservePoolWait(backend, time.Since(start), false)
 	}
 
 	// 尝试从池中获取连接
 	select {
 	case conn := <-pool.connections:
 		if conn.GetState() != connectivity.Shutdown {
-			return conn, nil
+			acquired("idle")
+			return pool, conn, nil
 		}
 		// 连接已关闭,创建新连接
 		atomic.AddInt32(&pool.currentSize, -1)
 	default:
 		// 池为空但未达到最大值时创建新连接
 		if atomic.LoadInt32(&pool.currentSize) < int32(pool.maxSize) {
-			if conn, err := createNewConnection(addr); err == nil {
+			if conn, err := createNewConnection(pool.addr, pool.plaintext); err == nil {
 				atomic.AddInt32(&pool.currentSize, 1)
-				return conn, nil
+				acquired("new")
+				return pool, conn, nil
 			}
 		}
 	}
@@ -125,15 +184,21 @@ func (s *GRPCService) getConnection(addr string) (*grpc.ClientConn, error) {
 	// 等待可用连接
 	select {
 	case conn := <-pool.connections:
-		return conn, nil
+		acquired("wait")
+		return pool, conn, nil
 	case <-time.After(5 * time.Second):
-		return nil, fmt.Errorf("connection pool timeout")
+		metrics.ObservePoolWait(backend, time.Since(start), true)
+		span.SetStatus(otelcodes.Error, "connection pool timeout")
+		return nil, nil, fmt.Errorf("connection pool timeout")
 	}
 }
 
-func createNewConnection(addr string) (*grpc.ClientConn, error) {
-	// 创建 TLS 凭证
+func createNewConnection(addr string, plaintext bool) (*grpc.ClientConn, error) {
+	// 创建 TLS 凭证，明文模式用于连接本地假上游或内网代理
 	creds := credentials.NewClientTLSFromCert(nil, "")
+	if plaintext {
+		creds = insecure.NewCredentials()
+	}
 
 	// 修改 keepalive 参数
 	kacp := keepalive.ClientParameters{
@@ -149,6 +214,8 @@ func createNewConnection(addr string) (*grpc.ClientConn, error) {
 		grpc.WithInitialWindowSize(1<<20),     // 1MB
 		grpc.WithInitialConnWindowSize(1<<20), // 1MB
 		grpc.WithUserAgent("dart-grpc/2.0.0"), // 添加 User-Agent 设置
+		grpc.WithUnaryInterceptor(tracing.UnaryClientInterceptor()),
+		grpc.WithStreamInterceptor(tracing.StreamClientInterceptor()),
 	)
 	if err != nil {
 		return nil, fmt.Errorf("connection error")
@@ -157,13 +224,15 @@ func createNewConnection(addr string) (*grpc.ClientConn, error) {
 	return conn, nil
 }
 
-func (s *GRPCService) SendCompletion(ctx context.Context, req *model.ChatCompletionRequest) (*model.ChatCompletionResponse, error) {
+// resolveModel 标准化并校验请求中的模型，返回原始模型名和对应的后端
+func (s *GRPCService) resolveModel(ctx context.Context, req *model.ChatCompletionRequest) (string, Backend, error) {
 	// 空值检查
 	if req == nil {
-		return nil, model.NewAPIError(model.ErrInvalidRequest, "request cannot be nil", http.StatusBadRequest)
+		return "", nil, model.NewAPIError(model.ErrInvalidRequest, "request cannot be nil", http.StatusBadRequest)
 	}
-	if s.config == nil {
-		return nil, model.NewAPIError(model.ErrInternalError, "service configuration is not initialized", http.StatusInternalServerError)
+	cfg := s.config.Load()
+	if cfg == nil {
+		return "", nil, model.NewAPIError(model.ErrInternalError, "service configuration is not initialized", http.StatusInternalServerError)
 	}
 
 	// 在开始时标准化模型名称
@@ -172,159 +241,365 @@ func (s *GRPCService) SendCompletion(ctx context.Context, req *model.ChatComplet
 
 	// 验证模型是否支持，如果不支持则尝试使用默认模型
 	if !model.IsModelSupported(req.Model) {
-		if s.config.DefaultModel == "" {
-			return nil, model.NewAPIError(
+		if cfg.DefaultModel == "" {
+			return "", nil, model.NewAPIError(
 				model.ErrModelNotFound,
 				fmt.Sprintf("Model '%s' does not exist", originalModel),
 				http.StatusNotFound,
 			)
 		}
-		req.Model = s.config.DefaultModel
+		req.Model = model.NormalizeModelName(cfg.DefaultModel)
 	}
+	usage.FromContext(ctx).SetModel(req.Model)
 
-	var conn *grpc.ClientConn
-	var err error
+	// 检查密钥是否允许使用该模型
+	if key := keystore.FromContext(ctx); key != nil && !key.AllowsModel(req.Model) {
+		return "", nil, model.NewAPIError(
+			model.ErrForbidden,
+			fmt.Sprintf("API key is not allowed to use model '%s'", originalModel),
+			http.StatusForbidden,
+		)
+	}
 
-	if model.IsGPTModel(req.Model) {
-		conn, err = s.getConnection(s.config.GPTGRPCAddr)
-		if err != nil {
-			return nil, fmt.Errorf("service unavailable: %v", err)
-		}
-		defer s.gptPool.returnConnection(conn)
+	backend, err := backendForModel(req.Model)
+	if err != nil {
+		return "", nil, model.NewAPIError(model.ErrInvalidModel, err.Error(), http.StatusInternalServerError)
+	}
 
-		// 使用buildGRPCRequest构建请求
-		grpcReq := buildGRPCRequest(req).(*gptpb.Request)
-		if grpcReq == nil {
-			return nil, fmt.Errorf("failed to build GPT request")
-		}
+	return originalModel, backend, nil
+}
 
-		client := gptpb.NewGPTInferenceServiceClient(conn)
-		resp, err := client.Predict(ctx, grpcReq)
-		if err != nil {
-			return nil, fmt.Errorf("request failed: %v", err)
-		}
+// SendCompletion 发送非流式请求，n 大于 1 时并行发起 n 次上游调用，合并为多个选项
+func (s *GRPCService) SendCompletion(ctx context.Context, req *model.ChatCompletionRequest) (*model.ChatCompletionResponse, error) {
+	originalModel, backend, err := s.resolveModel(ctx, req)
+	if err != nil {
+		return nil, err
+	}
 
-		// 添加空值检查
-		if resp == nil {
-			return nil, fmt.Errorf("received nil response")
+	n := req.Choices()
+	chunks := make([]*Chunk, n)
+	if n == 1 {
+		chunks[0], err = s.predict(ctx, backend, req)
+	} else {
+		errs := make([]error, n)
+		var wg sync.WaitGroup
+		for i := range chunks {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				chunks[i], errs[i] = s.predict(ctx, backend, req)
+			}(i)
+		}
+		wg.Wait()
+		for _, e := range errs {
+			if e != nil {
+				err = e
+				break
+			}
 		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// 使用tokenizer计算token数量，提示词只计一次
+	promptTokens := backend.CountPromptTokens(req)
+	completionTokens := 0
+	choices := make([]*model.Choice, n)
+	for i, chunk := range chunks {
+		limiter := newOutputLimiter(backend, req)
+		text := limiter.Write(chunk.Content) + limiter.Flush()
+		completionTokens += backend.CountCompletionTokens(req, text)
+
+		parser := newToolCallParser(req)
+		content, calls := parser.Write(text)
+		content += parser.Flush()
+		if parser.Called() {
+			content = strings.TrimSpace(content)
+		}
+		// 非流式响应中的调用不带序号
+		for j := range calls {
+			calls[j].Index = nil
+		}
+		choices[i] = &model.Choice{
+			Message: &model.ChatMessage{
+				Role:      model.RoleAssistant,
+				Content:   content,
+				ToolCalls: calls,
+			},
+			Index:        i,
+			FinishReason: finishReason(limiter, parser),
+			StopSequence: stopSequence(limiter, parser),
+		}
+	}
+
+	id := chunks[0].ID
+	if id == "" {
+		id = generateChatID()
+	}
+	created := chunks[0].Created
+	if created == 0 {
+		created = time.Now().Unix()
+	}
+
+	// 转换为 OpenAI 格式响应
+	return &model.ChatCompletionResponse{
+		ID:      id,
+		Object:  model.ObjectChatCompletion,
+		Created: created,
+		Model:   originalModel,
+		Choices: choices,
+		Usage: &model.Usage{
+			PromptTokens:     promptTokens,
+			CompletionTokens: completionTokens,
+			TotalTokens:      promptTokens + completionTokens,
+		},
+	}, nil
+}
 
-		// 检查响应状态码
-		if resp.ResponseCode != 200 && resp.ResponseCode != 0 {
-			return nil, fmt.Errorf("service error: response code %d", resp.ResponseCode)
-		}
+// predict 发起一次上游一元调用，返回解码后的响应
+func (s *GRPCService) predict(ctx context.Context, backend Backend, req *model.ChatCompletionRequest) (*Chunk, error) {
+	pool, conn, err := s.getConnection(ctx, backend.Name())
+	if err != nil {
+		return nil, fmt.Errorf("service unavailable: %v", err)
+	}
+	defer pool.returnConnection(conn)
 
-		// 使用tokenizer计算token数量
-		promptTokens := tokenizer.NumTokensFromMessages(req.Messages, req.Model)
+	grpcReq, err := s.buildRequest(backend, req)
+	if err != nil {
+		return nil, err
+	}
 
-		// 增加响应结构的完整性检查
-		if resp.Body == nil || resp.Body.MessageWarpper == nil ||
-			resp.Body.MessageWarpper.Message == nil {
-			return nil, fmt.Errorf("invalid response structure")
-		}
+	start := time.Now()
+	resp, err := backend.Predict(ctx, conn, grpcReq)
+	metrics.ObserveUpstream(backend.Name(), "predict", status.Code(err).String(), time.Since(start))
+	if err != nil {
+		return nil, fmt.Errorf("request failed: %v", err)
+	}
 
-		content := resp.Body.MessageWarpper.Message.Message
-		if content == "" {
-			return nil, fmt.Errorf("empty response content")
-		}
+	chunk, err := backend.DecodeChunk(resp)
+	if err != nil {
+		return nil, err
+	}
 
-		completionTokens := tokenizer.NumTokensFromMessage(&model.ChatMessage{
-			Role:    model.RoleAssistant,
-			Content: content,
-		}, req.Model)
+	// 检查响应状态码
+	if chunk.ResponseCode != 200 && chunk.ResponseCode != 0 {
+		return nil, fmt.Errorf("service error: response code %d", chunk.ResponseCode)
+	}
 
-		// 转换为 OpenAI 格式响应
-		response := &model.ChatCompletionResponse{
-			ID:      resp.Body.Id,
-			Object:  model.ObjectChatCompletion,
-			Created: int64(resp.Body.Time),
-			Model:   originalModel,
-			Choices: []*model.Choice{
-				{
-					Message: &model.ChatMessage{
-						Role:    model.RoleAssistant,
-						Content: content,
-					},
-					Index: 0,
-				},
-			},
-			Usage: &model.Usage{
-				PromptTokens:     promptTokens,
-				CompletionTokens: completionTokens,
-				TotalTokens:      promptTokens + completionTokens,
-			},
-		}
-		return response, nil
+	if chunk.Content == "" {
+		return nil, fmt.Errorf("empty response content")
+	}
+	return chunk, nil
+}
 
-	} else {
-		conn, err = s.getConnection(s.config.VertexGRPCAddr)
-		if err != nil {
-			return nil, fmt.Errorf("service unavailable: %v", err)
-		}
-		defer s.vertexPool.returnConnection(conn)
+// SendCompletionStream 发送流式请求，n 大于 1 时并行打开 n 个上游流，各选项的数据块交替输出
+func (s *GRPCService) SendCompletionStream(ctx context.Context, req *model.ChatCompletionRequest) (<-chan *model.ChatCompletionStreamResponse, error) {
+	originalModel, backend, err := s.resolveModel(ctx, req)
+	if err != nil {
+		return nil, err
+	}
 
-		// 使用buildGRPCRequest构建请求
-		grpcReq := buildGRPCRequest(req).(*vertexpb.Requests)
-		if grpcReq == nil {
-			return nil, fmt.Errorf("failed to build Vertex request")
+	// 网关提前结束输出时取消上游流
+	ctx, cancel := context.WithCancel(ctx)
+	n := req.Choices()
+	streams := make([]ChunkStream, n)
+	starts := make([]time.Time, n)
+	for i := range streams {
+		if streams[i], starts[i], err = s.openStream(ctx, backend, req); err != nil {
+			cancel()
+			return nil, err
 		}
+	}
 
-		client := vertexpb.NewVertexInferenceServiceClient(conn)
-		resp, err := client.Predict(ctx, grpcReq)
-		if err != nil {
-			return nil, fmt.Errorf("request failed: %v", err)
-		}
+	responseID := generateChatID()
+	if n == 1 {
+		responseChan := make(chan *model.ChatCompletionStreamResponse)
+		go func() {
+			defer cancel()
+			relayStream(ctx, backend, req, originalModel, responseID, 0, starts[0], streams[0], responseChan)
+		}()
+		return responseChan, nil
+	}
 
-		// 添加空值检查
-		if resp == nil {
-			return nil, fmt.Errorf("received nil response")
-		}
+	choiceChans := make([]<-chan *model.ChatCompletionStreamResponse, n)
+	for i := range streams {
+		choiceChan := make(chan *model.ChatCompletionStreamResponse)
+		choiceChans[i] = choiceChan
+		go relayStream(ctx, backend, req, originalModel, responseID, i, starts[i], streams[i], choiceChan)
+	}
+	responseChan := make(chan *model.ChatCompletionStreamResponse)
+	go func() {
+		defer cancel()
+		mergeChoices(ctx, choiceChans, responseChan)
+	}()
+	return responseChan, nil
+}
 
-		// 检查响应状态码
-		if resp.ResponseCode != 200 && resp.ResponseCode != 0 {
-			return nil, fmt.Errorf("service error: response code %d", resp.ResponseCode)
-		}
+// openStream 打开一个上游流，返回发起请求的时间
+func (s *GRPCService) openStream(ctx context.Context, backend Backend, req *model.ChatCompletionRequest) (ChunkStream, time.Time, error) {
+	pool, conn, err := s.getConnection(ctx, backend.Name())
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("service unavailable: %v", err)
+	}
+	defer pool.returnConnection(conn)
 
-		// 使用tokenizer计算token数量
-		params, _ := buildTokenCountParams(req.Messages)
-		promptTokens, err := tokenizer.NumTokensFromClaudeMessages(&params)
-		if err != nil {
-			log.Printf("Error counting prompt tokens: %v", err)
-			promptTokens = 0
+	grpcReq, err := s.buildRequest(backend, req)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	start := time.Now()
+	stream, err := backend.PredictStream(ctx, conn, grpcReq)
+	if err != nil {
+		metrics.ObserveUpstream(backend.Name(), "predict_stream", status.Code(err).String(), time.Since(start))
+		return nil, time.Time{}, fmt.Errorf("stream request failed")
+	}
+	return stream, start, nil
+}
+
+// mergeChoices 将多个选项的数据块合并到一个通道
+// 各选项结束块中的用量被移除，全部结束后汇总为最后一个只含用量的数据块，提示词只计一次
+func mergeChoices(ctx context.Context, choiceChans []<-chan *model.ChatCompletionStreamResponse, responseChan chan<- *model.ChatCompletionStreamResponse) {
+	defer close(responseChan)
+
+	merged := make(chan *model.ChatCompletionStreamResponse)
+	var wg sync.WaitGroup
+	for _, choiceChan := range choiceChans {
+		wg.Add(1)
+		go func(choiceChan <-chan *model.ChatCompletionStreamResponse) {
+			defer wg.Done()
+			for resp := range choiceChan {
+				merged <- resp
+			}
+		}(choiceChan)
+	}
+	go func() {
+		wg.Wait()
+		close(merged)
+	}()
+
+	var last *model.ChatCompletionStreamResponse
+	var total *model.Usage
+	for resp := range merged {
+		if resp.Usage != nil {
+			if total == nil {
+				total = &model.Usage{PromptTokens: resp.Usage.PromptTokens}
+			}
+			total.CompletionTokens += resp.Usage.CompletionTokens
+			resp.Usage = nil
 		}
+		last = resp
+		select {
+		case responseChan <- resp:
+		case <-ctx.Done():
+			// 继续读取直到各选项的流结束，避免 relayStream 阻塞
+		}
+	}
 
-		// 增加响应结构的完整性检查
-		if resp.Args == nil || resp.Args.Args == nil ||
-			resp.Args.Args.Args == nil {
-			return nil, fmt.Errorf("invalid response structure")
+	if total == nil {
+		return
+	}
+	total.TotalTokens = total.PromptTokens + total.CompletionTokens
+	select {
+	case responseChan <- &model.ChatCompletionStreamResponse{
+		ID:      last.ID,
+		Object:  model.ObjectChatCompletionChunk,
+		Created: last.Created,
+		Model:   last.Model,
+		Choices: []*model.ChatCompletionStreamChoice{},
+		Usage:   total,
+	}:
+	case <-ctx.Done():
+	}
+}
+
+// relayStream 读取上游流并转换为 OpenAI 格式的数据块，index 为选项序号
+// 上游以 204 响应码结束流；流异常中断时，如已收到内容仍会补发结束块
+// start 为发起上游请求的时间，用于统计首个内容块延迟和流的总时长
+func relayStream(ctx context.Context, backend Backend, req *model.ChatCompletionRequest, originalModel, responseID string, index int, start time.Time, stream ChunkStream, responseChan chan<- *model.ChatCompletionStreamResponse) {
+	defer close(responseChan)
+
+	code := codes.OK
+	defer func() {
+		elapsed := time.Since(start)
+		metrics.ObserveUpstream(backend.Name(), "predict_stream", code.String(), elapsed)
+		metrics.ObserveStream(req.Model, elapsed)
+	}()
+
+	promptTokens := backend.CountPromptTokens(req)
+	limiter := newOutputLimiter(backend, req)
+	parser := newToolCallParser(req)
+	isFirstChunk := true
+	// 流结束时记录拼接后的完整回复，在关闭数据通道之前执行，多个选项时只记录第一个
+	defer func() {
+		if index == 0 {
+			audit.FromContext(ctx).SetCompletion(limiter.Text())
+		}
+	}()
+
+	send := func(resp *model.ChatCompletionStreamResponse) bool {
+		select {
+		case responseChan <- resp:
+			return true
+		case <-ctx.Done():
+			code = status.FromContextError(ctx.Err()).Code()
+			return false
 		}
+	}
 
-		content := resp.Args.Args.Args.Message
-		if content == "" {
-			return nil, fmt.Errorf("empty response content")
+	sendDelta := func(delta *model.ChatCompletionStreamDelta, created int64) bool {
+		if isFirstChunk {
+			delta.Role = model.RoleAssistant
+			isFirstChunk = false
+			metrics.ObserveTTFT(req.Model, time.Since(start))
 		}
+		return send(&model.ChatCompletionStreamResponse{
+			ID:      responseID,
+			Object:  model.ObjectChatCompletionChunk,
+			Created: created,
+			Model:   originalModel,
+			Choices: []*model.ChatCompletionStreamChoice{
+				{
+					Delta: delta,
+					Index: index,
+				},
+			},
+		})
+	}
 
-		completionTokens, err := tokenizer.CountTokens(content)
-		if err != nil {
-			log.Printf("Error counting completion tokens: %v", err)
-			completionTokens = 0
-		} else {
-			completionTokens += 3
+	// sendContent 解析经过 stop 和 max_tokens 处理后的内容，分别发送普通内容和工具调用
+	sendContent := func(text string, created int64) bool {
+		content, calls := parser.Write(text)
+		if content != "" && !sendDelta(&model.ChatCompletionStreamDelta{Content: content}, created) {
+			return false
+		}
+		if len(calls) > 0 && !sendDelta(&model.ChatCompletionStreamDelta{ToolCalls: calls}, created) {
+			return false
 		}
+		return true
+	}
 
-		// 转换为 OpenAI 格式响应
-		response := &model.ChatCompletionResponse{
-			ID:      generateChatID(),
-			Object:  model.ObjectChatCompletion,
-			Created: time.Now().Unix(),
+	// 输出暂缓的内容并发送最终响应
+	sendFinal := func(created int64) {
+		if !sendContent(limiter.Flush(), created) {
+			return
+		}
+		if content := parser.Flush(); content != "" && !sendDelta(&model.ChatCompletionStreamDelta{Content: content}, created) {
+			return
+		}
+		completionTokens := backend.CountCompletionTokens(req, limiter.Text())
+		send(&model.ChatCompletionStreamResponse{
+			ID:      responseID,
+			Object:  model.ObjectChatCompletionChunk,
+			Created: created,
 			Model:   originalModel,
-			Choices: []*model.Choice{
+			Choices: []*model.ChatCompletionStreamChoice{
 				{
-					Message: &model.ChatMessage{
-						Role:    model.RoleAssistant,
-						Content: content,
-					},
-					Index: 0,
+					Delta:        &model.ChatCompletionStreamDelta{},
+					Index:        index,
+					FinishReason: finishReason(limiter, parser),
+					StopSequence: stopSequence(limiter, parser),
 				},
 			},
 			Usage: &model.Usage{
@@ -332,514 +607,95 @@ func (s *GRPCService) SendCompletion(ctx context.Context, req *model.ChatComplet
 				CompletionTokens: completionTokens,
 				TotalTokens:      promptTokens + completionTokens,
 			},
-		}
-		return response, nil
+		})
 	}
-}
 
-func (s *GRPCService) SendCompletionStream(ctx context.Context, req *model.ChatCompletionRequest) (<-chan *model.ChatCompletionStreamResponse, error) {
-	// 空值检查
-	if req == nil {
-		return nil, model.NewAPIError(model.ErrInvalidRequest, "request cannot be nil", http.StatusBadRequest)
-	}
-	if s.config == nil {
-		return nil, model.NewAPIError(model.ErrInternalError, "service configuration is not initialized", http.StatusInternalServerError)
-	}
-
-	// 在开始时标准化模型名称
-	originalModel := req.Model
-	req.Model = model.NormalizeModelName(req.Model)
-
-	// 验证模型是否支持，如果不支持则尝试使用默认模型
-	if !model.IsModelSupported(req.Model) {
-		if s.config.DefaultModel == "" {
-			return nil, model.NewAPIError(
-				model.ErrModelNotFound,
-				fmt.Sprintf("Model '%s' does not exist", originalModel),
-				http.StatusNotFound,
-			)
-		}
-		req.Model = s.config.DefaultModel
-	}
-	// 验证模型是否支持，如果不支持则尝试使用默认模型
-	if !model.IsModelSupported(req.Model) {
-		if s.config.DefaultModel == "" {
-			return nil, model.NewAPIError(
-				model.ErrModelNotFound,
-				fmt.Sprintf("Model '%s' does not exist", originalModel),
-				http.StatusNotFound,
-			)
-		}
-		req.Model = s.config.DefaultModel
-	}
-
-	responseChan := make(chan *model.ChatCompletionStreamResponse)
-
-	if model.IsGPTModel(req.Model) {
-		conn, err := s.getConnection(s.config.GPTGRPCAddr)
-		if err != nil {
-			return nil, fmt.Errorf("service unavailable")
+	for {
+		select {
+		case <-ctx.Done():
+			slog.InfoContext(ctx, "upstream stream timeout or canceled", "backend", backend.Name())
+			code = status.FromContextError(ctx.Err()).Code()
+			return
+		default:
 		}
-		defer s.gptPool.returnConnection(conn)
 
-		// 使用 buildGRPCRequest 构建请求
-		grpcReq := buildGRPCRequest(req).(*gptpb.Request)
-
-		client := gptpb.NewGPTInferenceServiceClient(conn)
-		stream, err := client.PredictWithStream(ctx, grpcReq)
+		resp, err := stream.Recv()
 		if err != nil {
-			return nil, fmt.Errorf("stream request failed")
-		}
-
-		go func() {
-			defer close(responseChan)
-
-			responseID := generateChatID()
-			promptTokens := tokenizer.NumTokensFromMessages(req.Messages, req.Model)
-			var completionTokens int
-			var fullContent string
-			isFirstChunk := true
-
-			// 获取当前时间戳作为默认值
-			currentTime := time.Now().Unix()
-
-			for {
-				select {
-				case <-ctx.Done():
-					log.Printf("GPT stream timeout or canceled")
-					return
-				default:
-					resp, err := stream.Recv()
-					if err != nil {
-						if err != io.EOF {
-							log.Printf("GPT stream error: %v", err)
-						}
-						return
-					}
-
-					// 添加空值检查
-					if resp == nil {
-						log.Printf("Received nil response")
-						continue
-					}
-
-					// 添加空值检查并使用默认时间
-					createdTime := currentTime
-					if resp.Body != nil {
-						createdTime = int64(resp.Body.Time)
-					}
-
-					// 处理 204 响应码
-					if resp.ResponseCode == 204 {
-						// 发送最终响应前的空值检查
-						if resp.Body != nil && resp.Body.MessageWarpper != nil &&
-							resp.Body.MessageWarpper.Message != nil &&
-							resp.Body.MessageWarpper.Message.Message != "" {
-
-							content := resp.Body.MessageWarpper.Message.Message
-							fullContent += content
-
-							response := &model.ChatCompletionStreamResponse{
-								ID:      responseID,
-								Object:  model.ObjectChatCompletionChunk,
-								Created: createdTime,
-								Model:   originalModel,
-								Choices: []*model.ChatCompletionStreamChoice{
-									{
-										Delta: &model.ChatCompletionStreamDelta{
-											Content: content,
-										},
-										Index: 0,
-									},
-								},
-							}
-
-							if isFirstChunk {
-								response.Choices[0].Delta.Role = model.RoleAssistant
-								isFirstChunk = false
-							}
-
-							select {
-							case responseChan <- response:
-							case <-ctx.Done():
-								return
-							}
-						}
-
-						// 发送最终响应
-						completionTokens = tokenizer.NumTokensFromText(fullContent, req.Model)
-						finalResponse := &model.ChatCompletionStreamResponse{
-							ID:      responseID,
-							Object:  model.ObjectChatCompletionChunk,
-							Created: createdTime,
-							Model:   originalModel,
-							Choices: []*model.ChatCompletionStreamChoice{
-								{
-									Delta:        &model.ChatCompletionStreamDelta{},
-									Index:        0,
-									FinishReason: model.FinishReasonStop,
-								},
-							},
-							Usage: &model.Usage{
-								PromptTokens:     promptTokens,
-								CompletionTokens: completionTokens,
-								TotalTokens:      promptTokens + completionTokens,
-							},
-						}
-
-						select {
-						case responseChan <- finalResponse:
-						case <-ctx.Done():
-							return
-						}
-						return
-					}
-
-					// 处理常规消息
-					if resp.Body != nil && resp.Body.MessageWarpper != nil &&
-						resp.Body.MessageWarpper.Message != nil &&
-						resp.Body.MessageWarpper.Message.Message != "" {
-
-						content := resp.Body.MessageWarpper.Message.Message
-						fullContent += content
-
-						response := &model.ChatCompletionStreamResponse{
-							ID:      responseID,
-							Object:  model.ObjectChatCompletionChunk,
-							Created: int64(resp.Body.Time),
-							Model:   originalModel,
-							Choices: []*model.ChatCompletionStreamChoice{
-								{
-									Delta: &model.ChatCompletionStreamDelta{
-										Content: content,
-									},
-									Index: 0,
-								},
-							},
-						}
-
-						if isFirstChunk {
-							response.Choices[0].Delta.Role = model.RoleAssistant
-							isFirstChunk = false
-						}
-
-						select {
-						case responseChan <- response:
-						case <-ctx.Done():
-							return
-						}
+			if err != io.EOF {
+				code = status.Code(err)
+				if st, ok := status.FromError(err); ok {
+					if st.Code() == codes.Internal && strings.Contains(st.Message(), "RST_STREAM") {
+						slog.WarnContext(ctx, "upstream stream terminated by RST_STREAM", "backend", backend.Name())
 					} else {
-						log.Printf("Received incomplete message structure")
-						continue
+						slog.ErrorContext(ctx, "upstream stream error", "backend", backend.Name(), "code", st.Code().String(), "error", st.Message())
 					}
+				} else {
+					slog.ErrorContext(ctx, "upstream stream error", "backend", backend.Name(), "error", err)
 				}
 			}
-		}()
-
-	} else {
-		conn, err := s.getConnection(s.config.VertexGRPCAddr)
-		if err != nil {
-			return nil, err
+			if limiter.Text() != "" || limiter.pending != "" {
+				sendFinal(time.Now().Unix())
+			}
+			return
 		}
-		defer s.vertexPool.returnConnection(conn)
 
-		grpcReq := buildGRPCRequest(req).(*vertexpb.Requests)
-		client := vertexpb.NewVertexInferenceServiceClient(conn)
-		stream, err := client.PredictWithStream(ctx, grpcReq)
+		chunk, err := backend.DecodeChunk(resp)
 		if err != nil {
-			return nil, fmt.Errorf("stream request failed")
-		}
-
-		go func() {
-			defer close(responseChan)
-
-			responseID := generateChatID()
-			params, _ := buildTokenCountParams(req.Messages)
-			promptTokens, err := tokenizer.NumTokensFromClaudeMessages(&params)
-			if err != nil {
-				log.Printf("Error counting prompt tokens: %v", err)
-				promptTokens = 0
-			}
-			var completionTokens int
-			var fullContent string
-			isFirstChunk := true
-
-			for {
-				select {
-				case <-ctx.Done():
-					log.Printf("Stream timeout or canceled")
-					return
-				default:
-					resp, err := stream.Recv()
-					if err != nil {
-						if err != io.EOF {
-							if st, ok := status.FromError(err); ok {
-								if st.Code() == codes.Internal && strings.Contains(st.Message(), "RST_STREAM") {
-									log.Printf("Stream terminated by RST_STREAM")
-								} else {
-									log.Printf("Stream error with code %v: %v", st.Code(), st.Message())
-								}
-							} else {
-								log.Printf("Stream error: %v", err)
-							}
-						}
-						// 发送最终响应
-						if fullContent != "" {
-							if completionTokens, err = tokenizer.CountTokens(fullContent); err != nil {
-								log.Printf("Error counting completion tokens: %v", err)
-								completionTokens = 0
-							} else {
-								completionTokens += 3
-							}
-
-							select {
-							case responseChan <- &model.ChatCompletionStreamResponse{
-								ID:      responseID,
-								Object:  model.ObjectChatCompletionChunk,
-								Created: time.Now().Unix(),
-								Model:   originalModel,
-								Choices: []*model.ChatCompletionStreamChoice{
-									{
-										Delta:        &model.ChatCompletionStreamDelta{},
-										Index:        0,
-										FinishReason: model.FinishReasonStop,
-									},
-								},
-								Usage: &model.Usage{
-									PromptTokens:     promptTokens,
-									CompletionTokens: completionTokens,
-									TotalTokens:      promptTokens + completionTokens,
-								},
-							}:
-							case <-ctx.Done():
-								return
-							}
-						}
-						return
-					}
-
-					if resp == nil {
-						log.Printf("Received nil response")
-						continue
-					}
-
-					// 处理204响应码
-					if resp.ResponseCode == 204 {
-						if resp.Args != nil && resp.Args.Args != nil &&
-							resp.Args.Args.Args != nil && resp.Args.Args.Args.Message != "" {
-							content := resp.Args.Args.Args.Message
-							fullContent += content
-
-							select {
-							case responseChan <- &model.ChatCompletionStreamResponse{
-								ID:      responseID,
-								Object:  model.ObjectChatCompletionChunk,
-								Created: time.Now().Unix(),
-								Model:   originalModel,
-								Choices: []*model.ChatCompletionStreamChoice{
-									{
-										Delta: &model.ChatCompletionStreamDelta{
-											Content: content,
-										},
-										Index: 0,
-									},
-								},
-							}:
-							case <-ctx.Done():
-								return
-							}
-						}
-
-						// 发送最终响应
-						if completionTokens, err = tokenizer.CountTokens(fullContent); err != nil {
-							log.Printf("Error counting completion tokens: %v", err)
-							completionTokens = 0
-						} else {
-							completionTokens += 3
-						}
-
-						select {
-						case responseChan <- &model.ChatCompletionStreamResponse{
-							ID:      responseID,
-							Object:  model.ObjectChatCompletionChunk,
-							Created: time.Now().Unix(),
-							Model:   originalModel,
-							Choices: []*model.ChatCompletionStreamChoice{
-								{
-									Delta:        &model.ChatCompletionStreamDelta{},
-									Index:        0,
-									FinishReason: model.FinishReasonStop,
-								},
-							},
-							Usage: &model.Usage{
-								PromptTokens:     promptTokens,
-								CompletionTokens: completionTokens,
-								TotalTokens:      promptTokens + completionTokens,
-							},
-						}:
-						case <-ctx.Done():
-							return
-						}
-						return
-					}
-
-					// 检查响应结构的完整性
-					if resp.Args != nil && resp.Args.Args != nil &&
-						resp.Args.Args.Args != nil && resp.Args.Args.Args.Message != "" {
-						content := resp.Args.Args.Args.Message
-						fullContent += content
-
-						response := &model.ChatCompletionStreamResponse{
-							ID:      responseID,
-							Object:  model.ObjectChatCompletionChunk,
-							Created: time.Now().Unix(),
-							Model:   originalModel,
-							Choices: []*model.ChatCompletionStreamChoice{
-								{
-									Delta: &model.ChatCompletionStreamDelta{
-										Content: content,
-									},
-									Index: 0,
-								},
-							},
-						}
-
-						if isFirstChunk {
-							response.Choices[0].Delta.Role = model.RoleAssistant
-							isFirstChunk = false
-						}
-
-						select {
-						case responseChan <- response:
-						case <-ctx.Done():
-							return
-						}
-					} else {
-						log.Printf("Received incomplete message structure")
-						continue
-					}
-				}
-			}
-		}()
-	}
-
-	return responseChan, nil
-}
-
-func (s *GRPCService) Close() error {
-	if s.vertexPool != nil {
-		s.vertexPool.closeAll()
-	}
-	if s.gptPool != nil {
-		s.gptPool.closeAll()
-	}
-	return nil
-}
-
-// 辅助函数
-func buildGRPCRequest(req *model.ChatCompletionRequest) interface{} {
-	if model.IsGPTModel(req.Model) {
-		var systemContent string
-		var dialogContent string
-
-		// 处理消息
-		for _, msg := range req.Messages {
-			if msg.Role == model.RoleSystem {
-				systemContent += fmt.Sprintf("system:%s;\r\n", msg.Content)
-			} else {
-				dialogContent += fmt.Sprintf("%s:%s;\r\n", msg.Role, msg.Content)
-			}
+			slog.DebugContext(ctx, "skipping undecodable upstream chunk", "backend", backend.Name(), "error", err)
+			continue
 		}
 
-		messages := []*gptpb.Message{}
-		if systemContent != "" {
-			messages = append(messages, &gptpb.Message{
-				Role:    0,
-				Message: systemContent,
-			})
+		// 添加空值检查并使用默认时间
+		created := chunk.Created
+		if created == 0 {
+			created = time.Now().Unix()
 		}
-		if dialogContent != "" {
-			messages = append(messages, &gptpb.Message{
-				Role:    1,
-				Message: dialogContent,
-			})
-		}
-		grpcReq := &gptpb.Request{
-			Models:      req.Model,
-			Messages:    messages,
-			Temperature: req.Temperature,
-			TopP:        req.TopP,
-		}
-
-		// log.Printf("GPT Request: %+v", grpcReq)
-		return grpcReq
-	} else {
-		// 构建 Vertex 请求
-		params, system := buildTokenCountParams(req.Messages)
-		var conversations []string
 
-		for _, msg := range params.Messages {
-			conversations = append(conversations, fmt.Sprintf("%s:%s", msg.Role, msg.Content))
+		// 处理 204 响应码
+		if chunk.Done() {
+			if !sendContent(limiter.Write(chunk.Content), created) {
+				return
+			}
+			sendFinal(created)
+			return
 		}
 
-		message := ""
-		if len(conversations) > 0 {
-			message = strings.Join(conversations, ";\r\n") + ";\r\n"
+		// 处理常规消息
+		if chunk.Content == "" {
+			slog.DebugContext(ctx, "skipping upstream chunk without content", "backend", backend.Name())
+			continue
 		}
-
-		if system != "" {
-			system = "system:" + system + ";\r\n"
+		if !sendContent(limiter.Write(chunk.Content), created) {
+			return
 		}
-
-		return &vertexpb.Requests{
-			Models: model.NormalizeModelName(req.Model),
-			Args: &vertexpb.Args{
-				Messages: &vertexpb.Messages{
-					Unknown: 1,
-					Message: message,
-				},
-				Rules: system,
-			},
+		// 遇到停止序列或达到 max_tokens 时提前结束，不再读取上游
+		if limiter.Done() {
+			sendFinal(created)
+			return
 		}
 	}
 }
 
-// 辅助函数用于构建 TokenCountParams
-func buildTokenCountParams(messages []model.ChatMessage) (tokenizer.TokenCountParams, string) {
-	var systemMessages []string
-	var conversations []model.ChatMessage
-	var currentMessage model.ChatMessage
-
-	// 先分离系统消息
-	for _, msg := range messages {
-		if msg.Role == model.RoleSystem {
-			systemMessages = append(systemMessages, msg.Content)
-		} else {
-			// 处理非系统消息
-			if currentMessage.Role == "" {
-				currentMessage = msg
-			} else if currentMessage.Role == msg.Role {
-				// 合并相同角色的连续消息
-				currentMessage.Content += "\n" + msg.Content
-			} else {
-				// 角色变化，保存当前消息并开始新消息
-				conversations = append(conversations, currentMessage)
-				currentMessage = msg
-			}
-		}
-	}
+// CountPromptTokens 计算请求提示词的token数量，不修改原请求
+func (s *GRPCService) CountPromptTokens(req *model.ChatCompletionRequest) int {
+	_, tokens := s.countPrompt(req)
+	return tokens
+}
 
-	// 添加最后一条消息
-	if currentMessage.Role != "" {
-		conversations = append(conversations, currentMessage)
+// countPrompt 返回请求实际使用的模型和提示词的token数量，不修改原请求，模型无法解析时为空
+func (s *GRPCService) countPrompt(req *model.ChatCompletionRequest) (string, int) {
+	counted := *req
+	if _, backend, err := s.resolveModel(context.Background(), &counted); err == nil {
+		return counted.Model, backend.CountPromptTokens(&counted)
 	}
+	return "", 0
+}
 
-	system := strings.Join(systemMessages, "\n")
-
-	return tokenizer.TokenCountParams{
-		Messages: conversations,
-		System:   system,
-	}, system
+func (s *GRPCService) Close() error {
+	for _, pool := range s.pools {
+		pool.closeAll()
+	}
+	return nil
 }
 
 // 新增一个生成统一格式 ID 的辅助函数
@@ -849,6 +705,14 @@ func generateChatID() string {
 	return "chatcmpl-" + id
 }
 
+// stats 返回连接池当前的连接数和空闲连接数
+func (p *ConnectionPool) stats() metrics.PoolStats {
+	return metrics.PoolStats{
+		Size: int(atomic.LoadInt32(&p.currentSize)),
+		Idle: len(p.connections),
+	}
+}
+
 // 添加归还连接的方法
 func (p *ConnectionPool) returnConnection(conn *grpc.ClientConn) {
 	if conn == nil {
@@ -921,7 +785,7 @@ func (p *ConnectionPool) scale(isExpand bool) {
 		}
 
 		for i := 0; i < expandSize && currentSize < int32(p.maxSize); i++ {
-			if conn, err := createNewConnection(p.addr); err == nil {
+			if conn, err := createNewConnection(p.addr, p.plaintext); err == nil {
 				select {
 				case p.connections <- conn:
 					atomic.AddInt32(&p.currentSize, 1)
@@ -0,0 +1,134 @@
+package service
+
+import (
+	"pieces-os-go/internal/model"
+	"strings"
+)
+
+// outputLimiter 在网关侧执行上游协议无法传递的 stop 和 max_tokens
+// 停止序列可能跨越流式数据块，可能是停止序列开头的尾部内容会暂缓输出，直到能确定是否匹配
+type outputLimiter struct {
+	stop      []string
+	maxTokens int
+	count     func(string) int // 计算文本的 token 数，不含用量统计中的固定开销
+
+	emitted strings.Builder // 已输出的内容
+	tokens  int             // 已输出内容的 token 数，按数据块累加
+	pending string          // 暂缓输出的内容
+	finish  model.FinishReason
+	matched string // 触发结束的停止序列
+}
+
+func newOutputLimiter(backend Backend, req *model.ChatCompletionRequest) *outputLimiter {
+	return &outputLimiter{
+		stop:      req.Stop,
+		maxTokens: req.OutputLimit(),
+		count: func(content string) int {
+			return backend.CountTextTokens(req, content)
+		},
+	}
+}
+
+// Write 处理上游返回的内容，返回可以输出的部分
+func (l *outputLimiter) Write(content string) string {
+	if l.finish != "" {
+		return ""
+	}
+
+	text := l.pending + content
+	l.pending = ""
+	if i, stop := l.indexStop(text); i >= 0 {
+		text = text[:i]
+		l.finish = model.FinishReasonStop
+		l.matched = stop
+	} else if hold := partialSuffix(text, l.stop...); hold > 0 {
+		l.pending = text[len(text)-hold:]
+		text = text[:len(text)-hold]
+	}
+	return l.emit(text)
+}
+
+// Flush 上游输出结束时返回暂缓输出的内容
+func (l *outputLimiter) Flush() string {
+	if l.finish != "" {
+		return ""
+	}
+	text := l.pending
+	l.pending = ""
+	return l.emit(text)
+}
+
+// Done 是否已遇到停止序列或达到 max_tokens，之后的上游内容都会被丢弃
+func (l *outputLimiter) Done() bool {
+	return l.finish != ""
+}
+
+// Text 返回已输出的全部内容
+func (l *outputLimiter) Text() string {
+	return l.emitted.String()
+}
+
+// FinishReason 返回结束原因，正常结束时为 stop
+func (l *outputLimiter) FinishReason() model.FinishReason {
+	if l.finish != "" {
+		return l.finish
+	}
+	return model.FinishReasonStop
+}
+
+// StopSequence 返回触发结束的停止序列，未遇到停止序列时为空
+func (l *outputLimiter) StopSequence() string {
+	return l.matched
+}
+
+// emit 按 max_tokens 截断即将输出的内容
+// 只计算本次内容的 token 数并累加，超出时在本次内容中二分查找能放下的最长前缀
+func (l *outputLimiter) emit(text string) string {
+	if l.maxTokens > 0 && text != "" {
+		n := l.count(text)
+		if budget := l.maxTokens - l.tokens; n > budget {
+			runes := []rune(text)
+			lo, hi := 0, len(runes)
+			for lo < hi {
+				mid := (lo + hi + 1) / 2
+				if l.count(string(runes[:mid])) <= budget {
+					lo = mid
+				} else {
+					hi = mid - 1
+				}
+			}
+			text = string(runes[:lo])
+			n = budget
+			l.finish = model.FinishReasonLength
+			l.pending = ""
+		}
+		l.tokens += n
+	}
+	l.emitted.WriteString(text)
+	return text
+}
+
+// indexStop 返回最早出现的停止序列及其位置，没有时返回 -1
+func (l *outputLimiter) indexStop(text string) (int, string) {
+	first, matched := -1, ""
+	for _, stop := range l.stop {
+		if i := strings.Index(text, stop); i >= 0 && (first < 0 || i < first) {
+			first, matched = i, stop
+		}
+	}
+	return first, matched
+}
+
+// partialSuffix 返回 text 结尾与某个标记开头相同的最长长度
+func partialSuffix(text string, marks ...string) int {
+	hold := 0
+	for _, mark := range marks {
+		for n := min(len(mark)-1, len(text)); n > hold; n-- {
+			if strings.HasSuffix(text, mark[:n]) {
+				hold = n
+				break
+			}
+		}
+	}
+	return hold
+}
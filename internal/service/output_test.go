@@ -0,0 +1,68 @@
+package service
+
+import (
+	"pieces-os-go/internal/model"
+	"pieces-os-go/pkg/tokenizer"
+	"strings"
+	"testing"
+)
+
+func TestOutputLimiterMaxTokens(t *testing.T) {
+	if err := tokenizer.InitTokenizers(); err != nil {
+		t.Fatalf("init tokenizers: %v", err)
+	}
+	tests := []struct {
+		name      string
+		backend   Backend
+		model     string
+		maxTokens int
+		chunks    []string
+		want      string
+		finish    model.FinishReason
+	}{
+		{"gpt cut inside chunk", gptBackend{}, "gpt-4o-mini", 3, []string{"one two", " three four", " five"}, "one two three", model.FinishReasonLength},
+		{"gpt within limit", gptBackend{}, "gpt-4o-mini", 10, []string{"one two", " three"}, "one two three", model.FinishReasonStop},
+		// 用量统计中的固定开销不计入 max_tokens
+		{"vertex single token", vertexBackend{}, "claude-3-5-sonnet@20240620", 1, []string{"one two"}, "one ", model.FinishReasonLength},
+		{"vertex cut inside chunk", vertexBackend{}, "claude-3-5-sonnet@20240620", 3, []string{"one two ", "three four"}, "one two three ", model.FinishReasonLength},
+		{"vertex exact limit", vertexBackend{}, "claude-3-5-sonnet@20240620", 3, []string{"one two", " three"}, "one two three", model.FinishReasonStop},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &model.ChatCompletionRequest{Model: tt.model, MaxTokens: tt.maxTokens}
+			l := newOutputLimiter(tt.backend, req)
+			var out strings.Builder
+			for _, chunk := range tt.chunks {
+				out.WriteString(l.Write(chunk))
+			}
+			out.WriteString(l.Flush())
+			if out.String() != tt.want || l.FinishReason() != tt.finish {
+				t.Errorf("output = %q, finish = %q, want %q, %q", out.String(), l.FinishReason(), tt.want, tt.finish)
+			}
+		})
+	}
+}
+
+func TestOutputLimiterCountsEachChunkOnce(t *testing.T) {
+	// 未达到限制时每个数据块只计算一次，已输出的内容不会重复计算
+	counted := 0
+	l := &outputLimiter{
+		maxTokens: 1000,
+		count: func(s string) int {
+			counted += len(s)
+			return len(strings.Fields(s))
+		},
+	}
+	var total int
+	for i := 0; i < 200; i++ {
+		chunk := " word"
+		total += len(chunk)
+		l.Write(chunk)
+	}
+	if counted != total {
+		t.Errorf("counted %d bytes for %d bytes of output", counted, total)
+	}
+	if l.Done() {
+		t.Error("limiter should not finish below max_tokens")
+	}
+}
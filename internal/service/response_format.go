@@ -0,0 +1,195 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"pieces-os-go/internal/jsonschema"
+	"pieces-os-go/internal/model"
+	"pieces-os-go/internal/ratelimit"
+	"strings"
+)
+
+const jsonObjectPrompt = `Respond with a single valid JSON object and nothing else. Do not wrap it in Markdown code fences and do not add any explanation before or after it.`
+
+const jsonSchemaPrompt = `Respond with a single valid JSON value that conforms to the following JSON Schema (name: %s) and nothing else. Do not wrap it in Markdown code fences and do not add any explanation before or after it.%s
+JSON Schema:
+%s`
+
+const formatFeedbackPrompt = `Your previous reply was rejected because it is not valid for the required response format: %s
+Reply again with only the corrected JSON.`
+
+// applyFormatPrompt 要求 JSON 输出时追加说明输出格式的系统消息
+func applyFormatPrompt(req *model.ChatCompletionRequest) {
+	if !req.StructuredOutput() {
+		return
+	}
+	prompt := jsonObjectPrompt
+	if req.ResponseFormat.Type == model.ResponseFormatJSONSchema {
+		schema := req.ResponseFormat.JSONSchema
+		var description string
+		if schema.Description != "" {
+			description = "\n" + schema.Description
+		}
+		body := string(schema.Schema)
+		if len(schema.Schema) == 0 {
+			body = "{}"
+		}
+		prompt = fmt.Sprintf(jsonSchemaPrompt, schema.Name, description, body)
+	}
+	req.Messages = insertSystemPrompt(req.Messages, prompt)
+}
+
+// conformFormat 校验结构化输出，不符合要求时把校验错误反馈给模型重新生成，最多重试 FormatRetries 次
+// 各次尝试的用量都会计入，返回的用量为所有尝试之和
+func (s *ChatService) conformFormat(ctx context.Context, req *model.ChatCompletionRequest, resp *model.ChatCompletionResponse) (*model.ChatCompletionResponse, error) {
+	retries := s.config.Load().FormatRetries
+	total := model.Usage{}
+	for attempt := 1; ; attempt++ {
+		if resp.Usage != nil {
+			total.PromptTokens += resp.Usage.PromptTokens
+			total.CompletionTokens += resp.Usage.CompletionTokens
+			total.TotalTokens += resp.Usage.TotalTokens
+		}
+
+		rejected, err := checkFormat(req, resp)
+		if err == nil {
+			resp.Usage = &total
+			return resp, nil
+		}
+		if attempt > retries {
+			return nil, model.NewAPIErrorWithDetails(
+				model.ErrInvalidOutput,
+				fmt.Sprintf("The model output did not match response_format after %d attempts: %v", attempt, err),
+				http.StatusBadGateway,
+				map[string]interface{}{
+					"attempts": attempt,
+					"error":    err.Error(),
+				},
+			)
+		}
+
+		slog.WarnContext(ctx, "completion does not match response_format, retrying", "attempt", attempt, "error", err)
+		retry := *req
+		retry.Messages = make([]model.ChatMessage, 0, len(req.Messages)+2)
+		retry.Messages = append(retry.Messages, req.Messages...)
+		retry.Messages = append(retry.Messages,
+			model.ChatMessage{Role: model.RoleAssistant, Content: rejected},
+			model.ChatMessage{Role: model.RoleUser, Content: fmt.Sprintf(formatFeedbackPrompt, err)},
+		)
+		if err := s.admitRetry(ctx, &retry, attempt, err); err != nil {
+			return nil, err
+		}
+		if resp, err = s.complete(ctx, &retry); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// admitRetry 重试前重新检查追加反馈后的提示词长度并为其预扣 token 额度
+// 提示词超出上下文窗口时停止重试，返回已尝试次数和最后的校验错误
+func (s *ChatService) admitRetry(ctx context.Context, retry *model.ChatCompletionRequest, attempt int, rejected error) error {
+	modelName, tokens := s.grpcService.countPrompt(retry)
+	if limit := model.MaxTokensOf(modelName).InputLimit(); limit > 0 && tokens > limit {
+		return model.NewAPIErrorWithDetails(
+			model.ErrInvalidOutput,
+			fmt.Sprintf("The model output did not match response_format after %d attempts and a retry prompt of %d tokens would exceed the maximum input length of %d tokens: %v",
+				attempt, tokens, limit, rejected),
+			http.StatusBadGateway,
+			map[string]interface{}{
+				"attempts":         attempt,
+				"error":            rejected.Error(),
+				"prompt_tokens":    tokens,
+				"max_input_tokens": limit,
+			},
+		)
+	}
+	return ratelimit.FromContext(ctx).Acquire(tokens)
+}
+
+// checkFormat 校验每个选项的内容，通过时将内容替换为去掉代码块标记后的 JSON
+// 请求调用工具的选项不校验，不通过时返回第一个不符合要求的内容和原因
+func checkFormat(req *model.ChatCompletionRequest, resp *model.ChatCompletionResponse) (string, error) {
+	var schema *jsonschema.Schema
+	if format := req.ResponseFormat; format.Type == model.ResponseFormatJSONSchema && len(format.JSONSchema.Schema) > 0 {
+		var err error
+		if schema, err = jsonschema.Compile(format.JSONSchema.Schema); err != nil {
+			return "", err
+		}
+	}
+
+	for _, choice := range resp.Choices {
+		if choice.Message == nil || choice.FinishReason == model.FinishReasonToolCalls {
+			continue
+		}
+		content := extractJSON(choice.Message.Content)
+		var err error
+		switch {
+		case choice.FinishReason == model.FinishReasonLength:
+			err = fmt.Errorf("the output was cut off by max_tokens")
+		case schema != nil:
+			err = schema.Validate([]byte(content))
+		case !json.Valid([]byte(content)):
+			err = fmt.Errorf("the output is not valid JSON")
+		case req.ResponseFormat.Type == model.ResponseFormatJSONObject && !strings.HasPrefix(content, "{"):
+			err = fmt.Errorf("the output is not a JSON object")
+		}
+		if err != nil {
+			return choice.Message.Content, err
+		}
+		choice.Message.Content = content
+	}
+	return "", nil
+}
+
+// extractJSON 去掉首尾空白和模型常加的 Markdown 代码块标记
+func extractJSON(content string) string {
+	content = strings.TrimSpace(content)
+	if !strings.HasPrefix(content, "```") || !strings.HasSuffix(content, "```") || len(content) < 6 {
+		return content
+	}
+	body := strings.TrimSuffix(content[3:], "```")
+	// 去掉 ```json 之类的语言标记
+	if i := strings.IndexByte(body, '\n'); i >= 0 && !strings.ContainsAny(body[:i], "{[\"") {
+		body = body[i+1:]
+	}
+	return strings.TrimSpace(body)
+}
+
+// streamChunks 将校验通过的完整响应转换为流式数据块，用量的位置与直接转发上游流时相同
+func streamChunks(resp *model.ChatCompletionResponse) []*model.ChatCompletionStreamResponse {
+	chunk := func(choices ...*model.ChatCompletionStreamChoice) *model.ChatCompletionStreamResponse {
+		return &model.ChatCompletionStreamResponse{
+			ID:      resp.ID,
+			Object:  model.ObjectChatCompletionChunk,
+			Created: resp.Created,
+			Model:   resp.Model,
+			Choices: choices,
+		}
+	}
+
+	var chunks []*model.ChatCompletionStreamResponse
+	for _, choice := range resp.Choices {
+		delta := &model.ChatCompletionStreamDelta{Role: model.RoleAssistant, Content: choice.Message.Content}
+		for i, call := range choice.Message.ToolCalls {
+			index := i
+			call.Index = &index
+			delta.ToolCalls = append(delta.ToolCalls, call)
+		}
+		chunks = append(chunks,
+			chunk(&model.ChatCompletionStreamChoice{Index: choice.Index, Delta: delta}),
+			chunk(&model.ChatCompletionStreamChoice{Index: choice.Index, Delta: &model.ChatCompletionStreamDelta{}, FinishReason: choice.FinishReason, StopSequence: choice.StopSequence}),
+		)
+	}
+	if len(resp.Choices) == 1 {
+		chunks[len(chunks)-1].Usage = resp.Usage
+	} else {
+		usage := chunk()
+		usage.Choices = []*model.ChatCompletionStreamChoice{}
+		usage.Usage = resp.Usage
+		chunks = append(chunks, usage)
+	}
+	return chunks
+}
@@ -0,0 +1,258 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"pieces-os-go/internal/model"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// 上游协议只能传递文本，工具定义和调用约定写入系统提示词，模型按约定的标签输出调用，由网关解析
+const (
+	toolCallOpen    = "<tool_call>"
+	toolCallClose   = "</tool_call>"
+	toolResultOpen  = "<tool_result"
+	toolResultClose = "</tool_result>"
+)
+
+const toolPromptTemplate = `You have access to the following tools, described as JSON:
+%s
+
+To call a tool, reply with one block per call in exactly this format, where "arguments" is a JSON object matching the tool's parameters:
+` + toolCallOpen + `
+{"name": "<tool name>", "arguments": {...}}
+` + toolCallClose + `
+
+You may call several tools in one reply. Do not write anything after the last tool call. Tool results will be sent back to you in ` + toolResultOpen + `> blocks.
+%s`
+
+// applyToolPrompt 将工具相关的内容改写为纯文本消息
+// 助手消息中的调用还原为约定的标签格式，工具结果改写为用户消息，需要调用工具时追加说明工具的系统消息
+func applyToolPrompt(req *model.ChatCompletionRequest) error {
+	names := make(map[string]string) // 调用 ID -> 工具名称
+	messages := make([]model.ChatMessage, 0, len(req.Messages)+1)
+	rewritten := false
+	for _, msg := range req.Messages {
+		switch {
+		case msg.Role == model.RoleAssistant && len(msg.ToolCalls) > 0:
+			var b strings.Builder
+			b.WriteString(msg.Content)
+			for _, call := range msg.ToolCalls {
+				names[call.ID] = call.Function.Name
+				block, err := formatToolCall(call)
+				if err != nil {
+					return err
+				}
+				if b.Len() > 0 {
+					b.WriteString("\n")
+				}
+				b.WriteString(block)
+			}
+			messages = append(messages, model.ChatMessage{Role: model.RoleAssistant, Content: b.String()})
+			rewritten = true
+
+		case msg.Role == model.RoleTool:
+			content := fmt.Sprintf("%s id=%q name=%q>\n%s\n%s", toolResultOpen, msg.ToolCallID, names[msg.ToolCallID], msg.Content, toolResultClose)
+			messages = append(messages, model.ChatMessage{Role: model.RoleUser, Content: content})
+			rewritten = true
+
+		default:
+			messages = append(messages, msg)
+		}
+	}
+
+	choice := req.ToolMode()
+	if choice.Mode != model.ToolChoiceNone {
+		tools, err := json.MarshalIndent(req.Tools, "", "  ")
+		if err != nil {
+			return err
+		}
+		var instruction string
+		switch choice.Mode {
+		case model.ToolChoiceRequired:
+			instruction = "You must call at least one tool."
+		case model.ToolChoiceFunction:
+			instruction = fmt.Sprintf("You must call the tool %q.", choice.Function)
+		default:
+			instruction = "Call a tool only when it is needed, otherwise answer normally."
+		}
+		messages = insertSystemPrompt(messages, fmt.Sprintf(toolPromptTemplate, tools, instruction))
+		rewritten = true
+	}
+
+	if rewritten {
+		req.Messages = messages
+	}
+	return nil
+}
+
+// insertSystemPrompt 将网关生成的系统消息放在已有的系统消息之后
+func insertSystemPrompt(messages []model.ChatMessage, prompt string) []model.ChatMessage {
+	at := 0
+	for at < len(messages) && messages[at].Role == model.RoleSystem {
+		at++
+	}
+	result := make([]model.ChatMessage, 0, len(messages)+1)
+	result = append(result, messages[:at]...)
+	result = append(result, model.ChatMessage{Role: model.RoleSystem, Content: prompt})
+	return append(result, messages[at:]...)
+}
+
+// formatToolCall 按约定的标签格式输出一次调用
+func formatToolCall(call model.ToolCall) (string, error) {
+	args := json.RawMessage(call.Function.Arguments)
+	if !json.Valid(args) {
+		// 历史消息中的参数不是合法 JSON 时按字符串原样保留
+		quoted, err := json.Marshal(call.Function.Arguments)
+		if err != nil {
+			return "", err
+		}
+		args = quoted
+	}
+	body, err := json.Marshal(struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"`
+	}{call.Function.Name, args})
+	if err != nil {
+		return "", err
+	}
+	return toolCallOpen + "\n" + string(body) + "\n" + toolCallClose, nil
+}
+
+// toolCallParser 从模型输出中解析工具调用，可以增量处理流式内容
+// 可能是调用开始标签的尾部内容会暂缓输出，调用在结束标签到达后整体返回
+type toolCallParser struct {
+	tools  map[string]bool // 可调用的工具，为空时不解析
+	buf    string
+	inCall bool
+	calls  int // 已解析的调用数
+}
+
+func newToolCallParser(req *model.ChatCompletionRequest) *toolCallParser {
+	p := &toolCallParser{}
+	if req.ToolMode().Mode == model.ToolChoiceNone {
+		return p
+	}
+	p.tools = make(map[string]bool, len(req.Tools))
+	for _, tool := range req.Tools {
+		p.tools[tool.Function.Name] = true
+	}
+	return p
+}
+
+// Write 处理一段输出，返回其中的普通内容和已完整的调用
+func (p *toolCallParser) Write(text string) (string, []model.ToolCall) {
+	if p.tools == nil {
+		return text, nil
+	}
+
+	p.buf += text
+	var content strings.Builder
+	var calls []model.ToolCall
+	for {
+		if !p.inCall {
+			i := strings.Index(p.buf, toolCallOpen)
+			if i < 0 {
+				hold := partialSuffix(p.buf, toolCallOpen)
+				content.WriteString(p.buf[:len(p.buf)-hold])
+				p.buf = p.buf[len(p.buf)-hold:]
+				break
+			}
+			content.WriteString(p.buf[:i])
+			p.buf = p.buf[i+len(toolCallOpen):]
+			p.inCall = true
+			continue
+		}
+
+		j := strings.Index(p.buf, toolCallClose)
+		if j < 0 {
+			break
+		}
+		body := p.buf[:j]
+		p.buf = p.buf[j+len(toolCallClose):]
+		p.inCall = false
+		if call, ok := p.parse(body); ok {
+			calls = append(calls, call)
+		} else {
+			content.WriteString(toolCallOpen + body + toolCallClose)
+		}
+	}
+
+	// 调用之间和调用之后的空白不作为内容输出
+	out := content.String()
+	if p.calls > 0 && strings.TrimSpace(out) == "" {
+		out = ""
+	}
+	return out, calls
+}
+
+// Flush 输出结束时返回暂缓的内容，未闭合的调用按普通内容返回
+func (p *toolCallParser) Flush() string {
+	out := p.buf
+	if p.inCall {
+		out = toolCallOpen + out
+	}
+	p.buf = ""
+	p.inCall = false
+	if p.calls > 0 && strings.TrimSpace(out) == "" {
+		return ""
+	}
+	return out
+}
+
+// Called 是否解析出了工具调用
+func (p *toolCallParser) Called() bool {
+	return p.calls > 0
+}
+
+// parse 解析一次调用，工具不存在或格式不正确时返回 false
+func (p *toolCallParser) parse(body string) (model.ToolCall, bool) {
+	var call struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"`
+	}
+	if err := json.Unmarshal([]byte(strings.TrimSpace(body)), &call); err != nil || !p.tools[call.Name] {
+		return model.ToolCall{}, false
+	}
+
+	// 参数统一为 JSON 字符串，模型输出字符串形式的参数时去掉一层引号
+	args := bytes.TrimSpace(call.Arguments)
+	var quoted string
+	if json.Unmarshal(args, &quoted) == nil {
+		args = []byte(quoted)
+	}
+	if len(args) == 0 || string(args) == "null" {
+		args = []byte("{}")
+	}
+
+	index := p.calls
+	p.calls++
+	return model.ToolCall{
+		Index: &index,
+		ID:    "call_" + strings.ReplaceAll(uuid.New().String(), "-", "")[:24],
+		Type:  model.ToolTypeFunction,
+		Function: model.FunctionCall{
+			Name:      call.Name,
+			Arguments: string(args),
+		},
+	}, true
+}
+
+// finishReason 返回选项的结束原因，达到 max_tokens 优先，其次是工具调用
+func finishReason(limiter *outputLimiter, parser *toolCallParser) model.FinishReason {
+	if reason := limiter.FinishReason(); reason == model.FinishReasonLength || !parser.Called() {
+		return reason
+	}
+	return model.FinishReasonToolCalls
+}
+
+// stopSequence 返回因停止序列结束时匹配到的序列，其他结束原因时为空
+func stopSequence(limiter *outputLimiter, parser *toolCallParser) string {
+	if finishReason(limiter, parser) != model.FinishReasonStop {
+		return ""
+	}
+	return limiter.StopSequence()
+}
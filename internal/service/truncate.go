@@ -0,0 +1,122 @@
+package service
+
+import (
+	"context"
+	"pieces-os-go/internal/model"
+)
+
+const (
+	// middleOutMinKeep middle_out 删减后每条消息首尾至少各保留的字符数
+	middleOutMinKeep = 100
+	// middleOutMaxRounds middle_out 最多删减的次数，避免 token 计数与字符数不成比例时反复计算
+	middleOutMaxRounds = 32
+	// middleOutMarker 替换被删除内容的标记
+	middleOutMarker = "\n\n[...]\n\n"
+)
+
+// truncatePrompt 按策略截断请求的消息，返回截断后的提示词 token 数
+// 无法截断到上限以内时不修改请求并返回原 token 数
+func (s *GRPCService) truncatePrompt(req *model.ChatCompletionRequest, strategy model.TruncationStrategy, limit, tokens int) int {
+	counted := *req
+	_, backend, err := s.resolveModel(context.Background(), &counted)
+	if err != nil {
+		return tokens
+	}
+	count := func(messages []model.ChatMessage) int {
+		counted.Messages = messages
+		return backend.CountPromptTokens(&counted)
+	}
+
+	report := &model.TruncationReport{Strategy: strategy, OriginalTokens: tokens, PromptTokens: tokens}
+	var messages []model.ChatMessage
+	switch strategy {
+	case model.TruncateDropOldest:
+		messages = dropTurns(req.Messages, 0, limit, count, report)
+	case model.TruncateKeepEnds:
+		messages = dropTurns(req.Messages, 1, limit, count, report)
+	case model.TruncateMiddleOut:
+		messages = middleOut(req.Messages, limit, count, report)
+	default:
+		return tokens
+	}
+
+	// 截断后仍超出上限时保留原请求，由调用方按原提示词报错
+	if report.PromptTokens > limit {
+		return tokens
+	}
+	req.Messages = messages
+	req.Truncated = report
+	return report.PromptTokens
+}
+
+// dropTurns 从第 skip 个对话轮次开始依次丢弃整轮对话，直到提示词不超过 limit
+// 一轮对话从用户消息开始，包含之后的助手消息，最后一轮始终保留，系统消息不参与计数和丢弃
+func dropTurns(messages []model.ChatMessage, skip, limit int, count func([]model.ChatMessage) int, report *model.TruncationReport) []model.ChatMessage {
+	var turns [][]int // 每轮对话在 messages 中的下标
+	for i, msg := range messages {
+		if msg.Role == model.RoleSystem {
+			continue
+		}
+		if len(turns) == 0 || msg.Role == model.RoleUser {
+			turns = append(turns, nil)
+		}
+		turns[len(turns)-1] = append(turns[len(turns)-1], i)
+	}
+
+	dropped := make([]bool, len(messages))
+	kept := messages
+	for next := skip; next < len(turns)-1 && report.PromptTokens > limit; next++ {
+		for _, i := range turns[next] {
+			dropped[i] = true
+		}
+		report.DroppedMessages += len(turns[next])
+
+		kept = make([]model.ChatMessage, 0, len(messages))
+		for i, msg := range messages {
+			if !dropped[i] {
+				kept = append(kept, msg)
+			}
+		}
+		report.PromptTokens = count(kept)
+	}
+	return kept
+}
+
+// middleOut 依次从最长的非系统消息中间删除内容，保留消息的开头和结尾，直到提示词不超过 limit
+func middleOut(messages []model.ChatMessage, limit int, count func([]model.ChatMessage) int, report *model.TruncationReport) []model.ChatMessage {
+	result := make([]model.ChatMessage, len(messages))
+	copy(result, messages)
+	shortened := make(map[int]bool)
+
+	for round := 0; round < middleOutMaxRounds && report.PromptTokens > limit; round++ {
+		longest, longestLen, totalLen := -1, 0, 0
+		for i, msg := range result {
+			n := len([]rune(msg.Content))
+			totalLen += n
+			if msg.Role != model.RoleSystem && n > longestLen {
+				longest, longestLen = i, n
+			}
+		}
+		removable := longestLen - 2*middleOutMinKeep
+		if longest < 0 || removable <= len([]rune(middleOutMarker)) {
+			break
+		}
+
+		// 按整体的字符与 token 比例估算需要删除的字符数，多删一成以减少重新计数的次数
+		runesPerToken := float64(totalLen) / float64(report.PromptTokens)
+		cut := int(float64(report.PromptTokens-limit)*runesPerToken*1.1) + len([]rune(middleOutMarker))
+		if cut > removable {
+			cut = removable
+		}
+
+		runes := []rune(result[longest].Content)
+		head := (len(runes) - cut) / 2
+		tail := len(runes) - cut - head
+		result[longest].Content = string(runes[:head]) + middleOutMarker + string(runes[len(runes)-tail:])
+		shortened[longest] = true
+
+		report.PromptTokens = count(result)
+	}
+	report.ShortenedMessages = len(shortened)
+	return result
+}
@@ -0,0 +1,106 @@
+package tracing
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// 上游是第三方服务，拦截器只记录客户端 span，不向上游注入 traceparent
+
+// UnaryClientInterceptor 为上游一元调用创建客户端 span
+func UnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		ctx, span := startRPCSpan(ctx, method, cc.Target())
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		endRPCSpan(span, err)
+		return err
+	}
+}
+
+// StreamClientInterceptor 为上游流式调用创建客户端 span
+// span 在流读到结尾、出错或 ctx 结束时结束，收到第一条消息时记录 first_message 事件
+func StreamClientInterceptor() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		ctx, span := startRPCSpan(ctx, method, cc.Target())
+		stream, err := streamer(ctx, desc, cc, method, opts...)
+		if err != nil {
+			endRPCSpan(span, err)
+			return nil, err
+		}
+
+		traced := &tracedStream{ClientStream: stream, span: span, done: make(chan struct{})}
+		go func() {
+			select {
+			case <-ctx.Done():
+				traced.finish(status.FromContextError(ctx.Err()).Err())
+			case <-traced.done:
+			}
+		}()
+		return traced, nil
+	}
+}
+
+type tracedStream struct {
+	grpc.ClientStream
+	span     trace.Span
+	received atomic.Int64 // ctx 结束时由另一个 goroutine 读取
+	once     sync.Once
+	done     chan struct{}
+}
+
+func (s *tracedStream) RecvMsg(m any) error {
+	err := s.ClientStream.RecvMsg(m)
+	switch {
+	case err == io.EOF:
+		s.finish(nil)
+	case err != nil:
+		s.finish(err)
+	default:
+		if s.received.Add(1) == 1 {
+			s.span.AddEvent("first_message")
+		}
+	}
+	return err
+}
+
+func (s *tracedStream) finish(err error) {
+	s.once.Do(func() {
+		s.span.SetAttributes(attribute.Int64("rpc.messages_received", s.received.Load()))
+		endRPCSpan(s.span, err)
+		close(s.done)
+	})
+}
+
+func startRPCSpan(ctx context.Context, fullMethod, target string) (context.Context, trace.Span) {
+	name := strings.TrimPrefix(fullMethod, "/")
+	service, method, _ := strings.Cut(name, "/")
+	return Tracer().Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.RPCSystemGRPC,
+			semconv.RPCService(service),
+			semconv.RPCMethod(method),
+			semconv.ServerAddress(target),
+		),
+	)
+}
+
+func endRPCSpan(span trace.Span, err error) {
+	st, _ := status.FromError(err)
+	span.SetAttributes(semconv.RPCGRPCStatusCodeKey.Int(int(st.Code())))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(otelcodes.Error, st.Message())
+	}
+	span.End()
+}
@@ -0,0 +1,295 @@
+package usage
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	queueSize     = 1024
+	maxBatchSize  = 256
+	flushInterval = time.Second
+)
+
+var recordsBucket = []byte("records")
+
+// Store 基于 bbolt 的用量记录存储
+// 记录先进入内存队列，由后台 goroutine 批量写入，避免每个请求都等待磁盘同步
+type Store struct {
+	db      *bolt.DB
+	queue   chan Record
+	flushCh chan chan struct{}
+	done    chan struct{}
+
+	mu     sync.RWMutex // 保护 closed，防止关闭后继续写入队列
+	closed bool
+}
+
+// Open 打开或创建用量数据库
+func Open(path string) (*Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("open usage db %s: %w", path, err)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(recordsBucket)
+		return err
+	}); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("init usage db %s: %w", path, err)
+	}
+
+	s := &Store{
+		db:      db,
+		queue:   make(chan Record, queueSize),
+		flushCh: make(chan chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go s.run()
+	return s, nil
+}
+
+// Add 异步写入一条记录，队列已满时丢弃并记录日志
+func (s *Store) Add(rec Record) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.queue <- rec:
+	default:
+		slog.Warn("usage queue is full, dropping record", "key", rec.KeyID, "model", rec.Model)
+	}
+}
+
+// Close 写入队列中剩余的记录并关闭数据库
+func (s *Store) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.queue)
+	s.mu.Unlock()
+
+	<-s.done
+	return s.db.Close()
+}
+
+func (s *Store) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	var batch []Record
+	write := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := s.write(batch); err != nil {
+			slog.Error("failed to write usage records", "count", len(batch), "error", err)
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case rec, ok := <-s.queue:
+			if !ok {
+				write()
+				return
+			}
+			batch = append(batch, rec)
+			if len(batch) >= maxBatchSize {
+				write()
+			}
+		case <-ticker.C:
+			write()
+		case ack := <-s.flushCh:
+			// 取出队列中已有的记录后一并写入
+			for drained := false; !drained; {
+				select {
+				case rec, ok := <-s.queue:
+					if !ok {
+						drained = true
+						break
+					}
+					batch = append(batch, rec)
+				default:
+					drained = true
+				}
+			}
+			write()
+			close(ack)
+		}
+	}
+}
+
+// flush 等待已入队的记录写入数据库
+func (s *Store) flush() {
+	ack := make(chan struct{})
+	select {
+	case s.flushCh <- ack:
+		<-ack
+	case <-s.done:
+	}
+}
+
+func (s *Store) write(records []Record) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(recordsBucket)
+		for _, rec := range records {
+			seq, err := b.NextSequence()
+			if err != nil {
+				return err
+			}
+			value, err := json.Marshal(rec)
+			if err != nil {
+				return err
+			}
+			if err := b.Put(recordKey(rec.Time, seq), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// recordKey 键为纳秒时间戳加序号，按时间有序便于范围查询
+func recordKey(t time.Time, seq uint64) []byte {
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint64(key[:8], uint64(t.UnixNano()))
+	binary.BigEndian.PutUint64(key[8:], seq)
+	return key
+}
+
+// Filter 查询条件，时间范围为 [From, To)，空字段表示不过滤
+type Filter struct {
+	From  time.Time
+	To    time.Time
+	KeyID string
+	Model string
+}
+
+// Query 按时间顺序返回符合条件的记录
+func (s *Store) Query(f Filter) ([]Record, error) {
+	s.flush()
+
+	records := []Record{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(recordsBucket).Cursor()
+		end := uint64(f.To.UnixNano())
+		for k, v := c.Seek(recordKey(f.From, 0)); k != nil; k, v = c.Next() {
+			if binary.BigEndian.Uint64(k[:8]) >= end {
+				break
+			}
+			var rec Record
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return fmt.Errorf("decode usage record: %w", err)
+			}
+			if (f.KeyID != "" && rec.KeyID != f.KeyID) || (f.Model != "" && rec.Model != f.Model) {
+				continue
+			}
+			records = append(records, rec)
+		}
+		return nil
+	})
+	return records, err
+}
+
+// 支持的聚合维度
+const (
+	GroupDay   = "day"
+	GroupKey   = "key"
+	GroupModel = "model"
+)
+
+// GroupFields 全部聚合维度
+var GroupFields = []string{GroupDay, GroupKey, GroupModel}
+
+// Summary 按维度聚合后的用量，未参与聚合的维度为空
+type Summary struct {
+	Day              string `json:"day,omitempty"` // UTC 日期
+	KeyID            string `json:"key_id,omitempty"`
+	KeyName          string `json:"key_name,omitempty"`
+	Model            string `json:"model,omitempty"`
+	Requests         int    `json:"requests"`
+	StreamRequests   int    `json:"stream_requests"`
+	Errors           int    `json:"errors"` // 状态码 >= 400 的请求数
+	PromptTokens     int64  `json:"prompt_tokens"`
+	CompletionTokens int64  `json:"completion_tokens"`
+	TotalTokens      int64  `json:"total_tokens"`
+	AvgLatencyMs     int64  `json:"avg_latency_ms"`
+}
+
+// Aggregate 按给定维度汇总记录，结果按日期、密钥、模型排序
+func Aggregate(records []Record, groupBy []string) []Summary {
+	group := make(map[string]bool, len(groupBy))
+	for _, g := range groupBy {
+		group[g] = true
+	}
+
+	type bucket struct {
+		Summary
+		latency int64
+	}
+	buckets := make(map[Summary]*bucket)
+	for _, rec := range records {
+		var id Summary
+		if group[GroupDay] {
+			id.Day = rec.Time.UTC().Format("2006-01-02")
+		}
+		if group[GroupKey] {
+			id.KeyID = rec.KeyID
+		}
+		if group[GroupModel] {
+			id.Model = rec.Model
+		}
+
+		b, ok := buckets[id]
+		if !ok {
+			b = &bucket{Summary: id}
+			buckets[id] = b
+		}
+		if group[GroupKey] {
+			b.KeyName = rec.KeyName // 密钥改名后使用最新的名称
+		}
+		b.Requests++
+		if rec.Stream {
+			b.StreamRequests++
+		}
+		if rec.Status >= 400 {
+			b.Errors++
+		}
+		b.PromptTokens += int64(rec.PromptTokens)
+		b.CompletionTokens += int64(rec.CompletionTokens)
+		b.TotalTokens += int64(rec.TotalTokens)
+		b.latency += rec.LatencyMs
+	}
+
+	summaries := make([]Summary, 0, len(buckets))
+	for _, b := range buckets {
+		b.AvgLatencyMs = b.latency / int64(b.Requests)
+		summaries = append(summaries, b.Summary)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		a, b := summaries[i], summaries[j]
+		if a.Day != b.Day {
+			return a.Day < b.Day
+		}
+		if a.KeyID != b.KeyID {
+			return a.KeyID < b.KeyID
+		}
+		return a.Model < b.Model
+	})
+	return summaries
+}
@@ -0,0 +1,117 @@
+// Package usage 记录每次模型调用的用量，用于按密钥、模型统计和内部计费
+package usage
+
+import (
+	"context"
+	"pieces-os-go/internal/model"
+	"sync"
+	"time"
+)
+
+// Record 一次模型调用的用量记录
+type Record struct {
+	Time             time.Time `json:"time"`
+	KeyID            string    `json:"key_id"` // 未启用认证时为空
+	KeyName          string    `json:"key_name"`
+	Model            string    `json:"model"` // 标准化后的模型名
+	Route            string    `json:"route"`
+	Stream           bool      `json:"stream"`
+	Status           int       `json:"status"`
+	PromptTokens     int       `json:"prompt_tokens"`
+	CompletionTokens int       `json:"completion_tokens"`
+	TotalTokens      int       `json:"total_tokens"`
+	LatencyMs        int64     `json:"latency_ms"`
+}
+
+// Entry 请求处理过程中由服务层填充的用量信息
+// 流式响应在单独的 goroutine 中产生用量，因此需要加锁
+type Entry struct {
+	mu     sync.Mutex
+	model  string
+	stream bool
+	usage  model.Usage
+}
+
+type entryKey struct{}
+
+// WithEntry 在请求上下文中创建用量条目
+func WithEntry(ctx context.Context) (context.Context, *Entry) {
+	e := &Entry{}
+	return context.WithValue(ctx, entryKey{}, e), e
+}
+
+// EnsureEntry 返回请求上下文中已有的用量条目，没有时创建
+// 指标和用量记录中间件共用同一个条目
+func EnsureEntry(ctx context.Context) (context.Context, *Entry) {
+	if e := FromContext(ctx); e != nil {
+		return ctx, e
+	}
+	return WithEntry(ctx)
+}
+
+// FromContext 返回请求上下文中的用量条目，未记录用量时返回 nil
+// Entry 的方法允许 nil 接收者，调用方无需判断
+func FromContext(ctx context.Context) *Entry {
+	e, _ := ctx.Value(entryKey{}).(*Entry)
+	return e
+}
+
+// SetModel 设置本次请求实际使用的模型
+func (e *Entry) SetModel(name string) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.model = name
+}
+
+// Model 返回本次请求实际使用的模型，请求未到达模型时为空
+func (e *Entry) Model() string {
+	if e == nil {
+		return ""
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.model
+}
+
+// SetStream 标记为流式请求
+func (e *Entry) SetStream() {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.stream = true
+}
+
+// AddTokens 累加上游返回的用量
+func (e *Entry) AddTokens(u *model.Usage) {
+	if e == nil || u == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.usage.PromptTokens += u.PromptTokens
+	e.usage.CompletionTokens += u.CompletionTokens
+	e.usage.TotalTokens += u.TotalTokens
+}
+
+// Fill 将条目中的信息写入记录，请求未到达模型时返回 false
+func (e *Entry) Fill(rec *Record) bool {
+	if e == nil {
+		return false
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.model == "" {
+		return false
+	}
+	rec.Model = e.model
+	rec.Stream = e.stream
+	rec.PromptTokens = e.usage.PromptTokens
+	rec.CompletionTokens = e.usage.CompletionTokens
+	rec.TotalTokens = e.usage.TotalTokens
+	return true
+}